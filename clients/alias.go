@@ -0,0 +1,166 @@
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// AliasAdmin is implemented by clients that can move aliases and close or delete indices.
+type AliasAdmin interface {
+	ElasticsearchClient
+	// IndexExists reports whether the index exists.
+	IndexExists(ctx context.Context, index string) (bool, error)
+	// AliasIndices returns the indices an alias points to, none if the alias does not exist.
+	AliasIndices(ctx context.Context, alias string) ([]string, error)
+	// UpdateAliases applies the actions of an _aliases request body atomically.
+	UpdateAliases(ctx context.Context, body io.Reader) error
+	// OpenIndex opens a closed index.
+	OpenIndex(ctx context.Context, index string) error
+	// CloseIndex closes an index, keeping its data on disk.
+	CloseIndex(ctx context.Context, index string) error
+	// DeleteIndex deletes an index and its data.
+	DeleteIndex(ctx context.Context, index string) error
+}
+
+// decodeAliasIndices returns the sorted index names of a _alias response.
+func decodeAliasIndices(body io.Reader) ([]string, error) {
+	var response map[string]json.RawMessage
+	if err := json.NewDecoder(body).Decode(&response); err != nil {
+		return nil, err
+	}
+	indices := make([]string, 0, len(response))
+	for index := range response {
+		indices = append(indices, index)
+	}
+	sort.Strings(indices)
+	return indices, nil
+}
+
+func (e *ES7Client) AliasIndices(ctx context.Context, alias string) ([]string, error) {
+	res, err := e.Client.Indices.GetAlias(e.Client.Indices.GetAlias.WithContext(ctx), e.Client.Indices.GetAlias.WithName(alias))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.IsError() {
+		return nil, responseError("get alias", res.StatusCode, res.Body)
+	}
+	return decodeAliasIndices(res.Body)
+}
+
+func (e *ES7Client) UpdateAliases(ctx context.Context, body io.Reader) error {
+	res, err := e.Client.Indices.UpdateAliases(body, e.Client.Indices.UpdateAliases.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return responseError("update aliases", res.StatusCode, res.Body)
+	}
+	return nil
+}
+
+func (e *ES7Client) OpenIndex(ctx context.Context, index string) error {
+	res, err := e.Client.Indices.Open([]string{index}, e.Client.Indices.Open.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return responseError("open index", res.StatusCode, res.Body)
+	}
+	return nil
+}
+
+func (e *ES7Client) CloseIndex(ctx context.Context, index string) error {
+	res, err := e.Client.Indices.Close([]string{index}, e.Client.Indices.Close.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return responseError("close index", res.StatusCode, res.Body)
+	}
+	return nil
+}
+
+func (e *ES7Client) DeleteIndex(ctx context.Context, index string) error {
+	res, err := e.Client.Indices.Delete([]string{index}, e.Client.Indices.Delete.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return responseError("delete index", res.StatusCode, res.Body)
+	}
+	return nil
+}
+
+func (e *ES8Client) AliasIndices(ctx context.Context, alias string) ([]string, error) {
+	res, err := e.Client.Indices.GetAlias(e.Client.Indices.GetAlias.WithContext(ctx), e.Client.Indices.GetAlias.WithName(alias))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.IsError() {
+		return nil, responseError("get alias", res.StatusCode, res.Body)
+	}
+	return decodeAliasIndices(res.Body)
+}
+
+func (e *ES8Client) UpdateAliases(ctx context.Context, body io.Reader) error {
+	res, err := e.Client.Indices.UpdateAliases(body, e.Client.Indices.UpdateAliases.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return responseError("update aliases", res.StatusCode, res.Body)
+	}
+	return nil
+}
+
+func (e *ES8Client) OpenIndex(ctx context.Context, index string) error {
+	res, err := e.Client.Indices.Open([]string{index}, e.Client.Indices.Open.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return responseError("open index", res.StatusCode, res.Body)
+	}
+	return nil
+}
+
+func (e *ES8Client) CloseIndex(ctx context.Context, index string) error {
+	res, err := e.Client.Indices.Close([]string{index}, e.Client.Indices.Close.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return responseError("close index", res.StatusCode, res.Body)
+	}
+	return nil
+}
+
+func (e *ES8Client) DeleteIndex(ctx context.Context, index string) error {
+	res, err := e.Client.Indices.Delete([]string{index}, e.Client.Indices.Delete.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return responseError("delete index", res.StatusCode, res.Body)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// stateBucket holds every key of the bolt store
+var stateBucket = []byte("state")
+
+// BoltStore keeps the state in an embedded bbolt database file, for migrations run without a Redis server.
+// Each write is a transaction fsync'd on commit. The database is locked by the process that opened it.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens or creates the database at path.
+func NewBoltStore(path string) (*BoltStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s, is another migration using it? %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(stateBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+// SaveJSON saves a value as JSON under key
+func (b *BoltStore) SaveJSON(ctx context.Context, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateBucket).Put([]byte(key), data)
+	})
+}
+
+// GetJSON unmarshals the value saved under key into dest. A missing key is reported as ErrNotFound.
+func (b *BoltStore) GetJSON(ctx context.Context, key string, dest interface{}) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		// The value is only valid during the transaction
+		data := tx.Bucket(stateBucket).Get([]byte(key))
+		if data == nil {
+			return fmt.Errorf("%w: %s", ErrNotFound, key)
+		}
+		if err := json.Unmarshal(data, dest); err != nil {
+			return fmt.Errorf("failed to unmarshal JSON: %w", err)
+		}
+		return nil
+	})
+}
+
+// Delete removes keys, ignoring those that do not exist
+func (b *BoltStore) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(stateBucket)
+		for _, key := range keys {
+			if err := bucket.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Keys returns the keys matching a glob pattern
+func (b *BoltStore) Keys(ctx context.Context, pattern string) ([]string, error) {
+	var keys []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateBucket).ForEach(func(key, _ []byte) error {
+			keys = append(keys, string(key))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return matchKeys(keys, pattern)
+}
+
+// Close closes the database, releasing its lock
+func (b *BoltStore) Close() error {
+	return b.db.Close()
+}
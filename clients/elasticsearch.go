@@ -1,9 +1,19 @@
 package clients
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
 	es7 "github.com/elastic/go-elasticsearch/v7"
+	esapi7 "github.com/elastic/go-elasticsearch/v7/esapi"
 	es8 "github.com/elastic/go-elasticsearch/v8"
+	esapi8 "github.com/elastic/go-elasticsearch/v8/esapi"
 	"gopkg.in/olivere/elastic.v3"
 )
 
@@ -11,6 +21,88 @@ type ElasticsearchClient interface {
 	Ping() error
 }
 
+// BulkClient is implemented by clients that can be used as an import target.
+type BulkClient interface {
+	ElasticsearchClient
+	// Bulk sends an NDJSON bulk payload and returns the HTTP status code and response body.
+	// The caller must close the body.
+	Bulk(ctx context.Context, body io.Reader) (int, io.ReadCloser, error)
+	// IndexExists reports whether the index exists.
+	IndexExists(ctx context.Context, index string) (bool, error)
+}
+
+// SearchClient is implemented by clients that can be used as an export source through the REST search API.
+// Each call returns the HTTP status code and response body, which the caller must close.
+type SearchClient interface {
+	ElasticsearchClient
+	// Search runs a search on index. A keepAlive above zero opens a scroll; preference may be empty.
+	Search(ctx context.Context, index string, body io.Reader, size int, keepAlive time.Duration, preference string) (int, io.ReadCloser, error)
+	// Scroll fetches the next page of a scroll.
+	Scroll(ctx context.Context, scrollID string, keepAlive time.Duration) (int, io.ReadCloser, error)
+	// ClearScroll releases a scroll context.
+	ClearScroll(ctx context.Context, scrollID string) error
+	// IndexSettings returns the flat settings of the indices matching index.
+	IndexSettings(ctx context.Context, index string) (int, io.ReadCloser, error)
+}
+
+// DocumentClient is implemented by clients that can fetch documents by _id.
+type DocumentClient interface {
+	ElasticsearchClient
+	// MultiGet runs an _mget request on index and returns the HTTP status code and response body.
+	// The caller must close the body.
+	MultiGet(ctx context.Context, index string, body io.Reader) (int, io.ReadCloser, error)
+}
+
+// PointInTimeClient is implemented by clients that can search a point in time, the only way to page
+// through an index in a total order on ES8, which cannot sort on _id. Searches of a point in time
+// are run with an empty index.
+type PointInTimeClient interface {
+	SearchClient
+	// OpenPointInTime opens a point in time of index kept alive for keepAlive, and returns its ID.
+	OpenPointInTime(ctx context.Context, index string, keepAlive time.Duration) (string, error)
+	// ClosePointInTime releases a point in time.
+	ClosePointInTime(ctx context.Context, id string) error
+}
+
+// IndexMetadata holds the mappings and settings of one index as returned by the cluster.
+type IndexMetadata struct {
+	Mappings map[string]interface{} `json:"mappings"`
+	Settings map[string]interface{} `json:"settings"`
+}
+
+// IndexAdmin is implemented by clients that can read and create index definitions.
+type IndexAdmin interface {
+	ElasticsearchClient
+	// IndexMetadata returns the mappings and settings of every index matching index, by index name.
+	IndexMetadata(ctx context.Context, index string) (map[string]IndexMetadata, error)
+	// CreateIndex creates an index with the given JSON body.
+	CreateIndex(ctx context.Context, index string, body io.Reader) error
+	// IndexExists reports whether the index exists.
+	IndexExists(ctx context.Context, index string) (bool, error)
+}
+
+// decodeIndexMetadata combines _mapping and _settings responses into IndexMetadata by index name.
+func decodeIndexMetadata(mappingBody, settingsBody io.Reader) (map[string]IndexMetadata, error) {
+	var mappings, settings map[string]IndexMetadata
+	if err := json.NewDecoder(mappingBody).Decode(&mappings); err != nil {
+		return nil, fmt.Errorf("failed to decode mappings: %w", err)
+	}
+	if err := json.NewDecoder(settingsBody).Decode(&settings); err != nil {
+		return nil, fmt.Errorf("failed to decode settings: %w", err)
+	}
+	for index, metadata := range mappings {
+		metadata.Settings = settings[index].Settings
+		mappings[index] = metadata
+	}
+	return mappings, nil
+}
+
+// responseError reads the body of a failed response into an error.
+func responseError(operation string, status int, body io.Reader) error {
+	message, _ := io.ReadAll(body)
+	return fmt.Errorf("%s failed: %d %s: %s", operation, status, http.StatusText(status), message)
+}
+
 type ES2Client struct {
 	Client *elastic.Client
 	URL    string
@@ -21,6 +113,61 @@ func (e *ES2Client) Ping() error {
 	return err
 }
 
+func (e *ES2Client) Bulk(ctx context.Context, body io.Reader) (int, io.ReadCloser, error) {
+	payload, err := io.ReadAll(body)
+	if err != nil {
+		return 0, nil, err
+	}
+	res, err := e.Client.PerformRequestC(ctx, "POST", "/_bulk", nil, string(payload))
+	var esErr *elastic.Error
+	if errors.As(err, &esErr) {
+		return esErr.Status, io.NopCloser(bytes.NewReader(nil)), nil
+	} else if err != nil {
+		return 0, nil, err
+	}
+	return res.StatusCode, io.NopCloser(bytes.NewReader(res.Body)), nil
+}
+
+func (e *ES2Client) MultiGet(ctx context.Context, index string, body io.Reader) (int, io.ReadCloser, error) {
+	payload, err := io.ReadAll(body)
+	if err != nil {
+		return 0, nil, err
+	}
+	res, err := e.Client.PerformRequestC(ctx, "POST", "/"+index+"/_mget", nil, string(payload))
+	var esErr *elastic.Error
+	if errors.As(err, &esErr) {
+		return esErr.Status, io.NopCloser(bytes.NewReader(nil)), nil
+	} else if err != nil {
+		return 0, nil, err
+	}
+	return res.StatusCode, io.NopCloser(bytes.NewReader(res.Body)), nil
+}
+
+func (e *ES2Client) IndexExists(ctx context.Context, index string) (bool, error) {
+	return e.Client.IndexExists(index).DoC(ctx)
+}
+
+func (e *ES2Client) IndexMetadata(ctx context.Context, index string) (map[string]IndexMetadata, error) {
+	mappings, err := e.Client.PerformRequestC(ctx, "GET", "/"+index+"/_mapping", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := e.Client.PerformRequestC(ctx, "GET", "/"+index+"/_settings", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeIndexMetadata(bytes.NewReader(mappings.Body), bytes.NewReader(settings.Body))
+}
+
+func (e *ES2Client) CreateIndex(ctx context.Context, index string, body io.Reader) error {
+	payload, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	_, err = e.Client.PerformRequestC(ctx, "PUT", "/"+index, nil, string(payload))
+	return err
+}
+
 type ES7Client struct {
 	Client *es7.Client
 }
@@ -34,6 +181,110 @@ func (e *ES7Client) Ping() error {
 	return nil
 }
 
+func (e *ES7Client) Bulk(ctx context.Context, body io.Reader) (int, io.ReadCloser, error) {
+	res, err := e.Client.Bulk(body, e.Client.Bulk.WithContext(ctx))
+	if err != nil {
+		return 0, nil, err
+	}
+	return res.StatusCode, res.Body, nil
+}
+
+func (e *ES7Client) MultiGet(ctx context.Context, index string, body io.Reader) (int, io.ReadCloser, error) {
+	res, err := e.Client.Mget(body, e.Client.Mget.WithContext(ctx), e.Client.Mget.WithIndex(index))
+	if err != nil {
+		return 0, nil, err
+	}
+	return res.StatusCode, res.Body, nil
+}
+
+func (e *ES7Client) IndexExists(ctx context.Context, index string) (bool, error) {
+	res, err := e.Client.Indices.Exists([]string{index}, e.Client.Indices.Exists.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	return res.StatusCode == http.StatusOK, nil
+}
+
+func (e *ES7Client) Search(ctx context.Context, index string, body io.Reader, size int, keepAlive time.Duration, preference string) (int, io.ReadCloser, error) {
+	options := []func(*esapi7.SearchRequest){
+		e.Client.Search.WithContext(ctx),
+		e.Client.Search.WithBody(body),
+		e.Client.Search.WithSize(size),
+	}
+	if index != "" {
+		options = append(options, e.Client.Search.WithIndex(index))
+	}
+	if keepAlive > 0 {
+		options = append(options, e.Client.Search.WithScroll(keepAlive))
+	}
+	if preference != "" {
+		options = append(options, e.Client.Search.WithPreference(preference))
+	}
+	res, err := e.Client.Search(options...)
+	if err != nil {
+		return 0, nil, err
+	}
+	return res.StatusCode, res.Body, nil
+}
+
+func (e *ES7Client) Scroll(ctx context.Context, scrollID string, keepAlive time.Duration) (int, io.ReadCloser, error) {
+	res, err := e.Client.Scroll(e.Client.Scroll.WithContext(ctx), e.Client.Scroll.WithScrollID(scrollID), e.Client.Scroll.WithScroll(keepAlive))
+	if err != nil {
+		return 0, nil, err
+	}
+	return res.StatusCode, res.Body, nil
+}
+
+func (e *ES7Client) ClearScroll(ctx context.Context, scrollID string) error {
+	res, err := e.Client.ClearScroll(e.Client.ClearScroll.WithContext(ctx), e.Client.ClearScroll.WithScrollID(scrollID))
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (e *ES7Client) IndexSettings(ctx context.Context, index string) (int, io.ReadCloser, error) {
+	res, err := e.Client.Indices.GetSettings(e.Client.Indices.GetSettings.WithContext(ctx), e.Client.Indices.GetSettings.WithIndex(index), e.Client.Indices.GetSettings.WithFlatSettings(true))
+	if err != nil {
+		return 0, nil, err
+	}
+	return res.StatusCode, res.Body, nil
+}
+
+func (e *ES7Client) IndexMetadata(ctx context.Context, index string) (map[string]IndexMetadata, error) {
+	mappings, err := e.Client.Indices.GetMapping(e.Client.Indices.GetMapping.WithContext(ctx), e.Client.Indices.GetMapping.WithIndex(index))
+	if err != nil {
+		return nil, err
+	}
+	defer mappings.Body.Close()
+	if mappings.IsError() {
+		return nil, responseError("get mapping", mappings.StatusCode, mappings.Body)
+	}
+
+	settings, err := e.Client.Indices.GetSettings(e.Client.Indices.GetSettings.WithContext(ctx), e.Client.Indices.GetSettings.WithIndex(index))
+	if err != nil {
+		return nil, err
+	}
+	defer settings.Body.Close()
+	if settings.IsError() {
+		return nil, responseError("get settings", settings.StatusCode, settings.Body)
+	}
+	return decodeIndexMetadata(mappings.Body, settings.Body)
+}
+
+func (e *ES7Client) CreateIndex(ctx context.Context, index string, body io.Reader) error {
+	res, err := e.Client.Indices.Create(index, e.Client.Indices.Create.WithContext(ctx), e.Client.Indices.Create.WithBody(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return responseError("create index", res.StatusCode, res.Body)
+	}
+	return nil
+}
+
 type ES8Client struct {
 	Client *es8.Client
 }
@@ -47,6 +298,144 @@ func (e *ES8Client) Ping() error {
 	return nil
 }
 
+func (e *ES8Client) Bulk(ctx context.Context, body io.Reader) (int, io.ReadCloser, error) {
+	res, err := e.Client.Bulk(body, e.Client.Bulk.WithContext(ctx))
+	if err != nil {
+		return 0, nil, err
+	}
+	return res.StatusCode, res.Body, nil
+}
+
+func (e *ES8Client) MultiGet(ctx context.Context, index string, body io.Reader) (int, io.ReadCloser, error) {
+	res, err := e.Client.Mget(body, e.Client.Mget.WithContext(ctx), e.Client.Mget.WithIndex(index))
+	if err != nil {
+		return 0, nil, err
+	}
+	return res.StatusCode, res.Body, nil
+}
+
+func (e *ES8Client) IndexExists(ctx context.Context, index string) (bool, error) {
+	res, err := e.Client.Indices.Exists([]string{index}, e.Client.Indices.Exists.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	return res.StatusCode == http.StatusOK, nil
+}
+
+func (e *ES8Client) Search(ctx context.Context, index string, body io.Reader, size int, keepAlive time.Duration, preference string) (int, io.ReadCloser, error) {
+	options := []func(*esapi8.SearchRequest){
+		e.Client.Search.WithContext(ctx),
+		e.Client.Search.WithBody(body),
+		e.Client.Search.WithSize(size),
+	}
+	if index != "" {
+		options = append(options, e.Client.Search.WithIndex(index))
+	}
+	if keepAlive > 0 {
+		options = append(options, e.Client.Search.WithScroll(keepAlive))
+	}
+	if preference != "" {
+		options = append(options, e.Client.Search.WithPreference(preference))
+	}
+	res, err := e.Client.Search(options...)
+	if err != nil {
+		return 0, nil, err
+	}
+	return res.StatusCode, res.Body, nil
+}
+
+func (e *ES8Client) Scroll(ctx context.Context, scrollID string, keepAlive time.Duration) (int, io.ReadCloser, error) {
+	res, err := e.Client.Scroll(e.Client.Scroll.WithContext(ctx), e.Client.Scroll.WithScrollID(scrollID), e.Client.Scroll.WithScroll(keepAlive))
+	if err != nil {
+		return 0, nil, err
+	}
+	return res.StatusCode, res.Body, nil
+}
+
+func (e *ES8Client) ClearScroll(ctx context.Context, scrollID string) error {
+	res, err := e.Client.ClearScroll(e.Client.ClearScroll.WithContext(ctx), e.Client.ClearScroll.WithScrollID(scrollID))
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (e *ES8Client) OpenPointInTime(ctx context.Context, index string, keepAlive time.Duration) (string, error) {
+	res, err := e.Client.OpenPointInTime([]string{index}, fmt.Sprintf("%dms", keepAlive.Milliseconds()), e.Client.OpenPointInTime.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return "", responseError("open point in time", res.StatusCode, res.Body)
+	}
+	var response struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return "", fmt.Errorf("failed to decode point in time: %w", err)
+	}
+	return response.ID, nil
+}
+
+func (e *ES8Client) ClosePointInTime(ctx context.Context, id string) error {
+	body, err := json.Marshal(map[string]string{"id": id})
+	if err != nil {
+		return err
+	}
+	res, err := e.Client.ClosePointInTime(e.Client.ClosePointInTime.WithContext(ctx), e.Client.ClosePointInTime.WithBody(bytes.NewReader(body)))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		return responseError("close point in time", res.StatusCode, res.Body)
+	}
+	return nil
+}
+
+func (e *ES8Client) IndexSettings(ctx context.Context, index string) (int, io.ReadCloser, error) {
+	res, err := e.Client.Indices.GetSettings(e.Client.Indices.GetSettings.WithContext(ctx), e.Client.Indices.GetSettings.WithIndex(index), e.Client.Indices.GetSettings.WithFlatSettings(true))
+	if err != nil {
+		return 0, nil, err
+	}
+	return res.StatusCode, res.Body, nil
+}
+
+func (e *ES8Client) IndexMetadata(ctx context.Context, index string) (map[string]IndexMetadata, error) {
+	mappings, err := e.Client.Indices.GetMapping(e.Client.Indices.GetMapping.WithContext(ctx), e.Client.Indices.GetMapping.WithIndex(index))
+	if err != nil {
+		return nil, err
+	}
+	defer mappings.Body.Close()
+	if mappings.IsError() {
+		return nil, responseError("get mapping", mappings.StatusCode, mappings.Body)
+	}
+
+	settings, err := e.Client.Indices.GetSettings(e.Client.Indices.GetSettings.WithContext(ctx), e.Client.Indices.GetSettings.WithIndex(index))
+	if err != nil {
+		return nil, err
+	}
+	defer settings.Body.Close()
+	if settings.IsError() {
+		return nil, responseError("get settings", settings.StatusCode, settings.Body)
+	}
+	return decodeIndexMetadata(mappings.Body, settings.Body)
+}
+
+func (e *ES8Client) CreateIndex(ctx context.Context, index string, body io.Reader) error {
+	res, err := e.Client.Indices.Create(index, e.Client.Indices.Create.WithContext(ctx), e.Client.Indices.Create.WithBody(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return responseError("create index", res.StatusCode, res.Body)
+	}
+	return nil
+}
+
 func NewElasticsearchClient(version int, url, username, password string) (ElasticsearchClient, error) {
 	switch version {
 	case 2:
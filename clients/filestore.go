@@ -0,0 +1,148 @@
+package clients
+
+import (
+	"context"
+	"elkmigration/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileStore keeps the state in one local JSON file, for migrations run without a Redis server.
+// Every write replaces the whole file: the new content is written to a temporary file, fsync'd and
+// renamed over the old one, so a crash leaves either the previous or the new state, never a torn file.
+// The file is read once when opened, so a single process may use it: an exclusive lock on a .lock file
+// next to it is held until Close, like the lock bbolt takes on its database.
+type FileStore struct {
+	path string
+	lock *os.File
+
+	mu     sync.Mutex
+	values map[string]json.RawMessage
+}
+
+// NewFileStore locks and opens the state file at path, which is created on the first write.
+func NewFileStore(path string) (*FileStore, error) {
+	lock, err := utils.LockFile(path+".lock", 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("%w, is another migration using %s?", err, path)
+	}
+	store := &FileStore{path: path, lock: lock, values: map[string]json.RawMessage{}}
+	if err := store.read(); err != nil {
+		utils.UnlockFile(lock)
+		return nil, err
+	}
+	return store, nil
+}
+
+// read loads the values of the state file, if it exists.
+func (f *FileStore) read() error {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &f.values); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", f.path, err)
+		}
+	}
+	return nil
+}
+
+// SaveJSON saves a value as JSON under key
+func (f *FileStore) SaveJSON(ctx context.Context, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	previous, existed := f.values[key]
+	f.values[key] = data
+	if err := f.write(); err != nil {
+		// Keep the state in memory as it is on disk
+		if existed {
+			f.values[key] = previous
+		} else {
+			delete(f.values, key)
+		}
+		return err
+	}
+	return nil
+}
+
+// GetJSON unmarshals the value saved under key into dest. A missing key is reported as ErrNotFound.
+func (f *FileStore) GetJSON(ctx context.Context, key string, dest interface{}) error {
+	f.mu.Lock()
+	data, ok := f.values[key]
+	f.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	if err := json.Unmarshal(data, dest); err != nil {
+		return fmt.Errorf("failed to unmarshal JSON: %w", err)
+	}
+	return nil
+}
+
+// Delete removes keys, ignoring those that do not exist
+func (f *FileStore) Delete(ctx context.Context, keys ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	removed := map[string]json.RawMessage{}
+	for _, key := range keys {
+		if data, ok := f.values[key]; ok {
+			removed[key] = data
+			delete(f.values, key)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	if err := f.write(); err != nil {
+		for key, data := range removed {
+			f.values[key] = data
+		}
+		return err
+	}
+	return nil
+}
+
+// Keys returns the keys matching a glob pattern
+func (f *FileStore) Keys(ctx context.Context, pattern string) ([]string, error) {
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.values))
+	for key := range f.values {
+		keys = append(keys, key)
+	}
+	f.mu.Unlock()
+	return matchKeys(keys, pattern)
+}
+
+// Close releases the lock; every write is already on disk.
+func (f *FileStore) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.lock == nil {
+		return nil
+	}
+	err := utils.UnlockFile(f.lock)
+	f.lock = nil
+	return err
+}
+
+// write atomically replaces the state file with the values. The caller must hold f.mu.
+func (f *FileStore) write() error {
+	data, err := json.MarshalIndent(f.values, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+	return utils.WriteFileAtomic(f.path, data)
+}
@@ -44,6 +44,11 @@ func InitRedis(logger *zap.Logger, config *config.Config) {
 	logger.Fatal("Unable to connect to Redis after multiple attempts", zap.Error(err))
 }
 
+// Close closes the Redis client connection.
+func (r *Redis) Close() error {
+	return r.Client.Close()
+}
+
 // CloseRedis closes the Redis client connection.
 func CloseRedis() {
 	if RedisClient != nil {
@@ -123,10 +128,14 @@ func (r *Redis) SaveJSON(ctx context.Context, key string, value interface{}) err
 	return nil
 }
 
-// GetJSON retrieves a JSON string from Redis and unmarshals it into an interface
+// GetJSON retrieves a JSON string from Redis and unmarshals it into an interface.
+// A missing key is reported as ErrNotFound.
 func (r *Redis) GetJSON(ctx context.Context, key string, dest interface{}) error {
 	// Get the JSON string from Redis
 	jsonData, err := r.Client.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to get from Redis: %w", err)
 	}
@@ -138,3 +147,41 @@ func (r *Redis) GetJSON(ctx context.Context, key string, dest interface{}) error
 
 	return nil
 }
+
+// PushJSON appends an interface as a JSON string to the tail of a Redis list
+func (r *Redis) PushJSON(ctx context.Context, key string, value interface{}) error {
+	jsonData, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+
+	if err := r.Client.RPush(ctx, key, jsonData).Err(); err != nil {
+		return fmt.Errorf("failed to push to Redis: %w", err)
+	}
+
+	return nil
+}
+
+// Delete removes keys from Redis, ignoring those that do not exist
+func (r *Redis) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := r.Client.Del(ctx, keys...).Err(); err != nil {
+		return fmt.Errorf("failed to delete from Redis: %w", err)
+	}
+	return nil
+}
+
+// Keys returns the keys matching a glob pattern, scanning instead of blocking Redis with KEYS
+func (r *Redis) Keys(ctx context.Context, pattern string) ([]string, error) {
+	var keys []string
+	iter := r.Client.Scan(ctx, 0, pattern, 0).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan Redis: %w", err)
+	}
+	return keys, nil
+}
@@ -0,0 +1,95 @@
+package clients
+
+import (
+	"context"
+	"elkmigration/config"
+	"sort"
+	"strings"
+)
+
+// Kinds of state a job keeps in the checkpoint store
+const (
+	stateCheckpoint = "checkpoint"
+	stateSyncMark   = "sync_mark"
+	stateVerify     = "verify"
+	stateCutover    = "cutover"
+)
+
+// Namespace builds the state keys of one migration job. Every key starts with REDIS_KEY_PREFIX and
+// JOB_ID, so jobs sharing a checkpoint store never read each other's state, and per-index state also carries
+// the source and target index, so the indices of a job never share a checkpoint.
+type Namespace struct {
+	prefix string
+	job    string
+}
+
+// NewNamespace returns the namespace of the configured job.
+func NewNamespace(config *config.Config) Namespace {
+	return Namespace{prefix: config.RedisKeyPrefix, job: config.JobID}
+}
+
+// Job returns the job ID.
+func (n Namespace) Job() string {
+	return n.job
+}
+
+func (n Namespace) key(parts ...string) string {
+	return strings.Join(append([]string{n.prefix, n.job}, parts...), ":")
+}
+
+// Checkpoint is the key of the export checkpoint of a source index, or of one of its slices.
+func (n Namespace) Checkpoint(source, target, slice string) string {
+	if slice == "" {
+		return n.key(stateCheckpoint, source, target)
+	}
+	return n.key(stateCheckpoint, source, target, "slice", slice)
+}
+
+// Checkpoints is the pattern matching every checkpoint key of the job.
+func (n Namespace) Checkpoints() string {
+	return n.key(stateCheckpoint, "*")
+}
+
+// SyncMark is the key of the sync high-water mark of a source index.
+func (n Namespace) SyncMark(source, target string) string {
+	return n.key(stateSyncMark, source, target)
+}
+
+// SyncMarks is the pattern matching every sync mark key of the job.
+func (n Namespace) SyncMarks() string {
+	return n.key(stateSyncMark, "*")
+}
+
+// Verify is the key of the outcome of the last verification of the job.
+func (n Namespace) Verify() string {
+	return n.key(stateVerify)
+}
+
+// Cutover is the key of the last alias cutover of the job.
+func (n Namespace) Cutover() string {
+	return n.key(stateCutover)
+}
+
+// All is the pattern matching every key of the job.
+func (n Namespace) All() string {
+	return n.key("*")
+}
+
+// Jobs returns the IDs of the jobs with state saved under a key prefix, sorted.
+func Jobs(ctx context.Context, store CheckpointStore, prefix string) ([]string, error) {
+	keys, err := store.Keys(ctx, prefix+":*")
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var jobs []string
+	for _, key := range keys {
+		job, _, _ := strings.Cut(strings.TrimPrefix(key, prefix+":"), ":")
+		if !seen[job] {
+			seen[job] = true
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Strings(jobs)
+	return jobs, nil
+}
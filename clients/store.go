@@ -0,0 +1,129 @@
+package clients
+
+import (
+	"context"
+	"elkmigration/config"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Checkpoint store backends, selected with CHECKPOINT_BACKEND
+const (
+	BackendRedis = "redis"
+	BackendFile  = "file"
+	BackendBolt  = "bolt"
+)
+
+// ErrNotFound is returned by GetJSON when no value is saved under the key.
+var ErrNotFound = errors.New("no state saved")
+
+// CheckpointStore keeps the JSON state of migration jobs: checkpoints, sync marks, verifications and cutovers.
+// Keys are built by Namespace and listed with Redis-style glob patterns.
+type CheckpointStore interface {
+	SaveJSON(ctx context.Context, key string, value interface{}) error
+	GetJSON(ctx context.Context, key string, dest interface{}) error
+	Delete(ctx context.Context, keys ...string) error
+	Keys(ctx context.Context, pattern string) ([]string, error)
+	Close() error
+}
+
+var Store CheckpointStore
+
+// InitCheckpointStore opens the store configured with CHECKPOINT_BACKEND and CHECKPOINT_PATH.
+// Only the Redis backend needs a server; the others keep the state on the local disk.
+func InitCheckpointStore(logger *zap.Logger, config *config.Config) error {
+	var err error
+	switch config.CheckpointBackend {
+	case BackendRedis:
+		InitRedis(logger, config)
+		Store = RedisClient
+		return nil
+	case BackendFile:
+		Store, err = NewFileStore(checkpointPath(config, "checkpoints.json"))
+	case BackendBolt:
+		Store, err = NewBoltStore(checkpointPath(config, "checkpoints.db"))
+	default:
+		return fmt.Errorf("unknown CHECKPOINT_BACKEND %q, expected redis, file or bolt", config.CheckpointBackend)
+	}
+	if err != nil {
+		Store = nil
+		return fmt.Errorf("failed to open %s checkpoint store: %w", config.CheckpointBackend, err)
+	}
+	logger.Info("Opened checkpoint store", zap.String("backend", config.CheckpointBackend))
+	return nil
+}
+
+// CloseCheckpointStore closes the store, flushing nothing: every write is durable once SaveJSON returns.
+func CloseCheckpointStore() {
+	if Store != nil {
+		Store.Close()
+	}
+}
+
+// checkpointPath is CHECKPOINT_PATH, or the default file of the backend under ./state.
+func checkpointPath(config *config.Config, name string) string {
+	if config.CheckpointPath != "" {
+		return config.CheckpointPath
+	}
+	return path.Join("./state", name)
+}
+
+// matchKeys returns the keys matching a glob pattern, sorted. As in Redis, "*" and "?" also match
+// "/", which appears in the keys of sliced checkpoints.
+func matchKeys(keys []string, pattern string) ([]string, error) {
+	re, err := globRegexp(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key pattern %q: %w", pattern, err)
+	}
+	var matched []string
+	for _, key := range keys {
+		if re.MatchString(key) {
+			matched = append(matched, key)
+		}
+	}
+	sort.Strings(matched)
+	return matched, nil
+}
+
+// globRegexp translates a Redis glob pattern, with "*", "?", "[...]" and "\" escapes, into a regular expression.
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			expr.WriteString("(?s:.*)")
+		case '?':
+			expr.WriteString("(?s:.)")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return nil, errors.New("unterminated [")
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "^") {
+				class = "^" + regexp.QuoteMeta(class[1:])
+			} else {
+				class = regexp.QuoteMeta(class)
+			}
+			// Keep ranges such as a-z, which QuoteMeta leaves alone
+			expr.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
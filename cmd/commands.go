@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"elkmigration/clients"
+	"elkmigration/config"
+	"elkmigration/cutover"
+	"elkmigration/job"
+	"elkmigration/logger"
+	"elkmigration/mapping"
+	"elkmigration/pipeline"
+	"elkmigration/verify"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+var (
+	verifyOptions = []option{
+		{name: "sample-rate", key: "VERIFY_SAMPLE_RATE", usage: "fraction of the documents whose content is compared, 0 to 1"},
+		{name: "max-ids", key: "VERIFY_MAX_IDS", usage: "most document IDs listed per category in the report"},
+		{name: "report", key: "VERIFY_REPORT_FILE", usage: "where to save the verification report"},
+	}
+	cutoverOptions = []option{
+		{name: "alias", key: "CUTOVER_ALIAS", usage: "alias moved onto the target index"},
+		{name: "previous", key: "CUTOVER_PREVIOUS", usage: "what to do with the indices the alias leaves: keep, close or delete"},
+		{name: "require-verify", key: "CUTOVER_REQUIRE_VERIFY", usage: "refuse the cutover unless the last verification passed", boolean: true},
+	}
+	statusOptions = []option{
+		{name: "slices", key: "EXPORT_SLICES", usage: "number of slices the checkpoints were saved with"},
+	}
+	mappingsOptions = []option{
+		{name: "type-split", key: "TYPE_SPLIT_MODE", usage: "how ES2 mapping types are migrated: none, index or field"},
+		{name: "mapping-report", key: "MAPPING_REPORT_FILE", usage: "where to save the mapping conversion report"},
+	}
+)
+
+var errVerificationFailed = errors.New("the target differs from the source")
+
+// runVerify verifies the target index, saves the report and records its outcome for the cutover.
+func runVerify(ctx context.Context, config *config.Config) error {
+	sourceClient, err := newSourceClient(config)
+	if err != nil {
+		return err
+	}
+	targetClient, err := newTargetClient(config)
+	if err != nil {
+		return err
+	}
+	indices, err := job.Resolve(ctx, sourceClient, config)
+	if err != nil {
+		return err
+	}
+	// Failing documents are not dead-lettered again, they show up as missing
+	transformer, err := pipeline.NewTransformer(config, nil, nil)
+	if err != nil {
+		return fmt.Errorf("error creating transformer: %w", err)
+	}
+	filter, err := pipeline.NewExportFilter(config)
+	if err != nil {
+		return fmt.Errorf("invalid export filter: %w", err)
+	}
+
+	report, err := verify.Verify(ctx, sourceClient, targetClient, config, indices, filter, transformer)
+	if err != nil {
+		return err
+	}
+	report.Log()
+	if config.VerifyReportFile != "" {
+		if err := report.WriteFile(config.VerifyReportFile); err != nil {
+			logger.Error("Failed to write verification report", zap.String("file", config.VerifyReportFile), zap.Error(err))
+		}
+	}
+	if err := report.Save(ctx, clients.Store, clients.NewNamespace(config).Verify()); err != nil {
+		logger.Error("Failed to record verification", zap.Error(err))
+	}
+	if !report.Passed {
+		return errVerificationFailed
+	}
+	return nil
+}
+
+// runCutover and runRollback only touch aliases on the target.
+func runCutover(ctx context.Context, config *config.Config) error {
+	targetClient, err := newTargetClient(config)
+	if err != nil {
+		return err
+	}
+	if err := cutover.Cutover(ctx, targetClient, clients.Store, config); err != nil {
+		return err
+	}
+	logger.Info("Alias cutover completed")
+	return nil
+}
+
+func runRollback(ctx context.Context, config *config.Config) error {
+	targetClient, err := newTargetClient(config)
+	if err != nil {
+		return err
+	}
+	if err := cutover.Rollback(ctx, targetClient, clients.Store, config); err != nil {
+		return err
+	}
+	logger.Info("Alias rollback completed")
+	return nil
+}
+
+// status is the migration state saved in the checkpoint store, as printed by the status command.
+type status struct {
+	Job     string          `json:"job"`
+	Source  string          `json:"source"`
+	Target  string          `json:"target"`
+	Indices []indexStatus   `json:"indices"`
+	Verify  *verify.Summary `json:"verify,omitempty"`
+	Cutover *cutover.Record `json:"cutover,omitempty"`
+}
+
+type indexStatus struct {
+	Source      string            `json:"source"`
+	Target      string            `json:"target"`
+	Checkpoints []sliceCheckpoint `json:"checkpoints"`
+	SyncMark    interface{}       `json:"sync_mark,omitempty"`
+}
+
+type sliceCheckpoint struct {
+	Slice      string        `json:"slice,omitempty"` // "id/max" for a sliced export
+	LastID     string        `json:"last_id,omitempty"`
+	Count      int           `json:"count"`
+	SortValues []interface{} `json:"sort_values,omitempty"`
+	File       string        `json:"file,omitempty"`
+	Offset     int64         `json:"offset,omitempty"`
+}
+
+// runStatus prints the checkpoints of the EXPORT_SLICES slices and the sync mark of every source index,
+// and the state of the other commands.
+func runStatus(ctx context.Context, config *config.Config) error {
+	sourceClient, err := newSourceClient(config)
+	if err != nil {
+		return err
+	}
+	indices, err := job.Resolve(ctx, sourceClient, config)
+	if err != nil {
+		return err
+	}
+
+	ns := clients.NewNamespace(config)
+	state := status{Job: ns.Job(), Source: config.ElkIndexFrom, Target: config.ElkIndexTo}
+	slices := []pipeline.Slice{{}}
+	if config.ExportSlices > 1 {
+		slices = slices[:0]
+		for i := 0; i < config.ExportSlices; i++ {
+			slices = append(slices, pipeline.Slice{ID: i, Max: config.ExportSlices})
+		}
+	}
+	for _, index := range indices {
+		entry := indexStatus{Source: index.Source, Target: index.Target}
+		for _, slice := range slices {
+			checkpoint, err := pipeline.LoadCheckpoint(ctx, clients.Store, index.Config(config), slice)
+			if err != nil {
+				return fmt.Errorf("failed to load checkpoint: %w", err)
+			}
+			sliceEntry := sliceCheckpoint{LastID: checkpoint.LastID, Count: checkpoint.Count, SortValues: checkpoint.SortValues, File: checkpoint.File, Offset: checkpoint.Offset}
+			if slice.Sliced() {
+				sliceEntry.Slice = fmt.Sprintf("%d/%d", slice.ID, slice.Max)
+			}
+			entry.Checkpoints = append(entry.Checkpoints, sliceEntry)
+		}
+		if _, err := getState(ctx, ns.SyncMark(index.Source, index.Target), &entry.SyncMark); err != nil {
+			return err
+		}
+		state.Indices = append(state.Indices, entry)
+	}
+
+	var summary verify.Summary
+	if found, err := getState(ctx, ns.Verify(), &summary); err != nil {
+		return err
+	} else if found {
+		state.Verify = &summary
+	}
+	var record cutover.Record
+	if found, err := getState(ctx, ns.Cutover(), &record); err != nil {
+		return err
+	} else if found {
+		state.Cutover = &record
+	}
+	return printJSON(state)
+}
+
+// getState reads a JSON record of the job, reporting whether it is saved.
+func getState(ctx context.Context, key string, dest interface{}) (bool, error) {
+	err := clients.Store.GetJSON(ctx, key, dest)
+	if errors.Is(err, clients.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	return true, nil
+}
+
+var resetSyncMark bool
+
+func resetCheckpointFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&resetSyncMark, "sync", false, "also delete the sync marks, so the next sync starts from SYNC_FROM")
+}
+
+// runResetCheckpoint deletes the export checkpoints of every index and slice of the job.
+func runResetCheckpoint(ctx context.Context, config *config.Config) error {
+	keys, err := pipeline.ResetCheckpoint(ctx, clients.Store, config)
+	if err != nil {
+		return err
+	}
+	if resetSyncMark {
+		marks, err := clients.Store.Keys(ctx, clients.NewNamespace(config).SyncMarks())
+		if err != nil {
+			return err
+		}
+		if err := clients.Store.Delete(ctx, marks...); err != nil {
+			return err
+		}
+		keys = append(keys, marks...)
+	}
+	logger.Info("Checkpoints reset", zap.String("job", config.JobID), zap.Strings("keys", keys))
+	return nil
+}
+
+var (
+	stateList   bool
+	stateDelete bool
+)
+
+func stateFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&stateList, "list", false, "list the jobs with state saved under REDIS_KEY_PREFIX")
+	fs.BoolVar(&stateDelete, "delete", false, "delete every checkpoint, sync mark and record of the job")
+}
+
+// runState prints every record saved for the job, keyed by state key. With --list it prints the
+// IDs of the jobs instead, and with --delete it deletes the state of the job.
+func runState(ctx context.Context, config *config.Config) error {
+	if stateList {
+		jobs, err := clients.Jobs(ctx, clients.Store, config.RedisKeyPrefix)
+		if err != nil {
+			return err
+		}
+		if jobs == nil {
+			jobs = []string{}
+		}
+		return printJSON(jobs)
+	}
+
+	keys, err := clients.Store.Keys(ctx, clients.NewNamespace(config).All())
+	if err != nil {
+		return err
+	}
+	if stateDelete {
+		if err := clients.Store.Delete(ctx, keys...); err != nil {
+			return err
+		}
+		logger.Info("Job state deleted", zap.String("job", config.JobID), zap.Strings("keys", keys))
+		return nil
+	}
+
+	records := map[string]json.RawMessage{}
+	for _, key := range keys {
+		var record json.RawMessage
+		if found, err := getState(ctx, key, &record); err != nil {
+			return err
+		} else if found {
+			records[key] = record
+		}
+	}
+	return printJSON(records)
+}
+
+var createMappings bool
+
+func mappingsFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&createMappings, "create", false, "create the missing target indices instead of printing their definitions")
+}
+
+// runMappings converts the source mappings and prints the target index definitions, or creates them with --create.
+// When several sources roll up into one target, the definition of the first source is kept, as the migration would.
+func runMappings(ctx context.Context, config *config.Config) error {
+	if config.SourceType == pipeline.SourceFile {
+		return errors.New("mappings are read from the source cluster, SOURCE_TYPE=file has none")
+	}
+	sourceClient, err := newSourceClient(config)
+	if err != nil {
+		return err
+	}
+	indices, err := job.Resolve(ctx, sourceClient, config)
+	if err != nil {
+		return err
+	}
+	var targetClient clients.ElasticsearchClient
+	if createMappings {
+		if targetClient, err = newTargetClient(config); err != nil {
+			return err
+		}
+	}
+
+	definitions := map[string]*mapping.IndexDefinition{}
+	for _, index := range indices {
+		indexConfig := index.Config(config)
+		splitter, err := pipeline.NewTypeSplitter(indexConfig)
+		if err != nil {
+			return fmt.Errorf("invalid type split configuration: %w", err)
+		}
+		if createMappings {
+			if err := mapping.CreateTargetIndex(ctx, sourceClient, targetClient, index.Source, splitter.Route, indexConfig.MappingReportFile); err != nil {
+				return err
+			}
+			continue
+		}
+
+		indexDefinitions, report, err := mapping.BuildDefinitions(ctx, sourceClient, index.Source, splitter.Route)
+		if err != nil {
+			return err
+		}
+		report.Log()
+		if indexConfig.MappingReportFile != "" {
+			if err := report.WriteFile(indexConfig.MappingReportFile); err != nil {
+				logger.Warn("Failed to write mapping report", zap.String("file", indexConfig.MappingReportFile), zap.Error(err))
+			}
+		}
+		for target, definition := range indexDefinitions {
+			if _, ok := definitions[target]; !ok {
+				definitions[target] = definition
+			}
+		}
+	}
+	if createMappings {
+		return nil
+	}
+	return printJSON(definitions)
+}
+
+// printJSON writes a command result on stdout.
+func printJSON(value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(os.Stdout, string(data))
+	return err
+}
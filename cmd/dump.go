@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"elkmigration/config"
+	"elkmigration/job"
+	"elkmigration/logger"
+	"elkmigration/pipeline"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+var (
+	dumpOutput    string
+	dumpLimit     int
+	dumpTransform bool
+)
+
+func dumpFlags(fs *flag.FlagSet) {
+	fs.StringVar(&dumpOutput, "output", "-", "file to write, - for stdout")
+	fs.IntVar(&dumpLimit, "limit", 0, "stop after this many source documents, 0 for all")
+	fs.BoolVar(&dumpTransform, "transform", false, "apply the transform rules, script and type routing, as the migration would")
+}
+
+// errDumpLimit stops reading the source once --limit documents are dumped.
+var errDumpLimit = errors.New("dump limit reached")
+
+// runDump writes the documents of the source indices, one search hit-shaped JSON object per line.
+func runDump(ctx context.Context, config *config.Config) error {
+	sourceClient, err := newSourceClient(config)
+	if err != nil {
+		return err
+	}
+	indices, err := job.Resolve(ctx, sourceClient, config)
+	if err != nil {
+		return err
+	}
+	filter, err := pipeline.NewExportFilter(config)
+	if err != nil {
+		return fmt.Errorf("invalid export filter: %w", err)
+	}
+	var transformer *pipeline.Transformer
+	if dumpTransform {
+		if transformer, err = pipeline.NewTransformer(config, nil, nil); err != nil {
+			return fmt.Errorf("error creating transformer: %w", err)
+		}
+	}
+
+	var out io.Writer = os.Stdout
+	if dumpOutput != "-" {
+		file, err := os.Create(dumpOutput)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	writer := bufio.NewWriter(out)
+	encoder := json.NewEncoder(writer)
+
+	read, written := 0, 0
+	for _, index := range indices {
+		indexConfig := index.Config(config)
+
+		// Transformed documents are written to the target index, untouched ones keep their source index
+		defaultIndex := index.Source
+		indexTransformer := transformer
+		if transformer != nil {
+			splitter, err := pipeline.NewTypeSplitter(indexConfig)
+			if err != nil {
+				return fmt.Errorf("invalid type split configuration: %w", err)
+			}
+			indexTransformer = transformer.WithSplitter(indexConfig, splitter)
+			defaultIndex = index.Target
+		}
+
+		err = pipeline.ReadSource(ctx, sourceClient, indexConfig, filter, func(doc *pipeline.Document) error {
+			if dumpLimit > 0 && read >= dumpLimit {
+				return errDumpLimit
+			}
+			read++
+			docs := []*pipeline.Document{doc}
+			if indexTransformer != nil {
+				var err error
+				if docs, err = indexTransformer.Transform(ctx, doc); err != nil {
+					return err
+				}
+			}
+			for _, d := range docs {
+				if err := encoder.Encode(pipeline.NewDocumentRecord(d, defaultIndex)); err != nil {
+					return err
+				}
+				written++
+			}
+			return nil
+		})
+		if errors.Is(err, errDumpLimit) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to dump %s: %w", index.Source, err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	logger.Info("Dump completed", zap.Int("read", read), zap.Int("written", written), zap.String("output", dumpOutput))
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// option is a command-line flag overriding a configuration variable.
+type option struct {
+	name    string
+	key     string // configuration variable, as in .env
+	usage   string
+	boolean bool
+}
+
+// Options shared by several commands
+var (
+	clusterOptions = []option{
+		{name: "from", key: "ELK_INDEX_FROM", usage: "comma-separated source indices, wildcards or aliases"},
+		{name: "to", key: "ELK_INDEX_TO", usage: "target index, or a template with {index}, {name} and {date}"},
+		{name: "date-layout", key: "INDEX_DATE_LAYOUT", usage: "Go layout of the date suffix of source index names"},
+		{name: "target-date-layout", key: "TARGET_DATE_LAYOUT", usage: "Go layout of {date} in target names, e.g. 2006.01 for monthly rollups"},
+		{name: "source-version", key: "SOURCE_VERSION", usage: "major version of the source cluster: 2, 7 or 8"},
+		{name: "source-type", key: "SOURCE_TYPE", usage: "where documents are read from: elasticsearch or file"},
+		{name: "source-files", key: "SOURCE_FILES", usage: "comma-separated files, globs, file sink directories or manifests to read"},
+		{name: "source-format", key: "SOURCE_FILE_FORMAT", usage: "format of the source files: auto, ndjson or bulk"},
+		{name: "target-version", key: "TARGET_VERSION", usage: "major version of the target cluster: 2, 7 or 8"},
+		{name: "redis", key: "REDIS_URL", usage: "Redis address holding the migration state"},
+		{name: "job", key: "JOB_ID", usage: "ID of the job, keeping its state apart from other jobs"},
+		{name: "checkpoint-backend", key: "CHECKPOINT_BACKEND", usage: "where the job state is kept: redis, file or bolt"},
+		{name: "checkpoint-path", key: "CHECKPOINT_PATH", usage: "state file of the file and bolt backends"},
+	}
+	stateOptions = []option{
+		{name: "redis", key: "REDIS_URL", usage: "Redis address holding the migration state"},
+		{name: "redis-prefix", key: "REDIS_KEY_PREFIX", usage: "prefix of the state keys of every job"},
+		{name: "job", key: "JOB_ID", usage: "ID of the job to print or delete"},
+		{name: "checkpoint-backend", key: "CHECKPOINT_BACKEND", usage: "where the job state is kept: redis, file or bolt"},
+		{name: "checkpoint-path", key: "CHECKPOINT_PATH", usage: "state file of the file and bolt backends"},
+	}
+	exportOptions = []option{
+		{name: "query", key: "EXPORT_QUERY", usage: "query DSL restricting the exported documents"},
+		{name: "query-file", key: "EXPORT_QUERY_FILE", usage: "file holding the query DSL"},
+		{name: "includes", key: "SOURCE_INCLUDES", usage: "comma-separated _source fields to export"},
+		{name: "excludes", key: "SOURCE_EXCLUDES", usage: "comma-separated _source fields to strip"},
+		{name: "time-field", key: "TIME_FIELD", usage: "timestamp field of the time range"},
+		{name: "time-from", key: "TIME_FROM", usage: "export documents from this date or date math"},
+		{name: "time-to", key: "TIME_TO", usage: "export documents before this date or date math"},
+	}
+	transformOptions = []option{
+		{name: "rules", key: "TRANSFORM_RULES_FILE", usage: "YAML or JSON field transformation rules"},
+		{name: "script", key: "TRANSFORM_SCRIPT_FILE", usage: "transform script run after the rules"},
+		{name: "type-split", key: "TYPE_SPLIT_MODE", usage: "how ES2 mapping types are migrated: none, index or field"},
+	}
+	importOptions = []option{
+		{name: "concurrency", key: "JOB_CONCURRENCY", usage: "number of source indices migrated at once"},
+		{name: "export-mode", key: "EXPORT_MODE", usage: "scroll or sorted"},
+		{name: "slices", key: "EXPORT_SLICES", usage: "number of parallel export workers"},
+		{name: "bulk-size", key: "BULK_SIZE", usage: "documents per bulk request"},
+		{name: "import-workers", key: "IMPORT_WORKERS", usage: "number of concurrent bulk senders"},
+		{name: "transform-workers", key: "TRANSFORM_WORKERS", usage: "number of transform workers, 0 for one per CPU"},
+		{name: "create-index", key: "CREATE_TARGET_INDEX", usage: "create the target index from the source mappings", boolean: true},
+		{name: "mapping-report", key: "MAPPING_REPORT_FILE", usage: "where to save the mapping conversion report"},
+		{name: "dead-letter-file", key: "DEAD_LETTER_FILE", usage: "NDJSON file of the documents rejected by the target"},
+		{name: "sink", key: "SINK_TYPE", usage: "where documents are written: elasticsearch or file"},
+		{name: "output-dir", key: "FILE_SINK_DIR", usage: "directory of the NDJSON part files and manifest of the file sink"},
+		{name: "compression", key: "FILE_SINK_COMPRESSION", usage: "compression of the part files: none, gzip or zstd"},
+		{name: "max-file-bytes", key: "FILE_SINK_MAX_BYTES", usage: "size at which a part file is rolled over, 0 for one part per worker"},
+	}
+)
+
+// options concatenates groups of options.
+func options(groups ...[]option) []option {
+	var all []option
+	for _, group := range groups {
+		all = append(all, group...)
+	}
+	return all
+}
+
+// addOptions registers the options on fs. They have no defaults of their own: unset flags leave the configuration as loaded.
+func addOptions(fs *flag.FlagSet, options []option) {
+	for _, o := range options {
+		usage := fmt.Sprintf("%s (%s)", o.usage, o.key)
+		if o.boolean {
+			fs.Bool(o.name, false, usage)
+		} else {
+			fs.String(o.name, "", usage)
+		}
+	}
+}
+
+// overrides returns the configuration variables set on the command line, by --set and by the option flags.
+// Option flags win over --set for the same variable.
+func overrides(fs *flag.FlagSet, options []option, sets settings) map[string]interface{} {
+	values := map[string]interface{}{}
+	for key, value := range sets {
+		values[key] = value
+	}
+	keys := map[string]string{}
+	for _, o := range options {
+		keys[o.name] = o.key
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if key, ok := keys[f.Name]; ok {
+			values[key] = f.Value.String()
+		}
+	})
+	return values
+}
+
+// settings collects repeated --set KEY=VALUE flags.
+type settings map[string]string
+
+func (s settings) String() string {
+	pairs := make([]string, 0, len(s))
+	for key, value := range s {
+		pairs = append(pairs, key+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (s settings) Set(pair string) error {
+	key, value, ok := strings.Cut(pair, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("expected KEY=VALUE, got %q", pair)
+	}
+	s[strings.ToUpper(key)] = value
+	return nil
+}
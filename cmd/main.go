@@ -1,27 +1,167 @@
 package main
 
 import (
+	"context"
 	"elkmigration/clients"
 	"elkmigration/config"
 	"elkmigration/logger"
 	"elkmigration/pipeline"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
 	"runtime"
-	"sync"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/rs/zerolog/log"
 	"go.uber.org/zap"
 )
 
-// Configuration for worker counts and buffer sizes
-const (
-	exportWorkers    = 1
-	transformWorkers = 1
-	importWorkers    = 1
-	bufferSize       = 100000
-)
+// command is a subcommand of the CLI, e.g. "elkmigration migrate --from logs --to logs-v2".
+type command struct {
+	name    string
+	summary string
+	options []option               // flags overriding configuration variables
+	flags   func(fs *flag.FlagSet) // flags of the command itself, not part of the configuration
+	state   bool                   // whether the command needs the checkpoint store
+	stdout  bool                   // whether the command prints its result on stdout, logging to stderr instead
+	run     func(ctx context.Context, config *config.Config) error
+}
+
+var commands = []*command{
+	{
+		name:    "migrate",
+		summary: "copy the source index into the target index, resuming from the last checkpoint",
+		options: options(clusterOptions, exportOptions, transformOptions, importOptions),
+		state:   true,
+		run:     runMigrate,
+	},
+	{
+		name:    "sync",
+		summary: "repeatedly copy the documents changed since the last round, until interrupted",
+		options: options(clusterOptions, exportOptions, transformOptions, importOptions, syncOptions),
+		state:   true,
+		run:     runSync,
+	},
+	{
+		name:    "verify",
+		summary: "compare the target index with what the source and transforms produce",
+		options: options(clusterOptions, exportOptions, transformOptions, verifyOptions),
+		state:   true,
+		run:     runVerify,
+	},
+	{
+		name:    "cutover",
+		summary: "move the alias onto the target index",
+		options: options(clusterOptions, cutoverOptions),
+		state:   true,
+		run:     runCutover,
+	},
+	{
+		name:    "rollback",
+		summary: "move the alias back to where it was before the last cutover",
+		options: options(clusterOptions, cutoverOptions),
+		state:   true,
+		run:     runRollback,
+	},
+	{
+		name:    "status",
+		summary: "print the saved checkpoints, sync marks, verification and cutover as JSON",
+		options: options(clusterOptions, statusOptions),
+		state:   true,
+		stdout:  true,
+		run:     runStatus,
+	},
+	{
+		name:    "reset-checkpoint",
+		summary: "delete the saved export checkpoints so the next migration starts over",
+		options: clusterOptions,
+		flags:   resetCheckpointFlags,
+		state:   true,
+		run:     runResetCheckpoint,
+	},
+	{
+		name:    "state",
+		summary: "print, list or delete the state saved for the job",
+		options: stateOptions,
+		flags:   stateFlags,
+		state:   true,
+		stdout:  true,
+		run:     runState,
+	},
+	{
+		name:    "mappings",
+		summary: "print the target index definitions converted from the source mappings",
+		options: options(clusterOptions, mappingsOptions),
+		flags:   mappingsFlags,
+		stdout:  true,
+		run:     runMappings,
+	},
+	{
+		name:    "dump",
+		summary: "write the source documents as NDJSON",
+		options: options(clusterOptions, exportOptions, transformOptions),
+		flags:   dumpFlags,
+		stdout:  true,
+		run:     runDump,
+	},
+}
+
+// defaultCommand parses the flags when no command is given; RUN_MODE then picks the command.
+var defaultCommand = &command{options: clusterOptions}
 
 func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run runs the command named by the first argument and returns the exit code:
+// 1 when the command fails, 2 when the command line is invalid.
+func run(args []string) int {
+	cmd := defaultCommand
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		if args[0] == "help" {
+			usage(os.Stdout)
+			return 0
+		}
+		if cmd = findCommand(args[0]); cmd == nil {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+			usage(os.Stderr)
+			return 2
+		}
+		args = args[1:]
+	}
+
+	fs := flag.NewFlagSet(strings.TrimSpace("elkmigration "+cmd.name), flag.ContinueOnError)
+	configFile := fs.String("config", "", "job file (.env, YAML or JSON) read instead of ./.env")
+	sets := settings{}
+	fs.Var(sets, "set", "set any configuration variable, as KEY=VALUE (repeatable)")
+	addOptions(fs, cmd.options)
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+	fs.Usage = func() {
+		if cmd == defaultCommand {
+			usage(fs.Output())
+		} else {
+			fmt.Fprintf(fs.Output(), "Usage: elkmigration %s [flags]\n\n%s.\n\nFlags:\n", cmd.name, cmd.summary)
+		}
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected arguments: %s\n", strings.Join(fs.Args(), " "))
+		return 2
+	}
+
 	// Record the start time
 	start := time.Now()
 	defer func() {
@@ -29,17 +169,33 @@ func main() {
 		log.Printf("Total execution time: %.2f seconds", duration.Seconds())
 	}()
 
-	logger.InitLogger("./logs/elkmigration.log")
+	console := os.Stdout
+	if cmd.stdout {
+		console = os.Stderr
+	}
+	logger.InitLoggerTo("./logs/elkmigration.log", console)
 	//logger.InitZLogger()
 	defer logger.Log.Sync()
 
-	config, err := config.LoadConfig()
+	config, err := config.LoadConfig(*configFile, overrides(fs, cmd.options, sets))
 	if err != nil {
-		logger.Error("Config Loading err, Set Default Values... ", zap.Error(err))
+		logger.Error("Config Loading err", zap.Error(err))
+		return 1
+	}
+	if cmd == defaultCommand {
+		if cmd = findCommand(config.RunMode); cmd == nil {
+			logger.Error("Invalid RUN_MODE", zap.String("mode", config.RunMode))
+			return 2
+		}
 	}
 
-	clients.InitRedis(logger.Log, config)
-	defer clients.CloseRedis()
+	if cmd.state {
+		if err := clients.InitCheckpointStore(logger.Log, config); err != nil {
+			logger.Error("Checkpoint store err", zap.Error(err))
+			return 1
+		}
+		defer clients.CloseCheckpointStore()
+	}
 
 	// Get the number of available CPU cores
 	numCPU := runtime.NumCPU()
@@ -51,64 +207,62 @@ func main() {
 	// Verify the number of CPUs Go is using
 	logger.Info("Go is using %d CPUs\n", zap.Any("", runtime.GOMAXPROCS(0)))
 
-	logger.Info("Starting Elasticsearch migration")
+	// Interrupting stops sync mode cleanly and cancels the other commands
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Initialize Elasticsearch clients
-	es2Client, err := clients.NewElasticsearchClient(2, config.Elk2Url, config.Elk2User, config.Elk2Pass)
+	logger.Info("Starting Elasticsearch migration", zap.String("command", cmd.name))
+	if err := cmd.run(ctx, config); err != nil {
+		logger.Error("Command failed", zap.String("command", cmd.name), zap.Error(err))
+		return 1
+	}
+	return 0
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// usage lists the commands.
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: elkmigration [command] [flags]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-18s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(w, "\nWithout a command, RUN_MODE picks one. Run \"elkmigration <command> -h\" for its flags.\n")
+	fmt.Fprintf(w, "Flags override the job file given with --config, or ./.env, and the environment.\n\n")
+}
+
+// newClient creates the Elasticsearch client of the configured endpoint of a major version.
+func newClient(config *config.Config, version int) (clients.ElasticsearchClient, error) {
+	url, user, pass, err := config.Endpoint(version)
+	if err != nil {
+		return nil, err
+	}
+	return clients.NewElasticsearchClient(version, url, user, pass)
+}
+
+// newSourceClient returns nil without error when documents are read from files.
+func newSourceClient(config *config.Config) (clients.ElasticsearchClient, error) {
+	if config.SourceType == pipeline.SourceFile {
+		return nil, nil
+	}
+	client, err := newClient(config, config.SourceVersion)
 	if err != nil {
-		logger.Error("Error creating Elasticsearch 2.x client", zap.Error(err))
-		return
+		return nil, fmt.Errorf("error creating source Elasticsearch client: %w", err)
 	}
+	return client, nil
+}
 
-	es8Client, err := clients.NewElasticsearchClient(8, config.Elk8Url, config.ELK8User, config.Elk8Pass)
+func newTargetClient(config *config.Config) (clients.ElasticsearchClient, error) {
+	client, err := newClient(config, config.TargetVersion)
 	if err != nil {
-		logger.Error("Error creating Elasticsearch 8.x client", zap.Error(err))
-		return
-	}
-
-	// Channels for pipeline stages with buffer
-	docs := make(chan map[string]interface{}, bufferSize)
-	transformedDocs := make(chan map[string]interface{}, bufferSize)
-	var wg sync.WaitGroup
-	var mu sync.Mutex // Mutex for shared resources
-
-	// Export stage worker pool
-	for i := 0; i < exportWorkers; i++ {
-		wg.Add(1)
-		go func(workerID int) {
-			defer wg.Done()
-			logger.Info("Starting export worker", zap.Int("workerID", workerID))
-			pipeline.ExportDocuments(es2Client, config, docs, clients.RedisClient, &mu)
-			logger.Info("Export worker completed", zap.Int("workerID", workerID))
-		}(i)
-	}
-
-	// Transform stage worker pool
-	for i := 0; i < transformWorkers; i++ {
-		wg.Add(1)
-		go func(workerID int) {
-			defer wg.Done()
-			logger.Info("Starting transform worker", zap.Int("workerID", workerID))
-			pipeline.TransformDocuments(docs, transformedDocs)
-			logger.Info("Transform worker completed", zap.Int("workerID", workerID))
-		}(i)
-	}
-
-	// Import stage worker pool
-	for i := 0; i < importWorkers; i++ {
-		wg.Add(1)
-		go func(workerID int) {
-			defer wg.Done()
-			logger.Info("Starting import worker", zap.Int("workerID", workerID))
-			pipeline.ImportDocuments(es8Client, config, transformedDocs)
-			logger.Info("Import worker completed", zap.Int("workerID", workerID))
-		}(i)
-	}
-
-	// Close channels after all work is done
-	wg.Wait()
-	close(docs)            // Close docs to stop transformers
-	close(transformedDocs) // Close transformedDocs to stop importers
-
-	logger.Info("Elasticsearch migration completed")
+		return nil, fmt.Errorf("error creating target Elasticsearch client: %w", err)
+	}
+	return client, nil
 }
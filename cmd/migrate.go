@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"elkmigration/clients"
+	"elkmigration/config"
+	"elkmigration/job"
+	"elkmigration/logger"
+	"elkmigration/mapping"
+	"elkmigration/pipeline"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Configuration for buffer sizes
+const (
+	bufferSize = 100000
+)
+
+var syncOptions = []option{
+	{name: "sync-field", key: "SYNC_FIELD", usage: "timestamp or sequence field compared with the sync mark"},
+	{name: "interval", key: "SYNC_INTERVAL", usage: "pause between sync rounds"},
+	{name: "sync-from", key: "SYNC_FROM", usage: "first sync mark when none is saved"},
+}
+
+// migration holds what the indices of a migrate or sync job share: the clients, the transform rules
+// and script, the dead-letter queue and the budget of bulk requests in flight.
+// With SINK_TYPE=file, documents are written to output instead of a target cluster.
+type migration struct {
+	sourceClient clients.ElasticsearchClient
+	targetClient clients.ElasticsearchClient
+	output       *pipeline.FileOutput
+	indices      []job.Index
+	filter       *pipeline.ExportFilter
+	transformer  *pipeline.Transformer // without type routing, which depends on the index
+	deadLetters  *pipeline.DeadLetterQueue
+	limiter      *pipeline.InFlightLimiter
+	sizer        *pipeline.BulkSizer
+}
+
+// newMigration resolves the source indices and creates their target indices if configured.
+// The dead-letter queue has to be closed by the caller.
+func newMigration(ctx context.Context, config *config.Config) (*migration, error) {
+	// Initialize Elasticsearch clients for the configured source and target versions
+	sourceClient, err := newSourceClient(config)
+	if err != nil {
+		return nil, err
+	}
+	var targetClient clients.ElasticsearchClient
+	var output *pipeline.FileOutput
+	switch config.SinkType {
+	case pipeline.SinkElasticsearch:
+		if targetClient, err = newTargetClient(config); err != nil {
+			return nil, err
+		}
+	case pipeline.SinkFile:
+		if output, err = pipeline.NewFileOutput(config); err != nil {
+			return nil, fmt.Errorf("error opening file sink: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown SINK_TYPE %q, expected elasticsearch or file", config.SinkType)
+	}
+	indices, err := job.Resolve(ctx, sourceClient, config)
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range indices {
+		logger.Info("Source index resolved", zap.String("source", index.Source), zap.String("target", index.Target))
+	}
+
+	// Create the target indices from the converted source mappings and settings before importing,
+	// one index at a time since several sources may share a target. Files carry no mappings.
+	if config.CreateTargetIndex && targetClient != nil && sourceClient != nil {
+		for _, index := range indices {
+			indexConfig := index.Config(config)
+			splitter, err := pipeline.NewTypeSplitter(indexConfig)
+			if err != nil {
+				return nil, fmt.Errorf("invalid type split configuration: %w", err)
+			}
+			if err := mapping.CreateTargetIndex(ctx, sourceClient, targetClient, index.Source, splitter.Route, indexConfig.MappingReportFile); err != nil {
+				return nil, fmt.Errorf("error creating target index for %s: %w", index.Source, err)
+			}
+		}
+	}
+
+	// Optional query, time range and _source filtering of the export
+	filter, err := pipeline.NewExportFilter(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid export filter: %w", err)
+	}
+	if filter.Active() {
+		logger.Info("Exporting a filtered subset of the source index", zap.Any("query", filter.Query), zap.Strings("includes", filter.Includes), zap.Strings("excludes", filter.Excludes))
+	}
+
+	// Bulk requests in flight are capped across every index and import worker
+	sizer, err := pipeline.NewBulkSizer(config)
+	if err != nil {
+		return nil, fmt.Errorf("error creating bulk sizer: %w", err)
+	}
+
+	// Rejected documents are written to the dead-letter sink and summarized at the end of the run.
+	// A Redis list sink needs the Redis connection even when the checkpoints are kept elsewhere.
+	if config.DeadLetterRedisKey != "" && clients.RedisClient == nil {
+		clients.InitRedis(logger.Log, config)
+	}
+	deadLetters, err := pipeline.NewDeadLetterQueue(config, clients.RedisClient)
+	if err != nil {
+		return nil, fmt.Errorf("error creating dead-letter sink: %w", err)
+	}
+
+	// Transform rules and script applied between export and import
+	transformer, err := pipeline.NewTransformer(config, nil, deadLetters)
+	if err != nil {
+		deadLetters.Close()
+		return nil, fmt.Errorf("error creating transformer: %w", err)
+	}
+
+	return &migration{
+		sourceClient: sourceClient,
+		targetClient: targetClient,
+		output:       output,
+		indices:      indices,
+		filter:       filter,
+		transformer:  transformer,
+		deadLetters:  deadLetters,
+		limiter:      pipeline.NewInFlightLimiter(config.MaxInFlightRequests, config.MaxInFlightBytes),
+		sizer:        sizer,
+	}, nil
+}
+
+// stages returns the transformer, routing documents of multi-type ES2 indices by their _type,
+// and the given number of sinks, one per import worker, for an index of the job.
+func (m *migration) stages(config *config.Config, workers int) (*pipeline.Transformer, []pipeline.Sink, error) {
+	splitter, err := pipeline.NewTypeSplitter(config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid type split configuration: %w", err)
+	}
+	sinks := make([]pipeline.Sink, workers)
+	for i := range sinks {
+		if m.output != nil {
+			sinks[i], err = pipeline.NewFileSink(m.output, config, m.deadLetters)
+		} else {
+			sinks[i], err = pipeline.NewSink(m.targetClient, config, m.deadLetters, m.limiter, m.sizer)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("error creating sink: %w", err)
+		}
+	}
+	return m.transformer.WithSplitter(config, splitter), sinks, nil
+}
+
+// runMigrate copies the source indices, JOB_CONCURRENCY at a time.
+func runMigrate(ctx context.Context, config *config.Config) error {
+	m, err := newMigration(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer m.deadLetters.Close()
+
+	indices := make(chan job.Index)
+	go func() {
+		defer close(indices)
+		for _, index := range m.indices {
+			select {
+			case indices <- index:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed []error
+	for i := 0; i < min(max(config.JobConcurrency, 1), len(m.indices)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indices {
+				if err := m.migrateIndex(ctx, index.Config(config)); err != nil {
+					logger.Error("Index migration failed", zap.String("index", index.Source), zap.Error(err))
+					mu.Lock()
+					failed = append(failed, fmt.Errorf("%s: %w", index.Source, err))
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	m.deadLetters.LogSummary()
+	if m.output != nil {
+		m.output.LogSummary()
+	}
+	if len(failed) > 0 {
+		return errors.Join(failed...)
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("migration interrupted: %w", ctx.Err())
+	}
+	logger.Info("Elasticsearch migration completed", zap.Int("indices", len(m.indices)))
+	return nil
+}
+
+// migrateIndex copies one source index through the export, transform and import worker pools.
+// The first stage to fail cancels the others and its error is returned; documents not yet
+// written stay unacknowledged, so the checkpoint never moves past them.
+func (m *migration) migrateIndex(ctx context.Context, config *config.Config) error {
+	transformer, sinks, err := m.stages(config, max(config.ImportWorkers, 1))
+	if err != nil {
+		return err
+	}
+
+	// One source per slice of the source index
+	exportWorkers := max(config.ExportSlices, 1)
+	sources := make([]pipeline.Source, exportWorkers)
+	for i := range sources {
+		sources[i], err = pipeline.NewSource(m.sourceClient, config, pipeline.Slice{ID: i, Max: exportWorkers}, m.filter, m.deadLetters)
+		if err != nil {
+			return fmt.Errorf("error creating source: %w", err)
+		}
+	}
+	logger.Info("Starting index migration", zap.String("source", config.ElkIndexFrom), zap.String("target", config.ElkIndexTo))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var errMu sync.Mutex
+	var stageErr error
+	fail := func(err error) {
+		errMu.Lock()
+		if stageErr == nil {
+			stageErr = err
+		}
+		errMu.Unlock()
+		cancel()
+	}
+
+	// Channels for pipeline stages with buffer
+	docs := make(chan *pipeline.Document, bufferSize)
+	transformedDocs := make(chan *pipeline.Document, bufferSize)
+	var wg sync.WaitGroup
+	var mu sync.Mutex // Mutex for shared resources
+
+	// Export stage worker pool, one worker per slice of the source index
+	var exportWg sync.WaitGroup
+	for i := 0; i < exportWorkers; i++ {
+		exportWg.Add(1)
+		go func(workerID int) {
+			defer exportWg.Done()
+			logger.Info("Starting export worker", zap.Int("workerID", workerID))
+			if err := pipeline.ExportDocuments(ctx, sources[workerID], config, pipeline.Slice{ID: workerID, Max: exportWorkers}, docs, clients.Store, &mu); err != nil {
+				fail(fmt.Errorf("export of slice %d failed: %w", workerID, err))
+				return
+			}
+			logger.Info("Export worker completed", zap.Int("workerID", workerID))
+		}(i)
+	}
+
+	// Close docs once every slice is exported to stop transformers
+	go func() {
+		exportWg.Wait()
+		close(docs)
+	}()
+
+	// Transform stage worker pool, which closes transformedDocs to stop importers once docs is drained
+	transformWorkers := config.TransformWorkers
+	if transformWorkers <= 0 {
+		transformWorkers = runtime.NumCPU()
+	}
+	go func() {
+		logger.Info("Starting transform workers", zap.Int("workers", transformWorkers), zap.Bool("ordered", config.TransformOrdered))
+		if err := pipeline.TransformDocuments(ctx, transformer, transformWorkers, config.TransformOrdered, docs, transformedDocs); err != nil {
+			fail(fmt.Errorf("transform failed: %w", err))
+			return
+		}
+		logger.Info("Transform workers completed")
+	}()
+
+	// Import stage worker pool
+	for i := range sinks {
+		wg.Add(1)
+		go func(workerID int) {
+			defer wg.Done()
+			logger.Info("Starting import worker", zap.Int("workerID", workerID))
+			if err := pipeline.ImportDocuments(ctx, sinks[workerID], transformedDocs); err != nil {
+				fail(fmt.Errorf("import worker %d failed: %w", workerID, err))
+				return
+			}
+			logger.Info("Import worker completed", zap.Int("workerID", workerID))
+		}(i)
+	}
+
+	// Wait for the importers, which finish once every transformed document is written,
+	// and for the exporters, which may still be returning after a failure
+	wg.Wait()
+	exportWg.Wait()
+	if stageErr != nil {
+		return stageErr
+	}
+	logger.Info("Index migration completed", zap.String("source", config.ElkIndexFrom), zap.String("target", config.ElkIndexTo))
+	return nil
+}
+
+// runSync catches the target up with later source writes until interrupted.
+func runSync(ctx context.Context, config *config.Config) error {
+	if config.SourceType == pipeline.SourceFile {
+		return errors.New("sync queries the source cluster and does not support SOURCE_TYPE=file")
+	}
+	m, err := newMigration(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer m.deadLetters.Close()
+	if len(m.indices) != 1 {
+		return fmt.Errorf("sync supports a single source index, %s matches %d", config.ElkIndexFrom, len(m.indices))
+	}
+
+	indexConfig := m.indices[0].Config(config)
+	// Sync rounds are written by a single sink
+	transformer, sinks, err := m.stages(indexConfig, 1)
+	if err != nil {
+		return err
+	}
+	sink := sinks[0]
+	err = pipeline.SyncDocuments(ctx, m.sourceClient, indexConfig, m.filter, transformer, sink, m.deadLetters, clients.Store)
+	if closeErr := sink.Close(); closeErr != nil {
+		logger.Error("Error closing sink", zap.Error(closeErr))
+	}
+	m.deadLetters.LogSummary()
+	if m.output != nil {
+		m.output.LogSummary()
+	}
+	if err != nil {
+		return fmt.Errorf("sync failed: %w", err)
+	}
+	logger.Info("Elasticsearch sync stopped")
+	return nil
+}
@@ -2,15 +2,21 @@ package config
 
 import (
 	"elkmigration/logger"
+	"fmt"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	"log"
+	"strings"
 )
 
 // Config holds the application configuration
 type Config struct {
-	ElkIndexFrom string `mapstructure:"ELK_INDEX_FROM"`
-	ElkIndexTo   string `mapstructure:"ELK_INDEX_TO"`
+	ElkIndexFrom string `mapstructure:"ELK_INDEX_FROM"` // comma-separated source indices, wildcards or aliases
+	ElkIndexTo   string `mapstructure:"ELK_INDEX_TO"`   // target index, a template with {index}, {name} and {date} for several sources
+
+	IndexDateLayout  string `mapstructure:"INDEX_DATE_LAYOUT"`  // Go layout of the date suffix of source index names, e.g. "2006.01.02"
+	TargetDateLayout string `mapstructure:"TARGET_DATE_LAYOUT"` // Go layout of {date} in target names, e.g. "2006.01" for monthly rollups; INDEX_DATE_LAYOUT when empty
+	JobConcurrency   int    `mapstructure:"JOB_CONCURRENCY"`    // number of source indices migrated at once
 
 	Elk2Url  string `mapstructure:"ELK2_URL"`
 	Elk2User string `mapstructure:"ELK2_USER"`
@@ -24,27 +30,106 @@ type Config struct {
 	ELK8User string `mapstructure:"ELK8_USER"`
 	Elk8Pass string `mapstructure:"ELK8_PASS"`
 
+	RunMode string `mapstructure:"RUN_MODE"` // command run when none is given on the command line, e.g. "migrate"
+
+	SourceVersion int `mapstructure:"SOURCE_VERSION"` // major version of the cluster to export from: 2, 7 or 8
+	TargetVersion int `mapstructure:"TARGET_VERSION"` // major version of the cluster to import into: 2, 7 or 8
+
+	SourceType       string `mapstructure:"SOURCE_TYPE"`        // where documents are read from: "elasticsearch" for the source cluster or "file"
+	SourceFiles      string `mapstructure:"SOURCE_FILES"`       // comma-separated files, globs, file sink directories or manifests read by the file source
+	SourceFileFormat string `mapstructure:"SOURCE_FILE_FORMAT"` // "ndjson" dumps, "bulk" request bodies, or "auto" to detect it per file
+
 	BulkSize      int    `mapstructure:"BULK_SIZE"`
 	MaxRetries    int    `mapstructure:"MAX_RETRIES"`
 	ScrollTimeout string `mapstructure:"SCROLL_TIMEOUT"`
 
-	RedisUrl           string `mapstructure:"REDIS_URL"`
-	RedisDb            int    `mapstructure:"REDIS_DB"`
-	RedisPass          string `mapstructure:"REDIS_PASSWORD"`
-	RedisKeyLastID     string `mapstructure:"REDIS_KEY_LAST_ID"`
-	RedisKeyLastDoc    string `mapstructure:"REDIS_KEY_LAST_DOC"`
-	RedisKeyLastOffset string `mapstructure:"REDIS_KEY_LAST_OFFSET"`
-	RedisKeyLastCount  string `mapstructure:"REDIS_KEY_LAST_Count"`
+	ExportMode string `mapstructure:"EXPORT_MODE"` // "scroll" or "sorted"
+	SortField  string `mapstructure:"SORT_FIELD"`
+
+	ExportSlices int `mapstructure:"EXPORT_SLICES"` // number of parallel export workers, one per slice
+
+	ExportQuery     string `mapstructure:"EXPORT_QUERY"`      // query DSL restricting the exported documents
+	ExportQueryFile string `mapstructure:"EXPORT_QUERY_FILE"` // file holding the query DSL, instead of EXPORT_QUERY
+	SourceIncludes  string `mapstructure:"SOURCE_INCLUDES"`   // comma-separated _source fields to export, all when empty
+	SourceExcludes  string `mapstructure:"SOURCE_EXCLUDES"`   // comma-separated _source fields to strip
+	TimeField       string `mapstructure:"TIME_FIELD"`        // timestamp field of the TIME_FROM/TIME_TO range
+	TimeFrom        string `mapstructure:"TIME_FROM"`         // export documents from this date or date math, e.g. "now-90d"
+	TimeTo          string `mapstructure:"TIME_TO"`           // export documents before this date or date math
+
+	SyncField    string `mapstructure:"SYNC_FIELD"`    // timestamp or sequence field compared with the sync mark
+	SyncInterval string `mapstructure:"SYNC_INTERVAL"` // pause between sync rounds
+	SyncFrom     string `mapstructure:"SYNC_FROM"`     // first sync mark when none is saved, e.g. the bulk copy start time
+	SyncOverlap  int64  `mapstructure:"SYNC_OVERLAP"`  // amount a numeric mark is lowered by each round, in field units (milliseconds for dates)
+
+	ImportWorkers       int `mapstructure:"IMPORT_WORKERS"`        // number of concurrent bulk senders
+	MaxInFlightRequests int `mapstructure:"MAX_INFLIGHT_REQUESTS"` // bulk requests outstanding at once, 0 for no limit
+	MaxInFlightBytes    int `mapstructure:"MAX_INFLIGHT_BYTES"`    // bulk payload bytes outstanding at once, 0 for no limit
+
+	BulkMinBytes      int    `mapstructure:"BULK_MIN_BYTES"`      // lower bound of the adaptive bulk payload size
+	BulkMaxBytes      int    `mapstructure:"BULK_MAX_BYTES"`      // upper bound of the adaptive bulk payload size
+	BulkTargetLatency string `mapstructure:"BULK_TARGET_LATENCY"` // bulk response time the payload size is tuned for
+
+	RedisUrl       string `mapstructure:"REDIS_URL"`
+	RedisDb        int    `mapstructure:"REDIS_DB"`
+	RedisPass      string `mapstructure:"REDIS_PASSWORD"`
+	RedisKeyPrefix string `mapstructure:"REDIS_KEY_PREFIX"` // first part of every state key, followed by the job ID
+
+	JobID string `mapstructure:"JOB_ID"` // names the job whose checkpoints, sync marks, verification and cutover are kept apart in the checkpoint store
+
+	CheckpointBackend string `mapstructure:"CHECKPOINT_BACKEND"` // where the job state is kept: redis, file or bolt
+	CheckpointPath    string `mapstructure:"CHECKPOINT_PATH"`    // state file of the file and bolt backends, empty for one under ./state
+
+	TransformWorkers int  `mapstructure:"TRANSFORM_WORKERS"` // number of transform workers, 0 for one per CPU
+	TransformOrdered bool `mapstructure:"TRANSFORM_ORDERED"` // keep documents in export order through the transform stage
+
+	TransformRulesFile  string `mapstructure:"TRANSFORM_RULES_FILE"`  // YAML or JSON field transformation rules, empty for none
+	TransformScriptFile string `mapstructure:"TRANSFORM_SCRIPT_FILE"` // script run on every document after the rules, empty for none
+
+	TypeSplitMode     string `mapstructure:"TYPE_SPLIT_MODE"`     // how ES2 mapping types are migrated: "none", "index" or "field"
+	TypeSplitModes    string `mapstructure:"TYPE_SPLIT_MODES"`    // per-type overrides, e.g. "user:index,comment:field"
+	TypeIndexTemplate string `mapstructure:"TYPE_INDEX_TEMPLATE"` // target index name in index mode, with {index} and {type} placeholders
+	TypeField         string `mapstructure:"TYPE_FIELD"`          // field holding the type in field mode
+
+	VerifySampleRate float64 `mapstructure:"VERIFY_SAMPLE_RATE"` // fraction of the documents whose content is compared, 0 to 1
+	VerifyMaxIDs     int     `mapstructure:"VERIFY_MAX_IDS"`     // most document IDs listed per category in the report, 0 for all
+	VerifyReportFile string  `mapstructure:"VERIFY_REPORT_FILE"` // where to save the verification report, empty to only log it
+
+	CutoverAlias         string `mapstructure:"CUTOVER_ALIAS"`          // alias moved onto ELK_INDEX_TO by the cutover
+	CutoverPrevious      string `mapstructure:"CUTOVER_PREVIOUS"`       // what to do with the indices the alias leaves: "keep", "close" or "delete"
+	CutoverRequireVerify bool   `mapstructure:"CUTOVER_REQUIRE_VERIFY"` // refuse the cutover unless the last verification of ELK_INDEX_TO passed
+
+	CreateTargetIndex bool   `mapstructure:"CREATE_TARGET_INDEX"` // create the target index from the converted source mappings
+	MappingReportFile string `mapstructure:"MAPPING_REPORT_FILE"` // where to save the mapping conversion report, empty to only log it
+
+	DeadLetterFile     string `mapstructure:"DEAD_LETTER_FILE"`
+	DeadLetterRedisKey string `mapstructure:"DEAD_LETTER_REDIS_KEY"`
+
+	SinkType            string `mapstructure:"SINK_TYPE"`             // where documents are written: "elasticsearch" for the target cluster or "file"
+	FileSinkDir         string `mapstructure:"FILE_SINK_DIR"`         // directory of the NDJSON part files and their manifest
+	FileSinkCompression string `mapstructure:"FILE_SINK_COMPRESSION"` // compression of the part files: "none", "gzip" or "zstd"
+	FileSinkMaxBytes    int64  `mapstructure:"FILE_SINK_MAX_BYTES"`   // size on disk at which a part file is rolled over
 }
 
-// LoadConfig initializes the application configuration from environment variables
-func LoadConfig() (*Config, error) {
-	viper.SetConfigName(".env") // Use .env for configuration
-	viper.SetConfigType("env")
-	viper.AddConfigPath(".")
-	if err := viper.ReadInConfig(); err != nil {
-		logger.Log.Warn("Error reading config file", zap.Error(err))
-		logger.Log.Info("Environment variable not set, using default")
+// LoadConfig initializes the application configuration from environment variables.
+// configFile is a job file (.env, YAML or JSON, by extension) read instead of ./.env, and overrides
+// are values keyed by variable name, such as command-line flags, taking precedence over every other source.
+func LoadConfig(configFile string, overrides map[string]interface{}) (*Config, error) {
+	if configFile != "" {
+		viper.SetConfigFile(configFile)
+		if err := viper.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("error reading config file %s: %w", configFile, err)
+		}
+	} else {
+		viper.SetConfigName(".env") // Use .env for configuration
+		viper.SetConfigType("env")
+		viper.AddConfigPath(".")
+		if err := viper.ReadInConfig(); err != nil {
+			logger.Log.Warn("Error reading config file", zap.Error(err))
+			logger.Log.Info("Environment variable not set, using default")
+		}
+	}
+	for key, value := range overrides {
+		viper.Set(key, value)
 	}
 
 	// Set up Viper to read environment variables
@@ -54,6 +139,10 @@ func LoadConfig() (*Config, error) {
 	viper.SetDefault("ELK_INDEX_FROM", "idx_from")
 	viper.SetDefault("ELK_INDEX_TO", "idx_to")
 
+	viper.SetDefault("INDEX_DATE_LAYOUT", "2006.01.02")
+	viper.SetDefault("TARGET_DATE_LAYOUT", "")
+	viper.SetDefault("JOB_CONCURRENCY", 1)
+
 	viper.SetDefault("ELK2_URL", "http://127.0.0.1:9202")
 	viper.SetDefault("ELK2_USER", "elastic")
 	viper.SetDefault("ELK2_PASS", "changeme")
@@ -66,17 +155,84 @@ func LoadConfig() (*Config, error) {
 	viper.SetDefault("ELK8_USER", "elastic")
 	viper.SetDefault("ELK8_PASS", "changeme")
 
+	viper.SetDefault("RUN_MODE", "migrate")
+
+	viper.SetDefault("SOURCE_VERSION", 2)
+	viper.SetDefault("TARGET_VERSION", 8)
+
+	viper.SetDefault("SOURCE_TYPE", "elasticsearch")
+	viper.SetDefault("SOURCE_FILES", "")
+	viper.SetDefault("SOURCE_FILE_FORMAT", "auto")
+
 	viper.SetDefault("BULK_SIZE", "1000")
 	viper.SetDefault("MAX_RETRIES", "60")
 	viper.SetDefault("SCROLL_TIMEOUT", "1m")
 
+	viper.SetDefault("EXPORT_MODE", "scroll")
+	viper.SetDefault("SORT_FIELD", "_uid")
+
+	viper.SetDefault("EXPORT_SLICES", 1)
+
+	viper.SetDefault("EXPORT_QUERY", "")
+	viper.SetDefault("EXPORT_QUERY_FILE", "")
+	viper.SetDefault("SOURCE_INCLUDES", "")
+	viper.SetDefault("SOURCE_EXCLUDES", "")
+	viper.SetDefault("TIME_FIELD", "@timestamp")
+	viper.SetDefault("TIME_FROM", "")
+	viper.SetDefault("TIME_TO", "")
+
+	viper.SetDefault("SYNC_FIELD", "updated_at")
+	viper.SetDefault("SYNC_INTERVAL", "30s")
+	viper.SetDefault("SYNC_FROM", "")
+	viper.SetDefault("SYNC_OVERLAP", 0)
+
+	viper.SetDefault("IMPORT_WORKERS", 1)
+	viper.SetDefault("MAX_INFLIGHT_REQUESTS", 4)
+	viper.SetDefault("MAX_INFLIGHT_BYTES", 200*1024*1024)
+
+	viper.SetDefault("BULK_MIN_BYTES", 1*1024*1024)
+	viper.SetDefault("BULK_MAX_BYTES", 50*1024*1024)
+	viper.SetDefault("BULK_TARGET_LATENCY", "2s")
+
 	viper.SetDefault("REDIS_URL", "127.0.0.1:6379")
 	viper.SetDefault("REDIS_DB", 0)
 	viper.SetDefault("REDIS_PASSWORD", nil)
-	viper.SetDefault("REDIS_KEY_LAST_ID", "id")
-	viper.SetDefault("REDIS_KEY_LAST_DOC", "doc")
-	viper.SetDefault("REDIS_KEY_LAST_OFFSET", 0)
-	viper.SetDefault("REDIS_KEY_LAST_COUNT", "count")
+	viper.SetDefault("REDIS_KEY_PREFIX", "elkmigration")
+
+	viper.SetDefault("JOB_ID", "default")
+
+	viper.SetDefault("CHECKPOINT_BACKEND", "redis")
+	viper.SetDefault("CHECKPOINT_PATH", "")
+
+	viper.SetDefault("TRANSFORM_WORKERS", 0)
+	viper.SetDefault("TRANSFORM_ORDERED", true)
+
+	viper.SetDefault("TRANSFORM_RULES_FILE", "")
+	viper.SetDefault("TRANSFORM_SCRIPT_FILE", "")
+
+	viper.SetDefault("TYPE_SPLIT_MODE", "none")
+	viper.SetDefault("TYPE_SPLIT_MODES", "")
+	viper.SetDefault("TYPE_INDEX_TEMPLATE", "{index}-{type}")
+	viper.SetDefault("TYPE_FIELD", "type")
+
+	viper.SetDefault("VERIFY_SAMPLE_RATE", 0.01)
+	viper.SetDefault("VERIFY_MAX_IDS", 1000)
+	viper.SetDefault("VERIFY_REPORT_FILE", "./logs/verify-report.json")
+
+	viper.SetDefault("CUTOVER_ALIAS", "")
+	viper.SetDefault("CUTOVER_PREVIOUS", "keep")
+	viper.SetDefault("CUTOVER_REQUIRE_VERIFY", true)
+
+	viper.SetDefault("CREATE_TARGET_INDEX", true)
+	viper.SetDefault("MAPPING_REPORT_FILE", "./logs/mapping-report.json")
+
+	viper.SetDefault("DEAD_LETTER_FILE", "./logs/deadletter.ndjson")
+	viper.SetDefault("DEAD_LETTER_REDIS_KEY", "")
+
+	viper.SetDefault("SINK_TYPE", "elasticsearch")
+	viper.SetDefault("FILE_SINK_DIR", "./export")
+	viper.SetDefault("FILE_SINK_COMPRESSION", "gzip")
+	viper.SetDefault("FILE_SINK_MAX_BYTES", 1024*1024*1024)
 
 	// Define a Config struct to hold the configuration
 	var config Config
@@ -87,6 +243,11 @@ func LoadConfig() (*Config, error) {
 		return nil, err
 	}
 
+	// The job ID is part of the state keys and of the patterns used to list them
+	if config.JobID == "" || strings.ContainsAny(config.JobID, ":*?[]\\") {
+		return nil, fmt.Errorf("invalid JOB_ID %q, it must be set and not contain ':' or glob characters", config.JobID)
+	}
+
 	// Log the loaded configuration (optional)
 	configLogger, _ := zap.NewProduction() // Adjust logging based on your setup
 	defer configLogger.Sync()
@@ -94,14 +255,82 @@ func LoadConfig() (*Config, error) {
 		zap.String("ELK2 URL", config.Elk2Url),
 		zap.String("ELK7 URL", config.Elk7Url),
 		zap.String("ELK8 URL", config.Elk8Url),
+		zap.String("RUN MODE", config.RunMode),
+		zap.Int("SOURCE VERSION", config.SourceVersion),
+		zap.Int("TARGET VERSION", config.TargetVersion),
+		zap.String("SOURCE TYPE", config.SourceType),
+		zap.String("SOURCE FILES", config.SourceFiles),
+		zap.String("SOURCE FILE FORMAT", config.SourceFileFormat),
 		zap.String("ELK INDEX FROM", config.ElkIndexFrom),
 		zap.String("ELK INDEX TO", config.ElkIndexTo),
+		zap.String("INDEX DATE LAYOUT", config.IndexDateLayout),
+		zap.String("TARGET DATE LAYOUT", config.TargetDateLayout),
+		zap.Int("JOB CONCURRENCY", config.JobConcurrency),
 		zap.Int("BULK SIZE", config.BulkSize),
-		zap.String("LAST OFFSET", config.RedisKeyLastOffset),
+		zap.String("JOB ID", config.JobID),
 		zap.Int("MAX RETRIES", config.MaxRetries),
 		zap.String("SCROLL TIMEOUT", config.ScrollTimeout),
+		zap.String("EXPORT MODE", config.ExportMode),
+		zap.String("SORT FIELD", config.SortField),
+		zap.Int("EXPORT SLICES", config.ExportSlices),
+		zap.String("EXPORT QUERY", config.ExportQuery),
+		zap.String("EXPORT QUERY FILE", config.ExportQueryFile),
+		zap.String("SOURCE INCLUDES", config.SourceIncludes),
+		zap.String("SOURCE EXCLUDES", config.SourceExcludes),
+		zap.String("TIME FIELD", config.TimeField),
+		zap.String("TIME FROM", config.TimeFrom),
+		zap.String("TIME TO", config.TimeTo),
+		zap.String("SYNC FIELD", config.SyncField),
+		zap.String("SYNC INTERVAL", config.SyncInterval),
+		zap.String("SYNC FROM", config.SyncFrom),
+		zap.Int64("SYNC OVERLAP", config.SyncOverlap),
+		zap.Int("IMPORT WORKERS", config.ImportWorkers),
+		zap.Int("MAX INFLIGHT REQUESTS", config.MaxInFlightRequests),
+		zap.Int("MAX INFLIGHT BYTES", config.MaxInFlightBytes),
+		zap.Int("BULK MIN BYTES", config.BulkMinBytes),
+		zap.Int("BULK MAX BYTES", config.BulkMaxBytes),
+		zap.String("BULK TARGET LATENCY", config.BulkTargetLatency),
 		zap.String("Redis URL", config.RedisUrl),
+		zap.String("REDIS KEY PREFIX", config.RedisKeyPrefix),
+		zap.String("CHECKPOINT BACKEND", config.CheckpointBackend),
+		zap.String("CHECKPOINT PATH", config.CheckpointPath),
+		zap.Int("TRANSFORM WORKERS", config.TransformWorkers),
+		zap.Bool("TRANSFORM ORDERED", config.TransformOrdered),
+		zap.String("TRANSFORM RULES FILE", config.TransformRulesFile),
+		zap.String("TRANSFORM SCRIPT FILE", config.TransformScriptFile),
+		zap.String("TYPE SPLIT MODE", config.TypeSplitMode),
+		zap.String("TYPE SPLIT MODES", config.TypeSplitModes),
+		zap.String("TYPE INDEX TEMPLATE", config.TypeIndexTemplate),
+		zap.String("TYPE FIELD", config.TypeField),
+		zap.Float64("VERIFY SAMPLE RATE", config.VerifySampleRate),
+		zap.Int("VERIFY MAX IDS", config.VerifyMaxIDs),
+		zap.String("VERIFY REPORT FILE", config.VerifyReportFile),
+		zap.String("CUTOVER ALIAS", config.CutoverAlias),
+		zap.String("CUTOVER PREVIOUS", config.CutoverPrevious),
+		zap.Bool("CUTOVER REQUIRE VERIFY", config.CutoverRequireVerify),
+		zap.Bool("CREATE TARGET INDEX", config.CreateTargetIndex),
+		zap.String("MAPPING REPORT FILE", config.MappingReportFile),
+		zap.String("DEAD LETTER FILE", config.DeadLetterFile),
+		zap.String("DEAD LETTER REDIS KEY", config.DeadLetterRedisKey),
+		zap.String("SINK TYPE", config.SinkType),
+		zap.String("FILE SINK DIR", config.FileSinkDir),
+		zap.String("FILE SINK COMPRESSION", config.FileSinkCompression),
+		zap.Int64("FILE SINK MAX BYTES", config.FileSinkMaxBytes),
 	)
 
 	return &config, nil
 }
+
+// Endpoint returns the URL and credentials configured for an Elasticsearch major version
+func (c *Config) Endpoint(version int) (url, user, pass string, err error) {
+	switch version {
+	case 2:
+		return c.Elk2Url, c.Elk2User, c.Elk2Pass, nil
+	case 7:
+		return c.Elk7Url, c.Elk7User, c.Elk7Pass, nil
+	case 8:
+		return c.Elk8Url, c.ELK8User, c.Elk8Pass, nil
+	default:
+		return "", "", "", fmt.Errorf("no endpoint configured for Elasticsearch version %d", version)
+	}
+}
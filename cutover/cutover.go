@@ -0,0 +1,215 @@
+package cutover
+
+import (
+	"bytes"
+	"context"
+	"elkmigration/clients"
+	"elkmigration/config"
+	"elkmigration/logger"
+	"elkmigration/verify"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// What to do with the indices the alias pointed to before the cutover
+const (
+	previousKeep   = "keep"
+	previousClose  = "close"
+	previousDelete = "delete"
+)
+
+// Record is the cutover saved in the checkpoint store, read back by Rollback.
+type Record struct {
+	Alias          string     `json:"alias"`
+	Index          string     `json:"index"`    // index the alias was moved to
+	Previous       []string   `json:"previous"` // indices the alias pointed to before, if any
+	PreviousAction string     `json:"previous_action"`
+	CutoverAt      time.Time  `json:"cutover_at"`
+	RolledBackAt   *time.Time `json:"rolled_back_at,omitempty"`
+}
+
+// Cutover atomically moves CUTOVER_ALIAS from the indices it points to onto ELK_INDEX_TO, making it the
+// write index, then keeps, closes or deletes the previous indices as set by CUTOVER_PREVIOUS.
+// The cutover is recorded in the checkpoint store before the previous indices are touched, so Rollback can undo it.
+// With CUTOVER_REQUIRE_VERIFY it is refused unless the last verification of ELK_INDEX_TO passed.
+func Cutover(ctx context.Context, client clients.ElasticsearchClient, store clients.CheckpointStore, config *config.Config) error {
+	admin, err := aliasAdmin(client, config)
+	if err != nil {
+		return err
+	}
+	switch config.CutoverPrevious {
+	case previousKeep, previousClose, previousDelete:
+	default:
+		return fmt.Errorf("invalid CUTOVER_PREVIOUS %q, expected %s, %s or %s", config.CutoverPrevious, previousKeep, previousClose, previousDelete)
+	}
+
+	exists, err := admin.IndexExists(ctx, config.ElkIndexTo)
+	if err != nil {
+		return fmt.Errorf("error checking if index exists: %w", err)
+	}
+	if !exists {
+		return fmt.Errorf("target index %s does not exist", config.ElkIndexTo)
+	}
+	if config.CutoverRequireVerify {
+		if err := requireVerified(ctx, store, config); err != nil {
+			return err
+		}
+	}
+
+	current, err := admin.AliasIndices(ctx, config.CutoverAlias)
+	if err != nil {
+		return err
+	}
+	record := &Record{
+		Alias:          config.CutoverAlias,
+		Index:          config.ElkIndexTo,
+		PreviousAction: config.CutoverPrevious,
+		CutoverAt:      time.Now(),
+	}
+	for _, index := range current {
+		if index != config.ElkIndexTo {
+			record.Previous = append(record.Previous, index)
+		}
+	}
+	if len(record.Previous) == 0 && len(current) > 0 {
+		logger.Info("Alias already points to the target index", zap.String("alias", config.CutoverAlias), zap.String("index", config.ElkIndexTo))
+		return nil
+	}
+
+	// Remove and add in one request, so readers and writers never see the alias missing
+	actions := make([]interface{}, 0, len(record.Previous)+1)
+	for _, index := range record.Previous {
+		actions = append(actions, aliasAction("remove", index, record.Alias, false))
+	}
+	actions = append(actions, aliasAction("add", record.Index, record.Alias, true))
+	if err := updateAliases(ctx, admin, actions); err != nil {
+		return err
+	}
+	logger.Info("Moved alias to the target index", zap.String("alias", record.Alias), zap.String("index", record.Index), zap.Strings("previous", record.Previous))
+
+	if err := store.SaveJSON(ctx, clients.NewNamespace(config).Cutover(), record); err != nil {
+		return fmt.Errorf("alias moved but the cutover could not be recorded for rollback: %w", err)
+	}
+
+	for _, index := range record.Previous {
+		switch record.PreviousAction {
+		case previousClose:
+			err = admin.CloseIndex(ctx, index)
+		case previousDelete:
+			err = admin.DeleteIndex(ctx, index)
+		default:
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to %s previous index %s: %w", record.PreviousAction, index, err)
+		}
+		logger.Info("Previous index handled", zap.String("index", index), zap.String("action", record.PreviousAction))
+	}
+	return nil
+}
+
+// Rollback undoes the last recorded cutover: it reopens the previous indices if they were closed and
+// atomically moves the alias back to them. A cutover that deleted the previous indices cannot be rolled back.
+func Rollback(ctx context.Context, client clients.ElasticsearchClient, store clients.CheckpointStore, config *config.Config) error {
+	admin, err := aliasAdmin(client, config)
+	if err != nil {
+		return err
+	}
+
+	var record Record
+	if err := store.GetJSON(ctx, clients.NewNamespace(config).Cutover(), &record); err != nil {
+		if errors.Is(err, clients.ErrNotFound) {
+			return errors.New("no cutover recorded")
+		}
+		return err
+	}
+	if record.RolledBackAt != nil {
+		return fmt.Errorf("the cutover of alias %s to %s was already rolled back at %s", record.Alias, record.Index, record.RolledBackAt.Format(time.RFC3339))
+	}
+	if record.PreviousAction == previousDelete && len(record.Previous) > 0 {
+		return fmt.Errorf("the previous indices %v were deleted by the cutover and cannot be restored", record.Previous)
+	}
+
+	if record.PreviousAction == previousClose {
+		for _, index := range record.Previous {
+			if err := admin.OpenIndex(ctx, index); err != nil {
+				return fmt.Errorf("failed to reopen previous index %s: %w", index, err)
+			}
+			logger.Info("Reopened previous index", zap.String("index", index))
+		}
+	}
+
+	// With a single previous index it becomes the write index again
+	actions := []interface{}{aliasAction("remove", record.Index, record.Alias, false)}
+	for _, index := range record.Previous {
+		actions = append(actions, aliasAction("add", index, record.Alias, len(record.Previous) == 1))
+	}
+	if err := updateAliases(ctx, admin, actions); err != nil {
+		return err
+	}
+	logger.Info("Moved alias back to the previous indices", zap.String("alias", record.Alias), zap.Strings("indices", record.Previous))
+
+	now := time.Now()
+	record.RolledBackAt = &now
+	if err := store.SaveJSON(ctx, clients.NewNamespace(config).Cutover(), &record); err != nil {
+		logger.Error("Failed to record the rollback", zap.Error(err))
+	}
+	return nil
+}
+
+func aliasAdmin(client clients.ElasticsearchClient, config *config.Config) (clients.AliasAdmin, error) {
+	admin, ok := client.(clients.AliasAdmin)
+	if !ok {
+		return nil, fmt.Errorf("target client %T cannot manage aliases", client)
+	}
+	if config.CutoverAlias == "" {
+		return nil, errors.New("CUTOVER_ALIAS must be set")
+	}
+	if strings.Contains(config.ElkIndexTo, "{") {
+		return nil, fmt.Errorf("ELK_INDEX_TO %q is a template, the cutover needs a single target index", config.ElkIndexTo)
+	}
+	if config.CutoverAlias == config.ElkIndexTo {
+		return nil, errors.New("CUTOVER_ALIAS must differ from ELK_INDEX_TO")
+	}
+	return admin, nil
+}
+
+// requireVerified checks the verification summary recorded by the verify mode.
+func requireVerified(ctx context.Context, store clients.CheckpointStore, config *config.Config) error {
+	var summary verify.Summary
+	if err := store.GetJSON(ctx, clients.NewNamespace(config).Verify(), &summary); err != nil {
+		if errors.Is(err, clients.ErrNotFound) {
+			return fmt.Errorf("no verification recorded, run verify first or set CUTOVER_REQUIRE_VERIFY=false")
+		}
+		return err
+	}
+	if summary.Target != config.ElkIndexTo {
+		return fmt.Errorf("the last verification was of %s, not %s", summary.Target, config.ElkIndexTo)
+	}
+	if !summary.Passed {
+		return fmt.Errorf("the last verification of %s at %s failed", summary.Target, summary.VerifiedAt.Format(time.RFC3339))
+	}
+	logger.Info("Target index verified", zap.String("index", summary.Target), zap.Time("verified_at", summary.VerifiedAt))
+	return nil
+}
+
+func aliasAction(action, index, alias string, writeIndex bool) map[string]interface{} {
+	params := map[string]interface{}{"index": index, "alias": alias}
+	if writeIndex {
+		params["is_write_index"] = true
+	}
+	return map[string]interface{}{action: params}
+}
+
+func updateAliases(ctx context.Context, admin clients.AliasAdmin, actions []interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{"actions": actions})
+	if err != nil {
+		return err
+	}
+	return admin.UpdateAliases(ctx, bytes.NewReader(body))
+}
@@ -0,0 +1,245 @@
+package estest
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// bulkOperation is one action of a bulk request with its source line.
+type bulkOperation struct {
+	action  string
+	index   string
+	docType string
+	id      string
+	routing string
+	parent  string
+	source  []byte
+}
+
+// bulkParameters are the parameters accepted in bulk action lines, by version; others are refused.
+var bulkParameters = map[int]map[string]bool{
+	2: {"_index": true, "_type": true, "_id": true, "_routing": true, "routing": true, "_parent": true, "parent": true,
+		"_version": true, "_version_type": true, "_retry_on_conflict": true, "_timestamp": true, "_ttl": true},
+	7: {"_index": true, "_type": true, "_id": true, "routing": true, "version": true, "version_type": true,
+		"if_seq_no": true, "if_primary_term": true, "retry_on_conflict": true, "pipeline": true, "require_alias": true},
+	8: {"_index": true, "_id": true, "routing": true, "version": true, "version_type": true, "if_seq_no": true,
+		"if_primary_term": true, "retry_on_conflict": true, "pipeline": true, "require_alias": true, "dynamic_templates": true},
+}
+
+// bulk answers a bulk request. Malformed action lines fail the whole request; otherwise each item
+// succeeds or fails on its own, from an injected item fault, an invalid source, a closed index,
+// a missing document or a version conflict, and the response flags errors like Elasticsearch.
+func (s *Server) bulk(defaultIndex string, body []byte) (int, interface{}) {
+	operations, apiErr := s.parseBulk(defaultIndex, body)
+	if apiErr != nil {
+		return apiErr.response()
+	}
+
+	items := make([]interface{}, 0, len(operations))
+	errors := false
+	for _, operation := range operations {
+		result := s.applyBulkOperation(operation)
+		if _, failed := result["error"]; failed {
+			errors = true
+		}
+		items = append(items, map[string]interface{}{operation.action: result})
+	}
+	return http.StatusOK, map[string]interface{}{"took": 1, "errors": errors, "items": items}
+}
+
+// parseBulk reads the action and source lines of a bulk body.
+func (s *Server) parseBulk(defaultIndex string, body []byte) ([]*bulkOperation, *apiError) {
+	var lines [][]byte
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return nil, &apiError{http.StatusBadRequest, "action_request_validation_exception", "Validation Failed: 1: no requests added;"}
+	}
+
+	var operations []*bulkOperation
+	for i := 0; i < len(lines); i++ {
+		lineNumber := i + 1
+		var action map[string]map[string]interface{}
+		if err := decodeJSON(lines[i], &action); err != nil || len(action) != 1 {
+			return nil, &apiError{http.StatusBadRequest, "illegal_argument_exception", fmt.Sprintf("Malformed action/metadata line [%d], expected an object with a single action", lineNumber)}
+		}
+
+		operation := &bulkOperation{index: defaultIndex}
+		var meta map[string]interface{}
+		for name, parameters := range action {
+			operation.action, meta = name, parameters
+		}
+		switch operation.action {
+		case "index", "create", "update", "delete":
+		default:
+			return nil, &apiError{http.StatusBadRequest, "illegal_argument_exception", fmt.Sprintf("Malformed action/metadata line [%d], expected field [create], [delete], [index] or [update] but found [%s]", lineNumber, operation.action)}
+		}
+		for key, value := range meta {
+			if !bulkParameters[s.version][key] {
+				return nil, &apiError{http.StatusBadRequest, "illegal_argument_exception", fmt.Sprintf("Action/metadata line [%d] contains an unknown parameter [%s]", lineNumber, key)}
+			}
+			text := fmt.Sprint(value)
+			switch key {
+			case "_index":
+				operation.index = text
+			case "_type":
+				operation.docType = text
+			case "_id":
+				operation.id = text
+			case "_routing", "routing":
+				operation.routing = text
+			case "_parent", "parent":
+				operation.parent = text
+			}
+		}
+
+		if operation.action != "delete" {
+			i++
+			if i >= len(lines) {
+				return nil, &apiError{http.StatusBadRequest, "illegal_argument_exception", "The bulk request must be terminated by a newline [\\n]"}
+			}
+			operation.source = lines[i]
+		}
+		if validation := s.validateBulkOperation(operation); validation != "" {
+			return nil, &apiError{http.StatusBadRequest, "action_request_validation_exception", "Validation Failed: 1: " + validation + ";"}
+		}
+		operations = append(operations, operation)
+	}
+	return operations, nil
+}
+
+// validateBulkOperation returns why an operation is invalid, empty if it is valid.
+func (s *Server) validateBulkOperation(operation *bulkOperation) string {
+	switch {
+	case operation.index == "":
+		return "index is missing"
+	case s.version == 2 && operation.docType == "":
+		return "type is missing"
+	case operation.id == "" && (operation.action == "update" || operation.action == "delete"):
+		return "id is missing"
+	}
+	return ""
+}
+
+// applyBulkOperation applies one bulk operation and returns its item result. The caller must hold s.mu.
+func (s *Server) applyBulkOperation(operation *bulkOperation) map[string]interface{} {
+	if operation.id == "" {
+		s.sequence++
+		operation.id = "estest" + strconv.Itoa(s.sequence)
+	}
+	result := map[string]interface{}{"_index": operation.index, "_id": operation.id}
+	switch s.version {
+	case 2:
+		result["_type"] = operation.docType
+	case 7:
+		result["_type"] = "_doc"
+	}
+	fail := func(status int, errorType, reason string) map[string]interface{} {
+		result["status"] = status
+		result["error"] = map[string]interface{}{"type": errorType, "reason": reason}
+		return result
+	}
+
+	if fault := s.takeItemFault(operation.id); fault != nil {
+		return fail(fault.Status, fault.errorType(), fault.reason())
+	}
+	idx, apiErr := s.writeIndex(operation.index)
+	if apiErr != nil {
+		return fail(apiErr.status, apiErr.typ, apiErr.reason)
+	}
+	result["_index"] = idx.name
+	if idx.closed {
+		return fail(http.StatusBadRequest, "index_closed_exception", "closed")
+	}
+
+	var source map[string]interface{}
+	if operation.source != nil {
+		if err := decodeJSON(operation.source, &source); err != nil || source == nil {
+			return fail(http.StatusBadRequest, "mapper_parsing_exception", "failed to parse")
+		}
+	}
+
+	key := s.docKey(operation.docType, operation.id)
+	existing, exists := idx.docs[key]
+	doc := Document{Type: operation.docType, ID: operation.id, Routing: operation.routing, Parent: operation.parent, Source: source}
+	status, outcome := http.StatusCreated, "created"
+	if exists {
+		status, outcome = http.StatusOK, "updated"
+	}
+
+	switch operation.action {
+	case "create":
+		if exists {
+			return fail(http.StatusConflict, "version_conflict_engine_exception", fmt.Sprintf("[%s]: version conflict, document already exists (current version [%d])", operation.id, existing.Version))
+		}
+	case "update":
+		upsert, partial, problem := updateSources(source)
+		if problem != "" {
+			return fail(http.StatusBadRequest, "illegal_argument_exception", problem)
+		}
+		if exists {
+			doc.Source = mergeSource(copyValue(existing.Source).(map[string]interface{}), partial)
+			if doc.Routing == "" {
+				doc.Routing = existing.Routing
+			}
+			if doc.Parent == "" {
+				doc.Parent = existing.Parent
+			}
+		} else if upsert != nil {
+			doc.Source = upsert
+		} else {
+			return fail(http.StatusNotFound, "document_missing_exception", "["+operation.id+"]: document missing")
+		}
+	case "delete":
+		if !exists {
+			result["status"], result["result"], result["found"] = http.StatusNotFound, "not_found", false
+			return result
+		}
+		delete(idx.docs, key)
+		result["_version"] = existing.Version + 1
+		result["status"], result["result"], result["found"] = http.StatusOK, "deleted", true
+		return result
+	}
+
+	stored := s.put(idx, doc)
+	result["_version"] = stored.Version
+	result["status"], result["result"] = status, outcome
+	result["_shards"] = map[string]interface{}{"total": 2, "successful": 1, "failed": 0}
+	return result
+}
+
+// updateSources reads an update body: the partial document, and the document to create if there is
+// none, from upsert or from the partial document with doc_as_upsert. Scripts are not supported.
+func updateSources(body map[string]interface{}) (upsert, partial map[string]interface{}, problem string) {
+	if _, ok := body["script"]; ok {
+		return nil, nil, "scripts are not supported by the fake cluster"
+	}
+	partial, _ = body["doc"].(map[string]interface{})
+	upsert, _ = body["upsert"].(map[string]interface{})
+	if asUpsert, _ := body["doc_as_upsert"].(bool); asUpsert && upsert == nil {
+		upsert = partial
+	}
+	if partial == nil && upsert == nil {
+		return nil, nil, "Validation Failed: 1: script or doc is missing;"
+	}
+	return upsert, partial, ""
+}
+
+// mergeSource merges a partial document into a source, recursing into objects present in both.
+func mergeSource(source, partial map[string]interface{}) map[string]interface{} {
+	for key, value := range partial {
+		child, isObject := value.(map[string]interface{})
+		existing, wasObject := source[key].(map[string]interface{})
+		if isObject && wasObject {
+			source[key] = mergeSource(existing, child)
+		} else {
+			source[key] = copyValue(value)
+		}
+	}
+	return source
+}
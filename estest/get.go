@@ -0,0 +1,156 @@
+package estest
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// mgetItem is a document requested by an _mget body.
+type mgetItem struct {
+	index   string
+	docType string
+	id      string
+	routing string
+	source  *sourceFilter
+}
+
+// mget answers an _mget request, with the documents in a docs array or, for the index of the
+// URL, their IDs in an ids array. Every document is answered, as found or not, in request order;
+// a document routed to another shard than the one its request routing selects is not found.
+func (s *Server) mget(defaultIndex string, body []byte) (int, interface{}) {
+	var request map[string]interface{}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return (&apiError{http.StatusBadRequest, "action_request_validation_exception", "Validation Failed: 1: request body is missing;"}).response()
+	}
+	if err := decodeJSON(body, &request); err != nil {
+		return (&apiError{http.StatusBadRequest, "parse_exception", "failed to parse request body: " + err.Error()}).response()
+	}
+
+	var items []mgetItem
+	for key, value := range request {
+		list, ok := value.([]interface{})
+		if !ok {
+			return (&apiError{http.StatusBadRequest, "parsing_exception", "[" + key + "] must be an array"}).response()
+		}
+		switch key {
+		case "ids":
+			for _, id := range stringList(list) {
+				items = append(items, mgetItem{index: defaultIndex, id: id})
+			}
+		case "docs":
+			for _, entry := range list {
+				object, ok := entry.(map[string]interface{})
+				if !ok {
+					return (&apiError{http.StatusBadRequest, "parsing_exception", "docs array element should include an object"}).response()
+				}
+				item, apiErr := s.parseMgetItem(defaultIndex, object)
+				if apiErr != nil {
+					return apiErr.response()
+				}
+				items = append(items, item)
+			}
+		default:
+			return (&apiError{http.StatusBadRequest, "parsing_exception", "unknown key [" + key + "] for a START_ARRAY"}).response()
+		}
+	}
+	if len(items) == 0 {
+		return (&apiError{http.StatusBadRequest, "action_request_validation_exception", "Validation Failed: 1: no documents to get;"}).response()
+	}
+
+	docs := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		if item.index == "" {
+			return (&apiError{http.StatusBadRequest, "action_request_validation_exception", "Validation Failed: 1: index is missing for doc 0;"}).response()
+		}
+		docs = append(docs, s.getDocument(item))
+	}
+	return http.StatusOK, map[string]interface{}{"docs": docs}
+}
+
+// parseMgetItem reads an entry of the docs array of an _mget body. ES8 no longer knows mapping types,
+// and only ES2 names the routing _routing.
+func (s *Server) parseMgetItem(defaultIndex string, object map[string]interface{}) (mgetItem, *apiError) {
+	item := mgetItem{index: defaultIndex}
+	for key, value := range object {
+		var err error
+		switch {
+		case key == "_index":
+			item.index, _ = value.(string)
+		case key == "_id":
+			item.id, _ = value.(string)
+		case key == "_type" && s.version < 8:
+			item.docType, _ = value.(string)
+		case key == "routing" || key == "_routing" && s.version == 2:
+			item.routing, _ = value.(string)
+		case key == "_source":
+			item.source, err = parseSourceFilter(value)
+		default:
+			return item, &apiError{http.StatusBadRequest, "parsing_exception", "Unknown key for a " + jsonKind(value) + " in [" + key + "]."}
+		}
+		if err != nil {
+			return item, &apiError{http.StatusBadRequest, "parsing_exception", err.Error()}
+		}
+	}
+	if item.id == "" {
+		return item, &apiError{http.StatusBadRequest, "action_request_validation_exception", "Validation Failed: 1: id is missing;"}
+	}
+	return item, nil
+}
+
+// getDocument returns the _mget response entry of one requested document. The caller must hold s.mu.
+func (s *Server) getDocument(item mgetItem) map[string]interface{} {
+	response := map[string]interface{}{"_index": item.index, "_id": item.id}
+	switch {
+	case s.version == 2 && item.docType != "":
+		response["_type"] = item.docType
+	case s.version == 7:
+		response["_type"] = "_doc"
+	}
+
+	indices, apiErr := s.resolve(item.index)
+	if apiErr == nil && len(indices) != 1 {
+		apiErr = &apiError{http.StatusBadRequest, "illegal_argument_exception", "alias [" + item.index + "] has more than one index associated with it, can't execute a single index op"}
+	}
+	if apiErr == nil && indices[0].closed {
+		apiErr = &apiError{http.StatusBadRequest, "index_closed_exception", "closed"}
+	}
+	if apiErr != nil {
+		response["error"] = errorBody(apiErr.status, apiErr.typ, apiErr.reason)["error"]
+		return response
+	}
+	idx := indices[0]
+	response["_index"] = idx.name
+
+	var doc *storedDocument
+	if s.version == 2 && item.docType == "" {
+		// Without a type, ES2 gets the first document with that ID in any type
+		for _, stored := range idx.ordered() {
+			if stored.ID == item.id {
+				doc = stored
+				break
+			}
+		}
+	} else {
+		doc = idx.docs[s.docKey(item.docType, item.id)]
+	}
+	requested := &Document{ID: item.id, Routing: item.routing}
+	if doc == nil || shardOf(requested, idx.shards()) != shardOf(&doc.Document, idx.shards()) {
+		response["found"] = false
+		return response
+	}
+
+	if s.version == 2 {
+		response["_type"] = doc.Type
+	}
+	if doc.Routing != "" {
+		response["_routing"] = doc.Routing
+	}
+	response["_version"] = doc.Version
+	response["found"] = true
+	if item.source == nil {
+		response["_source"] = copyValue(doc.Source)
+	} else if !item.source.disabled {
+		response["_source"] = filterSource(doc.Source, "", item.source.includes, item.source.excludes)
+	}
+	return response
+}
@@ -0,0 +1,693 @@
+package estest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Document is a document stored in the fake cluster.
+type Document struct {
+	Type    string // mapping type, only kept on ES2
+	ID      string
+	Routing string
+	Parent  string // only kept on ES2
+	Version int64
+	Source  map[string]interface{}
+
+	// RawSource, if set, is returned as the _source of the document in place of Source,
+	// in search hits, to serve a source that clients cannot parse
+	RawSource string
+}
+
+// index is an index of the fake cluster.
+type index struct {
+	name     string
+	settings map[string]interface{} // flat settings, keyed like "index.number_of_shards"
+	mappings map[string]interface{}
+	aliases  map[string]bool
+	closed   bool
+
+	docs     map[string]*storedDocument // by _uid on ES2, by _id otherwise
+	sequence int                        // insertion counter, giving the _doc order
+}
+
+// storedDocument is a document with its insertion order.
+type storedDocument struct {
+	Document
+	seq int
+}
+
+// shards returns the number of primary shards of the index.
+func (i *index) shards() int {
+	shards, _ := strconv.Atoi(fmt.Sprint(i.settings["index.number_of_shards"]))
+	return max(shards, 1)
+}
+
+// ordered returns the documents in insertion order.
+func (i *index) ordered() []*storedDocument {
+	docs := make([]*storedDocument, 0, len(i.docs))
+	for _, doc := range i.docs {
+		docs = append(docs, doc)
+	}
+	sort.Slice(docs, func(a, b int) bool { return docs[a].seq < docs[b].seq })
+	return docs
+}
+
+// docKey returns the key of a document in an index: ES2 identifies documents by type and ID.
+func (s *Server) docKey(docType, id string) string {
+	if s.version == 2 {
+		return docType + "#" + id
+	}
+	return id
+}
+
+// shardOf returns the shard holding a document, chosen from its routing like Elasticsearch does,
+// although with a different hash function.
+func shardOf(doc *Document, shards int) int {
+	routing := doc.Routing
+	if routing == "" {
+		routing = doc.Parent
+	}
+	if routing == "" {
+		routing = doc.ID
+	}
+	return int(hashString(routing) % uint32(shards))
+}
+
+// hashString hashes routing values and IDs.
+func hashString(value string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	return h.Sum32()
+}
+
+// versionsCreated are the index.version.created settings of new indices.
+var versionsCreated = map[int]string{
+	2: "2040699",
+	7: "7171099",
+	8: "8512000",
+}
+
+// defaultShards returns the number of shards of indices created without settings.
+func (s *Server) defaultShards() int {
+	if s.version == 2 {
+		return 5
+	}
+	return 1
+}
+
+// newIndex adds an empty index, with the settings the cluster sets itself. The caller must hold s.mu.
+func (s *Server) newIndex(name string, settings map[string]interface{}, mappings map[string]interface{}) *index {
+	s.sequence++
+	idx := &index{
+		name: name,
+		settings: map[string]interface{}{
+			"index.number_of_shards":   strconv.Itoa(s.defaultShards()),
+			"index.number_of_replicas": "1",
+			"index.uuid":               fmt.Sprintf("estest-%d", s.sequence),
+			"index.creation_date":      strconv.FormatInt(time.Now().UnixMilli(), 10),
+			"index.version.created":    versionsCreated[s.version],
+			"index.provided_name":      name,
+		},
+		mappings: mappings,
+		aliases:  map[string]bool{},
+		docs:     map[string]*storedDocument{},
+	}
+	for key, value := range settings {
+		idx.settings[key] = value
+	}
+	if idx.mappings == nil {
+		idx.mappings = map[string]interface{}{}
+	}
+	s.indices[name] = idx
+	return idx
+}
+
+// apiError is an error answered with an Elasticsearch error response.
+type apiError struct {
+	status int
+	typ    string
+	reason string
+}
+
+func (e *apiError) Error() string {
+	return e.typ + ": " + e.reason
+}
+
+// response returns the status and body of the error response.
+func (e *apiError) response() (int, interface{}) {
+	return e.status, errorBody(e.status, e.typ, e.reason)
+}
+
+// indexNotFound is the error returned for a missing index.
+func indexNotFound(name string) *apiError {
+	return &apiError{http.StatusNotFound, "index_not_found_exception", "no such index [" + name + "]"}
+}
+
+// resolve returns the indices matching a comma-separated list of index names, aliases and wildcards.
+// Wildcards only match open indices; names and aliases that match nothing are an error.
+// The caller must hold s.mu.
+func (s *Server) resolve(expression string) ([]*index, *apiError) {
+	matched := map[string]*index{}
+	for _, name := range strings.Split(expression, ",") {
+		if name == "_all" || name == "*" {
+			for _, idx := range s.indices {
+				if !idx.closed {
+					matched[idx.name] = idx
+				}
+			}
+			continue
+		}
+		if strings.ContainsAny(name, "*?") {
+			for _, idx := range s.indices {
+				if idx.closed {
+					continue
+				}
+				if ok, _ := path.Match(name, idx.name); ok {
+					matched[idx.name] = idx
+				}
+				for alias := range idx.aliases {
+					if ok, _ := path.Match(name, alias); ok {
+						matched[idx.name] = idx
+					}
+				}
+			}
+			continue
+		}
+		if idx, ok := s.indices[name]; ok {
+			matched[name] = idx
+			continue
+		}
+		found := false
+		for _, idx := range s.indices {
+			if idx.aliases[name] {
+				matched[idx.name] = idx
+				found = true
+			}
+		}
+		if !found {
+			return nil, indexNotFound(name)
+		}
+	}
+
+	indices := make([]*index, 0, len(matched))
+	for _, idx := range matched {
+		indices = append(indices, idx)
+	}
+	sort.Slice(indices, func(a, b int) bool { return indices[a].name < indices[b].name })
+	return indices, nil
+}
+
+// writeIndex returns the index written by a bulk item addressed to name, creating it if needed.
+// The caller must hold s.mu.
+func (s *Server) writeIndex(name string) (*index, *apiError) {
+	if idx, ok := s.indices[name]; ok {
+		return idx, nil
+	}
+	var targets []*index
+	for _, idx := range s.indices {
+		if idx.aliases[name] {
+			targets = append(targets, idx)
+		}
+	}
+	switch {
+	case len(targets) == 1:
+		return targets[0], nil
+	case len(targets) > 1:
+		return nil, &apiError{http.StatusBadRequest, "illegal_argument_exception", "no write index is defined for alias [" + name + "]"}
+	}
+	if err := s.checkIndexName(name); err != nil {
+		return nil, err
+	}
+	return s.newIndex(name, nil, nil), nil
+}
+
+// checkIndexName checks that a new index may be named name. The caller must hold s.mu.
+func (s *Server) checkIndexName(name string) *apiError {
+	if name == "" || strings.HasPrefix(name, "_") || strings.ContainsAny(name, `*?"<>|/\, #:`) || name != strings.ToLower(name) {
+		return &apiError{http.StatusBadRequest, "invalid_index_name_exception", "Invalid index name [" + name + "]"}
+	}
+	for _, idx := range s.indices {
+		if idx.aliases[name] {
+			return &apiError{http.StatusBadRequest, "invalid_index_name_exception", "Invalid index name [" + name + "], already exists as alias"}
+		}
+	}
+	return nil
+}
+
+// put stores a document, replacing the document with the same key, and returns the stored copy.
+// The caller must hold s.mu.
+func (s *Server) put(idx *index, doc Document) *storedDocument {
+	if s.version == 2 {
+		if doc.Type == "" {
+			doc.Type = "doc"
+		}
+		// Dynamic mapping adds the types of indexed documents
+		if _, ok := idx.mappings[doc.Type]; !ok {
+			idx.mappings[doc.Type] = map[string]interface{}{"properties": map[string]interface{}{}}
+		}
+	} else {
+		doc.Type, doc.Parent = "", ""
+	}
+	if doc.Source == nil {
+		doc.Source = map[string]interface{}{}
+	}
+
+	key := s.docKey(doc.Type, doc.ID)
+	stored, exists := idx.docs[key]
+	if !exists {
+		idx.sequence++
+		stored = &storedDocument{seq: idx.sequence}
+		idx.docs[key] = stored
+	}
+	if doc.Version == 0 {
+		doc.Version = stored.Version + 1
+	}
+	stored.Document = doc
+	return stored
+}
+
+// CreateIndex creates an index with the given number of shards and mappings, 0 for the default shard count.
+func (s *Server) CreateIndex(name string, shards int, mappings map[string]interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.indices[name]; ok {
+		return fmt.Errorf("index %s already exists", name)
+	}
+	if err := s.checkIndexName(name); err != nil {
+		return err
+	}
+	settings := map[string]interface{}{}
+	if shards > 0 {
+		settings["index.number_of_shards"] = strconv.Itoa(shards)
+	}
+	s.newIndex(name, settings, copyValue(mappings).(map[string]interface{}))
+	return nil
+}
+
+// AddDocuments stores documents in an index or the single index of an alias, creating the index if needed.
+// Documents without a version get the next version of the document they replace.
+func (s *Server) AddDocuments(name string, docs ...Document) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idx, err := s.writeIndex(name)
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		if doc.ID == "" {
+			return errors.New("document without an ID")
+		}
+		doc.Source = copyValue(doc.Source).(map[string]interface{})
+		s.put(idx, doc)
+	}
+	return nil
+}
+
+// Documents returns copies of the documents of an index in insertion order, nil if the index does not exist.
+func (s *Server) Documents(name string) []Document {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idx, ok := s.indices[name]
+	if !ok {
+		return nil
+	}
+	docs := make([]Document, 0, len(idx.docs))
+	for _, stored := range idx.ordered() {
+		doc := stored.Document
+		doc.Source = copyValue(doc.Source).(map[string]interface{})
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+// Count returns the number of documents in an index.
+func (s *Server) Count(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if idx, ok := s.indices[name]; ok {
+		return len(idx.docs)
+	}
+	return 0
+}
+
+// Indices returns the names of the indices of the cluster in order.
+func (s *Server) Indices() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make(map[string]bool, len(s.indices))
+	for name := range s.indices {
+		names[name] = true
+	}
+	return sortedNames(names)
+}
+
+// Mappings returns a copy of the mappings of an index, nil if the index does not exist.
+func (s *Server) Mappings(name string) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if idx, ok := s.indices[name]; ok {
+		return copyValue(idx.mappings).(map[string]interface{})
+	}
+	return nil
+}
+
+// IsClosed reports whether an index exists and is closed.
+func (s *Server) IsClosed(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idx, ok := s.indices[name]
+	return ok && idx.closed
+}
+
+// AddAlias points an alias to indices, which must exist.
+func (s *Server) AddAlias(alias string, indices ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.indices[alias]; ok {
+		return fmt.Errorf("alias %s clashes with an index", alias)
+	}
+	for _, name := range indices {
+		idx, ok := s.indices[name]
+		if !ok {
+			return indexNotFound(name)
+		}
+		idx.aliases[alias] = true
+	}
+	return nil
+}
+
+// AliasIndices returns the indices an alias points to in order.
+func (s *Server) AliasIndices(alias string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := map[string]bool{}
+	for _, idx := range s.indices {
+		if idx.aliases[alias] {
+			names[idx.name] = true
+		}
+	}
+	return sortedNames(names)
+}
+
+// indexExists answers HEAD /{index}.
+func (s *Server) indexExists(expression string) (int, interface{}) {
+	indices, err := s.resolve(expression)
+	if err != nil || len(indices) == 0 {
+		return http.StatusNotFound, nil
+	}
+	return http.StatusOK, nil
+}
+
+// createIndex answers PUT /{index} with a body holding the settings, mappings and aliases of the index.
+func (s *Server) createIndex(name string, body []byte) (int, interface{}) {
+	if _, ok := s.indices[name]; ok {
+		errorType := "resource_already_exists_exception"
+		if s.version == 2 {
+			errorType = "index_already_exists_exception"
+		}
+		return (&apiError{http.StatusBadRequest, errorType, "index [" + name + "] already exists"}).response()
+	}
+	if err := s.checkIndexName(name); err != nil {
+		return err.response()
+	}
+
+	var request struct {
+		Settings map[string]interface{}            `json:"settings"`
+		Mappings map[string]interface{}            `json:"mappings"`
+		Aliases  map[string]map[string]interface{} `json:"aliases"`
+	}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := decodeJSON(body, &request); err != nil {
+			return (&apiError{http.StatusBadRequest, "parse_exception", "failed to parse request body: " + err.Error()}).response()
+		}
+	}
+	settings := map[string]interface{}{}
+	flattenSettings("", request.Settings, settings)
+	for key, value := range settings {
+		if !strings.HasPrefix(key, "index.") {
+			delete(settings, key)
+			settings["index."+key] = value
+		}
+	}
+
+	idx := s.newIndex(name, settings, request.Mappings)
+	for alias := range request.Aliases {
+		idx.aliases[alias] = true
+	}
+	return http.StatusOK, map[string]interface{}{"acknowledged": true, "shards_acknowledged": true, "index": name}
+}
+
+// deleteIndex answers DELETE /{index}. Aliases cannot be deleted this way.
+func (s *Server) deleteIndex(expression string) (int, interface{}) {
+	indices, err := s.resolve(expression)
+	if err != nil {
+		return err.response()
+	}
+	for _, name := range strings.Split(expression, ",") {
+		if _, ok := s.indices[name]; !ok && !strings.ContainsAny(name, "*?") && name != "_all" {
+			return (&apiError{http.StatusBadRequest, "illegal_argument_exception", "The provided expression [" + name + "] matches an alias, specify the corresponding concrete indices instead."}).response()
+		}
+	}
+	for _, idx := range indices {
+		delete(s.indices, idx.name)
+	}
+	return http.StatusOK, map[string]interface{}{"acknowledged": true}
+}
+
+// setClosed answers POST /{index}/_open and /{index}/_close.
+func (s *Server) setClosed(expression string, closed bool) (int, interface{}) {
+	indices, err := s.resolve(expression)
+	if err != nil {
+		return err.response()
+	}
+	for _, idx := range indices {
+		idx.closed = closed
+	}
+	return http.StatusOK, map[string]interface{}{"acknowledged": true, "shards_acknowledged": true}
+}
+
+// getMapping answers GET /{index}/_mapping.
+func (s *Server) getMapping(expression string) (int, interface{}) {
+	indices, err := s.resolve(expression)
+	if err != nil {
+		return err.response()
+	}
+	response := map[string]interface{}{}
+	for _, idx := range indices {
+		response[idx.name] = map[string]interface{}{"mappings": idx.mappings}
+	}
+	return http.StatusOK, response
+}
+
+// getSettings answers GET /{index}/_settings, as flat settings or nested objects.
+func (s *Server) getSettings(expression string, flat bool) (int, interface{}) {
+	indices, err := s.resolve(expression)
+	if err != nil {
+		return err.response()
+	}
+	response := map[string]interface{}{}
+	for _, idx := range indices {
+		var settings interface{} = idx.settings
+		if !flat {
+			settings = nestSettings(idx.settings)
+		}
+		response[idx.name] = map[string]interface{}{"settings": settings}
+	}
+	return http.StatusOK, response
+}
+
+// getAlias answers GET /_alias/{name} with the indices holding the matching aliases.
+func (s *Server) getAlias(expression, name string) (int, interface{}) {
+	indices, err := s.resolve(expression)
+	if err != nil {
+		return err.response()
+	}
+	response := map[string]interface{}{}
+	for _, idx := range indices {
+		aliases := map[string]interface{}{}
+		for alias := range idx.aliases {
+			for _, pattern := range strings.Split(name, ",") {
+				if ok, _ := path.Match(pattern, alias); ok || pattern == "_all" {
+					aliases[alias] = map[string]interface{}{}
+				}
+			}
+		}
+		if len(aliases) > 0 {
+			response[idx.name] = map[string]interface{}{"aliases": aliases}
+		}
+	}
+	if len(response) == 0 {
+		return http.StatusNotFound, map[string]interface{}{"error": "alias [" + name + "] missing", "status": http.StatusNotFound}
+	}
+	return http.StatusOK, response
+}
+
+// aliasAction is one action of an _aliases request.
+type aliasAction struct {
+	Index   string   `json:"index"`
+	Indices []string `json:"indices"`
+	Alias   string   `json:"alias"`
+	Aliases []string `json:"aliases"`
+}
+
+// updateAliases answers POST /_aliases, applying every action or none.
+func (s *Server) updateAliases(body []byte) (int, interface{}) {
+	var request struct {
+		Actions []map[string]aliasAction `json:"actions"`
+	}
+	if err := decodeJSON(body, &request); err != nil {
+		return (&apiError{http.StatusBadRequest, "parse_exception", "failed to parse request body: " + err.Error()}).response()
+	}
+
+	// Keep the current state to roll back to on error
+	indices := make(map[string]*index, len(s.indices))
+	aliases := make(map[string]map[string]bool, len(s.indices))
+	for name, idx := range s.indices {
+		indices[name] = idx
+		aliases[name] = make(map[string]bool, len(idx.aliases))
+		for alias := range idx.aliases {
+			aliases[name][alias] = true
+		}
+	}
+	for _, actions := range request.Actions {
+		for kind, action := range actions {
+			if err := s.applyAliasAction(kind, action); err != nil {
+				s.indices = indices
+				for name, idx := range indices {
+					idx.aliases = aliases[name]
+				}
+				return err.response()
+			}
+		}
+	}
+	return http.StatusOK, map[string]interface{}{"acknowledged": true}
+}
+
+// applyAliasAction applies one add, remove or remove_index action. The caller must hold s.mu.
+func (s *Server) applyAliasAction(kind string, action aliasAction) *apiError {
+	names := action.Indices
+	if action.Index != "" {
+		names = append(names, action.Index)
+	}
+	aliasNames := action.Aliases
+	if action.Alias != "" {
+		aliasNames = append(aliasNames, action.Alias)
+	}
+	if len(names) == 0 {
+		return &apiError{http.StatusBadRequest, "action_request_validation_exception", "Validation Failed: 1: index is missing;"}
+	}
+
+	var indices []*index
+	for _, name := range names {
+		idx, ok := s.indices[name]
+		if !ok {
+			return indexNotFound(name)
+		}
+		indices = append(indices, idx)
+	}
+
+	switch kind {
+	case "add":
+		for _, alias := range aliasNames {
+			if _, ok := s.indices[alias]; ok {
+				return &apiError{http.StatusBadRequest, "invalid_alias_name_exception", "Invalid alias name [" + alias + "]: an index or data stream exists with the same name as the alias"}
+			}
+			for _, idx := range indices {
+				idx.aliases[alias] = true
+			}
+		}
+	case "remove":
+		for _, alias := range aliasNames {
+			for _, idx := range indices {
+				if !idx.aliases[alias] {
+					return &apiError{http.StatusNotFound, "aliases_not_found_exception", "aliases [" + alias + "] missing"}
+				}
+				delete(idx.aliases, alias)
+			}
+		}
+	case "remove_index":
+		for _, idx := range indices {
+			delete(s.indices, idx.name)
+		}
+	default:
+		return &apiError{http.StatusBadRequest, "parsing_exception", "unknown alias action [" + kind + "]"}
+	}
+	return nil
+}
+
+// flattenSettings flattens nested settings into dotted keys, with scalar values as strings like Elasticsearch.
+func flattenSettings(prefix string, settings map[string]interface{}, flat map[string]interface{}) {
+	for key, value := range settings {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			flattenSettings(key, v, flat)
+		case []interface{}:
+			values := make([]interface{}, len(v))
+			for i, item := range v {
+				values[i] = fmt.Sprint(item)
+			}
+			flat[key] = values
+		default:
+			flat[key] = fmt.Sprint(v)
+		}
+	}
+}
+
+// nestSettings expands flat settings into nested objects.
+func nestSettings(flat map[string]interface{}) map[string]interface{} {
+	nested := map[string]interface{}{}
+	for key, value := range flat {
+		parts := strings.Split(key, ".")
+		current := nested
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := current[part].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				current[part] = child
+			}
+			current = child
+		}
+		current[parts[len(parts)-1]] = value
+	}
+	return nested
+}
+
+// decodeJSON decodes a request body, keeping numbers as json.Number.
+func decodeJSON(data []byte, dest interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(dest)
+}
+
+// copyValue deep copies a decoded JSON value, so callers never share documents with the server.
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			copied[key] = copyValue(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = copyValue(item)
+		}
+		return copied
+	default:
+		return v
+	}
+}
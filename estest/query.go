@@ -0,0 +1,457 @@
+package estest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// matches reports whether a document matches a query. Queries compare exact values: term, terms, range,
+// prefix, ids and exists, combined with bool and constant_score. match and match_phrase compare
+// lowercased words instead of analyzed text. Other queries are refused like unknown ones.
+func (s *Server) matches(query map[string]interface{}, idx *index, doc *storedDocument) (bool, *apiError) {
+	if len(query) == 0 {
+		return true, nil
+	}
+	if len(query) != 1 {
+		return false, parsingError("[query] must contain exactly one query")
+	}
+	for kind, body := range query {
+		switch kind {
+		case "match_all":
+			return true, nil
+		case "match_none":
+			return false, nil
+		case "bool":
+			return s.matchesBool(body, idx, doc)
+		case "constant_score":
+			options, ok := body.(map[string]interface{})
+			filter, _ := options["filter"].(map[string]interface{})
+			if !ok || filter == nil {
+				return false, parsingError("[constant_score] requires a 'filter' element")
+			}
+			return s.matches(filter, idx, doc)
+		case "ids":
+			options, _ := body.(map[string]interface{})
+			values, _ := options["values"].([]interface{})
+			for _, value := range values {
+				if fmt.Sprint(value) == doc.ID {
+					return true, nil
+				}
+			}
+			return false, nil
+		case "exists":
+			options, _ := body.(map[string]interface{})
+			field, _ := options["field"].(string)
+			if field == "" {
+				return false, parsingError("[exists] must be provided with a [field]")
+			}
+			return len(s.fieldValues(idx, doc, field)) > 0, nil
+		case "term", "terms", "range", "prefix", "match", "match_phrase":
+			field, value, err := fieldQuery(kind, body)
+			if err != nil {
+				return false, err
+			}
+			return s.matchesField(kind, value, s.fieldValues(idx, doc, field))
+		default:
+			return false, parsingError("unknown query [" + kind + "]")
+		}
+	}
+	return false, nil
+}
+
+// matchesBool evaluates a bool query: every must and filter clause, no must_not clause,
+// and at least minimum_should_match should clauses, 1 by default when there is no must or filter clause.
+func (s *Server) matchesBool(body interface{}, idx *index, doc *storedDocument) (bool, *apiError) {
+	options, ok := body.(map[string]interface{})
+	if !ok {
+		return false, parsingError("[bool] query malformed")
+	}
+	required := 0
+	for _, occur := range []string{"must", "filter"} {
+		clauses, err := boolClauses(options[occur])
+		if err != nil {
+			return false, err
+		}
+		required += len(clauses)
+		for _, clause := range clauses {
+			if matched, err := s.matches(clause, idx, doc); err != nil || !matched {
+				return false, err
+			}
+		}
+	}
+	clauses, err := boolClauses(options["must_not"])
+	if err != nil {
+		return false, err
+	}
+	for _, clause := range clauses {
+		if matched, err := s.matches(clause, idx, doc); err != nil || matched {
+			return false, err
+		}
+	}
+
+	should, err := boolClauses(options["should"])
+	if err != nil {
+		return false, err
+	}
+	minimum := 0
+	if required == 0 && len(should) > 0 {
+		minimum = 1
+	}
+	if value, ok := options["minimum_should_match"]; ok {
+		minimum, err = minimumShouldMatch(value, len(should))
+		if err != nil {
+			return false, err
+		}
+	}
+	matched := 0
+	for _, clause := range should {
+		ok, err := s.matches(clause, idx, doc)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			matched++
+		}
+	}
+	return matched >= minimum, nil
+}
+
+// boolClauses reads the clauses of one occurrence of a bool query, a single query or a list.
+func boolClauses(value interface{}) ([]map[string]interface{}, *apiError) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		return []map[string]interface{}{v}, nil
+	case []interface{}:
+		clauses := make([]map[string]interface{}, 0, len(v))
+		for _, item := range v {
+			clause, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, parsingError("[bool] clause must be an object")
+			}
+			clauses = append(clauses, clause)
+		}
+		return clauses, nil
+	default:
+		return nil, parsingError("[bool] clause must be an object or an array")
+	}
+}
+
+// minimumShouldMatch reads a minimum_should_match count or percentage of the should clauses.
+func minimumShouldMatch(value interface{}, clauses int) (int, *apiError) {
+	text := fmt.Sprint(value)
+	if percent, ok := strings.CutSuffix(text, "%"); ok {
+		number, err := strconv.Atoi(percent)
+		if err != nil {
+			return 0, parsingError("invalid minimum_should_match [" + text + "]")
+		}
+		if number < 0 {
+			return clauses + clauses*number/100, nil
+		}
+		return clauses * number / 100, nil
+	}
+	number, err := strconv.Atoi(text)
+	if err != nil {
+		return 0, parsingError("invalid minimum_should_match [" + text + "]")
+	}
+	if number < 0 {
+		return clauses + number, nil
+	}
+	return number, nil
+}
+
+// fieldQuery reads the field and the value or options of a query on a single field.
+func fieldQuery(kind string, body interface{}) (string, interface{}, *apiError) {
+	options, ok := body.(map[string]interface{})
+	if !ok {
+		return "", nil, parsingError("[" + kind + "] query malformed, no start_object after query name")
+	}
+	var field string
+	var value interface{}
+	for key, item := range options {
+		if key == "boost" || key == "_name" {
+			continue
+		}
+		if field != "" {
+			return "", nil, parsingError("[" + kind + "] query doesn't support multiple fields, found [" + field + "] and [" + key + "]")
+		}
+		field, value = key, item
+	}
+	if field == "" {
+		return "", nil, parsingError("[" + kind + "] query requires a field")
+	}
+	return field, value, nil
+}
+
+// matchesField evaluates a term, terms, range, prefix, match or match_phrase query on the values of a field.
+func (s *Server) matchesField(kind string, query interface{}, values []interface{}) (bool, *apiError) {
+	// The short form gives the value, the long form an object of options
+	options, long := query.(map[string]interface{})
+	value := query
+	if long && kind != "range" {
+		switch kind {
+		case "match", "match_phrase":
+			value = options["query"]
+		default:
+			value = options["value"]
+		}
+	}
+
+	switch kind {
+	case "term":
+		return anyValue(values, func(v interface{}) bool { return valuesEqual(v, value) }), nil
+	case "terms":
+		terms, ok := query.([]interface{})
+		if !ok {
+			return false, parsingError("[terms] query requires an array of terms")
+		}
+		return anyValue(values, func(v interface{}) bool {
+			for _, term := range terms {
+				if valuesEqual(v, term) {
+					return true
+				}
+			}
+			return false
+		}), nil
+	case "prefix":
+		prefix := fmt.Sprint(value)
+		return anyValue(values, func(v interface{}) bool {
+			text, ok := v.(string)
+			return ok && strings.HasPrefix(text, prefix)
+		}), nil
+	case "match":
+		words := textWords(fmt.Sprint(value))
+		return anyValue(values, func(v interface{}) bool {
+			text, ok := v.(string)
+			if !ok {
+				return valuesEqual(v, value)
+			}
+			for _, word := range textWords(text) {
+				for _, queried := range words {
+					if word == queried {
+						return true
+					}
+				}
+			}
+			return false
+		}), nil
+	case "match_phrase":
+		phrase := strings.Join(textWords(fmt.Sprint(value)), " ")
+		return anyValue(values, func(v interface{}) bool {
+			text, ok := v.(string)
+			return ok && strings.Contains(" "+strings.Join(textWords(text), " ")+" ", " "+phrase+" ")
+		}), nil
+	case "range":
+		if !long {
+			return false, parsingError("[range] query malformed, no start_object after query name")
+		}
+		return anyValue(values, func(v interface{}) bool { return inRange(v, options) }), nil
+	}
+	return false, nil
+}
+
+// inRange reports whether a value is within the bounds of a range query, given as gt, gte, lt and lte
+// or as from, to, include_lower and include_upper. A null bound is unbounded.
+func inRange(value interface{}, options map[string]interface{}) bool {
+	includeLower, includeUpper := true, true
+	if include, ok := options["include_lower"].(bool); ok {
+		includeLower = include
+	}
+	if include, ok := options["include_upper"].(bool); ok {
+		includeUpper = include
+	}
+	for key, bound := range options {
+		if bound == nil {
+			continue
+		}
+		var ok bool
+		switch key {
+		case "gt":
+			ok = compareValues(value, bound) > 0
+		case "gte":
+			ok = compareValues(value, bound) >= 0
+		case "lt":
+			ok = compareValues(value, bound) < 0
+		case "lte":
+			ok = compareValues(value, bound) <= 0
+		case "from":
+			c := compareValues(value, bound)
+			ok = c > 0 || c == 0 && includeLower
+		case "to":
+			c := compareValues(value, bound)
+			ok = c < 0 || c == 0 && includeUpper
+		default:
+			continue
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// fieldValues returns the values of a field of a document: a metadata field, or a dotted path in the source
+// with arrays flattened. A .keyword suffix reads the field itself, like the keyword sub-field of dynamic mappings.
+func (s *Server) fieldValues(idx *index, doc *storedDocument, field string) []interface{} {
+	switch field {
+	case "_id":
+		return []interface{}{doc.ID}
+	case "_uid":
+		return []interface{}{doc.Type + "#" + doc.ID}
+	case "_type":
+		if s.version == 2 {
+			return []interface{}{doc.Type}
+		}
+		return []interface{}{"_doc"}
+	case "_index":
+		return []interface{}{idx.name}
+	case "_routing":
+		if doc.Routing == "" {
+			return nil
+		}
+		return []interface{}{doc.Routing}
+	}
+
+	values := sourceValues(doc.Source, strings.Split(field, "."))
+	if len(values) == 0 && strings.HasSuffix(field, ".keyword") {
+		values = sourceValues(doc.Source, strings.Split(strings.TrimSuffix(field, ".keyword"), "."))
+	}
+	return values
+}
+
+// sourceValues returns the non-null values at a path in a source object, flattening arrays.
+// Field names containing dots are matched too.
+func sourceValues(value interface{}, path []string) []interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		var values []interface{}
+		for _, item := range v {
+			values = append(values, sourceValues(item, path)...)
+		}
+		return values
+	case map[string]interface{}:
+		if len(path) == 0 {
+			return []interface{}{v}
+		}
+		var values []interface{}
+		for i := 1; i <= len(path); i++ {
+			if child, ok := v[strings.Join(path[:i], ".")]; ok {
+				values = append(values, sourceValues(child, path[i:])...)
+			}
+		}
+		return values
+	default:
+		if len(path) > 0 {
+			return nil
+		}
+		return []interface{}{v}
+	}
+}
+
+// anyValue reports whether any value satisfies match.
+func anyValue(values []interface{}, match func(interface{}) bool) bool {
+	for _, value := range values {
+		if match(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// valuesEqual compares two values, numerically when one is a number and the other a number or numeric string.
+func valuesEqual(a, b interface{}) bool {
+	if x, y, ok := numbers(a, b); ok {
+		return x == y
+	}
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+// compareValues orders two values: numerically when one is a number and the other a number or numeric
+// string, lexicographically otherwise. Numbers sort before other values.
+func compareValues(a, b interface{}) int {
+	if x, y, ok := numbers(a, b); ok {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	if _, ok := toNumber(a); ok {
+		return -1
+	}
+	if _, ok := toNumber(b); ok {
+		return 1
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// numbers converts two values to numbers when one of them is a number, coercing the other from a string
+// like a numeric field does.
+func numbers(a, b interface{}) (float64, float64, bool) {
+	x, aNumber := toNumber(a)
+	y, bNumber := toNumber(b)
+	if !aNumber && !bNumber {
+		return 0, 0, false
+	}
+	if !aNumber {
+		x, aNumber = parseNumber(a)
+	}
+	if !bNumber {
+		y, bNumber = parseNumber(b)
+	}
+	return x, y, aNumber && bNumber
+}
+
+// toNumber converts a decoded JSON number or a Go number to a float64.
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	default:
+		return 0, false
+	}
+}
+
+// parseNumber converts a numeric string to a float64.
+func parseNumber(value interface{}) (float64, bool) {
+	text, ok := value.(string)
+	if !ok {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(text, 64)
+	return f, err == nil
+}
+
+// textWords splits text into lowercased words, a crude stand-in for the standard analyzer.
+func textWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// parsingError is the error returned for a malformed query.
+func parsingError(reason string) *apiError {
+	return &apiError{http.StatusBadRequest, "parsing_exception", reason}
+}
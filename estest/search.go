@@ -0,0 +1,831 @@
+package estest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultSearchSize = 10
+
+// scrollContext is an open scroll: the hits of the search, taken when it started, and the position reached.
+type scrollContext struct {
+	hits      []map[string]interface{}
+	next      int
+	size      int
+	shards    int
+	keepAlive time.Duration
+	expires   time.Time
+}
+
+// pointInTime is an open point in time: the documents of its indices when it was opened.
+type pointInTime struct {
+	hits      []*searchHit
+	shards    int
+	keepAlive time.Duration
+	expires   time.Time
+}
+
+// searchRequest is the part of a search body understood by the fake.
+type searchRequest struct {
+	pit         *searchPointInTime
+	query       map[string]interface{}
+	sort        []sortField
+	searchAfter []interface{}
+	slice       *searchSlice
+	source      *sourceFilter
+	version     bool
+	size        int
+	from        int
+}
+
+type searchPointInTime struct {
+	ID        string `json:"id"`
+	KeepAlive string `json:"keep_alive"`
+}
+
+type searchSlice struct {
+	ID  int `json:"id"`
+	Max int `json:"max"`
+}
+
+// sortField is one sort criterion of a search.
+type sortField struct {
+	field string
+	desc  bool
+}
+
+// sourceFilter selects the _source fields returned in hits.
+type sourceFilter struct {
+	disabled bool
+	includes []string
+	excludes []string
+}
+
+// searchHit is a document matching a search, with its sort values.
+type searchHit struct {
+	index    *index
+	doc      *storedDocument
+	shardDoc int64 // _shard_doc sort value in a point in time: the shard across its indices, then the document
+	sort     []interface{}
+}
+
+// search answers a search on the indices matching expression, restricted to a mapping type on ES2.
+// With a scroll parameter it opens a scroll over every matching document. A search of a point in time
+// reads the documents of the point in time, and names no index.
+func (s *Server) search(expression, docType string, params url.Values, body []byte) (int, interface{}) {
+	request, apiErr := s.parseSearch(params, body)
+	if apiErr != nil {
+		return apiErr.response()
+	}
+	var keepAlive time.Duration
+	scrolling := params.Get("scroll") != ""
+	if scrolling {
+		var err error
+		if keepAlive, err = parseKeepAlive(params.Get("scroll")); err != nil {
+			return (&apiError{http.StatusBadRequest, "parse_exception", err.Error()}).response()
+		}
+		if request.searchAfter != nil {
+			return (&apiError{http.StatusBadRequest, "action_request_validation_exception", "Validation Failed: 1: using [search_after] is not allowed in a scroll context;"}).response()
+		}
+	} else if request.slice != nil && request.pit == nil {
+		return (&apiError{http.StatusBadRequest, "action_request_validation_exception", "Validation Failed: 1: [slice] can only be used with [scroll] or [point-in-time] requests;"}).response()
+	}
+	for _, field := range request.sort {
+		// ES8 disables indices.id_field_data.enabled, which ES7 only deprecates
+		if field.field == "_id" && s.version >= 8 {
+			return shardsFailed(http.StatusBadRequest, "illegal_argument_exception", "Fielddata access on the _id field is disallowed, you can re-enable it by updating the dynamic cluster setting: indices.id_field_data.enabled")
+		}
+		if field.field == "_shard_doc" && request.pit == nil {
+			return (&apiError{http.StatusBadRequest, "action_request_validation_exception", "Validation Failed: 1: [_shard_doc] sort field cannot be used without [point in time];"}).response()
+		}
+	}
+	if request.slice != nil && (request.slice.Max <= 1 || request.slice.ID < 0 || request.slice.ID >= request.slice.Max) {
+		return (&apiError{http.StatusBadRequest, "illegal_argument_exception", "invalid slice id or max"}).response()
+	}
+
+	var candidates []*searchHit
+	var shards int
+	if request.pit != nil {
+		if expression != "_all" {
+			return (&apiError{http.StatusBadRequest, "action_request_validation_exception", "Validation Failed: 1: [indices] cannot be used with point in time. Do not specify any index with point in time.;"}).response()
+		}
+		if scrolling {
+			return (&apiError{http.StatusBadRequest, "action_request_validation_exception", "Validation Failed: 1: using [point in time] is not allowed in a scroll context;"}).response()
+		}
+		s.expireScrolls()
+		context, ok := s.pits[request.pit.ID]
+		if !ok {
+			return shardsFailed(http.StatusNotFound, "search_context_missing_exception", "No search context found for id ["+request.pit.ID+"]")
+		}
+		if request.pit.KeepAlive != "" {
+			duration, err := parseKeepAlive(request.pit.KeepAlive)
+			if err != nil {
+				return (&apiError{http.StatusBadRequest, "parse_exception", err.Error()}).response()
+			}
+			context.keepAlive = duration
+		}
+		context.expires = time.Now().Add(context.keepAlive)
+		for _, hit := range context.hits {
+			copied := *hit
+			candidates = append(candidates, &copied)
+		}
+		shards = context.shards
+	} else {
+		indices, apiErr := s.resolve(expression)
+		if apiErr != nil {
+			return apiErr.response()
+		}
+		for _, idx := range indices {
+			if idx.closed {
+				return (&apiError{http.StatusBadRequest, "index_closed_exception", "closed"}).response()
+			}
+			shards += idx.shards()
+			for _, doc := range idx.ordered() {
+				candidates = append(candidates, &searchHit{index: idx, doc: doc})
+			}
+		}
+	}
+	preferred, apiErr := parseShardPreference(params.Get("preference"))
+	if apiErr != nil {
+		return apiErr.response()
+	}
+
+	// Keep the matching documents, in index and insertion order
+	var hits []*searchHit
+	for _, hit := range candidates {
+		idx, doc := hit.index, hit.doc
+		if docType != "" && doc.Type != docType {
+			continue
+		}
+		if preferred != nil && !preferred[shardOf(&doc.Document, idx.shards())] {
+			continue
+		}
+		if request.slice != nil && int(hashString(doc.ID)%uint32(request.slice.Max)) != request.slice.ID {
+			continue
+		}
+		matched, apiErr := s.matches(request.query, idx, doc)
+		if apiErr != nil {
+			return apiErr.response()
+		}
+		if matched {
+			hits = append(hits, hit)
+		}
+	}
+
+	if len(request.sort) > 0 {
+		for _, hit := range hits {
+			hit.sort = make([]interface{}, len(request.sort))
+			for i, field := range request.sort {
+				hit.sort[i] = s.sortValue(hit, field)
+			}
+		}
+		sort.SliceStable(hits, func(a, b int) bool { return compareSortValues(hits[a].sort, hits[b].sort, request.sort) < 0 })
+		if request.searchAfter != nil {
+			if len(request.searchAfter) != len(request.sort) {
+				return (&apiError{http.StatusBadRequest, "illegal_argument_exception", "search_after has " + strconv.Itoa(len(request.searchAfter)) + " value(s) but sort has " + strconv.Itoa(len(request.sort)) + "."}).response()
+			}
+			after := hits[:0]
+			for _, hit := range hits {
+				if compareSortValues(hit.sort, request.searchAfter, request.sort) > 0 {
+					after = append(after, hit)
+				}
+			}
+			hits = after
+		}
+	} else if request.searchAfter != nil {
+		return (&apiError{http.StatusBadRequest, "illegal_argument_exception", "Sort must contain at least one field."}).response()
+	}
+
+	rendered := make([]map[string]interface{}, len(hits))
+	for i, hit := range hits {
+		rendered[i] = s.renderHit(hit, request)
+	}
+
+	if scrolling {
+		s.sequence++
+		id := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("estest-scroll-%d", s.sequence)))
+		context := &scrollContext{hits: rendered, size: request.size, shards: shards, keepAlive: keepAlive, expires: time.Now().Add(keepAlive)}
+		s.scrolls[id] = context
+		return http.StatusOK, s.scrollPage(id, context)
+	}
+
+	total := len(rendered)
+	from := min(request.from, total)
+	to := min(from+request.size, total)
+	response := s.searchResponse("", rendered[from:to], total, shards)
+	if request.pit != nil {
+		response["pit_id"] = request.pit.ID
+	}
+	return http.StatusOK, response
+}
+
+// openPointInTime answers POST /{index}/_pit, keeping the documents of the indices matching expression
+// as they are now for the searches of the point in time.
+func (s *Server) openPointInTime(expression, keepAliveParam string) (int, interface{}) {
+	if keepAliveParam == "" {
+		return (&apiError{http.StatusBadRequest, "action_request_validation_exception", "Validation Failed: 1: [keep_alive] is not specified;"}).response()
+	}
+	keepAlive, err := parseKeepAlive(keepAliveParam)
+	if err != nil {
+		return (&apiError{http.StatusBadRequest, "parse_exception", err.Error()}).response()
+	}
+	indices, apiErr := s.resolve(expression)
+	if apiErr != nil {
+		return apiErr.response()
+	}
+
+	context := &pointInTime{keepAlive: keepAlive, expires: time.Now().Add(keepAlive)}
+	for _, idx := range indices {
+		if idx.closed {
+			return (&apiError{http.StatusBadRequest, "index_closed_exception", "closed"}).response()
+		}
+		for _, doc := range idx.ordered() {
+			snapshot := *doc
+			shard := context.shards + shardOf(&doc.Document, idx.shards())
+			context.hits = append(context.hits, &searchHit{index: idx, doc: &snapshot, shardDoc: int64(shard)<<32 | int64(doc.seq)})
+		}
+		context.shards += idx.shards()
+	}
+	s.sequence++
+	id := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("estest-pit-%d", s.sequence)))
+	s.pits[id] = context
+	return http.StatusOK, map[string]interface{}{"id": id}
+}
+
+// closePointInTime answers DELETE /_pit, with the ID of the point in time in a JSON body.
+func (s *Server) closePointInTime(body []byte) (int, interface{}) {
+	var request struct {
+		ID string `json:"id"`
+	}
+	if err := decodeJSON(body, &request); err != nil || request.ID == "" {
+		return (&apiError{http.StatusBadRequest, "action_request_validation_exception", "Validation Failed: 1: point in time id is missing;"}).response()
+	}
+	s.expireScrolls()
+	if _, ok := s.pits[request.ID]; !ok {
+		return http.StatusNotFound, map[string]interface{}{"succeeded": true, "num_freed": 0}
+	}
+	delete(s.pits, request.ID)
+	return http.StatusOK, map[string]interface{}{"succeeded": true, "num_freed": 1}
+}
+
+// scroll answers a request for the next page of a scroll, reading the scroll ID and keep-alive from
+// the URL or from the body, which is JSON or the bare scroll ID on ES2.
+func (s *Server) scroll(pathID, keepAliveParam, idParam string, body []byte) (int, interface{}) {
+	var request struct {
+		Scroll   string `json:"scroll"`
+		ScrollID string `json:"scroll_id"`
+	}
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 {
+		if trimmed[0] == '{' {
+			if err := decodeJSON(trimmed, &request); err != nil {
+				return (&apiError{http.StatusBadRequest, "parse_exception", "failed to parse request body: " + err.Error()}).response()
+			}
+		} else {
+			request.ScrollID = string(trimmed)
+		}
+	}
+	id := firstNonEmpty(request.ScrollID, idParam, pathID)
+	if id == "" {
+		return (&apiError{http.StatusBadRequest, "action_request_validation_exception", "Validation Failed: 1: scrollId is missing;"}).response()
+	}
+
+	s.expireScrolls()
+	context, ok := s.scrolls[id]
+	if !ok {
+		return scrollMissing(id)
+	}
+	if keepAlive := firstNonEmpty(keepAliveParam, request.Scroll); keepAlive != "" {
+		duration, err := parseKeepAlive(keepAlive)
+		if err != nil {
+			return (&apiError{http.StatusBadRequest, "parse_exception", err.Error()}).response()
+		}
+		context.keepAlive = duration
+	}
+	context.expires = time.Now().Add(context.keepAlive)
+	return http.StatusOK, s.scrollPage(id, context)
+}
+
+// scrollMissing is the response to a request on a scroll that expired or was cleared.
+func scrollMissing(id string) (int, interface{}) {
+	return shardsFailed(http.StatusNotFound, "search_context_missing_exception", "No search context found for id ["+id+"]")
+}
+
+// shardsFailed is the response to a search failing on every shard, with the shard error as root cause.
+func shardsFailed(status int, errorType, reason string) (int, interface{}) {
+	body := errorBody(status, "search_phase_execution_exception", "all shards failed")
+	body["error"].(map[string]interface{})["root_cause"] = []interface{}{
+		map[string]interface{}{"type": errorType, "reason": reason},
+	}
+	return status, body
+}
+
+// scrollPage returns the next page of a scroll and moves past it.
+func (s *Server) scrollPage(id string, context *scrollContext) map[string]interface{} {
+	from := context.next
+	to := min(from+context.size, len(context.hits))
+	context.next = to
+	return s.searchResponse(id, context.hits[from:to], len(context.hits), context.shards)
+}
+
+// clearScroll answers DELETE /_search/scroll, with the scroll IDs in the URL, in a JSON body or,
+// on ES2, as the bare body.
+func (s *Server) clearScroll(pathIDs string, body []byte) (int, interface{}) {
+	var ids []string
+	if pathIDs != "" {
+		ids = strings.Split(pathIDs, ",")
+	}
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 {
+		if trimmed[0] == '{' {
+			var request struct {
+				ScrollID json.RawMessage `json:"scroll_id"`
+			}
+			if err := decodeJSON(trimmed, &request); err != nil {
+				return (&apiError{http.StatusBadRequest, "parse_exception", "failed to parse request body: " + err.Error()}).response()
+			}
+			var list []string
+			var single string
+			if err := json.Unmarshal(request.ScrollID, &list); err == nil {
+				ids = append(ids, list...)
+			} else if err := json.Unmarshal(request.ScrollID, &single); err == nil {
+				ids = append(ids, single)
+			}
+		} else {
+			ids = append(ids, strings.Split(string(trimmed), ",")...)
+		}
+	}
+
+	s.expireScrolls()
+	freed := 0
+	for _, id := range ids {
+		if id == "_all" {
+			freed += len(s.scrolls)
+			s.scrolls = map[string]*scrollContext{}
+			continue
+		}
+		if _, ok := s.scrolls[id]; ok {
+			delete(s.scrolls, id)
+			freed++
+		}
+	}
+	status := http.StatusOK
+	if freed == 0 {
+		status = http.StatusNotFound
+	}
+	return status, map[string]interface{}{"succeeded": true, "num_freed": freed}
+}
+
+// expireScrolls drops the scroll contexts and points in time whose keep-alive has elapsed.
+// The caller must hold s.mu.
+func (s *Server) expireScrolls() {
+	now := time.Now()
+	for id, context := range s.scrolls {
+		if now.After(context.expires) {
+			delete(s.scrolls, id)
+		}
+	}
+	for id, context := range s.pits {
+		if now.After(context.expires) {
+			delete(s.pits, id)
+		}
+	}
+}
+
+// searchResponse builds the body of a search or scroll response.
+func (s *Server) searchResponse(scrollID string, hits []map[string]interface{}, total, shards int) map[string]interface{} {
+	var totalHits interface{} = total
+	if s.version >= 7 {
+		totalHits = map[string]interface{}{"value": total, "relation": "eq"}
+	}
+	response := map[string]interface{}{
+		"took":      1,
+		"timed_out": false,
+		"_shards":   map[string]interface{}{"total": shards, "successful": shards, "skipped": 0, "failed": 0},
+		"hits": map[string]interface{}{
+			"total":     totalHits,
+			"max_score": nil,
+			"hits":      hits,
+		},
+	}
+	if scrollID != "" {
+		response["_scroll_id"] = scrollID
+	}
+	return response
+}
+
+// renderHit builds the JSON of a hit, with a copy of its filtered source.
+func (s *Server) renderHit(hit *searchHit, request *searchRequest) map[string]interface{} {
+	doc := hit.doc
+	rendered := map[string]interface{}{
+		"_index": hit.index.name,
+		"_id":    doc.ID,
+	}
+	switch {
+	case s.version == 2:
+		rendered["_type"] = doc.Type
+		if doc.Parent != "" {
+			rendered["_parent"] = doc.Parent
+		}
+	case s.version == 7:
+		rendered["_type"] = "_doc"
+	}
+	if doc.Routing != "" {
+		rendered["_routing"] = doc.Routing
+	}
+	if request.version {
+		rendered["_version"] = doc.Version
+	}
+	if hit.sort != nil {
+		rendered["_score"] = nil
+		rendered["sort"] = hit.sort
+	} else {
+		rendered["_score"] = 1.0
+	}
+	if doc.RawSource != "" {
+		rendered["_source"] = json.RawMessage(doc.RawSource)
+	} else if request.source == nil {
+		rendered["_source"] = copyValue(doc.Source)
+	} else if !request.source.disabled {
+		rendered["_source"] = filterSource(doc.Source, "", request.source.includes, request.source.excludes)
+	}
+	return rendered
+}
+
+// parseSearch reads the search body and the size and from URL parameters.
+// ES2 rejects the keys it does not know yet, like search_after and slice.
+func (s *Server) parseSearch(params url.Values, body []byte) (*searchRequest, *apiError) {
+	request := &searchRequest{size: defaultSearchSize}
+	var raw map[string]interface{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := decodeJSON(body, &raw); err != nil {
+			return nil, &apiError{http.StatusBadRequest, "parse_exception", "failed to parse search source: " + err.Error()}
+		}
+	}
+	if raw == nil {
+		raw = map[string]interface{}{}
+	}
+	for _, name := range []string{"size", "from"} {
+		if value := params.Get(name); value != "" {
+			raw[name] = json.Number(value)
+		}
+	}
+
+	for key, value := range raw {
+		var err error
+		switch key {
+		case "pit":
+			if s.version == 2 {
+				return nil, &apiError{http.StatusBadRequest, "search_parse_exception", "failed to parse search source. unknown search element [" + key + "]"}
+			}
+			request.pit = &searchPointInTime{}
+			if err = remarshal(value, request.pit); err == nil && request.pit.ID == "" {
+				err = fmt.Errorf("[pit] requires an id")
+			}
+		case "query":
+			query, ok := value.(map[string]interface{})
+			if !ok {
+				err = fmt.Errorf("[query] must be an object")
+			}
+			request.query = query
+		case "sort":
+			request.sort, err = parseSort(value)
+		case "search_after", "slice":
+			if s.version == 2 {
+				return nil, &apiError{http.StatusBadRequest, "search_parse_exception", "failed to parse search source. unknown search element [" + key + "]"}
+			}
+			if key == "slice" {
+				request.slice = &searchSlice{}
+				err = remarshal(value, request.slice)
+			} else if after, ok := value.([]interface{}); ok {
+				request.searchAfter = after
+			} else {
+				err = fmt.Errorf("[search_after] must be an array")
+			}
+		case "_source":
+			request.source, err = parseSourceFilter(value)
+		case "version":
+			request.version, _ = value.(bool)
+		case "size", "from":
+			var number int64
+			if number, err = strconv.ParseInt(fmt.Sprint(value), 10, 64); err == nil {
+				if key == "size" {
+					request.size = int(number)
+				} else {
+					request.from = int(number)
+				}
+			}
+		case "track_total_hits", "timeout", "terminate_after", "stored_fields", "fields", "docvalue_fields", "explain", "min_score", "track_scores":
+			// Accepted and ignored
+		default:
+			return nil, &apiError{http.StatusBadRequest, "parsing_exception", "Unknown key for a " + jsonKind(value) + " in [" + key + "]."}
+		}
+		if err != nil {
+			return nil, &apiError{http.StatusBadRequest, "parsing_exception", err.Error()}
+		}
+	}
+	return request, nil
+}
+
+// parseSort reads a sort as a field name, an object of fields and orders, or an array of either.
+func parseSort(value interface{}) ([]sortField, error) {
+	switch v := value.(type) {
+	case string:
+		return []sortField{{field: v, desc: v == "_score"}}, nil
+	case []interface{}:
+		var fields []sortField
+		for _, item := range v {
+			parsed, err := parseSort(item)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, parsed...)
+		}
+		return fields, nil
+	case map[string]interface{}:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fields := make([]sortField, 0, len(v))
+		for _, name := range names {
+			order := v[name]
+			if options, ok := order.(map[string]interface{}); ok {
+				order = options["order"]
+			}
+			switch order {
+			case "asc":
+				fields = append(fields, sortField{field: name})
+			case "desc":
+				fields = append(fields, sortField{field: name, desc: true})
+			case nil:
+				fields = append(fields, sortField{field: name, desc: name == "_score"})
+			default:
+				return nil, fmt.Errorf("unknown sort order [%v]", order)
+			}
+		}
+		return fields, nil
+	default:
+		return nil, fmt.Errorf("malformed sort")
+	}
+}
+
+// parseSourceFilter reads a _source value: a boolean, a field pattern, a list of patterns or an object
+// of includes and excludes.
+func parseSourceFilter(value interface{}) (*sourceFilter, error) {
+	filter := &sourceFilter{}
+	switch v := value.(type) {
+	case bool:
+		filter.disabled = !v
+	case string:
+		filter.includes = []string{v}
+	case []interface{}:
+		filter.includes = stringList(v)
+	case map[string]interface{}:
+		for key, patterns := range v {
+			var list []string
+			switch p := patterns.(type) {
+			case string:
+				list = []string{p}
+			case []interface{}:
+				list = stringList(p)
+			}
+			switch key {
+			case "includes", "include":
+				filter.includes = list
+			case "excludes", "exclude":
+				filter.excludes = list
+			default:
+				return nil, fmt.Errorf("unknown key [%s] in _source", key)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("malformed _source")
+	}
+	return filter, nil
+}
+
+// parseShardPreference reads a "_shards:n,m" preference into the set of shards to search, nil for every shard.
+func parseShardPreference(preference string) (map[int]bool, *apiError) {
+	if !strings.HasPrefix(preference, "_shards:") {
+		return nil, nil
+	}
+	list, _, _ := strings.Cut(strings.TrimPrefix(preference, "_shards:"), "|")
+	shards := map[int]bool{}
+	for _, item := range strings.Split(list, ",") {
+		shard, err := strconv.Atoi(item)
+		if err != nil {
+			return nil, &apiError{http.StatusBadRequest, "illegal_argument_exception", "invalid shard preference [" + preference + "]"}
+		}
+		shards[shard] = true
+	}
+	return shards, nil
+}
+
+// parseKeepAlive parses an Elasticsearch time value like 1m, 30s or 60000ms.
+func parseKeepAlive(value string) (time.Duration, error) {
+	units := []struct {
+		suffix string
+		unit   time.Duration
+	}{
+		{"nanos", time.Nanosecond},
+		{"micros", time.Microsecond},
+		{"ms", time.Millisecond},
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+	}
+	for _, unit := range units {
+		if number, ok := strings.CutSuffix(value, unit.suffix); ok {
+			if count, err := strconv.ParseInt(number, 10, 64); err == nil {
+				return time.Duration(count) * unit.unit, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("failed to parse setting [scroll] with value [%s] as a time value", value)
+}
+
+// sortValue returns the value a hit is sorted on for one sort field, nil when the document has none.
+// Multi-valued fields sort on their smallest value, or their largest in descending order.
+func (s *Server) sortValue(hit *searchHit, field sortField) interface{} {
+	switch field.field {
+	case "_doc":
+		return hit.doc.seq
+	case "_shard_doc":
+		return hit.shardDoc
+	case "_score":
+		return 1.0
+	}
+	values := s.fieldValues(hit.index, hit.doc, field.field)
+	if len(values) == 0 {
+		return nil
+	}
+	chosen := values[0]
+	for _, value := range values[1:] {
+		if c := compareValues(value, chosen); (c < 0 && !field.desc) || (c > 0 && field.desc) {
+			chosen = value
+		}
+	}
+	return chosen
+}
+
+// compareSortValues compares two lists of sort values in the order of the sort fields.
+// Missing values sort last whatever the order.
+func compareSortValues(a, b []interface{}, fields []sortField) int {
+	for i, field := range fields {
+		switch {
+		case a[i] == nil && b[i] == nil:
+			continue
+		case a[i] == nil:
+			return 1
+		case b[i] == nil:
+			return -1
+		}
+		c := compareValues(a[i], b[i])
+		if field.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// filterSource returns a copy of a source keeping the fields matched by the include patterns,
+// all when there are none, minus those matched by the exclude patterns.
+func filterSource(source map[string]interface{}, prefix string, includes, excludes []string) map[string]interface{} {
+	filtered := map[string]interface{}{}
+	for key, value := range source {
+		fieldPath := key
+		if prefix != "" {
+			fieldPath = prefix + "." + key
+		}
+		if matchesPattern(excludes, fieldPath) {
+			continue
+		}
+		included := len(includes) == 0 || matchesPattern(includes, fieldPath)
+		if !included && !parentOfPattern(includes, fieldPath) {
+			continue
+		}
+		// An included object still drops its excluded fields; a parent keeps its included fields
+		var subIncludes []string
+		if !included {
+			subIncludes = includes
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			child := filterSource(v, fieldPath, subIncludes, excludes)
+			if included || len(child) > 0 {
+				filtered[key] = child
+			}
+		case []interface{}:
+			var items []interface{}
+			for _, item := range v {
+				if object, ok := item.(map[string]interface{}); ok {
+					if child := filterSource(object, fieldPath, subIncludes, excludes); included || len(child) > 0 {
+						items = append(items, child)
+					}
+				} else if included {
+					items = append(items, copyValue(item))
+				}
+			}
+			if included || len(items) > 0 {
+				filtered[key] = items
+			}
+		default:
+			if included {
+				filtered[key] = v
+			}
+		}
+	}
+	return filtered
+}
+
+// matchesPattern reports whether a field path matches one of the patterns, or is inside a matched object.
+func matchesPattern(patterns []string, fieldPath string) bool {
+	for _, pattern := range patterns {
+		if wildcardMatch(pattern, fieldPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// parentOfPattern reports whether fields inside the object at fieldPath may match one of the patterns.
+func parentOfPattern(patterns []string, fieldPath string) bool {
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, fieldPath+".") || strings.Contains(pattern, "*") {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardMatch matches a value against a pattern where * matches any characters.
+func wildcardMatch(pattern, value string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == value
+	}
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(value, part)
+		if i < 0 {
+			return false
+		}
+		value = value[i+len(part):]
+	}
+	return strings.HasSuffix(value, parts[len(parts)-1])
+}
+
+// remarshal converts a decoded JSON value into dest.
+func remarshal(value interface{}, dest interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dest)
+}
+
+// stringList returns the string items of a list.
+func stringList(values []interface{}) []string {
+	list := make([]string, 0, len(values))
+	for _, value := range values {
+		list = append(list, fmt.Sprint(value))
+	}
+	return list
+}
+
+// jsonKind names the JSON token starting a value, as used in Elasticsearch parsing errors.
+func jsonKind(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return "START_OBJECT"
+	case []interface{}:
+		return "START_ARRAY"
+	default:
+		return "VALUE"
+	}
+}
+
+// firstNonEmpty returns the first non-empty value.
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
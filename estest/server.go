@@ -0,0 +1,427 @@
+// Package estest provides an in-process fake Elasticsearch server for tests. It speaks enough of the
+// ES2, ES7 and ES8 REST APIs used by the migration clients (search with scroll or point in time, bulk,
+// multi get, index, mapping, settings and alias endpoints) for the export and import stages to run
+// without a real cluster, and can inject failures: error responses, 429s, dropped connections,
+// rejected bulk items and expired scrolls.
+//
+// The fake keeps everything in memory and makes every write visible to searches immediately.
+// Queries support the exact-value subset of the query DSL used by the migration.
+package estest
+
+import (
+	"bytes"
+	"elkmigration/clients"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Endpoint names a group of API requests, for injecting failures and counting requests.
+type Endpoint string
+
+const (
+	EndpointInfo          Endpoint = "info"           // GET and HEAD /
+	EndpointBulk          Endpoint = "bulk"           // POST /_bulk
+	EndpointMultiGet      Endpoint = "mget"           // /{index}/_mget
+	EndpointSearch        Endpoint = "search"         // /{index}/_search
+	EndpointScroll        Endpoint = "scroll"         // /_search/scroll
+	EndpointClearScroll   Endpoint = "clear_scroll"   // DELETE /_search/scroll
+	EndpointOpenPIT       Endpoint = "open_pit"       // POST /{index}/_pit
+	EndpointClosePIT      Endpoint = "close_pit"      // DELETE /_pit
+	EndpointIndexExists   Endpoint = "index_exists"   // HEAD /{index}
+	EndpointCreateIndex   Endpoint = "create_index"   // PUT /{index}
+	EndpointDeleteIndex   Endpoint = "delete_index"   // DELETE /{index}
+	EndpointOpenIndex     Endpoint = "open_index"     // POST /{index}/_open
+	EndpointCloseIndex    Endpoint = "close_index"    // POST /{index}/_close
+	EndpointMapping       Endpoint = "mapping"        // GET /{index}/_mapping
+	EndpointSettings      Endpoint = "settings"       // GET /{index}/_settings
+	EndpointGetAlias      Endpoint = "get_alias"      // GET /_alias/{name}
+	EndpointUpdateAliases Endpoint = "update_aliases" // POST /_aliases
+)
+
+// Fault is a failure injected in place of the normal response of a request or bulk item.
+type Fault struct {
+	Status     int    // HTTP status of the error
+	Type       string // error type, derived from Status when empty
+	Reason     string
+	Disconnect bool // close the connection without responding; only applies to whole requests
+}
+
+// errorType returns the error type of the fault.
+func (f Fault) errorType() string {
+	if f.Type != "" {
+		return f.Type
+	}
+	switch f.Status {
+	case http.StatusBadRequest:
+		return "illegal_argument_exception"
+	case http.StatusNotFound:
+		return "resource_not_found_exception"
+	case http.StatusConflict:
+		return "version_conflict_engine_exception"
+	case http.StatusTooManyRequests:
+		return "es_rejected_execution_exception"
+	default:
+		return "exception"
+	}
+}
+
+// reason returns the error reason of the fault.
+func (f Fault) reason() string {
+	if f.Reason != "" {
+		return f.Reason
+	}
+	return "injected failure"
+}
+
+// injectedFault is a Fault applied a limited number of times, or forever when remaining is zero.
+type injectedFault struct {
+	Fault
+	remaining int
+	ids       map[string]bool // bulk item IDs the fault applies to, all when empty
+}
+
+// use consumes one application of the fault and reports whether it is used up.
+func (f *injectedFault) use() bool {
+	if f.remaining == 0 {
+		return false
+	}
+	f.remaining--
+	return f.remaining == 0
+}
+
+// Server is a fake Elasticsearch cluster of a given major version, served over HTTP by httptest.
+// The embedded httptest.Server gives its URL; Close stops it.
+type Server struct {
+	*httptest.Server
+	version int
+
+	mu         sync.Mutex
+	indices    map[string]*index
+	scrolls    map[string]*scrollContext
+	pits       map[string]*pointInTime
+	sequence   int // source of scroll IDs and generated document IDs
+	faults     map[Endpoint][]*injectedFault
+	itemFaults []*injectedFault
+	requests   map[Endpoint]int
+}
+
+// NewServer starts a fake cluster answering like Elasticsearch 2, 7 or 8. It panics on any other version.
+func NewServer(version int) *Server {
+	if _, ok := versionNumbers[version]; !ok {
+		panic(fmt.Sprintf("estest: unsupported Elasticsearch version %d", version))
+	}
+	s := &Server{
+		version:  version,
+		indices:  map[string]*index{},
+		scrolls:  map[string]*scrollContext{},
+		pits:     map[string]*pointInTime{},
+		faults:   map[Endpoint][]*injectedFault{},
+		requests: map[Endpoint]int{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// versionNumbers are the versions reported by the fake; ES7 clients require at least 7.14.
+var versionNumbers = map[int]string{
+	2: "2.4.6",
+	7: "7.17.10",
+	8: "8.15.0",
+}
+
+// Version returns the major version of the fake cluster.
+func (s *Server) Version() int {
+	return s.version
+}
+
+// Client returns a migration client of the server version connected to the fake cluster.
+func (s *Server) Client() (clients.ElasticsearchClient, error) {
+	return clients.NewElasticsearchClient(s.version, s.URL, "", "")
+}
+
+// FailRequests makes the next times requests to endpoint fail with fault, or every request when times is zero.
+// Faults on the same endpoint apply in the order they were added.
+func (s *Server) FailRequests(endpoint Endpoint, times int, fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[endpoint] = append(s.faults[endpoint], &injectedFault{Fault: fault, remaining: times})
+}
+
+// FailBulkItems makes the bulk items writing the documents with the given IDs fail with fault, in otherwise
+// successful bulk requests. With no IDs the fault applies to every item. Each of those items fails times
+// times, or always when times is zero, so a 429 fault exercises the retry of rejected items.
+func (s *Server) FailBulkItems(times int, fault Fault, ids ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(ids) == 0 {
+		s.itemFaults = append(s.itemFaults, &injectedFault{Fault: fault, remaining: times})
+		return
+	}
+	for _, id := range ids {
+		s.itemFaults = append(s.itemFaults, &injectedFault{Fault: fault, remaining: times, ids: map[string]bool{id: true}})
+	}
+}
+
+// ClearFaults removes every injected request and bulk item fault.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = map[Endpoint][]*injectedFault{}
+	s.itemFaults = nil
+}
+
+// ExpireScrolls drops every open scroll context and point in time, as if their keep-alive had elapsed.
+func (s *Server) ExpireScrolls() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scrolls = map[string]*scrollContext{}
+	s.pits = map[string]*pointInTime{}
+}
+
+// OpenScrolls returns the number of scroll contexts neither cleared nor expired.
+func (s *Server) OpenScrolls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireScrolls()
+	return len(s.scrolls)
+}
+
+// OpenPointsInTime returns the number of points in time neither closed nor expired.
+func (s *Server) OpenPointsInTime() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireScrolls()
+	return len(s.pits)
+}
+
+// Requests returns the number of requests received by endpoint, including failed ones.
+func (s *Server) Requests(endpoint Endpoint) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[endpoint]
+}
+
+// serveHTTP routes a request to its endpoint, applying any injected fault first.
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.version >= 7 {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	}
+
+	route, ok := s.route(r)
+	if !ok {
+		s.writeError(w, r, http.StatusBadRequest, "illegal_argument_exception", fmt.Sprintf("no handler found for uri [%s] and method [%s]", r.URL.Path, r.Method))
+		return
+	}
+
+	s.mu.Lock()
+	s.requests[route.endpoint]++
+	fault := s.takeFault(route.endpoint)
+	if fault == nil {
+		status, response := route.handle(body)
+		s.mu.Unlock()
+		s.writeResponse(w, r, status, response)
+		return
+	}
+	s.mu.Unlock()
+
+	if fault.Disconnect {
+		// Aborts the response and closes the connection
+		panic(http.ErrAbortHandler)
+	}
+	s.writeError(w, r, fault.Status, fault.errorType(), fault.reason())
+}
+
+// takeFault returns the next fault injected on endpoint, if any. The caller must hold s.mu.
+func (s *Server) takeFault(endpoint Endpoint) *Fault {
+	faults := s.faults[endpoint]
+	if len(faults) == 0 {
+		return nil
+	}
+	fault := faults[0].Fault
+	if faults[0].use() {
+		s.faults[endpoint] = faults[1:]
+	}
+	return &fault
+}
+
+// takeItemFault returns the next bulk item fault matching a document ID, if any. The caller must hold s.mu.
+func (s *Server) takeItemFault(id string) *Fault {
+	for i, fault := range s.itemFaults {
+		if len(fault.ids) > 0 && !fault.ids[id] {
+			continue
+		}
+		if fault.use() {
+			s.itemFaults = append(s.itemFaults[:i:i], s.itemFaults[i+1:]...)
+		}
+		return &fault.Fault
+	}
+	return nil
+}
+
+// route is a request matched to an endpoint, handled under s.mu.
+type route struct {
+	endpoint Endpoint
+	handle   func(body []byte) (int, interface{})
+}
+
+// route matches a request to its endpoint and handler.
+func (s *Server) route(r *http.Request) (route, bool) {
+	query := r.URL.Query()
+	var parts []string
+	for _, part := range strings.Split(r.URL.Path, "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	method := r.Method
+	read := method == http.MethodGet || method == http.MethodPost
+
+	switch {
+	case len(parts) == 0 && (method == http.MethodGet || method == http.MethodHead):
+		return route{EndpointInfo, func([]byte) (int, interface{}) { return s.info() }}, true
+
+	case len(parts) >= 2 && parts[0] == "_search" && parts[1] == "scroll":
+		ids := strings.Join(parts[2:], "/")
+		if method == http.MethodDelete {
+			return route{EndpointClearScroll, func(body []byte) (int, interface{}) { return s.clearScroll(ids, body) }}, true
+		}
+		if read {
+			return route{EndpointScroll, func(body []byte) (int, interface{}) {
+				return s.scroll(ids, query.Get("scroll"), query.Get("scroll_id"), body)
+			}}, true
+		}
+
+	case len(parts) <= 3 && len(parts) > 0 && parts[len(parts)-1] == "_search" && read:
+		expression, docType := "_all", ""
+		if len(parts) > 1 {
+			expression = parts[0]
+		}
+		if len(parts) == 3 {
+			docType = parts[1]
+		}
+		return route{EndpointSearch, func(body []byte) (int, interface{}) { return s.search(expression, docType, query, body) }}, true
+
+	case len(parts) <= 2 && len(parts) > 0 && parts[len(parts)-1] == "_bulk" && (method == http.MethodPost || method == http.MethodPut):
+		defaultIndex := ""
+		if len(parts) == 2 {
+			defaultIndex = parts[0]
+		}
+		return route{EndpointBulk, func(body []byte) (int, interface{}) { return s.bulk(defaultIndex, body) }}, true
+
+	case len(parts) == 2 && parts[1] == "_pit" && method == http.MethodPost && s.version >= 7:
+		return route{EndpointOpenPIT, func([]byte) (int, interface{}) { return s.openPointInTime(parts[0], query.Get("keep_alive")) }}, true
+
+	case len(parts) == 1 && parts[0] == "_pit" && method == http.MethodDelete && s.version >= 7:
+		return route{EndpointClosePIT, s.closePointInTime}, true
+
+	case len(parts) <= 2 && len(parts) > 0 && parts[len(parts)-1] == "_mget" && read:
+		defaultIndex := ""
+		if len(parts) == 2 {
+			defaultIndex = parts[0]
+		}
+		return route{EndpointMultiGet, func(body []byte) (int, interface{}) { return s.mget(defaultIndex, body) }}, true
+
+	case len(parts) == 1 && parts[0] == "_aliases" && (method == http.MethodPost || method == http.MethodPut):
+		return route{EndpointUpdateAliases, s.updateAliases}, true
+
+	case (len(parts) == 2 && parts[0] == "_alias" || len(parts) == 3 && parts[1] == "_alias") && (method == http.MethodGet || method == http.MethodHead):
+		expression := "_all"
+		if len(parts) == 3 {
+			expression = parts[0]
+		}
+		name := parts[len(parts)-1]
+		return route{EndpointGetAlias, func([]byte) (int, interface{}) { return s.getAlias(expression, name) }}, true
+
+	case len(parts) == 1 && !strings.HasPrefix(parts[0], "_"):
+		name := parts[0]
+		switch method {
+		case http.MethodHead:
+			return route{EndpointIndexExists, func([]byte) (int, interface{}) { return s.indexExists(name) }}, true
+		case http.MethodPut:
+			return route{EndpointCreateIndex, func(body []byte) (int, interface{}) { return s.createIndex(name, body) }}, true
+		case http.MethodDelete:
+			return route{EndpointDeleteIndex, func([]byte) (int, interface{}) { return s.deleteIndex(name) }}, true
+		}
+
+	case len(parts) == 2 && parts[1] == "_open" && method == http.MethodPost:
+		return route{EndpointOpenIndex, func([]byte) (int, interface{}) { return s.setClosed(parts[0], false) }}, true
+
+	case len(parts) == 2 && parts[1] == "_close" && method == http.MethodPost:
+		return route{EndpointCloseIndex, func([]byte) (int, interface{}) { return s.setClosed(parts[0], true) }}, true
+
+	case len(parts) >= 2 && parts[1] == "_mapping" && method == http.MethodGet:
+		return route{EndpointMapping, func([]byte) (int, interface{}) { return s.getMapping(parts[0]) }}, true
+
+	case len(parts) >= 2 && parts[1] == "_settings" && method == http.MethodGet:
+		flat := query.Get("flat_settings") == "true"
+		return route{EndpointSettings, func([]byte) (int, interface{}) { return s.getSettings(parts[0], flat) }}, true
+	}
+	return route{}, false
+}
+
+// info answers the root endpoint, read by the clients to check the cluster.
+func (s *Server) info() (int, interface{}) {
+	return http.StatusOK, map[string]interface{}{
+		"name":         "estest",
+		"cluster_name": "estest",
+		"version": map[string]interface{}{
+			"number":         versionNumbers[s.version],
+			"build_flavor":   "default",
+			"lucene_version": "",
+		},
+		"tagline": "You Know, for Search",
+	}
+}
+
+// writeResponse writes a JSON response; HEAD requests only get the status.
+func (s *Server) writeResponse(w http.ResponseWriter, r *http.Request, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead || response == nil {
+		return
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(response); err != nil {
+		panic(fmt.Sprintf("estest: failed to encode response: %v", err))
+	}
+	w.Write(buf.Bytes())
+}
+
+// writeError writes an Elasticsearch error response.
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, status int, errorType, reason string) {
+	s.writeResponse(w, r, status, errorBody(status, errorType, reason))
+}
+
+// errorBody builds the body of an Elasticsearch error response.
+func errorBody(status int, errorType, reason string) map[string]interface{} {
+	cause := map[string]interface{}{"type": errorType, "reason": reason}
+	return map[string]interface{}{
+		"error": map[string]interface{}{
+			"root_cause": []interface{}{cause},
+			"type":       errorType,
+			"reason":     reason,
+		},
+		"status": status,
+	}
+}
+
+// sortedNames returns the keys of a set in order.
+func sortedNames(set map[string]bool) []string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
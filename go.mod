@@ -5,11 +5,14 @@ go 1.23.3
 require (
 	github.com/elastic/go-elasticsearch/v7 v7.17.10
 	github.com/elastic/go-elasticsearch/v8 v8.15.0
+	github.com/klauspost/compress v1.17.2
 	github.com/redis/go-redis/v9 v9.7.0
 	github.com/rs/zerolog v1.33.0
 	github.com/spf13/viper v1.19.0
+	go.etcd.io/bbolt v1.3.11
 	go.uber.org/zap v1.27.0
 	gopkg.in/olivere/elastic.v3 v3.0.75
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -42,5 +45,4 @@ require (
 	golang.org/x/sys v0.19.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,142 @@
+package job
+
+import (
+	"context"
+	"elkmigration/clients"
+	"elkmigration/config"
+	"elkmigration/pipeline"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Index is one source index of a job and the target index it is migrated to.
+type Index struct {
+	Source string
+	Target string
+
+	// namespaced is set when the job covers more than ELK_INDEX_FROM itself,
+	// so each index writes its own report files
+	namespaced bool
+}
+
+// Resolve expands ELK_INDEX_FROM, a comma-separated list of indices, wildcards such as "logstash-2016.*"
+// and aliases, into the concrete indices of the source cluster, and names their targets from ELK_INDEX_TO.
+// ELK_INDEX_TO is a template which may contain:
+//   - {index}: the source index name
+//   - {name}: the source index name without its date suffix, e.g. "logstash" for "logstash-2016.01.05"
+//   - {date}: the date suffix, parsed with INDEX_DATE_LAYOUT and formatted with TARGET_DATE_LAYOUT,
+//     so "2006.01" rolls daily indices up into monthly ones
+//
+// Several source indices may share a target. The indices are returned sorted by source name.
+// With SOURCE_TYPE=file, ELK_INDEX_FROM only names the job's checkpoints and client may be nil.
+func Resolve(ctx context.Context, client clients.ElasticsearchClient, config *config.Config) ([]Index, error) {
+	if config.SourceType == pipeline.SourceFile {
+		target, err := TargetName(config, config.ElkIndexFrom)
+		if err != nil {
+			return nil, err
+		}
+		return []Index{{Source: config.ElkIndexFrom, Target: target}}, nil
+	}
+
+	admin, ok := client.(clients.IndexAdmin)
+	if !ok {
+		return nil, fmt.Errorf("source client %T cannot resolve indices", client)
+	}
+
+	seen := map[string]bool{}
+	var sources []string
+	for _, pattern := range strings.Split(config.ElkIndexFrom, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		metadata, err := admin.IndexMetadata(ctx, pattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve source index %s: %w", pattern, err)
+		}
+		if len(metadata) == 0 {
+			return nil, fmt.Errorf("no source index matches %s", pattern)
+		}
+		for name := range metadata {
+			if !seen[name] {
+				seen[name] = true
+				sources = append(sources, name)
+			}
+		}
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("ELK_INDEX_FROM must name at least one index")
+	}
+	sort.Strings(sources)
+
+	namespaced := len(sources) > 1 || sources[0] != config.ElkIndexFrom
+	indices := make([]Index, len(sources))
+	for i, source := range sources {
+		target, err := TargetName(config, source)
+		if err != nil {
+			return nil, err
+		}
+		indices[i] = Index{Source: source, Target: target, namespaced: namespaced}
+	}
+	return indices, nil
+}
+
+// TargetName renders the ELK_INDEX_TO template for a source index.
+func TargetName(config *config.Config, source string) (string, error) {
+	template := config.ElkIndexTo
+	target := strings.ReplaceAll(template, "{index}", source)
+	if strings.Contains(template, "{name}") || strings.Contains(template, "{date}") {
+		name, date, ok := splitDate(source, config.IndexDateLayout)
+		if !ok {
+			return "", fmt.Errorf("source index %s has no date suffix matching INDEX_DATE_LAYOUT %q", source, config.IndexDateLayout)
+		}
+		layout := config.TargetDateLayout
+		if layout == "" {
+			layout = config.IndexDateLayout
+		}
+		target = strings.ReplaceAll(target, "{name}", name)
+		target = strings.ReplaceAll(target, "{date}", date.Format(layout))
+	}
+	// Index names must be lowercase
+	return strings.ToLower(target), nil
+}
+
+// splitDate splits a source index name into its prefix and its trailing date, as laid out by layout.
+// The separator before the date is dropped from the prefix.
+func splitDate(source, layout string) (string, time.Time, bool) {
+	if layout == "" || len(source) < len(layout) {
+		return "", time.Time{}, false
+	}
+	prefix, suffix := source[:len(source)-len(layout)], source[len(source)-len(layout):]
+	date, err := time.Parse(layout, suffix)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return strings.TrimRight(prefix, "-_."), date, true
+}
+
+// Config returns the configuration to migrate the index with: the source and target indices are
+// set, which keeps the Redis state of each index apart, and in jobs of several indices the report
+// files are suffixed with the source index name.
+func (i Index) Config(base *config.Config) *config.Config {
+	config := *base
+	config.ElkIndexFrom = i.Source
+	config.ElkIndexTo = i.Target
+	if !i.namespaced {
+		return &config
+	}
+	config.MappingReportFile = suffixFile(config.MappingReportFile, i.Source)
+	return &config
+}
+
+// suffixFile inserts a suffix before the extension of a file name, "report.json" becoming "report-logs.json".
+func suffixFile(path, suffix string) string {
+	if path == "" {
+		return ""
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + suffix + ext
+}
@@ -32,6 +32,12 @@ func colorizeLevel(level zapcore.Level) string {
 
 // InitLogger initializes a Zap logger with both console and file output
 func InitLogger(logFilePath string) {
+	InitLoggerTo(logFilePath, os.Stdout)
+}
+
+// InitLoggerTo initializes the logger like InitLogger, writing the console output to console,
+// e.g. os.Stderr for commands that print their results on stdout
+func InitLoggerTo(logFilePath string, console *os.File) {
 	// Customize the encoder config for the console
 	consoleEncoderConfig := zap.NewProductionEncoderConfig()
 	consoleEncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder // Format timestamps
@@ -58,7 +64,7 @@ func InitLogger(logFilePath string) {
 	// Console logging core
 	consoleCore := zapcore.NewCore(
 		zapcore.NewConsoleEncoder(consoleEncoderConfig),
-		zapcore.Lock(os.Stdout),
+		zapcore.Lock(console),
 		zapcore.DebugLevel,
 	)
 
@@ -0,0 +1,477 @@
+package mapping
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// IndexDefinition is the body of a create index request on the target.
+type IndexDefinition struct {
+	Settings map[string]interface{} `json:"settings,omitempty"`
+	Mappings map[string]interface{} `json:"mappings,omitempty"`
+}
+
+// Convert turns the mappings and settings of a source index into an ES8-compatible index definition.
+// mappings is the "mappings" object of the index as returned by the _mapping API: one entry per
+// mapping type on ES2, or a typeless mapping (with "properties" at the top) on ES7 and later.
+// settings is the "settings" object returned by the _settings API.
+// Every lossy conversion is recorded in the returned report.
+func Convert(mappings, settings map[string]interface{}) (*IndexDefinition, *Report) {
+	report := &Report{}
+	// The settings go first, so the mappings know the analyzers that were removed
+	convertedSettings := convertSettings(settings, report)
+	definition := &IndexDefinition{
+		Settings: convertedSettings,
+		Mappings: convertMappings(mappings, report),
+	}
+	return definition, report
+}
+
+// convertMappings flattens ES2 mapping types into a single typeless mapping.
+func convertMappings(mappings map[string]interface{}, report *Report) map[string]interface{} {
+	if len(mappings) == 0 {
+		return nil
+	}
+	if _, typeless := mappings["properties"]; typeless {
+		return convertRoot("mappings", mappings, report)
+	}
+
+	types := sortedKeys(mappings)
+	merged := map[string]interface{}{}
+	var flattened []string
+	for _, typeName := range types {
+		path := "mappings." + typeName
+		if typeName == "_default_" {
+			report.add(path, "removed", "the _default_ mapping is not supported; use an index template instead")
+			continue
+		}
+		typeMapping, ok := mappings[typeName].(map[string]interface{})
+		if !ok {
+			report.add(path, "removed", "mapping type is not an object")
+			continue
+		}
+		mergeRoot(merged, convertRoot(path, typeMapping, report), path, report)
+		flattened = append(flattened, typeName)
+	}
+	if len(flattened) > 1 {
+		report.add("mappings", "merged", fmt.Sprintf("mapping types %s flattened into one typeless mapping", strings.Join(flattened, ", ")))
+	}
+	return merged
+}
+
+// convertRoot converts the root object of a mapping type, including its meta fields.
+func convertRoot(path string, root map[string]interface{}, report *Report) map[string]interface{} {
+	converted := map[string]interface{}{}
+	for _, key := range sortedKeys(root) {
+		value := root[key]
+		keyPath := path + "." + key
+		switch key {
+		case "properties":
+			converted[key] = convertProperties(keyPath, value, report)
+		case "dynamic_templates":
+			converted[key] = convertDynamicTemplates(keyPath, value, report)
+		case "dynamic", "date_detection", "numeric_detection", "dynamic_date_formats", "_source", "_meta", "_routing":
+			converted[key] = value
+		case "_all":
+			report.add(keyPath, "removed", "_all no longer exists; use copy_to to a custom field if full-text search across fields is needed")
+		case "_timestamp", "_ttl":
+			report.add(keyPath, "removed", key+" no longer exists; store the value in a regular field")
+		case "_parent":
+			report.add(keyPath, "removed", "parent/child relations must be remodelled with a join field")
+		default:
+			report.add(keyPath, "removed", "meta field or root option not supported on ES8")
+		}
+	}
+	return converted
+}
+
+// convertDynamicTemplates converts the mapping of each dynamic template.
+func convertDynamicTemplates(path string, value interface{}, report *Report) interface{} {
+	templates, ok := value.([]interface{})
+	if !ok {
+		return value
+	}
+	converted := make([]interface{}, 0, len(templates))
+	for i, entry := range templates {
+		named, ok := entry.(map[string]interface{})
+		if !ok {
+			report.add(fmt.Sprintf("%s.%d", path, i), "removed", "dynamic template is not an object")
+			continue
+		}
+		convertedEntry := map[string]interface{}{}
+		for _, name := range sortedKeys(named) {
+			definition, ok := named[name].(map[string]interface{})
+			if !ok {
+				report.add(path+"."+name, "removed", "dynamic template is not an object")
+				continue
+			}
+			convertedTemplate := map[string]interface{}{}
+			for key, option := range definition {
+				if fieldMapping, ok := option.(map[string]interface{}); ok && key == "mapping" {
+					option = convertField(path+"."+name+".mapping", fieldMapping, report)
+				}
+				convertedTemplate[key] = option
+			}
+			convertedEntry[name] = convertedTemplate
+		}
+		converted = append(converted, convertedEntry)
+	}
+	return converted
+}
+
+// convertProperties converts every field of a "properties" object.
+func convertProperties(path string, value interface{}, report *Report) map[string]interface{} {
+	properties, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	converted := make(map[string]interface{}, len(properties))
+	for _, name := range sortedKeys(properties) {
+		field, ok := properties[name].(map[string]interface{})
+		if !ok {
+			report.add(path+"."+name, "removed", "field mapping is not an object")
+			continue
+		}
+		converted[name] = convertField(path+"."+name, field, report)
+	}
+	return converted
+}
+
+// dateFormatCamelCase matches the camelCase built-in date format names removed in ES8, e.g. dateOptionalTime.
+var dateFormatCamelCase = regexp.MustCompile(`^[a-z]+([A-Z][a-z]+)+$`)
+
+// convertField converts the mapping of one field, recursing into objects and multi-fields.
+func convertField(path string, field map[string]interface{}, report *Report) map[string]interface{} {
+	fieldType, _ := field["type"].(string)
+	stringType := fieldType == "string"
+	if stringType {
+		fieldType = convertStringType(path, field, report)
+	}
+
+	converted := map[string]interface{}{}
+	if fieldType != "" {
+		converted["type"] = fieldType
+	}
+
+	for _, key := range sortedKeys(field) {
+		value := field[key]
+		keyPath := path + "." + key
+		switch key {
+		case "type":
+		case "properties":
+			converted[key] = convertProperties(keyPath, value, report)
+		case "fields":
+			converted[key] = convertProperties(keyPath, value, report)
+		case "index":
+			// ES2 used "analyzed"/"not_analyzed"/"no"; ES8 only has true/false
+			switch value {
+			case "no", false:
+				converted[key] = false
+			case true:
+			case "analyzed", "not_analyzed":
+				// On a string field the type conversion is reported instead
+				if !stringType {
+					report.add(keyPath, "converted", fmt.Sprintf("index: %v replaced by the default index: true", value))
+				}
+			default:
+				report.add(keyPath, "removed", fmt.Sprintf("unsupported index option %v", value))
+			}
+		case "norms":
+			// ES2 norms were an object such as {"enabled": false, "loading": "eager"}
+			options, ok := value.(map[string]interface{})
+			if !ok {
+				converted[key] = value
+				continue
+			}
+			for _, option := range sortedKeys(options) {
+				if enabled, ok := options[option].(bool); ok && option == "enabled" {
+					converted[key] = enabled
+				} else {
+					report.add(keyPath+"."+option, "removed", "norms option not supported on ES8")
+				}
+			}
+		case "doc_values":
+			if fieldType == "text" {
+				report.add(keyPath, "removed", "text fields have no doc_values")
+			} else {
+				converted[key] = value
+			}
+		case "fielddata":
+			if options, ok := value.(map[string]interface{}); ok && options["format"] == "disabled" {
+				report.add(keyPath, "removed", "fielddata is never loaded on ES8 unless enabled on a text field")
+				continue
+			}
+			if fieldType == "text" {
+				report.add(keyPath, "removed", "fielddata is disabled by default on text fields; set fielddata: true or use a keyword sub-field for aggregations")
+			} else {
+				report.add(keyPath, "removed", "fielddata settings are not supported on "+fieldType+" fields; doc_values are used instead")
+			}
+		case "format":
+			converted[key] = convertDateFormat(keyPath, value, report)
+		case "index_analyzer":
+			if name, _ := value.(string); report.analyzerRemoved(name) {
+				report.add(keyPath, "removed", "analyzer "+name+" no longer exists; the field uses the default analyzer")
+			} else {
+				converted["analyzer"] = value
+				report.add(keyPath, "converted", "index_analyzer renamed to analyzer")
+			}
+		case "position_offset_gap":
+			converted["position_increment_gap"] = value
+			report.add(keyPath, "converted", "position_offset_gap renamed to position_increment_gap")
+		case "analyzer", "search_analyzer", "search_quote_analyzer":
+			name, _ := value.(string)
+			switch {
+			case fieldType == "keyword":
+				report.add(keyPath, "removed", key+" does not apply to keyword fields")
+			case report.analyzerRemoved(name):
+				report.add(keyPath, "removed", "analyzer "+name+" no longer exists; the field uses the default analyzer")
+			default:
+				converted[key] = value
+			}
+		case "position_increment_gap", "index_options", "term_vector":
+			if fieldType == "keyword" {
+				report.add(keyPath, "removed", key+" does not apply to keyword fields")
+			} else {
+				converted[key] = value
+			}
+		case "ignore_above", "null_value":
+			if fieldType == "text" {
+				report.add(keyPath, "removed", key+" does not apply to text fields")
+			} else {
+				converted[key] = value
+			}
+		case "include_in_all":
+			report.add(keyPath, "removed", "_all no longer exists")
+		case "boost":
+			report.add(keyPath, "removed", "index-time boosts are not supported; boost at query time instead")
+		case "precision_step":
+			report.add(keyPath, "removed", "numeric fields are indexed with points and have no precision_step")
+		case "geohash", "geohash_prefix", "geohash_precision", "lat_lon", "validate", "validate_lat", "validate_lon", "normalize", "normalize_lat", "normalize_lon":
+			report.add(keyPath, "removed", "geo_point option not supported on ES8")
+		case "copy_to", "store", "ignore_malformed", "coerce", "similarity", "scaling_factor", "enabled", "dynamic",
+			"include_in_parent", "include_in_root", "eager_global_ordinals", "tree", "precision", "strategy",
+			"analyzed_fields", "max_input_length", "preserve_separators", "preserve_position_increments":
+			converted[key] = value
+		default:
+			report.add(keyPath, "removed", "field option not supported on ES8")
+		}
+	}
+	return converted
+}
+
+// convertStringType maps an ES2 string field to keyword or text according to its index option.
+func convertStringType(path string, field map[string]interface{}, report *Report) string {
+	switch field["index"] {
+	case "not_analyzed":
+		report.add(path, "converted", "not_analyzed string mapped to keyword")
+		return "keyword"
+	case "no":
+		report.add(path, "converted", "unindexed string mapped to keyword with index: false")
+		return "keyword"
+	default:
+		report.add(path, "converted", "analyzed string mapped to text")
+		return "text"
+	}
+}
+
+// convertDateFormat renames the camelCase built-in date formats to their snake_case names.
+func convertDateFormat(path string, value interface{}, report *Report) interface{} {
+	format, ok := value.(string)
+	if !ok {
+		return value
+	}
+	parts := strings.Split(format, "||")
+	for i, part := range parts {
+		if !dateFormatCamelCase.MatchString(part) {
+			continue
+		}
+		var snake strings.Builder
+		for _, r := range part {
+			if r >= 'A' && r <= 'Z' {
+				snake.WriteByte('_')
+				r += 'a' - 'A'
+			}
+			snake.WriteRune(r)
+		}
+		parts[i] = snake.String()
+		report.add(path, "converted", fmt.Sprintf("date format %s renamed to %s", part, parts[i]))
+	}
+	return strings.Join(parts, "||")
+}
+
+// mergeRoot merges the converted mapping of one type into the flattened mapping.
+// A field defined differently by two types keeps its first definition.
+func mergeRoot(merged, root map[string]interface{}, path string, report *Report) {
+	for _, key := range sortedKeys(root) {
+		value := root[key]
+		if key != "properties" {
+			if existing, ok := merged[key]; ok && !reflect.DeepEqual(existing, value) {
+				report.add(path+"."+key, "conflict", "differs between mapping types; keeping the first definition")
+				continue
+			}
+			merged[key] = value
+			continue
+		}
+
+		properties, _ := value.(map[string]interface{})
+		mergedProperties, _ := merged["properties"].(map[string]interface{})
+		if mergedProperties == nil {
+			mergedProperties = map[string]interface{}{}
+			merged["properties"] = mergedProperties
+		}
+		mergeProperties(mergedProperties, properties, path+".properties", report)
+	}
+}
+
+func mergeProperties(merged, properties map[string]interface{}, path string, report *Report) {
+	for _, name := range sortedKeys(properties) {
+		field := properties[name]
+		existing, ok := merged[name]
+		if !ok {
+			merged[name] = field
+			continue
+		}
+
+		// Objects defined by several types are merged field by field
+		existingObject, _ := existing.(map[string]interface{})
+		fieldObject, _ := field.(map[string]interface{})
+		existingProperties, existingIsObject := existingObject["properties"].(map[string]interface{})
+		fieldProperties, fieldIsObject := fieldObject["properties"].(map[string]interface{})
+		if existingIsObject && fieldIsObject {
+			mergeProperties(existingProperties, fieldProperties, path+"."+name+".properties", report)
+			continue
+		}
+
+		if !reflect.DeepEqual(existing, field) {
+			report.add(path+"."+name, "conflict", "field mapped differently by several types; keeping the first definition")
+		}
+	}
+}
+
+// internalSettings are index settings set by the cluster itself, dropped without being reported.
+var internalSettings = map[string]bool{
+	"creation_date": true,
+	"uuid":          true,
+	"version":       true,
+	"provided_name": true,
+}
+
+// convertSettings keeps the index settings that can be carried over to ES8 and converts the analysis chain.
+func convertSettings(settings map[string]interface{}, report *Report) map[string]interface{} {
+	indexSettings, ok := settings["index"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	converted := map[string]interface{}{}
+	for _, key := range sortedKeys(indexSettings) {
+		value := indexSettings[key]
+		switch {
+		case key == "number_of_shards", key == "number_of_replicas", key == "refresh_interval", key == "max_result_window":
+			converted[key] = value
+		case key == "analysis":
+			if analysis, ok := value.(map[string]interface{}); ok {
+				converted[key] = convertAnalysis("settings.index.analysis", analysis, report)
+			} else {
+				report.add("settings.index.analysis", "removed", "analysis settings are not an object")
+			}
+		case internalSettings[key]:
+		default:
+			report.add("settings.index."+key, "removed", "index setting not carried over to the target")
+		}
+	}
+	return map[string]interface{}{"index": converted}
+}
+
+// renamedAnalysisTypes are tokenizer and token filter types renamed since ES2.
+var renamedAnalysisTypes = map[string]string{
+	"nGram":                    "ngram",
+	"edgeNGram":                "edge_ngram",
+	"delimited_payload_filter": "delimited_payload",
+}
+
+// removedAnalyzerTypes are built-in analyzers of ES2 that no longer exist.
+var removedAnalyzerTypes = map[string]bool{
+	"standard_html_strip": true,
+}
+
+// convertAnalysis renames deprecated tokenizer and filter types, removes the "standard" token filter,
+// which was a no-op and no longer exists, and removes the analyzers of a type that no longer exists.
+// The removed analyzers are recorded in the report, so the fields using them fall back to the default analyzer.
+func convertAnalysis(path string, analysis map[string]interface{}, report *Report) map[string]interface{} {
+	removedFilters := map[string]bool{"standard": true}
+
+	converted := map[string]interface{}{}
+	for _, section := range sortedKeys(analysis) {
+		definitions, ok := analysis[section].(map[string]interface{})
+		if !ok {
+			converted[section] = analysis[section]
+			continue
+		}
+
+		convertedSection := map[string]interface{}{}
+		for _, name := range sortedKeys(definitions) {
+			definition, ok := definitions[name].(map[string]interface{})
+			if !ok {
+				convertedSection[name] = definitions[name]
+				continue
+			}
+			definitionPath := path + "." + section + "." + name
+			definitionType, _ := definition["type"].(string)
+			if section == "filter" && definitionType == "standard" {
+				removedFilters[name] = true
+				report.add(definitionPath, "removed", "the standard token filter no longer exists")
+				continue
+			}
+			if section == "analyzer" && removedAnalyzerTypes[definitionType] {
+				report.removeAnalyzer(name)
+				report.add(definitionPath, "removed", "the "+definitionType+" analyzer no longer exists")
+				continue
+			}
+
+			convertedDefinition := make(map[string]interface{}, len(definition))
+			for key, value := range definition {
+				convertedDefinition[key] = value
+			}
+			if renamed, ok := renamedAnalysisTypes[definitionType]; ok && (section == "filter" || section == "tokenizer") {
+				convertedDefinition["type"] = renamed
+				report.add(definitionPath, "converted", fmt.Sprintf("type %s renamed to %s", definitionType, renamed))
+			}
+			convertedSection[name] = convertedDefinition
+		}
+		converted[section] = convertedSection
+	}
+
+	// Drop references to removed filters from the analyzers
+	analyzers, _ := converted["analyzer"].(map[string]interface{})
+	for _, name := range sortedKeys(analyzers) {
+		analyzer, _ := analyzers[name].(map[string]interface{})
+		filters, ok := analyzer["filter"].([]interface{})
+		if !ok {
+			continue
+		}
+		kept := make([]interface{}, 0, len(filters))
+		for _, filter := range filters {
+			if filterName, _ := filter.(string); removedFilters[filterName] {
+				report.add(path+".analyzer."+name+".filter", "removed", "reference to removed filter "+filterName)
+				continue
+			}
+			kept = append(kept, filter)
+		}
+		analyzer["filter"] = kept
+	}
+	return converted
+}
+
+// sortedKeys returns the keys of a map in order, so conversions and reports are deterministic.
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,361 @@
+package mapping
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// decode parses a JSON object of a test case.
+func decode(t *testing.T, data string) map[string]interface{} {
+	t.Helper()
+	if data == "" {
+		return nil
+	}
+	var value map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		t.Fatalf("invalid JSON %s: %v", data, err)
+	}
+	return value
+}
+
+func checkChanges(t *testing.T, report *Report, want []Change) {
+	t.Helper()
+	if len(report.Changes) == 0 && len(want) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(report.Changes, want) {
+		t.Errorf("changes = %+v\nwant %+v", report.Changes, want)
+	}
+}
+
+func TestConvertField(t *testing.T) {
+	const path = "mappings.doc.properties.f"
+	tests := []struct {
+		name    string
+		field   string
+		want    string
+		changes []Change
+	}{
+		{
+			name:    "analyzed string",
+			field:   `{"type": "string", "analyzer": "english"}`,
+			want:    `{"type": "text", "analyzer": "english"}`,
+			changes: []Change{{path, "converted", "analyzed string mapped to text"}},
+		},
+		{
+			name:    "not analyzed string",
+			field:   `{"type": "string", "index": "not_analyzed", "ignore_above": 256, "doc_values": true}`,
+			want:    `{"type": "keyword", "ignore_above": 256, "doc_values": true}`,
+			changes: []Change{{path, "converted", "not_analyzed string mapped to keyword"}},
+		},
+		{
+			name:    "unindexed string",
+			field:   `{"type": "string", "index": "no"}`,
+			want:    `{"type": "keyword", "index": false}`,
+			changes: []Change{{path, "converted", "unindexed string mapped to keyword with index: false"}},
+		},
+		{
+			name:  "multi-field",
+			field: `{"type": "string", "fields": {"raw": {"type": "string", "index": "not_analyzed"}}}`,
+			want:  `{"type": "text", "fields": {"raw": {"type": "keyword"}}}`,
+			changes: []Change{
+				{path, "converted", "analyzed string mapped to text"},
+				{path + ".fields.raw", "converted", "not_analyzed string mapped to keyword"},
+			},
+		},
+		{
+			name:  "object",
+			field: `{"properties": {"name": {"type": "string", "index": "not_analyzed"}, "age": {"type": "integer"}}}`,
+			want:  `{"properties": {"name": {"type": "keyword"}, "age": {"type": "integer"}}}`,
+			changes: []Change{
+				{path + ".properties.name", "converted", "not_analyzed string mapped to keyword"},
+			},
+		},
+		{
+			name:    "not analyzed number",
+			field:   `{"type": "long", "index": "not_analyzed"}`,
+			want:    `{"type": "long"}`,
+			changes: []Change{{path + ".index", "converted", "index: not_analyzed replaced by the default index: true"}},
+		},
+		{
+			name:  "doc_values on text",
+			field: `{"type": "string", "doc_values": false}`,
+			want:  `{"type": "text"}`,
+			changes: []Change{
+				{path, "converted", "analyzed string mapped to text"},
+				{path + ".doc_values", "removed", "text fields have no doc_values"},
+			},
+		},
+		{
+			name:  "disabled fielddata",
+			field: `{"type": "string", "fielddata": {"format": "disabled"}}`,
+			want:  `{"type": "text"}`,
+			changes: []Change{
+				{path, "converted", "analyzed string mapped to text"},
+				{path + ".fielddata", "removed", "fielddata is never loaded on ES8 unless enabled on a text field"},
+			},
+		},
+		{
+			name:  "fielddata on text",
+			field: `{"type": "string", "fielddata": {"loading": "eager"}}`,
+			want:  `{"type": "text"}`,
+			changes: []Change{
+				{path, "converted", "analyzed string mapped to text"},
+				{path + ".fielddata", "removed", "fielddata is disabled by default on text fields; set fielddata: true or use a keyword sub-field for aggregations"},
+			},
+		},
+		{
+			name:    "fielddata on number",
+			field:   `{"type": "double", "fielddata": {"format": "array"}, "doc_values": true}`,
+			want:    `{"type": "double", "doc_values": true}`,
+			changes: []Change{{path + ".fielddata", "removed", "fielddata settings are not supported on double fields; doc_values are used instead"}},
+		},
+		{
+			name:  "norms enabled",
+			field: `{"type": "string", "norms": {"enabled": false}}`,
+			want:  `{"type": "text", "norms": false}`,
+			changes: []Change{
+				{path, "converted", "analyzed string mapped to text"},
+			},
+		},
+		{
+			name:  "norms loading",
+			field: `{"type": "string", "norms": {"enabled": true, "loading": "eager"}}`,
+			want:  `{"type": "text", "norms": true}`,
+			changes: []Change{
+				{path, "converted", "analyzed string mapped to text"},
+				{path + ".norms.loading", "removed", "norms option not supported on ES8"},
+			},
+		},
+		{
+			name:  "norms without enabled",
+			field: `{"type": "string", "norms": {"loading": "lazy"}}`,
+			want:  `{"type": "text"}`,
+			changes: []Change{
+				{path, "converted", "analyzed string mapped to text"},
+				{path + ".norms.loading", "removed", "norms option not supported on ES8"},
+			},
+		},
+		{
+			name:  "keyword analyzer",
+			field: `{"type": "string", "index": "not_analyzed", "analyzer": "standard"}`,
+			want:  `{"type": "keyword"}`,
+			changes: []Change{
+				{path, "converted", "not_analyzed string mapped to keyword"},
+				{path + ".analyzer", "removed", "analyzer does not apply to keyword fields"},
+			},
+		},
+		{
+			name:  "removed built-in analyzer",
+			field: `{"type": "string", "analyzer": "standard_html_strip", "search_analyzer": "standard"}`,
+			want:  `{"type": "text", "search_analyzer": "standard"}`,
+			changes: []Change{
+				{path, "converted", "analyzed string mapped to text"},
+				{path + ".analyzer", "removed", "analyzer standard_html_strip no longer exists; the field uses the default analyzer"},
+			},
+		},
+		{
+			name:  "renamed options",
+			field: `{"type": "string", "index_analyzer": "english", "position_offset_gap": 100}`,
+			want:  `{"type": "text", "analyzer": "english", "position_increment_gap": 100}`,
+			changes: []Change{
+				{path, "converted", "analyzed string mapped to text"},
+				{path + ".index_analyzer", "converted", "index_analyzer renamed to analyzer"},
+				{path + ".position_offset_gap", "converted", "position_offset_gap renamed to position_increment_gap"},
+			},
+		},
+		{
+			name:  "date format",
+			field: `{"type": "date", "format": "dateOptionalTime||epoch_millis"}`,
+			want:  `{"type": "date", "format": "date_optional_time||epoch_millis"}`,
+			changes: []Change{
+				{path + ".format", "converted", "date format dateOptionalTime renamed to date_optional_time"},
+			},
+		},
+		{
+			name:  "removed options",
+			field: `{"type": "integer", "include_in_all": false, "boost": 2, "precision_step": 8, "store": true}`,
+			want:  `{"type": "integer", "store": true}`,
+			changes: []Change{
+				{path + ".boost", "removed", "index-time boosts are not supported; boost at query time instead"},
+				{path + ".include_in_all", "removed", "_all no longer exists"},
+				{path + ".precision_step", "removed", "numeric fields are indexed with points and have no precision_step"},
+			},
+		},
+		{
+			name:  "geo_point options",
+			field: `{"type": "geo_point", "geohash": true, "lat_lon": true}`,
+			want:  `{"type": "geo_point"}`,
+			changes: []Change{
+				{path + ".geohash", "removed", "geo_point option not supported on ES8"},
+				{path + ".lat_lon", "removed", "geo_point option not supported on ES8"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mappings := map[string]interface{}{"doc": map[string]interface{}{"properties": map[string]interface{}{"f": decode(t, tt.field)}}}
+			definition, report := Convert(mappings, nil)
+
+			want := map[string]interface{}{"properties": map[string]interface{}{"f": decode(t, tt.want)}}
+			if !reflect.DeepEqual(definition.Mappings, want) {
+				t.Errorf("mappings = %v, want %v", definition.Mappings, want)
+			}
+			checkChanges(t, report, tt.changes)
+		})
+	}
+}
+
+func TestConvertRoot(t *testing.T) {
+	mappings := decode(t, `{
+		"_default_": {"_all": {"enabled": false}},
+		"doc": {
+			"_all": {"enabled": false},
+			"_timestamp": {"enabled": true},
+			"_ttl": {"enabled": true, "default": "1d"},
+			"_parent": {"type": "user"},
+			"_source": {"excludes": ["secret"]},
+			"_size": {"enabled": true},
+			"dynamic": "strict",
+			"dynamic_templates": [{"strings": {"match_mapping_type": "string", "mapping": {"type": "string", "index": "not_analyzed"}}}],
+			"properties": {"a": {"type": "long"}}
+		}
+	}`)
+	definition, report := Convert(mappings, nil)
+
+	want := decode(t, `{
+		"_source": {"excludes": ["secret"]},
+		"dynamic": "strict",
+		"dynamic_templates": [{"strings": {"match_mapping_type": "string", "mapping": {"type": "keyword"}}}],
+		"properties": {"a": {"type": "long"}}
+	}`)
+	if !reflect.DeepEqual(definition.Mappings, want) {
+		t.Errorf("mappings = %v, want %v", definition.Mappings, want)
+	}
+	checkChanges(t, report, []Change{
+		{"mappings._default_", "removed", "the _default_ mapping is not supported; use an index template instead"},
+		{"mappings.doc._all", "removed", "_all no longer exists; use copy_to to a custom field if full-text search across fields is needed"},
+		{"mappings.doc._parent", "removed", "parent/child relations must be remodelled with a join field"},
+		{"mappings.doc._size", "removed", "meta field or root option not supported on ES8"},
+		{"mappings.doc._timestamp", "removed", "_timestamp no longer exists; store the value in a regular field"},
+		{"mappings.doc._ttl", "removed", "_ttl no longer exists; store the value in a regular field"},
+		{"mappings.doc.dynamic_templates.strings.mapping", "converted", "not_analyzed string mapped to keyword"},
+	})
+}
+
+func TestConvertTypeless(t *testing.T) {
+	mappings := decode(t, `{"properties": {"a": {"type": "keyword"}, "b": {"type": "text", "fielddata": true}}}`)
+	definition, report := Convert(mappings, nil)
+	if want := decode(t, `{"properties": {"a": {"type": "keyword"}, "b": {"type": "text"}}}`); !reflect.DeepEqual(definition.Mappings, want) {
+		t.Errorf("mappings = %v, want %v", definition.Mappings, want)
+	}
+	checkChanges(t, report, []Change{
+		{"mappings.properties.b.fielddata", "removed", "fielddata is disabled by default on text fields; set fielddata: true or use a keyword sub-field for aggregations"},
+	})
+}
+
+func TestConvertMergesTypes(t *testing.T) {
+	mappings := decode(t, `{
+		"event": {
+			"dynamic": "strict",
+			"properties": {
+				"message": {"type": "string"},
+				"status": {"type": "string", "index": "not_analyzed"},
+				"user": {"properties": {"name": {"type": "string", "index": "not_analyzed"}}}
+			}
+		},
+		"metric": {
+			"dynamic": true,
+			"properties": {
+				"message": {"type": "string"},
+				"status": {"type": "integer"},
+				"value": {"type": "double"},
+				"user": {"properties": {"id": {"type": "long"}}}
+			}
+		}
+	}`)
+	definition, report := Convert(mappings, nil)
+
+	want := decode(t, `{
+		"dynamic": "strict",
+		"properties": {
+			"message": {"type": "text"},
+			"status": {"type": "keyword"},
+			"value": {"type": "double"},
+			"user": {"properties": {"name": {"type": "keyword"}, "id": {"type": "long"}}}
+		}
+	}`)
+	if !reflect.DeepEqual(definition.Mappings, want) {
+		t.Errorf("mappings = %v, want %v", definition.Mappings, want)
+	}
+	checkChanges(t, report, []Change{
+		{"mappings.event.properties.message", "converted", "analyzed string mapped to text"},
+		{"mappings.event.properties.status", "converted", "not_analyzed string mapped to keyword"},
+		{"mappings.event.properties.user.properties.name", "converted", "not_analyzed string mapped to keyword"},
+		{"mappings.metric.properties.message", "converted", "analyzed string mapped to text"},
+		{"mappings.metric.dynamic", "conflict", "differs between mapping types; keeping the first definition"},
+		{"mappings.metric.properties.status", "conflict", "field mapped differently by several types; keeping the first definition"},
+		{"mappings", "merged", "mapping types event, metric flattened into one typeless mapping"},
+	})
+}
+
+func TestConvertSettings(t *testing.T) {
+	settings := decode(t, `{"index": {
+		"number_of_shards": "5",
+		"number_of_replicas": "1",
+		"creation_date": "1500000000000",
+		"uuid": "abc",
+		"version": {"created": "2040699"},
+		"cache": {"query_cache": {"enabled": "true"}},
+		"analysis": {
+			"filter": {
+				"std": {"type": "standard"},
+				"grams": {"type": "edgeNGram", "min_gram": 2, "max_gram": 5},
+				"payloads": {"type": "delimited_payload_filter"}
+			},
+			"tokenizer": {"grams": {"type": "nGram"}},
+			"analyzer": {
+				"autocomplete": {"type": "custom", "tokenizer": "standard", "filter": ["std", "lowercase", "grams"]},
+				"html": {"type": "standard_html_strip"}
+			}
+		}
+	}}`)
+	mappings := decode(t, `{"doc": {"properties": {
+		"title": {"type": "string", "analyzer": "html", "search_analyzer": "autocomplete"}
+	}}}`)
+	definition, report := Convert(mappings, settings)
+
+	wantSettings := decode(t, `{"index": {
+		"number_of_shards": "5",
+		"number_of_replicas": "1",
+		"analysis": {
+			"filter": {
+				"grams": {"type": "edge_ngram", "min_gram": 2, "max_gram": 5},
+				"payloads": {"type": "delimited_payload"}
+			},
+			"tokenizer": {"grams": {"type": "ngram"}},
+			"analyzer": {
+				"autocomplete": {"type": "custom", "tokenizer": "standard", "filter": ["lowercase", "grams"]}
+			}
+		}
+	}}`)
+	if !reflect.DeepEqual(definition.Settings, wantSettings) {
+		t.Errorf("settings = %v, want %v", definition.Settings, wantSettings)
+	}
+	wantMappings := decode(t, `{"properties": {"title": {"type": "text", "search_analyzer": "autocomplete"}}}`)
+	if !reflect.DeepEqual(definition.Mappings, wantMappings) {
+		t.Errorf("mappings = %v, want %v", definition.Mappings, wantMappings)
+	}
+	checkChanges(t, report, []Change{
+		{"settings.index.analysis.analyzer.html", "removed", "the standard_html_strip analyzer no longer exists"},
+		{"settings.index.analysis.filter.grams", "converted", "type edgeNGram renamed to edge_ngram"},
+		{"settings.index.analysis.filter.payloads", "converted", "type delimited_payload_filter renamed to delimited_payload"},
+		{"settings.index.analysis.filter.std", "removed", "the standard token filter no longer exists"},
+		{"settings.index.analysis.tokenizer.grams", "converted", "type nGram renamed to ngram"},
+		{"settings.index.analysis.analyzer.autocomplete.filter", "removed", "reference to removed filter std"},
+		{"settings.index.cache", "removed", "index setting not carried over to the target"},
+		{"mappings.doc.properties.title", "converted", "analyzed string mapped to text"},
+		{"mappings.doc.properties.title.analyzer", "removed", "analyzer html no longer exists; the field uses the default analyzer"},
+	})
+}
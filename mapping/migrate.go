@@ -0,0 +1,171 @@
+package mapping
+
+import (
+	"bytes"
+	"context"
+	"elkmigration/clients"
+	"elkmigration/logger"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Router returns the target index of a source mapping type, and the field to add to hold the type, if any.
+type Router func(typeName string) (index, typeField string)
+
+// BuildDefinitions reads the mappings and settings of the source index and converts them into one
+// definition per target index, grouping the mapping types as routed. When from matches several indices
+// (an alias or wildcard) their mappings are flattened together and the settings of the first index,
+// by name, are used.
+func BuildDefinitions(ctx context.Context, source clients.ElasticsearchClient, from string, route Router) (map[string]*IndexDefinition, *Report, error) {
+	admin, ok := source.(clients.IndexAdmin)
+	if !ok {
+		return nil, nil, fmt.Errorf("source client %T cannot read index definitions", source)
+	}
+
+	metadata, err := admin.IndexMetadata(ctx, from)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read source index definition: %w", err)
+	}
+	if len(metadata) == 0 {
+		return nil, nil, errors.New("no source index matches " + from)
+	}
+
+	indices := make([]string, 0, len(metadata))
+	for index := range metadata {
+		indices = append(indices, index)
+	}
+	sort.Strings(indices)
+
+	// Group the mapping types by target index, keyed like the types of one index so they are flattened
+	groups := map[string]map[string]interface{}{}
+	typeFields := map[string]string{}
+	addType := func(target, typeField, key string, mapping interface{}) {
+		if groups[target] == nil {
+			groups[target] = map[string]interface{}{}
+		}
+		groups[target][key] = mapping
+		if typeField != "" {
+			typeFields[target] = typeField
+		}
+	}
+	defaultIndex, _ := route("")
+	for _, index := range indices {
+		prefix := ""
+		if len(indices) > 1 {
+			prefix = index + "/"
+		}
+		indexMappings := metadata[index].Mappings
+		if _, typeless := indexMappings["properties"]; typeless || len(indexMappings) == 0 {
+			addType(defaultIndex, "", strings.TrimSuffix(prefix, "/"), indexMappings)
+			continue
+		}
+		for typeName, typeMapping := range indexMappings {
+			target, typeField := defaultIndex, ""
+			if typeName != "_default_" {
+				target, typeField = route(typeName)
+			}
+			addType(target, typeField, prefix+typeName, typeMapping)
+		}
+	}
+
+	// A single typeless index converts as is
+	if len(indices) == 1 && len(groups) == 1 {
+		if _, typeless := metadata[indices[0]].Mappings["properties"]; typeless {
+			groups[defaultIndex] = metadata[indices[0]].Mappings
+		}
+	}
+
+	settings := metadata[indices[0]].Settings
+	definitions := make(map[string]*IndexDefinition, len(groups))
+	report := &Report{}
+	for target, mappings := range groups {
+		definition, targetReport := Convert(mappings, settings)
+		if typeField := typeFields[target]; typeField != "" {
+			addTypeField(definition, typeField, targetReport)
+		}
+		for _, change := range targetReport.Changes {
+			if len(groups) > 1 {
+				change.Path = target + ":" + change.Path
+			}
+			report.Changes = append(report.Changes, change)
+		}
+		definitions[target] = definition
+	}
+	sort.SliceStable(report.Changes, func(i, j int) bool { return report.Changes[i].Path < report.Changes[j].Path })
+	return definitions, report, nil
+}
+
+// addTypeField maps the synthetic field holding the ES2 _type of documents merged into one index.
+func addTypeField(definition *IndexDefinition, typeField string, report *Report) {
+	if definition.Mappings == nil {
+		definition.Mappings = map[string]interface{}{}
+	}
+	properties, ok := definition.Mappings["properties"].(map[string]interface{})
+	if !ok {
+		properties = map[string]interface{}{}
+		definition.Mappings["properties"] = properties
+	}
+	if _, exists := properties[typeField]; exists {
+		report.add("mappings.properties."+typeField, "conflict", "the type field already exists in the source mapping and is overwritten with the document type")
+	}
+	properties[typeField] = map[string]interface{}{"type": "keyword"}
+	report.add("mappings.properties."+typeField, "added", "keyword field holding the ES2 mapping type")
+}
+
+// CreateTargetIndex creates the target indices from the converted definition of the source index,
+// skipping those that already exist. The conversion report is logged and, if reportFile is set, saved as JSON.
+func CreateTargetIndex(ctx context.Context, source, target clients.ElasticsearchClient, from string, route Router, reportFile string) error {
+	admin, ok := target.(clients.IndexAdmin)
+	if !ok {
+		return fmt.Errorf("target client %T cannot create indices", target)
+	}
+	if _, typed := target.(*clients.ES2Client); typed {
+		return errors.New("converted index definitions are typeless and cannot be created on an ES2 target")
+	}
+
+	definitions, report, err := BuildDefinitions(ctx, source, from, route)
+	if err != nil {
+		return err
+	}
+	report.Log()
+	if reportFile != "" {
+		if err := report.WriteFile(reportFile); err != nil {
+			logger.Warn("Failed to write mapping report", zap.String("file", reportFile), zap.Error(err))
+		}
+	}
+
+	for _, index := range sortedDefinitionKeys(definitions) {
+		exists, err := admin.IndexExists(ctx, index)
+		if err != nil {
+			return fmt.Errorf("error checking if index exists: %w", err)
+		}
+		if exists {
+			logger.Info("Target index already exists, keeping its mappings", zap.String("index", index))
+			continue
+		}
+
+		body, err := json.Marshal(definitions[index])
+		if err != nil {
+			return err
+		}
+		if err := admin.CreateIndex(ctx, index, bytes.NewReader(body)); err != nil {
+			return err
+		}
+		logger.Info("Created target index from source mappings", zap.String("index", index))
+	}
+	return nil
+}
+
+func sortedDefinitionKeys(definitions map[string]*IndexDefinition) []string {
+	keys := make([]string, 0, len(definitions))
+	for key := range definitions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
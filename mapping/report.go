@@ -0,0 +1,61 @@
+package mapping
+
+import (
+	"elkmigration/logger"
+	"encoding/json"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+// Change is one lossy or notable conversion made to the index definition.
+type Change struct {
+	Path   string `json:"path"`   // mapping or settings path, e.g. "mappings.properties.title"
+	Action string `json:"action"` // what was done: converted, removed, merged, conflict
+	Detail string `json:"detail"` // human-readable explanation
+}
+
+// Report lists every change made while converting an index definition.
+type Report struct {
+	Changes []Change `json:"changes"`
+
+	removedAnalyzers map[string]bool // custom analyzers removed from the settings, referenced by the mappings
+}
+
+func (r *Report) add(path, action, detail string) {
+	r.Changes = append(r.Changes, Change{Path: path, Action: action, Detail: detail})
+}
+
+// removeAnalyzer records a custom analyzer removed from the analysis settings.
+func (r *Report) removeAnalyzer(name string) {
+	if r.removedAnalyzers == nil {
+		r.removedAnalyzers = map[string]bool{}
+	}
+	r.removedAnalyzers[name] = true
+}
+
+// analyzerRemoved reports whether a field referencing the named analyzer must drop the reference:
+// the custom analyzer was removed, or it is a built-in analyzer that no longer exists.
+func (r *Report) analyzerRemoved(name string) bool {
+	return r.removedAnalyzers[name] || removedAnalyzerTypes[name]
+}
+
+// Log writes every change to the logger.
+func (r *Report) Log() {
+	if len(r.Changes) == 0 {
+		logger.Info("Index definition converted without changes")
+		return
+	}
+	for _, change := range r.Changes {
+		logger.Warn("Index definition changed", zap.String("path", change.Path), zap.String("action", change.Action), zap.String("detail", change.Detail))
+	}
+}
+
+// WriteFile saves the report as JSON.
+func (r *Report) WriteFile(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
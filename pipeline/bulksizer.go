@@ -0,0 +1,88 @@
+package pipeline
+
+import (
+	"elkmigration/config"
+	"elkmigration/logger"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	retryInitialDelay = 1 * time.Second  // First backoff delay when retrying a bulk request
+	retryMaxDelay     = 60 * time.Second // Upper bound of the backoff delay
+)
+
+// BulkSizer adapts the bulk request payload size to how the target keeps up.
+// The target size shrinks on rejections and slow responses and grows while requests
+// complete well under the latency goal, staying within [minBytes, maxBytes].
+// It is shared by all import workers since they write to the same cluster.
+type BulkSizer struct {
+	minBytes      int
+	maxBytes      int
+	targetLatency time.Duration
+
+	mu     sync.Mutex
+	target int
+}
+
+// NewBulkSizer creates a BulkSizer from the BULK_MIN_BYTES, BULK_MAX_BYTES and BULK_TARGET_LATENCY settings.
+// It starts at the minimum size and grows from there.
+func NewBulkSizer(config *config.Config) (*BulkSizer, error) {
+	targetLatency, err := time.ParseDuration(config.BulkTargetLatency)
+	if err != nil {
+		return nil, fmt.Errorf("invalid BULK_TARGET_LATENCY: %w", err)
+	}
+	if config.BulkMinBytes <= 0 || config.BulkMaxBytes < config.BulkMinBytes {
+		return nil, fmt.Errorf("invalid bulk byte window [%d, %d]", config.BulkMinBytes, config.BulkMaxBytes)
+	}
+	return &BulkSizer{
+		minBytes:      config.BulkMinBytes,
+		maxBytes:      config.BulkMaxBytes,
+		targetLatency: targetLatency,
+		target:        config.BulkMinBytes,
+	}, nil
+}
+
+// Target returns the current payload size, in bytes, at which a batch should be sent.
+func (s *BulkSizer) Target() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.target
+}
+
+// Observe records the outcome of a bulk request of the given size and adjusts the target.
+func (s *BulkSizer) Observe(size int, latency time.Duration, rejected bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous := s.target
+	switch {
+	case rejected:
+		s.target /= 2
+	case latency > s.targetLatency:
+		s.target = s.target * 3 / 4
+	case latency < s.targetLatency/2 && size >= s.target/2:
+		// Only grow on requests that were near the target, not on small trailing batches
+		s.target = s.target * 5 / 4
+	}
+	s.target = min(max(s.target, s.minBytes), s.maxBytes)
+
+	if s.target < previous {
+		logger.Info("Reducing bulk size", zap.Int("bytes", s.target), zap.Duration("latency", latency), zap.Bool("rejected", rejected))
+	}
+}
+
+// retryBackoff returns the delay before retry attempt n (0-based):
+// exponential growth from retryInitialDelay capped at retryMaxDelay, with jitter
+// so that concurrent workers do not retry in lockstep.
+func retryBackoff(attempt int) time.Duration {
+	delay := retryMaxDelay
+	if attempt < 6 {
+		delay = min(retryInitialDelay<<attempt, retryMaxDelay)
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,197 @@
+package pipeline
+
+import (
+	"context"
+	"elkmigration/clients"
+	"elkmigration/config"
+	"elkmigration/logger"
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Checkpoint is the export position saved to the checkpoint store.
+type Checkpoint struct {
+	LastID   string // _id of the last document durably written to the target
+	ScrollID string // scroll ID of the page that document came from, or its point in time in sorted mode on ES8
+	Count    int    // number of documents durably written so far
+
+	// SortValues are the sort values of that document in sorted export mode.
+	// A restart queries for documents sorting strictly after them.
+	SortValues []interface{}
+
+	// File and Offset locate the end of that document in a file source: the file it was read from
+	// and the uncompressed byte offset right after it.
+	File   string
+	Offset int64
+}
+
+// checkpointRecord is the checkpoint of a slice as saved to the store: one JSON value, written at once
+// so a reader never sees the position of one document with the count of another.
+type checkpointRecord struct {
+	Source     string                 `json:"source"`
+	Target     string                 `json:"target"`
+	LastID     string                 `json:"last_id"`
+	ScrollID   string                 `json:"scroll_id,omitempty"`
+	Count      int                    `json:"count"`
+	SortValues []interface{}          `json:"sort_values,omitempty"`
+	File       string                 `json:"file,omitempty"`
+	Offset     int64                  `json:"offset,omitempty"`
+	LastDoc    map[string]interface{} `json:"last_doc,omitempty"`
+	SavedAt    time.Time              `json:"saved_at"`
+}
+
+// LoadCheckpoint reads the last committed checkpoint of a slice from the store.
+// A zero Checkpoint is returned when no migration state has been saved yet.
+func LoadCheckpoint(ctx context.Context, store clients.CheckpointStore, config *config.Config, slice Slice) (Checkpoint, error) {
+	var record checkpointRecord
+	if err := store.GetJSON(ctx, checkpointKey(config, slice), &record); err != nil {
+		if errors.Is(err, clients.ErrNotFound) {
+			return Checkpoint{}, nil
+		}
+		return Checkpoint{}, err
+	}
+	return Checkpoint{LastID: record.LastID, ScrollID: record.ScrollID, Count: record.Count, SortValues: record.SortValues, File: record.File, Offset: record.Offset}, nil
+}
+
+// ResetCheckpoint deletes the saved checkpoints of every index and slice of the job,
+// whatever they were saved with, so the next migration starts over.
+func ResetCheckpoint(ctx context.Context, store clients.CheckpointStore, config *config.Config) ([]string, error) {
+	keys, err := store.Keys(ctx, clients.NewNamespace(config).Checkpoints())
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Delete(ctx, keys...); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// pendingDocument is a document handed to the pipeline but not yet acknowledged by the target.
+type pendingDocument struct {
+	position Checkpoint
+	source   map[string]interface{}
+	acked    bool
+}
+
+// CheckpointTracker commits export checkpoints once the import stage acknowledges them.
+// Documents are numbered in export order and the committed position is the low watermark:
+// the last document for which it and every document before it have been acknowledged.
+// Resuming from it never skips a document that has not reached the target.
+type CheckpointTracker struct {
+	store  clients.CheckpointStore
+	key    string
+	source string
+	target string
+
+	base int // documents already committed when tracking started
+
+	mu        sync.Mutex
+	next      uint64 // sequence number of the next tracked document
+	watermark uint64 // every sequence number below this is acknowledged
+	pending   map[uint64]*pendingDocument
+	committed Checkpoint
+}
+
+// NewCheckpointTracker starts tracking a slice from the given committed checkpoint.
+func NewCheckpointTracker(store clients.CheckpointStore, config *config.Config, slice Slice, committed Checkpoint) *CheckpointTracker {
+	return &CheckpointTracker{
+		store:     store,
+		key:       checkpointKey(config, slice),
+		source:    config.ElkIndexFrom,
+		target:    config.ElkIndexTo,
+		base:      committed.Count,
+		pending:   make(map[uint64]*pendingDocument),
+		committed: committed,
+	}
+}
+
+// Track registers an exported document with the position it was read at.
+// The tracker fills in the LastID and Count of the position.
+// The document is acknowledged through doc.Ack once the target has accepted it.
+func (t *CheckpointTracker) Track(doc *Document, position Checkpoint) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	doc.seq = t.next
+	doc.tracker = t
+	t.next++
+
+	position.LastID = doc.ID
+	position.Count = t.base + int(doc.seq) + 1
+	t.pending[doc.seq] = &pendingDocument{
+		position: position,
+		source:   doc.Source,
+	}
+}
+
+// Ack marks documents as durably written and commits the new low watermark, if it moved.
+func (t *CheckpointTracker) Ack(seqs ...uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, seq := range seqs {
+		if pending, ok := t.pending[seq]; ok {
+			pending.acked = true
+		}
+	}
+
+	var last *pendingDocument
+	for {
+		pending, ok := t.pending[t.watermark]
+		if !ok || !pending.acked {
+			break
+		}
+		delete(t.pending, t.watermark)
+		t.watermark++
+		last = pending
+	}
+	if last == nil {
+		return
+	}
+
+	t.committed = last.position
+	t.save(last)
+}
+
+// Committed returns the last committed checkpoint.
+func (t *CheckpointTracker) Committed() Checkpoint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.committed
+}
+
+// save writes the checkpoint to the store. The caller must hold t.mu.
+func (t *CheckpointTracker) save(last *pendingDocument) {
+	record := checkpointRecord{
+		Source:     t.source,
+		Target:     t.target,
+		LastID:     last.position.LastID,
+		ScrollID:   last.position.ScrollID,
+		Count:      last.position.Count,
+		SortValues: last.position.SortValues,
+		File:       last.position.File,
+		Offset:     last.position.Offset,
+		LastDoc:    last.source,
+		SavedAt:    time.Now(),
+	}
+	if err := t.store.SaveJSON(context.Background(), t.key, record); err != nil {
+		logger.Error("Failed to save checkpoint", zap.String("key", t.key), zap.Error(err))
+	}
+}
+
+// ackDocuments acknowledges a batch of documents written to the target,
+// committing once per tracker rather than once per document.
+func ackDocuments(docs []*Document) {
+	seqs := make(map[*CheckpointTracker][]uint64)
+	for _, doc := range docs {
+		if doc.release() {
+			seqs[doc.tracker] = append(seqs[doc.tracker], doc.seq)
+		}
+	}
+	for tracker, trackerSeqs := range seqs {
+		tracker.Ack(trackerSeqs...)
+	}
+}
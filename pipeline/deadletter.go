@@ -0,0 +1,184 @@
+package pipeline
+
+import (
+	"context"
+	"elkmigration/clients"
+	"elkmigration/config"
+	"elkmigration/logger"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// errDeadLetter is returned when a rejected document could not be written to the dead-letter sink.
+var errDeadLetter = errors.New("failed to write to the dead-letter sink")
+
+// FailedDocument is a document rejected by the target, as written to the dead-letter sink.
+// A line of a source file that could not be parsed has no source, but its file, offset and text;
+// a hit of the source cluster whose _source could not be parsed keeps it as raw text.
+type FailedDocument struct {
+	Index     string                 `json:"index"`
+	ID        string                 `json:"id,omitempty"`
+	Type      string                 `json:"type,omitempty"`
+	Routing   string                 `json:"routing,omitempty"`
+	Status    int                    `json:"status"`
+	ErrorType string                 `json:"error_type"`
+	Reason    string                 `json:"reason"`
+	Source    map[string]interface{} `json:"source"`
+	File      string                 `json:"file,omitempty"`
+	Offset    int64                  `json:"offset,omitempty"`
+	Line      string                 `json:"line,omitempty"`
+	RawSource string                 `json:"raw_source,omitempty"`
+	FailedAt  time.Time              `json:"failed_at"`
+}
+
+// retryable reports whether the target may accept the document when it is sent again later:
+// it was rejected for load, with 429, or by a server error, rather than for its content.
+func (f *FailedDocument) retryable() bool {
+	return f.Status == http.StatusTooManyRequests || f.Status >= http.StatusInternalServerError
+}
+
+// DeadLetterSink stores documents the target refused to index.
+type DeadLetterSink interface {
+	Write(ctx context.Context, failed *FailedDocument) error
+	Close() error
+}
+
+// FileDeadLetter appends failed documents to an NDJSON file.
+type FileDeadLetter struct {
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// NewFileDeadLetter opens (or creates) the NDJSON dead-letter file in append mode.
+func NewFileDeadLetter(path string) (*FileDeadLetter, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dead-letter file: %w", err)
+	}
+	return &FileDeadLetter{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (f *FileDeadLetter) Write(_ context.Context, failed *FailedDocument) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.encoder.Encode(failed)
+}
+
+func (f *FileDeadLetter) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+// RedisDeadLetter pushes failed documents as JSON onto a Redis list.
+type RedisDeadLetter struct {
+	redis *clients.Redis
+	key   string
+}
+
+func NewRedisDeadLetter(redis *clients.Redis, key string) *RedisDeadLetter {
+	return &RedisDeadLetter{redis: redis, key: key}
+}
+
+func (r *RedisDeadLetter) Write(ctx context.Context, failed *FailedDocument) error {
+	return r.redis.PushJSON(ctx, r.key, failed)
+}
+
+func (r *RedisDeadLetter) Close() error {
+	return nil
+}
+
+// DeadLetterQueue records rejected documents to a sink and keeps a per-reason summary for the run.
+type DeadLetterQueue struct {
+	sink DeadLetterSink
+
+	mu        sync.Mutex
+	counts    map[string]int
+	total     int
+	retryable int // documents rejected with a retryable error
+}
+
+// NewDeadLetterQueue builds the dead-letter queue from config.
+// A Redis list is used when DEAD_LETTER_REDIS_KEY is set, otherwise the NDJSON file at DEAD_LETTER_FILE.
+func NewDeadLetterQueue(config *config.Config, redis *clients.Redis) (*DeadLetterQueue, error) {
+	var sink DeadLetterSink
+	if config.DeadLetterRedisKey != "" {
+		sink = NewRedisDeadLetter(redis, config.DeadLetterRedisKey)
+	} else {
+		fileSink, err := NewFileDeadLetter(config.DeadLetterFile)
+		if err != nil {
+			return nil, err
+		}
+		sink = fileSink
+	}
+	return &DeadLetterQueue{sink: sink, counts: make(map[string]int)}, nil
+}
+
+// Add stores a rejected document and counts its failure reason.
+// When the sink cannot store it an error wrapping errDeadLetter is returned: the caller must then
+// leave the document unacknowledged, so the checkpoint does not move past a document that was lost.
+func (q *DeadLetterQueue) Add(ctx context.Context, failed *FailedDocument) error {
+	if err := q.sink.Write(ctx, failed); err != nil {
+		logger.Error("Failed to write document to dead-letter sink", zap.String("id", failed.ID), zap.Error(err))
+		return fmt.Errorf("%w: document %s: %w", errDeadLetter, failed.ID, err)
+	}
+
+	q.mu.Lock()
+	q.counts[failed.ErrorType]++
+	q.total++
+	if failed.retryable() {
+		q.retryable++
+	}
+	q.mu.Unlock()
+	return nil
+}
+
+// Total returns the number of rejected documents recorded so far.
+func (q *DeadLetterQueue) Total() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.total
+}
+
+// retryableTotal returns the number of documents recorded so far that were rejected with a retryable error.
+func (q *DeadLetterQueue) retryableTotal() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.retryable
+}
+
+// LogSummary logs the number of rejected documents grouped by error type.
+func (q *DeadLetterQueue) LogSummary() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.total == 0 {
+		logger.Info("No documents were rejected by the target")
+		return
+	}
+
+	errorTypes := make([]string, 0, len(q.counts))
+	for errorType := range q.counts {
+		errorTypes = append(errorTypes, errorType)
+	}
+	sort.Slice(errorTypes, func(i, j int) bool { return q.counts[errorTypes[i]] > q.counts[errorTypes[j]] })
+
+	logger.Warn("Documents rejected by the target", zap.Int("total", q.total))
+	for _, errorType := range errorTypes {
+		logger.Warn("Rejected documents by reason", zap.String("error_type", errorType), zap.Int("count", q.counts[errorType]))
+	}
+}
+
+// Close closes the underlying sink.
+func (q *DeadLetterQueue) Close() error {
+	return q.sink.Close()
+}
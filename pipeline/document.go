@@ -0,0 +1,84 @@
+package pipeline
+
+import "sync/atomic"
+
+// Document is the envelope passed between the export, transform and import stages.
+// It keeps the source hit metadata next to the document body so the target
+// receives the same _id and routing as the source cluster.
+type Document struct {
+	Index   string                 // target index, ELK_INDEX_TO when empty
+	ID      string                 // source _id
+	Type    string                 // source _type (ES2 mapping type)
+	Routing string                 // source _routing
+	Parent  string                 // source _parent (ES2 parent/child)
+	Version *int64                 // source _version, when returned by the scroll
+	Source  map[string]interface{} // document body (_source)
+
+	position Checkpoint         // where the source read the document, set by the Source
+	seq      uint64             // export sequence number, assigned by the tracker
+	tracker  *CheckpointTracker // commits the export checkpoint once the document is written
+	group    *ackGroup          // documents sharing this export position, when fanned out
+}
+
+// ackGroup holds back the acknowledgement of a document fanned out into several
+// until every one of them has been handled.
+type ackGroup struct {
+	remaining atomic.Int32
+}
+
+// BulkRouting returns the routing value to use on the target.
+// ES2 child documents are routed by their parent ID unless an explicit routing was set.
+func (d *Document) BulkRouting() string {
+	if d.Routing != "" {
+		return d.Routing
+	}
+	return d.Parent
+}
+
+// TargetIndex returns the index the document is written to, defaultIndex unless the transform stage routed it elsewhere.
+func (d *Document) TargetIndex(defaultIndex string) string {
+	if d.Index != "" {
+		return d.Index
+	}
+	return defaultIndex
+}
+
+// Derive returns a new document with the given _id and body, sharing the metadata and the export
+// position of d. The position is acknowledged once d and every document derived from it are handled.
+func (d *Document) Derive(id string, source map[string]interface{}) *Document {
+	if d.group == nil {
+		d.group = &ackGroup{}
+		d.group.remaining.Store(1)
+	}
+	d.group.remaining.Add(1)
+	return &Document{
+		Index:    d.Index,
+		ID:       id,
+		Type:     d.Type,
+		Routing:  d.Routing,
+		Parent:   d.Parent,
+		Version:  d.Version,
+		Source:   source,
+		position: d.position,
+		seq:      d.seq,
+		tracker:  d.tracker,
+		group:    d.group,
+	}
+}
+
+// Ack acknowledges that the document has been durably handled by the target,
+// allowing the export checkpoint to move past it.
+func (d *Document) Ack() {
+	if d.release() {
+		d.tracker.Ack(d.seq)
+	}
+}
+
+// release reports whether acknowledging the document moves its export position,
+// which a fanned out document only does once the last document of its group is handled.
+func (d *Document) release() bool {
+	if d.tracker == nil {
+		return false
+	}
+	return d.group == nil || d.group.remaining.Add(-1) == 0
+}
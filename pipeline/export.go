@@ -5,111 +5,91 @@ import (
 	"elkmigration/clients"
 	"elkmigration/config"
 	"elkmigration/logger"
-	"encoding/json"
+	"fmt"
 	"sync"
 	"time"
 
 	"go.uber.org/zap"
-	"gopkg.in/olivere/elastic.v3"
 )
 
 const (
-	initialDelay = 1 * time.Second
+	exportModeScroll = "scroll" // plain scroll, resumed by skipping up to the last committed _id
+	exportModeSorted = "sorted" // sorted on SORT_FIELD, resumed with a query after the last sort values
 )
 
-// ExportDocuments exports documents from Elasticsearch 2.x, with state-saving to Redis.
-// Accepts a mutex to prevent race conditions when accessing Redis.
-func ExportDocuments(client clients.ElasticsearchClient, config *config.Config, docs chan<- map[string]interface{}, redis *clients.Redis, mu *sync.Mutex) {
-	defer close(docs)
-	
-	var ctx = context.Background()
-
-	es2Client := client.(*clients.ES2Client).Client
-
-	// Retrieve last processed document ID from Redis
+// ExportDocuments exports one slice of the source index through source, with state-saving to the checkpoint store.
+// Accepts a mutex to prevent race conditions when accessing the store.
+// The checkpoint is not saved here: each document is tracked and the import stage
+// commits it once the target has acknowledged the write.
+// Several slices may send to the same docs channel; the caller closes it once every slice has returned.
+// It returns nil once the slice is exhausted, or an error when the source keeps failing or ctx is cancelled.
+func ExportDocuments(ctx context.Context, source Source, config *config.Config, slice Slice, docs chan<- *Document, store clients.CheckpointStore, mu *sync.Mutex) error {
+	// Retrieve the last committed checkpoint from the store
 	mu.Lock()
-	lastID, err := redis.Get(ctx, config.RedisKeyLastID, nil)
-	lastCount, _ := redis.Get(ctx, config.RedisKeyLastCount, 0)
-	lastOffset, _ := redis.Get(ctx, config.RedisKeyLastOffset, nil)
+	checkpoint, err := LoadCheckpoint(ctx, store, config, slice)
 	mu.Unlock()
 
 	if err != nil {
-		logger.Info("Start Process from the Beginning", zap.Error(err))
+		return fmt.Errorf("failed to load checkpoint: %w", err)
+	}
+	if checkpoint.Count == 0 {
+		logger.Info("Start Process from the Beginning", zap.Int("slice", slice.ID))
+	} else {
+		logger.Info("Resuming after last committed document", zap.Int("slice", slice.ID), zap.String("last ID", checkpoint.LastID), zap.Int("last Count", checkpoint.Count))
 	}
 
-	resume := lastID != nil
-
-	scroll := es2Client.Scroll(config.ElkIndexFrom).Size(config.BulkSize).Scroll(config.ScrollTimeout)
+	tracker := NewCheckpointTracker(store, config, slice, checkpoint)
 
-	if lastOffset != nil {
-		scroll = es2Client.Scroll(config.ElkIndexFrom).Size(config.BulkSize).Scroll(config.ScrollTimeout).ScrollId(lastOffset.(string))
+	if err := source.Open(ctx, checkpoint); err != nil {
+		return fmt.Errorf("failed to open source: %w", err)
 	}
+	defer func() {
+		if err := source.Close(); err != nil {
+			logger.Warn("Failed to close source", zap.Int("slice", slice.ID), zap.Error(err))
+		}
+	}()
 
 	for {
-		// Execute scroll with retries and exponential backoff
-		var result *elastic.SearchResult
+		// Read the next batch with retries and exponential backoff
+		var batch []*Document
 		retries := 0
 		for {
-			result, err = scroll.Do()
+			batch, err = source.Next(ctx)
 			if err == nil {
 				break
 			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			if retries >= config.MaxRetries {
-				logger.Error("Max retries reached during scroll execution", zap.Error(err))
-				return
+				return fmt.Errorf("max retries reached during scroll execution: %w", err)
+			}
+			delay := retryBackoff(retries) // Exponential backoff, capped
+			logger.Warn("Scroll execution error, retrying", zap.Int("attempt", retries+1), zap.Duration("delay", delay), zap.Error(err))
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
 			}
-			logger.Warn("Scroll execution error, retrying", zap.Int("attempt", retries+1), zap.Error(err))
-			time.Sleep(time.Duration(1<<retries) * initialDelay) // Exponential backoff
 			retries++
 		}
 
-		// Check if the scroll has reached the end
-		if len(result.Hits.Hits) == 0 {
-			logger.Info("Reached end of index")
-			close(docs)
+		// Check if the source has reached the end
+		if len(batch) == 0 {
+			logger.Info("Reached end of index", zap.Int("slice", slice.ID))
+			return nil
 		}
 
-		for idx, hit := range result.Hits.Hits {
-			// Skip documents until we reach the one after lastID on recovery
-			if resume && hit.Id == lastID {
-				resume = false
-				continue
-			} else if resume {
-				continue
-			}
-
-			// Process the document
-			var doc map[string]interface{}
-			if err := json.Unmarshal(*hit.Source, &doc); err != nil {
-				logger.Warn("Error unmarshalling document", zap.Error(err))
-				continue
+		for idx, doc := range batch {
+			tracker.Track(doc, source.Checkpoint(doc))
+			// Send document to the next stage
+			select {
+			case docs <- doc:
+			case <-ctx.Done():
+				return ctx.Err()
 			}
-			docs <- doc // Send document to the next stage
 
-			// Save the last processed document ID to Redis with a mutex lock
-			mu.Lock()
-			if err := redis.Save(ctx, config.RedisKeyLastID, hit.Id); err != nil {
-				logger.Error("Failed to save last ID to Redis", zap.Error(err))
-			}
-
-			if err := redis.Save(ctx, config.RedisKeyLastOffset, result.ScrollId); err != nil {
-				logger.Error("Failed to save last Offset to Redis", zap.Error(err))
-			}
-
-			lastCount = lastCount.(int) + 1
-			if err := redis.Save(ctx, config.RedisKeyLastCount, lastCount); err != nil {
-				logger.Error("Failed to save last Offset to Redis", zap.Error(err))
-			}
-
-			if err := redis.SaveJSON(ctx, config.RedisKeyLastDoc, doc); err != nil {
-				logger.Error("Failed to save last Doc to Redis", zap.Error(err))
-			}
-			mu.Unlock()
-
-			logger.Info("Exported document", zap.Int("idx", idx), zap.String("hit ID", hit.Id), zap.Any("last Count", lastCount), zap.String("last Doc ", "in your redis..."), zap.Any("last scrollID (offset)", result.ScrollId))
+			logger.Info("Exported document", zap.Int("slice", slice.ID), zap.Int("idx", idx), zap.String("hit ID", doc.ID), zap.Int("committed Count", tracker.Committed().Count))
 		}
-
-		// Update the scroll with the current scroll ID
-		scroll = es2Client.Scroll(config.ElkIndexFrom).Size(config.BulkSize).ScrollId(result.ScrollId).Scroll(config.ScrollTimeout)
 	}
 }
@@ -0,0 +1,373 @@
+package pipeline
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"elkmigration/config"
+	"elkmigration/logger"
+	"elkmigration/utils"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
+)
+
+// Sink types, selected with SINK_TYPE
+const (
+	SinkElasticsearch = "elasticsearch"
+	SinkFile          = "file"
+)
+
+// ManifestFile is the name of the manifest in FILE_SINK_DIR.
+const ManifestFile = "manifest.json"
+
+// fileBatchBytes caps the NDJSON a file sink buffers before writing it, next to BULK_SIZE documents.
+const fileBatchBytes = 8 * 1024 * 1024
+
+// compressionExtensions maps the supported FILE_SINK_COMPRESSION values to the extension of the part files.
+var compressionExtensions = map[string]string{
+	"none": "",
+	"gzip": ".gz",
+	"zstd": ".zst",
+}
+
+// FileManifest lists the part files of FILE_SINK_DIR. It is replaced atomically after every batch,
+// so it never lists a document that is not on disk.
+type FileManifest struct {
+	Documents int         `json:"documents"`
+	Parts     []*FilePart `json:"parts"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// FilePart is an NDJSON file of DocumentRecord lines. Bytes and SHA256 cover the file up to its last batch.
+type FilePart struct {
+	File        string    `json:"file"`
+	Index       string    `json:"index"` // ELK_INDEX_TO of the sink which wrote it; each line names its own _index
+	Compression string    `json:"compression"`
+	Documents   int       `json:"documents"`
+	Bytes       int64     `json:"bytes"`
+	SHA256      string    `json:"sha256"`
+	Complete    bool      `json:"complete"` // no more batches are appended to the file
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// FileOutput is the directory of part files shared by the file sinks of a job, with its manifest.
+type FileOutput struct {
+	dir         string
+	compression string
+	maxBytes    int64
+
+	mu       sync.Mutex
+	manifest FileManifest
+}
+
+// NewFileOutput opens FILE_SINK_DIR. The parts of an earlier run listed in its manifest are kept,
+// so a resumed migration adds new parts after them.
+func NewFileOutput(config *config.Config) (*FileOutput, error) {
+	if _, ok := compressionExtensions[config.FileSinkCompression]; !ok {
+		return nil, fmt.Errorf("unknown FILE_SINK_COMPRESSION %q, expected none, gzip or zstd", config.FileSinkCompression)
+	}
+	if err := os.MkdirAll(config.FileSinkDir, 0755); err != nil {
+		return nil, err
+	}
+	output := &FileOutput{dir: config.FileSinkDir, compression: config.FileSinkCompression, maxBytes: config.FileSinkMaxBytes}
+
+	data, err := os.ReadFile(filepath.Join(output.dir, ManifestFile))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return output, nil
+	case err != nil:
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &output.manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", ManifestFile, err)
+	}
+	if err := output.recoverParts(); err != nil {
+		return nil, err
+	}
+	logger.Info("Appending to an existing file export", zap.String("dir", output.dir), zap.Int("parts", len(output.manifest.Parts)), zap.Int("documents", output.manifest.Documents))
+	return output, nil
+}
+
+// recoverParts closes the parts an interrupted run left open, cutting off what was written after their
+// last batch. Those documents were never acknowledged, so the export checkpoint resumes before them.
+func (o *FileOutput) recoverParts() error {
+	changed := false
+	for _, part := range o.manifest.Parts {
+		if part.Complete {
+			continue
+		}
+		path := filepath.Join(o.dir, part.File)
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if info.Size() < part.Bytes {
+			return fmt.Errorf("part %s is shorter than recorded in the manifest", path)
+		}
+		if info.Size() > part.Bytes {
+			if err := os.Truncate(path, part.Bytes); err != nil {
+				return err
+			}
+			logger.Warn("Truncated a part file left open by an interrupted run", zap.String("file", path), zap.Int64("bytes", part.Bytes))
+		}
+		part.Complete = true
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return o.save()
+}
+
+// createPart creates the next part file and lists it in the manifest.
+func (o *FileOutput) createPart(index string) (*FilePart, *os.File, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	part := &FilePart{
+		File:        fmt.Sprintf("part-%05d.ndjson%s", len(o.manifest.Parts)+1, compressionExtensions[o.compression]),
+		Index:       index,
+		Compression: o.compression,
+		CreatedAt:   time.Now(),
+	}
+	path := filepath.Join(o.dir, part.File)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create part file: %w", err)
+	}
+	o.manifest.Parts = append(o.manifest.Parts, part)
+	if err := o.save(); err != nil {
+		o.manifest.Parts = o.manifest.Parts[:len(o.manifest.Parts)-1]
+		file.Close()
+		os.Remove(path)
+		return nil, nil, err
+	}
+	return part, file, nil
+}
+
+// commit records documents written to a part, its new size and checksum, and whether it is complete.
+// The manifest is left as it was when it cannot be saved.
+func (o *FileOutput) commit(part *FilePart, documents int, size int64, checksum string, complete bool) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	previous := *part
+	part.Documents += documents
+	part.Bytes = size
+	part.SHA256 = checksum
+	part.Complete = complete
+	o.manifest.Documents += documents
+	if err := o.save(); err != nil {
+		*part = previous
+		o.manifest.Documents -= documents
+		return err
+	}
+	return nil
+}
+
+// save replaces the manifest. The caller must hold o.mu, except while the output is being opened.
+func (o *FileOutput) save() error {
+	o.manifest.UpdatedAt = time.Now()
+	data, err := json.MarshalIndent(o.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := utils.WriteFileAtomic(filepath.Join(o.dir, ManifestFile), data); err != nil {
+		return fmt.Errorf("failed to save manifest: %w", err)
+	}
+	return nil
+}
+
+// LogSummary logs the parts and documents written so far.
+func (o *FileOutput) LogSummary() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	logger.Info("File export summary", zap.String("dir", o.dir), zap.Int("parts", len(o.manifest.Parts)), zap.Int("documents", o.manifest.Documents))
+}
+
+// frameWriter compresses one batch into a self-contained gzip member or zstd frame. Concatenated
+// members and frames form a valid file, so a part can be cut after any batch.
+type frameWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// plainWriter is the frameWriter of uncompressed parts.
+type plainWriter struct {
+	w io.Writer
+}
+
+func (p *plainWriter) Write(data []byte) (int, error) { return p.w.Write(data) }
+func (p *plainWriter) Close() error                   { return nil }
+func (p *plainWriter) Reset(w io.Writer)              { p.w = w }
+
+func newFrameWriter(compression string) (frameWriter, error) {
+	switch compression {
+	case "gzip":
+		return gzip.NewWriter(nil), nil
+	case "zstd":
+		return zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	default:
+		return &plainWriter{}, nil
+	}
+}
+
+// FileSink writes documents as DocumentRecord lines to rotating part files of a FileOutput.
+// A batch is written once it holds BULK_SIZE documents or fileBatchBytes of NDJSON, then fsync'd and
+// recorded in the manifest before its documents are acknowledged. A part is complete once it reaches
+// FILE_SINK_MAX_BYTES on disk, unless it is 0, or when the sink is closed.
+type FileSink struct {
+	output      *FileOutput
+	config      *config.Config
+	deadLetters *DeadLetterQueue
+	frames      frameWriter
+
+	// Batch of encoded documents not written yet
+	docs    []*Document
+	buf     bytes.Buffer
+	encoder *json.Encoder
+
+	// Part file being written
+	part *FilePart
+	file *os.File
+	hash hash.Hash
+	size int64
+}
+
+// NewFileSink creates a sink writing to output. Each import worker needs its own FileSink.
+func NewFileSink(output *FileOutput, config *config.Config, deadLetters *DeadLetterQueue) (*FileSink, error) {
+	frames, err := newFrameWriter(output.compression)
+	if err != nil {
+		return nil, err
+	}
+	sink := &FileSink{output: output, config: config, deadLetters: deadLetters, frames: frames}
+	sink.encoder = json.NewEncoder(&sink.buf)
+	return sink, nil
+}
+
+func (s *FileSink) Write(ctx context.Context, docs ...*Document) error {
+	for _, doc := range docs {
+		index := doc.TargetIndex(s.config.ElkIndexTo)
+		if err := s.encoder.Encode(NewDocumentRecord(doc, s.config.ElkIndexTo)); err != nil {
+			logger.Warn("Error encoding document", zap.String("id", doc.ID), zap.Error(err))
+			if err := s.deadLetters.Add(ctx, newFailedDocument(index, doc, 0, "encoding_error", err.Error())); err != nil {
+				return err
+			}
+			doc.Ack()
+			continue
+		}
+		s.docs = append(s.docs, doc)
+
+		if len(s.docs) >= s.config.BulkSize || s.buf.Len() >= fileBatchBytes {
+			if err := s.Flush(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Flush writes the batch to the current part, rolling over to a new part once it is full.
+// On error the batch is dropped unacknowledged, so the export checkpoint stays before it,
+// and the part is cut back to its last batch and closed.
+func (s *FileSink) Flush(_ context.Context) error {
+	if len(s.docs) == 0 {
+		return nil
+	}
+	docs := s.docs
+	s.docs = nil
+	defer s.buf.Reset()
+
+	if s.part == nil {
+		part, file, err := s.output.createPart(s.config.ElkIndexTo)
+		if err != nil {
+			return err
+		}
+		s.part, s.file, s.hash, s.size = part, file, sha256.New(), 0
+	}
+	if err := s.writeBatch(); err != nil {
+		file := s.part.File
+		s.abortPart()
+		return fmt.Errorf("failed to write %d documents to %s: %w", len(docs), file, err)
+	}
+	full := s.output.maxBytes > 0 && s.size >= s.output.maxBytes
+	if err := s.output.commit(s.part, len(docs), s.size, hex.EncodeToString(s.hash.Sum(nil)), full); err != nil {
+		s.abortPart()
+		return err
+	}
+	ackDocuments(docs)
+	logger.Info("File batch written", zap.String("file", s.part.File), zap.Int("documents_count", len(docs)))
+
+	if full {
+		s.closePart()
+	}
+	return nil
+}
+
+// writeBatch appends the buffered NDJSON to the part as one frame and fsyncs it.
+func (s *FileSink) writeBatch() error {
+	counter := &countingWriter{w: io.MultiWriter(s.file, s.hash)}
+	s.frames.Reset(counter)
+	if _, err := s.frames.Write(s.buf.Bytes()); err != nil {
+		return err
+	}
+	if err := s.frames.Close(); err != nil {
+		return err
+	}
+	s.size += counter.n
+	return s.file.Sync()
+}
+
+// abortPart cuts the part back to its last committed batch, which the manifest already lists,
+// and closes it so the next batch starts a new part.
+func (s *FileSink) abortPart() {
+	if err := s.file.Truncate(s.part.Bytes); err != nil {
+		logger.Error("Failed to truncate part file", zap.String("file", s.part.File), zap.Error(err))
+	}
+	if err := s.output.commit(s.part, 0, s.part.Bytes, s.part.SHA256, true); err != nil {
+		logger.Error("Failed to close part file in the manifest", zap.String("file", s.part.File), zap.Error(err))
+	}
+	s.closePart()
+}
+
+func (s *FileSink) closePart() {
+	if err := s.file.Close(); err != nil {
+		logger.Error("Error closing part file", zap.String("file", s.part.File), zap.Error(err))
+	}
+	s.part, s.file, s.hash = nil, nil, nil
+}
+
+// Close writes the last batch and completes the current part.
+func (s *FileSink) Close() error {
+	err := s.Flush(context.Background())
+	if s.part != nil {
+		if commitErr := s.output.commit(s.part, 0, s.size, hex.EncodeToString(s.hash.Sum(nil)), true); commitErr != nil && err == nil {
+			err = commitErr
+		}
+		s.closePart()
+	}
+	return err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(data []byte) (int, error) {
+	n, err := c.w.Write(data)
+	c.n += int64(n)
+	return n, err
+}
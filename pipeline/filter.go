@@ -0,0 +1,117 @@
+package pipeline
+
+import (
+	"elkmigration/config"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ExportFilter restricts the export to the documents matching a query and a time range,
+// and to a subset of their _source fields.
+type ExportFilter struct {
+	Query    map[string]interface{} // query DSL combining EXPORT_QUERY and the time range, nil to export everything
+	Includes []string               // _source fields to keep, all when empty
+	Excludes []string               // _source fields to strip
+	NoSource bool                   // fetch only the metadata of the documents, with an empty _source
+}
+
+// NewExportFilter builds the filter from EXPORT_QUERY or EXPORT_QUERY_FILE, the TIME_FIELD range
+// and SOURCE_INCLUDES/SOURCE_EXCLUDES. The query may be a bare query or a search body with a "query" key.
+// TIME_FROM and TIME_TO accept dates or date math such as "now-90d"; the range includes TIME_FROM
+// and excludes TIME_TO.
+func NewExportFilter(config *config.Config) (*ExportFilter, error) {
+	filter := &ExportFilter{
+		Includes: splitList(config.SourceIncludes),
+		Excludes: splitList(config.SourceExcludes),
+	}
+
+	if config.ExportQuery != "" && config.ExportQueryFile != "" {
+		return nil, fmt.Errorf("EXPORT_QUERY and EXPORT_QUERY_FILE are mutually exclusive")
+	}
+	raw := []byte(config.ExportQuery)
+	if config.ExportQueryFile != "" {
+		data, err := os.ReadFile(config.ExportQueryFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read export query: %w", err)
+		}
+		raw = data
+	}
+
+	var clauses []interface{}
+	if len(strings.TrimSpace(string(raw))) > 0 {
+		var query map[string]interface{}
+		if err := json.Unmarshal(raw, &query); err != nil {
+			return nil, fmt.Errorf("invalid export query: %w", err)
+		}
+		if body, ok := query["query"].(map[string]interface{}); ok {
+			query = body
+		}
+		clauses = append(clauses, query)
+	}
+
+	if config.TimeFrom != "" || config.TimeTo != "" {
+		if config.TimeField == "" {
+			return nil, fmt.Errorf("TIME_FIELD must be set to filter by TIME_FROM and TIME_TO")
+		}
+		bounds := map[string]interface{}{}
+		if config.TimeFrom != "" {
+			bounds["gte"] = config.TimeFrom
+		}
+		if config.TimeTo != "" {
+			bounds["lt"] = config.TimeTo
+		}
+		clauses = append(clauses, map[string]interface{}{"range": map[string]interface{}{config.TimeField: bounds}})
+	}
+
+	switch len(clauses) {
+	case 0:
+	case 1:
+		filter.Query = clauses[0].(map[string]interface{})
+	default:
+		filter.Query = map[string]interface{}{"bool": map[string]interface{}{"filter": clauses}}
+	}
+	return filter, nil
+}
+
+// Active reports whether the filter restricts the export in any way.
+func (f *ExportFilter) Active() bool {
+	return f != nil && (f.Query != nil || len(f.Includes) > 0 || len(f.Excludes) > 0 || f.NoSource)
+}
+
+// sourceFilter returns the "_source" value of a search body, nil when every field is fetched.
+func (f *ExportFilter) sourceFilter() interface{} {
+	if f != nil && f.NoSource {
+		return false
+	}
+	if f == nil || (len(f.Includes) == 0 && len(f.Excludes) == 0) {
+		return nil
+	}
+	source := map[string]interface{}{}
+	if len(f.Includes) > 0 {
+		source["includes"] = f.Includes
+	}
+	if len(f.Excludes) > 0 {
+		source["excludes"] = f.Excludes
+	}
+	return source
+}
+
+// splitList splits a comma-separated configuration value, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// rawQuery is a query DSL object usable as an elastic.v3 query.
+type rawQuery map[string]interface{}
+
+func (q rawQuery) Source() (interface{}, error) {
+	return map[string]interface{}(q), nil
+}
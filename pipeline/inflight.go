@@ -0,0 +1,55 @@
+package pipeline
+
+import "sync"
+
+// InFlightLimiter caps the number of bulk requests and payload bytes outstanding
+// against the target at once, across all import workers.
+type InFlightLimiter struct {
+	maxRequests int
+	maxBytes    int
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	requests int
+	bytes    int
+}
+
+// NewInFlightLimiter creates a limiter. A limit <= 0 disables that limit.
+func NewInFlightLimiter(maxRequests, maxBytes int) *InFlightLimiter {
+	l := &InFlightLimiter{maxRequests: maxRequests, maxBytes: maxBytes}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// Acquire blocks until a request of the given size fits within the limits.
+// A request larger than the byte limit is let through once nothing else is in flight,
+// so an oversized payload cannot block forever.
+func (l *InFlightLimiter) Acquire(size int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for !l.fits(size) {
+		l.cond.Wait()
+	}
+	l.requests++
+	l.bytes += size
+}
+
+// Release returns the capacity taken by Acquire.
+func (l *InFlightLimiter) Release(size int) {
+	l.mu.Lock()
+	l.requests--
+	l.bytes -= size
+	l.mu.Unlock()
+	l.cond.Broadcast()
+}
+
+// fits reports whether a request can start now. The caller must hold l.mu.
+func (l *InFlightLimiter) fits(size int) bool {
+	if l.requests == 0 {
+		return true
+	}
+	if l.maxRequests > 0 && l.requests >= l.maxRequests {
+		return false
+	}
+	return l.maxBytes <= 0 || l.bytes+size <= l.maxBytes
+}
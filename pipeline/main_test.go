@@ -0,0 +1,57 @@
+package pipeline
+
+import (
+	"context"
+	"elkmigration/logger"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	logger.Log = zap.NewNop()
+	os.Exit(m.Run())
+}
+
+// recordedDeadLetters keeps the documents written to a dead-letter queue in memory.
+type recordedDeadLetters struct {
+	mu     sync.Mutex
+	failed []*FailedDocument
+}
+
+func (r *recordedDeadLetters) Write(_ context.Context, failed *FailedDocument) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failed = append(r.failed, failed)
+	return nil
+}
+
+func (r *recordedDeadLetters) Close() error {
+	return nil
+}
+
+func (r *recordedDeadLetters) documents() []*FailedDocument {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*FailedDocument(nil), r.failed...)
+}
+
+// newRecordedQueue returns a dead-letter queue recording to memory.
+func newRecordedQueue() (*DeadLetterQueue, *recordedDeadLetters) {
+	recorded := &recordedDeadLetters{}
+	return &DeadLetterQueue{sink: recorded, counts: make(map[string]int)}, recorded
+}
+
+// failingDeadLetters is a dead-letter sink that cannot store anything, like an unreachable Redis.
+type failingDeadLetters struct{}
+
+func (failingDeadLetters) Write(context.Context, *FailedDocument) error {
+	return errors.New("connection refused")
+}
+
+func (failingDeadLetters) Close() error {
+	return nil
+}
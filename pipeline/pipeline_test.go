@@ -0,0 +1,429 @@
+package pipeline
+
+import (
+	"context"
+	"elkmigration/clients"
+	"elkmigration/config"
+	"elkmigration/estest"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// newSourceServer returns a fake cluster whose logs index holds the documents doc-00 to doc-<count-1>.
+func newSourceServer(t *testing.T, version, count int) *estest.Server {
+	t.Helper()
+	server := estest.NewServer(version)
+	t.Cleanup(server.Close)
+	if err := server.CreateIndex("logs", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		doc := estest.Document{ID: fmt.Sprintf("doc-%02d", i), Source: map[string]interface{}{"n": i}}
+		if version == 2 {
+			doc.Type = "log"
+		}
+		if err := server.AddDocuments("logs", doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return server
+}
+
+func migrationConfig() *config.Config {
+	return &config.Config{
+		ElkIndexFrom:      "logs",
+		ElkIndexTo:        "copy",
+		BulkSize:          4,
+		ScrollTimeout:     "1m",
+		ExportMode:        exportModeScroll,
+		BulkMinBytes:      1 << 20,
+		BulkMaxBytes:      1 << 20,
+		BulkTargetLatency: "1s",
+		TransformWorkers:  2,
+	}
+}
+
+func newCheckpointStore(t *testing.T) clients.CheckpointStore {
+	t.Helper()
+	store, err := clients.NewFileStore(filepath.Join(t.TempDir(), "checkpoints.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// newSources returns the sources of every export slice of the source server.
+func newSources(t *testing.T, server *estest.Server, cfg *config.Config) []Source {
+	t.Helper()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := make([]Source, max(cfg.ExportSlices, 1))
+	for i := range sources {
+		if sources[i], err = NewSource(client, cfg, Slice{ID: i, Max: len(sources)}, &ExportFilter{}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return sources
+}
+
+// runPipeline exports the sources, transforms and imports the documents to the target server with a
+// single sink, and returns the errors of every stage. A transform or import error stops the export; an export
+// error lets the documents already exported be written, as if the migration had been interrupted.
+func runPipeline(t *testing.T, sources []Source, target *estest.Server, cfg *config.Config, store clients.CheckpointStore, deadLetters *DeadLetterQueue) error {
+	t.Helper()
+	client, err := target.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizer, err := NewBulkSizer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink, err := NewSink(client, cfg, deadLetters, NewInFlightLimiter(0, 0), sizer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transformer, err := NewTransformer(cfg, nil, deadLetters)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	docs := make(chan *Document, 10)
+	transformedDocs := make(chan *Document, 10)
+	var mu sync.Mutex
+	var exportWg sync.WaitGroup
+	errs := make([]error, len(sources)+1)
+	for i, source := range sources {
+		exportWg.Add(1)
+		go func() {
+			defer exportWg.Done()
+			errs[i] = ExportDocuments(ctx, source, cfg, Slice{ID: i, Max: len(sources)}, docs, store, &mu)
+		}()
+	}
+	go func() {
+		exportWg.Wait()
+		close(docs)
+	}()
+	transformed := make(chan error, 1)
+	go func() {
+		err := TransformDocuments(ctx, transformer, cfg.TransformWorkers, cfg.TransformOrdered, docs, transformedDocs)
+		if err != nil {
+			cancel()
+		}
+		transformed <- err
+	}()
+
+	if errs[len(sources)] = ImportDocuments(ctx, sink, transformedDocs); errs[len(sources)] != nil {
+		cancel()
+	}
+	exportWg.Wait()
+	return errors.Join(append(errs, <-transformed)...)
+}
+
+// checkTarget checks that the target holds every document of the source, each written once,
+// except the dead-lettered ones.
+func checkTarget(t *testing.T, target *estest.Server, count int, deadLettered ...string) {
+	t.Helper()
+	skipped := map[string]bool{}
+	for _, id := range deadLettered {
+		skipped[id] = true
+	}
+	var want []string
+	for i := 0; i < count; i++ {
+		if id := fmt.Sprintf("doc-%02d", i); !skipped[id] {
+			want = append(want, id)
+		}
+	}
+	var got []string
+	for _, doc := range target.Documents("copy") {
+		got = append(got, doc.ID)
+		if doc.Version != 1 {
+			t.Errorf("%s written %d times", doc.ID, doc.Version)
+		}
+	}
+	sort.Strings(got)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("target holds %v, want %v", got, want)
+	}
+}
+
+// checkCommitted checks the number of documents committed in the checkpoint of every slice.
+func checkCommitted(t *testing.T, store clients.CheckpointStore, cfg *config.Config, want int) {
+	t.Helper()
+	total := 0
+	for i := 0; i < max(cfg.ExportSlices, 1); i++ {
+		checkpoint, err := LoadCheckpoint(context.Background(), store, cfg, Slice{ID: i, Max: max(cfg.ExportSlices, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += checkpoint.Count
+	}
+	if total != want {
+		t.Errorf("committed %d documents, want %d", total, want)
+	}
+}
+
+func TestMigrateToCompletion(t *testing.T) {
+	for _, versions := range [][2]int{{2, 8}, {7, 7}, {8, 8}} {
+		for _, slices := range []int{1, 2} {
+			t.Run(fmt.Sprintf("ES%d to ES%d in %d slices", versions[0], versions[1], slices), func(t *testing.T) {
+				source, target := newSourceServer(t, versions[0], 25), estest.NewServer(versions[1])
+				defer target.Close()
+				cfg := migrationConfig()
+				cfg.ExportSlices = slices
+				cfg.TransformRulesFile = filepath.Join(t.TempDir(), "rules.yml")
+				if err := os.WriteFile(cfg.TransformRulesFile, []byte(`{rules: [{action: rename, field: n, to: number}]}`), 0644); err != nil {
+					t.Fatal(err)
+				}
+				store := newCheckpointStore(t)
+
+				if err := runPipeline(t, newSources(t, source, cfg), target, cfg, store, nil); err != nil {
+					t.Fatalf("migration failed: %v", err)
+				}
+				checkTarget(t, target, 25)
+				checkCommitted(t, store, cfg, 25)
+				for _, doc := range target.Documents("copy") {
+					if _, ok := doc.Source["number"]; !ok || len(doc.Source) != 1 {
+						t.Errorf("%s = %v, want the transformed source", doc.ID, doc.Source)
+					}
+				}
+				if open := source.OpenScrolls(); open != 0 {
+					t.Errorf("%d scrolls left open", open)
+				}
+			})
+		}
+	}
+}
+
+func TestMigrateBulkItemErrors(t *testing.T) {
+	source, target := newSourceServer(t, 8, 10), estest.NewServer(8)
+	defer target.Close()
+	target.FailBulkItems(0, estest.Fault{Status: http.StatusBadRequest, Type: "mapper_parsing_exception", Reason: "failed to parse field [n]"}, "doc-02", "doc-07")
+	cfg := migrationConfig()
+	store := newCheckpointStore(t)
+	deadLetters, recorded := newRecordedQueue()
+
+	if err := runPipeline(t, newSources(t, source, cfg), target, cfg, store, deadLetters); err != nil {
+		t.Fatalf("migration failed: %v", err)
+	}
+	checkTarget(t, target, 10, "doc-02", "doc-07")
+	// The rejected documents do not hold the checkpoint back
+	checkCommitted(t, store, cfg, 10)
+
+	failed := recorded.documents()
+	sort.Slice(failed, func(i, j int) bool { return failed[i].ID < failed[j].ID })
+	if len(failed) != 2 {
+		t.Fatalf("dead-lettered %d documents, want 2", len(failed))
+	}
+	for i, id := range []string{"doc-02", "doc-07"} {
+		if got := failed[i]; got.ID != id || got.Index != "copy" || got.Status != http.StatusBadRequest || got.ErrorType != "mapper_parsing_exception" || got.Source == nil {
+			t.Errorf("dead letter %d = %+v, want %s rejected with its source", i, got, id)
+		}
+	}
+}
+
+func TestMigrateRetriesRejections(t *testing.T) {
+	source, target := newSourceServer(t, 8, 10), estest.NewServer(8)
+	defer target.Close()
+	target.FailRequests(estest.EndpointBulk, 1, estest.Fault{Status: http.StatusTooManyRequests})
+	target.FailBulkItems(1, estest.Fault{Status: http.StatusTooManyRequests}, "doc-05")
+	cfg := migrationConfig()
+	cfg.MaxRetries = 2
+	store := newCheckpointStore(t)
+	deadLetters, recorded := newRecordedQueue()
+
+	if err := runPipeline(t, newSources(t, source, cfg), target, cfg, store, deadLetters); err != nil {
+		t.Fatalf("migration failed: %v", err)
+	}
+	checkTarget(t, target, 10)
+	checkCommitted(t, store, cfg, 10)
+	if failed := recorded.documents(); len(failed) != 0 {
+		t.Errorf("dead-lettered %d documents, want none", len(failed))
+	}
+	// 3 batches, the first sent again after the request was rejected and the one of doc-05 after its item was
+	if requests := target.Requests(estest.EndpointBulk); requests != 5 {
+		t.Errorf("%d bulk requests, want 5", requests)
+	}
+}
+
+func TestMigrateRetriesExhausted(t *testing.T) {
+	source, target := newSourceServer(t, 8, 6), estest.NewServer(8)
+	defer target.Close()
+	target.FailBulkItems(0, estest.Fault{Status: http.StatusTooManyRequests}, "doc-01")
+	cfg := migrationConfig()
+	cfg.MaxRetries = 1
+	store := newCheckpointStore(t)
+	deadLetters, recorded := newRecordedQueue()
+
+	if err := runPipeline(t, newSources(t, source, cfg), target, cfg, store, deadLetters); err != nil {
+		t.Fatalf("migration failed: %v", err)
+	}
+	checkTarget(t, target, 6, "doc-01")
+	checkCommitted(t, store, cfg, 6)
+	if failed := recorded.documents(); len(failed) != 1 || failed[0].ID != "doc-01" || failed[0].ErrorType != "max_retries_exceeded" {
+		t.Errorf("dead-lettered %v, want doc-01 after the last retry", failed)
+	}
+}
+
+func TestMigrateSplitsTooLargeRequests(t *testing.T) {
+	source, target := newSourceServer(t, 8, 8), estest.NewServer(8)
+	defer target.Close()
+	// The first batch of 4 documents is split in two batches of 2, and the first of those in single documents;
+	// the first document alone is still too large
+	target.FailRequests(estest.EndpointBulk, 3, estest.Fault{Status: http.StatusRequestEntityTooLarge})
+	cfg := migrationConfig()
+	store := newCheckpointStore(t)
+	deadLetters, recorded := newRecordedQueue()
+
+	if err := runPipeline(t, newSources(t, source, cfg), target, cfg, store, deadLetters); err != nil {
+		t.Fatalf("migration failed: %v", err)
+	}
+	failed := recorded.documents()
+	if len(failed) != 1 || failed[0].ErrorType != "payload_too_large" || failed[0].Status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("dead-lettered %v, want one document too large", failed)
+	}
+	checkTarget(t, target, 8, failed[0].ID)
+	checkCommitted(t, store, cfg, 8)
+	// 3 refused requests, then the second single document, the second half of the first batch and the second batch
+	if requests := target.Requests(estest.EndpointBulk); requests != 6 {
+		t.Errorf("%d bulk requests, want 6", requests)
+	}
+}
+
+func TestMigrateStopsWhenTargetFails(t *testing.T) {
+	source, target := newSourceServer(t, 8, 10), estest.NewServer(8)
+	defer target.Close()
+	target.FailRequests(estest.EndpointBulk, 0, estest.Fault{Status: http.StatusServiceUnavailable})
+	cfg := migrationConfig()
+	store := newCheckpointStore(t)
+
+	if err := runPipeline(t, newSources(t, source, cfg), target, cfg, store, nil); err == nil {
+		t.Fatal("migration succeeded with the target down")
+	}
+	checkCommitted(t, store, cfg, 0)
+
+	target.ClearFaults()
+	if err := runPipeline(t, newSources(t, source, cfg), target, cfg, store, nil); err != nil {
+		t.Fatalf("resumed migration failed: %v", err)
+	}
+	checkTarget(t, target, 10)
+	checkCommitted(t, store, cfg, 10)
+}
+
+// interruptedSource calls interrupt once the first batch has been read.
+type interruptedSource struct {
+	Source
+	interrupt func()
+	read      bool
+}
+
+func (s *interruptedSource) Next(ctx context.Context) ([]*Document, error) {
+	if s.read && s.interrupt != nil {
+		s.interrupt()
+		s.interrupt = nil
+	}
+	s.read = true
+	return s.Source.Next(ctx)
+}
+
+func TestMigrateResume(t *testing.T) {
+	tests := []struct {
+		name      string
+		version   int
+		sorted    bool
+		interrupt func(source *estest.Server)
+	}{
+		{
+			name:    "scroll fails",
+			version: 7,
+			interrupt: func(source *estest.Server) {
+				source.FailRequests(estest.EndpointScroll, 0, estest.Fault{Status: http.StatusInternalServerError})
+			},
+		},
+		{
+			name:      "scroll expires",
+			version:   8,
+			interrupt: func(source *estest.Server) { source.ExpireScrolls() },
+		},
+		{
+			name:      "ES2 scroll expires",
+			version:   2,
+			interrupt: func(source *estest.Server) { source.ExpireScrolls() },
+		},
+		{
+			name:    "sorted search fails",
+			version: 8,
+			sorted:  true,
+			interrupt: func(source *estest.Server) {
+				source.FailRequests(estest.EndpointSearch, 0, estest.Fault{Status: http.StatusInternalServerError})
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, target := newSourceServer(t, tt.version, 10), estest.NewServer(8)
+			defer target.Close()
+			cfg := migrationConfig()
+			if tt.sorted {
+				cfg.ExportMode = exportModeSorted
+				cfg.SortField = "n"
+			}
+			store := newCheckpointStore(t)
+
+			// The export fails after the first page, which is still written and committed
+			first := &interruptedSource{Source: newSources(t, source, cfg)[0], interrupt: func() { tt.interrupt(source) }}
+			if err := runPipeline(t, []Source{first}, target, cfg, store, nil); err == nil {
+				t.Fatal("interrupted migration succeeded")
+			}
+			checkCommitted(t, store, cfg, cfg.BulkSize)
+
+			source.ClearFaults()
+			if err := runPipeline(t, newSources(t, source, cfg), target, cfg, store, nil); err != nil {
+				t.Fatalf("resumed migration failed: %v", err)
+			}
+			checkTarget(t, target, 10)
+			checkCommitted(t, store, cfg, 10)
+		})
+	}
+}
+
+func TestMigrateStopsWhenDeadLettersFail(t *testing.T) {
+	source, target := newSourceServer(t, 8, 10), estest.NewServer(8)
+	defer target.Close()
+	target.FailBulkItems(0, estest.Fault{Status: http.StatusBadRequest, Type: "mapper_parsing_exception"}, "doc-06")
+	cfg := migrationConfig()
+	store := newCheckpointStore(t)
+
+	unavailable := &DeadLetterQueue{sink: failingDeadLetters{}, counts: make(map[string]int)}
+	if err := runPipeline(t, newSources(t, source, cfg), target, cfg, store, unavailable); !errors.Is(err, errDeadLetter) {
+		t.Fatalf("migration error = %v, want the dead-letter failure", err)
+	}
+	// The batch of doc-06 is not committed, so the rejected document is not lost
+	checkCommitted(t, store, cfg, 4)
+	if unavailable.Total() != 0 {
+		t.Errorf("counted %d dead-lettered documents, want none", unavailable.Total())
+	}
+
+	deadLetters, recorded := newRecordedQueue()
+	if err := runPipeline(t, newSources(t, source, cfg), target, cfg, store, deadLetters); err != nil {
+		t.Fatalf("resumed migration failed: %v", err)
+	}
+	checkCommitted(t, store, cfg, 10)
+	if failed := recorded.documents(); len(failed) != 1 || failed[0].ID != "doc-06" {
+		t.Errorf("dead-lettered %v, want doc-06", failed)
+	}
+	if count := target.Count("copy"); count != 9 {
+		t.Errorf("target holds %d documents, want 9", count)
+	}
+}
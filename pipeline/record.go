@@ -0,0 +1,25 @@
+package pipeline
+
+// DocumentRecord is a document as a line of an NDJSON dump, in the shape of a search hit.
+type DocumentRecord struct {
+	Index   string                 `json:"_index"`
+	Type    string                 `json:"_type,omitempty"`
+	ID      string                 `json:"_id"`
+	Routing string                 `json:"_routing,omitempty"`
+	Parent  string                 `json:"_parent,omitempty"`
+	Version *int64                 `json:"_version,omitempty"`
+	Source  map[string]interface{} `json:"_source"`
+}
+
+// NewDocumentRecord returns the record of a document, in defaultIndex unless it was routed elsewhere.
+func NewDocumentRecord(doc *Document, defaultIndex string) *DocumentRecord {
+	return &DocumentRecord{
+		Index:   doc.TargetIndex(defaultIndex),
+		Type:    doc.Type,
+		ID:      doc.ID,
+		Routing: doc.Routing,
+		Parent:  doc.Parent,
+		Version: doc.Version,
+		Source:  doc.Source,
+	}
+}
@@ -0,0 +1,393 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"elkmigration/clients"
+	"elkmigration/config"
+	"elkmigration/logger"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultES2Type is the mapping type given to documents without one when writing to an ES2 target.
+const defaultES2Type = "doc"
+
+// errPayloadTooLarge is returned when the target refuses a bulk request with 413.
+var errPayloadTooLarge = errors.New("bulk request payload too large")
+
+// Sink writes documents to the migration target.
+type Sink interface {
+	// Write adds documents to the sink, which sends them to the target in batches.
+	// Each document is acknowledged once durably written or recorded in the dead-letter queue.
+	// An error leaves the documents that could not be written unacknowledged; the sink should not be used further.
+	Write(ctx context.Context, docs ...*Document) error
+	// Flush sends any buffered documents.
+	Flush(ctx context.Context) error
+	// Close flushes and releases the sink.
+	Close() error
+}
+
+// NewSink creates the Sink writing to ELK_INDEX_TO for the given client.
+// Each import worker needs its own Sink; the dead-letter queue, limiter and sizer are shared.
+func NewSink(client clients.ElasticsearchClient, config *config.Config, deadLetters *DeadLetterQueue, limiter *InFlightLimiter, sizer *BulkSizer) (Sink, error) {
+	switch c := client.(type) {
+	case *clients.ES2Client:
+		return NewBulkSink(c, true, config, deadLetters, limiter, sizer)
+	case *clients.ES7Client:
+		return NewBulkSink(c, false, config, deadLetters, limiter, sizer)
+	case *clients.ES8Client:
+		return NewBulkSink(c, false, config, deadLetters, limiter, sizer)
+	default:
+		return nil, fmt.Errorf("unsupported target client %T", client)
+	}
+}
+
+// BulkSink writes documents to an Elasticsearch index with the bulk API.
+// A batch is sent once it holds BULK_SIZE documents or reaches the payload size chosen by sizer.
+type BulkSink struct {
+	client      clients.BulkClient
+	typed       bool // send _type in bulk actions, for ES2 targets
+	config      *config.Config
+	deadLetters *DeadLetterQueue
+	limiter     *InFlightLimiter
+	sizer       *BulkSizer
+
+	batch *bulkBatch
+}
+
+// NewBulkSink creates a bulk sink and checks whether the target index exists.
+func NewBulkSink(client clients.BulkClient, typed bool, config *config.Config, deadLetters *DeadLetterQueue, limiter *InFlightLimiter, sizer *BulkSizer) (*BulkSink, error) {
+	// Check if the target index exists
+	exists, err := client.IndexExists(context.Background(), config.ElkIndexTo)
+	if err != nil {
+		return nil, fmt.Errorf("error checking if index exists: %w", err)
+	}
+	if !exists {
+		logger.Warn("Target index does not exist, it will be created with dynamic mappings", zap.String("index", config.ElkIndexTo))
+	}
+
+	return &BulkSink{
+		client:      client,
+		typed:       typed,
+		config:      config,
+		deadLetters: deadLetters,
+		limiter:     limiter,
+		sizer:       sizer,
+		batch:       &bulkBatch{},
+	}, nil
+}
+
+func (s *BulkSink) Write(ctx context.Context, docs ...*Document) error {
+	for _, doc := range docs {
+		index := doc.TargetIndex(s.config.ElkIndexTo)
+		if err := s.batch.Add(index, doc, s.typed); err != nil {
+			logger.Warn("Error encoding document", zap.String("id", doc.ID), zap.Error(err))
+			if err := s.deadLetters.Add(ctx, newFailedDocument(index, doc, 0, "encoding_error", err.Error())); err != nil {
+				return err
+			}
+			doc.Ack()
+			continue
+		}
+
+		// Send bulk request when reaching the bulkSize or the adaptive payload size
+		if s.batch.Len() >= s.config.BulkSize || s.batch.Bytes() >= s.sizer.Target() {
+			if err := s.Flush(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *BulkSink) Flush(ctx context.Context) error {
+	if s.batch.Len() == 0 {
+		return nil
+	}
+	batch := s.batch
+	s.batch = &bulkBatch{} // Reset the bulk data buffer
+	return s.writeBatch(ctx, batch)
+}
+
+func (s *BulkSink) Close() error {
+	return s.Flush(context.Background())
+}
+
+// bulkBatch holds documents together with their encoded bulk lines (action and source).
+type bulkBatch struct {
+	docs  []*Document
+	lines [][]byte
+	bytes int
+}
+
+// Add encodes a document as an index action for the given index and appends it.
+func (b *bulkBatch) Add(index string, doc *Document, typed bool) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	if err := encoder.Encode(bulkAction(index, doc, typed)); err != nil {
+		return err
+	}
+	if err := encoder.Encode(doc.Source); err != nil {
+		return err
+	}
+	b.add(doc, buf.Bytes())
+	return nil
+}
+
+func (b *bulkBatch) add(doc *Document, line []byte) {
+	b.docs = append(b.docs, doc)
+	b.lines = append(b.lines, line)
+	b.bytes += len(line)
+}
+
+// Len returns the number of documents in the batch.
+func (b *bulkBatch) Len() int {
+	return len(b.docs)
+}
+
+// Bytes returns the size of the bulk payload.
+func (b *bulkBatch) Bytes() int {
+	return b.bytes
+}
+
+// Payload returns the NDJSON body of the bulk request.
+func (b *bulkBatch) Payload() []byte {
+	return bytes.Join(b.lines, nil)
+}
+
+// split divides the batch into two halves.
+func (b *bulkBatch) split() (*bulkBatch, *bulkBatch) {
+	first, second := &bulkBatch{}, &bulkBatch{}
+	half := len(b.docs) / 2
+	for i, doc := range b.docs {
+		if i < half {
+			first.add(doc, b.lines[i])
+		} else {
+			second.add(doc, b.lines[i])
+		}
+	}
+	return first, second
+}
+
+// writeBatch sends a batch to the target. Failed requests are retried as a whole,
+// and items rejected with 429 are retried on their own, with exponential backoff and
+// jitter, up to MAX_RETRIES attempts. A request refused as too large is split in two,
+// and a single document refused as too large is sent to the dead-letter queue.
+// Items still rejected with 429 after the last attempt are sent to the dead-letter queue too.
+// When the request itself keeps failing, such as while the target is down, an error is returned
+// and the documents are left unacknowledged, so the checkpoint does not move past them.
+// The same goes for documents that could not be written to the dead-letter queue, which are not retried.
+func (s *BulkSink) writeBatch(ctx context.Context, batch *bulkBatch) error {
+	pending := batch
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		retry, err := s.executeBulkRequest(ctx, pending)
+		s.sizer.Observe(pending.Bytes(), time.Since(start), err != nil || retry.Len() > 0)
+
+		if errors.Is(err, errDeadLetter) {
+			// Sending the batch again does not help the dead-letter sink
+			return err
+		}
+		if errors.Is(err, errPayloadTooLarge) {
+			if pending.Len() == 1 {
+				doc := pending.docs[0]
+				logger.Error("Document too large for a bulk request", zap.String("id", doc.ID), zap.Int("bytes", pending.Bytes()))
+				if err := s.deadLetters.Add(ctx, newFailedDocument(doc.TargetIndex(s.config.ElkIndexTo), doc, http.StatusRequestEntityTooLarge, "payload_too_large", err.Error())); err != nil {
+					return err
+				}
+				ackDocuments(pending.docs)
+				return nil
+			}
+			logger.Warn("Bulk payload too large, splitting batch", zap.Int("documents_count", pending.Len()), zap.Int("bytes", pending.Bytes()))
+			first, second := pending.split()
+			if err := s.writeBatch(ctx, first); err != nil {
+				return err
+			}
+			return s.writeBatch(ctx, second)
+		}
+		if err == nil {
+			if retry.Len() == 0 {
+				logger.Info("Bulk request completed", zap.Int("documents_count", pending.Len()))
+				return nil
+			}
+			pending = retry
+		}
+
+		if attempt >= s.config.MaxRetries {
+			if err != nil {
+				logger.Error("Max retries reached during bulk insert", zap.Int("documents_count", pending.Len()), zap.Error(err))
+				return fmt.Errorf("bulk request failed after %d attempts: %w", attempt+1, err)
+			}
+			reason := "rejected with 429 by the target"
+			logger.Error("Max retries reached during bulk insert", zap.Int("documents_count", pending.Len()), zap.String("reason", reason))
+			for i, doc := range pending.docs {
+				if err := s.deadLetters.Add(ctx, newFailedDocument(doc.TargetIndex(s.config.ElkIndexTo), doc, http.StatusTooManyRequests, "max_retries_exceeded", reason)); err != nil {
+					ackDocuments(pending.docs[:i])
+					return err
+				}
+			}
+			ackDocuments(pending.docs)
+			return nil
+		}
+
+		delay := retryBackoff(attempt)
+		if err != nil {
+			logger.Warn("Error during bulk insert, retrying...", zap.Int("attempt", attempt+1), zap.Duration("delay", delay), zap.Error(err))
+		} else {
+			logger.Warn("Bulk items rejected with 429, retrying...", zap.Int("attempt", attempt+1), zap.Duration("delay", delay), zap.Int("documents_count", pending.Len()))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// bulkAction builds the bulk "index" action line for a document, preserving the source _id and routing.
+// The _type is only sent to an ES2 target (typed is true), which also keeps _parent;
+// ES7 and ES8 indices have no custom mapping types and route children by their parent.
+func bulkAction(index string, doc *Document, typed bool) map[string]interface{} {
+	action := map[string]interface{}{
+		"_index": index,
+	}
+	if doc.ID != "" {
+		action["_id"] = doc.ID
+	}
+	if typed {
+		docType := doc.Type
+		if docType == "" {
+			docType = defaultES2Type
+		}
+		action["_type"] = docType
+		if doc.Routing != "" {
+			action["_routing"] = doc.Routing
+		}
+		if doc.Parent != "" {
+			action["_parent"] = doc.Parent
+		}
+	} else if routing := doc.BulkRouting(); routing != "" {
+		action["routing"] = routing
+	}
+	return map[string]interface{}{"index": action}
+}
+
+// bulkResponse is the subset of the _bulk response body needed to find rejected items.
+type bulkResponse struct {
+	Errors bool                          `json:"errors"`
+	Items  []map[string]bulkResponseItem `json:"items"`
+}
+
+type bulkResponseItem struct {
+	Index  string          `json:"_index"`
+	ID     string          `json:"_id"`
+	Status int             `json:"status"`
+	Error  *bulkErrorCause `json:"error,omitempty"`
+}
+
+type bulkErrorCause struct {
+	Type     string          `json:"type"`
+	Reason   string          `json:"reason"`
+	CausedBy *bulkErrorCause `json:"caused_by,omitempty"`
+}
+
+// String flattens the error and its causes into a single reason line.
+func (e *bulkErrorCause) String() string {
+	reason := e.Reason
+	if e.CausedBy != nil {
+		reason += ": " + e.CausedBy.String()
+	}
+	return reason
+}
+
+// executeBulkRequest sends one bulk payload and parses the response item by item.
+// Items the target rejected are written, with their original source, to the dead-letter queue,
+// except 429 rejections which are returned in a new batch to be retried.
+// Every document not returned for retry is acknowledged.
+// On error nothing is acknowledged and the whole batch may be retried, unless a rejected item
+// could not be written to the dead-letter queue.
+func (s *BulkSink) executeBulkRequest(ctx context.Context, batch *bulkBatch) (*bulkBatch, error) {
+	bulkPayload := batch.Payload()
+	s.limiter.Acquire(len(bulkPayload))
+	defer s.limiter.Release(len(bulkPayload))
+
+	status, body, err := s.client.Bulk(ctx, bytes.NewReader(bulkPayload))
+	if err != nil {
+		logger.Error("Failed to execute bulk request", zap.Error(err))
+		return nil, err
+	}
+	defer body.Close()
+
+	// Check for errors in the response
+	if status == http.StatusRequestEntityTooLarge {
+		return nil, errPayloadTooLarge
+	}
+	if status > 299 {
+		logger.Error("Bulk request failed when importing", zap.Int("status", status))
+		return nil, fmt.Errorf("bulk request failed: %d %s", status, http.StatusText(status))
+	}
+
+	var response bulkResponse
+	if err := json.NewDecoder(body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to decode bulk response: %w", err)
+	}
+
+	retry := &bulkBatch{}
+	if !response.Errors {
+		ackDocuments(batch.docs)
+		return retry, nil
+	}
+	if len(response.Items) != batch.Len() {
+		logger.Warn("Bulk response item count does not match request", zap.Int("items", len(response.Items)), zap.Int("documents", batch.Len()))
+	}
+
+	failed := 0
+	done := make([]*Document, 0, batch.Len())
+	for i, doc := range batch.docs {
+		if i >= len(response.Items) {
+			// No result for this document; send it again
+			retry.add(doc, batch.lines[i])
+			continue
+		}
+		for _, result := range response.Items[i] {
+			switch {
+			case result.Error == nil:
+				done = append(done, doc)
+			case result.Status == http.StatusTooManyRequests:
+				retry.add(doc, batch.lines[i])
+			default:
+				failed++
+				if err := s.deadLetters.Add(ctx, newFailedDocument(doc.TargetIndex(s.config.ElkIndexTo), doc, result.Status, result.Error.Type, result.Error.String())); err != nil {
+					return nil, err
+				}
+				done = append(done, doc)
+			}
+		}
+	}
+
+	// Documents indexed or recorded in the dead-letter sink let the export checkpoint move past them
+	ackDocuments(done)
+
+	logger.Warn("Bulk request had rejected documents", zap.Int("failed", failed), zap.Int("retry", retry.Len()), zap.Int("documents_count", batch.Len()))
+	return retry, nil
+}
+
+// newFailedDocument builds the dead-letter record of a document rejected by the target.
+func newFailedDocument(index string, doc *Document, status int, errorType, reason string) *FailedDocument {
+	return &FailedDocument{
+		Index:     index,
+		ID:        doc.ID,
+		Type:      doc.Type,
+		Routing:   doc.BulkRouting(),
+		Status:    status,
+		ErrorType: errorType,
+		Reason:    reason,
+		Source:    doc.Source,
+		FailedAt:  time.Now(),
+	}
+}
@@ -0,0 +1,89 @@
+package pipeline
+
+import (
+	"elkmigration/clients"
+	"elkmigration/config"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/olivere/elastic.v3"
+)
+
+// Slice identifies one of Max disjoint partitions of the source index, read by one export worker.
+// A Slice with Max <= 1 covers the whole index.
+type Slice struct {
+	ID  int
+	Max int
+}
+
+// Sliced reports whether the export is split into several slices.
+func (s Slice) Sliced() bool {
+	return s.Max > 1
+}
+
+// checkpointKey is the key holding the checkpoint of one slice of the source index, in the job namespace.
+// Each slice of a sliced export gets its own key so the workers never share state.
+func checkpointKey(config *config.Config, slice Slice) string {
+	name := ""
+	if slice.Sliced() {
+		name = fmt.Sprintf("%d/%d", slice.ID, slice.Max)
+	}
+	return clients.NewNamespace(config).Checkpoint(config.ElkIndexFrom, config.ElkIndexTo, name)
+}
+
+// es2ShardPreference partitions the primary shards of an ES2 index between the slices
+// and returns the search preference restricting a scroll to this slice.
+// ES2 has no sliced scroll, so the slices are split by shard.
+func es2ShardPreference(client *elastic.Client, index string, slice Slice) (string, error) {
+	shards, err := es2ShardCount(client, index)
+	if err != nil {
+		return "", err
+	}
+	return shardPreference(shards, slice)
+}
+
+// shardPreference returns the "_shards:n,m" search preference of a slice: shard n is read by slice n % Max.
+func shardPreference(shards int, slice Slice) (string, error) {
+	var assigned []string
+	for shard := slice.ID; shard < shards; shard += slice.Max {
+		assigned = append(assigned, strconv.Itoa(shard))
+	}
+	if len(assigned) == 0 {
+		return "", fmt.Errorf("slice %d has no shards: index has %d shards for %d slices", slice.ID, shards, slice.Max)
+	}
+	return "_shards:" + strings.Join(assigned, ","), nil
+}
+
+// es2ShardCount returns the number of primary shards of an index.
+// For an alias or wildcard the largest shard count of the matching indices is returned.
+func es2ShardCount(client *elastic.Client, index string) (int, error) {
+	settings, err := client.IndexGetSettings(index).FlatSettings(true).Do()
+	if err != nil {
+		return 0, err
+	}
+
+	indexSettings := make([]map[string]interface{}, 0, len(settings))
+	for _, response := range settings {
+		indexSettings = append(indexSettings, response.Settings)
+	}
+	return maxShardCount(index, indexSettings)
+}
+
+// maxShardCount returns the largest index.number_of_shards in a list of flat index settings.
+func maxShardCount(index string, indexSettings []map[string]interface{}) (int, error) {
+	shards := 0
+	for _, settings := range indexSettings {
+		value, _ := settings["index.number_of_shards"].(string)
+		count, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid index.number_of_shards %q: %w", value, err)
+		}
+		shards = max(shards, count)
+	}
+	if shards == 0 {
+		return 0, errors.New("no shards found for index " + index)
+	}
+	return shards, nil
+}
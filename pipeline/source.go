@@ -0,0 +1,111 @@
+package pipeline
+
+import (
+	"context"
+	"elkmigration/clients"
+	"elkmigration/config"
+	"elkmigration/logger"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// Source reads the documents of one slice of the source index.
+type Source interface {
+	// Open starts reading right after the given committed checkpoint (zero to read from the beginning).
+	Open(ctx context.Context, from Checkpoint) error
+	// Next returns the next batch of documents, or an empty batch once the slice is exhausted.
+	// After an error Next may be called again to retry.
+	Next(ctx context.Context) ([]*Document, error)
+	// Checkpoint returns the position to resume from after doc, a document returned by Next.
+	Checkpoint(doc *Document) Checkpoint
+	// Close releases the cursor on the source cluster.
+	Close() error
+}
+
+// NewSource creates the Source reading one slice of ELK_INDEX_FROM for the given client,
+// restricted by filter if it is not nil. With SOURCE_TYPE=file the slice of SOURCE_FILES is read
+// instead, and client is not used. Lines that are not documents, and hits whose _source cannot be
+// parsed, go to deadLetters, if not nil.
+func NewSource(client clients.ElasticsearchClient, config *config.Config, slice Slice, filter *ExportFilter, deadLetters *DeadLetterQueue) (Source, error) {
+	if config.SourceType == SourceFile {
+		return NewFileSource(config, slice, filter, deadLetters)
+	}
+	switch c := client.(type) {
+	case *clients.ES2Client:
+		return NewES2Source(c, config, slice, filter, deadLetters), nil
+	case *clients.ES7Client:
+		return NewRestSource(c, config, slice, filter, deadLetters)
+	case *clients.ES8Client:
+		return NewRestSource(c, config, slice, filter, deadLetters)
+	default:
+		return nil, fmt.Errorf("unsupported source client %T", client)
+	}
+}
+
+// ReadSource reads every document of ELK_INDEX_FROM matching filter, without checkpoints, and passes
+// them to handle. Reading stops at the first error, including one returned by handle. Lines of
+// source files that are not documents, and hits whose _source cannot be parsed, are only logged.
+func ReadSource(ctx context.Context, client clients.ElasticsearchClient, config *config.Config, filter *ExportFilter, handle func(doc *Document) error) error {
+	source, err := NewSource(client, config, Slice{}, filter, nil)
+	if err != nil {
+		return err
+	}
+	if err := source.Open(ctx, Checkpoint{}); err != nil {
+		return err
+	}
+	defer func() {
+		if err := source.Close(); err != nil {
+			logger.Warn("Failed to close source", zap.Error(err))
+		}
+	}()
+
+	for {
+		batch, err := source.Next(ctx)
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		for _, doc := range batch {
+			if err := handle(doc); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// rejectSource logs a hit whose _source cannot be parsed and sends it to deadLetters, if not nil,
+// with its raw source. The error of the dead-letter queue is returned.
+func rejectSource(ctx context.Context, deadLetters *DeadLetterQueue, config *config.Config, doc *Document, source []byte, err error) error {
+	logger.Warn("Error unmarshalling document", zap.String("hit ID", doc.ID), zap.Error(err))
+	if deadLetters == nil {
+		return nil
+	}
+	failed := newFailedDocument(config.ElkIndexTo, doc, 0, "parse_error", err.Error())
+	failed.RawSource = string(source)
+	return deadLetters.Add(ctx, failed)
+}
+
+// resumeSkipper skips documents up to and including the last committed one, for sources
+// that cannot query for the documents after a checkpoint and have to re-read from the start.
+type resumeSkipper struct {
+	lastID string
+}
+
+// skip reports whether a document with the given _id was already committed.
+func (r *resumeSkipper) skip(id string) bool {
+	if r.lastID == "" {
+		return false
+	}
+	if id == r.lastID {
+		r.lastID = ""
+	}
+	return true
+}
+
+// skipping reports whether the last committed document has not been reached yet.
+func (r *resumeSkipper) skipping() bool {
+	return r.lastID != ""
+}
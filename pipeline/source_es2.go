@@ -0,0 +1,231 @@
+package pipeline
+
+import (
+	"context"
+	"elkmigration/clients"
+	"elkmigration/config"
+	"elkmigration/logger"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"go.uber.org/zap"
+	"gopkg.in/olivere/elastic.v3"
+)
+
+const es2TiebreakerField = "_uid" // unique on ES2, used to break ties on a non-unique SORT_FIELD
+
+// ES2Source reads a slice of an ES2 index with the scroll API.
+// Slices are split by shard since ES2 has no sliced scroll. In sorted mode the scroll is
+// sorted on SORT_FIELD and _uid, and a restart opens a new scroll after the last sort values.
+type ES2Source struct {
+	client      *elastic.Client
+	config      *config.Config
+	slice       Slice
+	filter      *ExportFilter
+	deadLetters *DeadLetterQueue
+
+	preference string
+	sorted     bool
+	sortFields []string
+
+	scroll   *elastic.ScrollService
+	scrollID string
+	lastSort []interface{} // sort values of the last document read
+	reopen   bool          // open a new scroll after lastSort on the next call, after a failure
+	skipper  resumeSkipper
+
+	pending []*elastic.SearchHit // hits of the current page not returned yet
+}
+
+func NewES2Source(client *clients.ES2Client, config *config.Config, slice Slice, filter *ExportFilter, deadLetters *DeadLetterQueue) *ES2Source {
+	return &ES2Source{
+		client:      client.Client,
+		config:      config,
+		slice:       slice,
+		filter:      filter,
+		deadLetters: deadLetters,
+		sorted:      config.ExportMode == exportModeSorted,
+		sortFields:  es2SortFields(config.SortField),
+	}
+}
+
+func (s *ES2Source) Open(_ context.Context, from Checkpoint) error {
+	// Restrict the scroll to the shards of this slice
+	if s.slice.Sliced() {
+		preference, err := es2ShardPreference(s.client, s.config.ElkIndexFrom, s.slice)
+		if err != nil {
+			return err
+		}
+		s.preference = preference
+		logger.Info("Exporting slice", zap.Int("slice", s.slice.ID), zap.Int("slices", s.slice.Max), zap.String("preference", preference))
+	}
+
+	// A scroll ID cannot be replayed, so a resumed run opens a new scroll.
+	// In sorted mode it starts right after the last committed sort values;
+	// otherwise it skips documents up to and including the last committed one.
+	if s.sorted && len(from.SortValues) == len(s.sortFields) {
+		s.lastSort = from.SortValues
+	} else if from.LastID != "" {
+		if s.sorted {
+			logger.Warn("No sort values in checkpoint, resuming by skipping to the last committed ID")
+		}
+		s.skipper = resumeSkipper{lastID: from.LastID}
+	}
+
+	s.scroll = newES2Scroll(s.client, s.config, s.filter, s.preference, s.sorted, s.sortFields, s.lastSort)
+	return nil
+}
+
+func (s *ES2Source) Next(ctx context.Context) ([]*Document, error) {
+	for {
+		// Hits of the last page are returned before the scroll goes on. A page made
+		// only of skipped documents is not the end of the index.
+		if len(s.pending) > 0 {
+			batch, err := s.documents(ctx)
+			if err != nil || len(batch) > 0 {
+				return batch, err
+			}
+			continue
+		}
+
+		// The scroll context may have expired; a sorted export can reopen
+		// a fresh one after the last document it read.
+		if s.reopen && s.sorted && !s.skipper.skipping() {
+			s.scroll = newES2Scroll(s.client, s.config, s.filter, s.preference, s.sorted, s.sortFields, s.lastSort)
+		}
+
+		result, err := s.scroll.DoC(ctx)
+		if errors.Is(err, io.EOF) {
+			// The scroll service reports a page without hits as EOF: the scroll has reached the end
+			s.reopen = false
+			return nil, nil
+		}
+		if err != nil {
+			s.reopen = true
+			return nil, err
+		}
+		s.reopen = false
+		s.scrollID = result.ScrollId
+
+		// Check if the scroll has reached the end
+		if result.Hits == nil || len(result.Hits.Hits) == 0 {
+			return nil, nil
+		}
+
+		// Update the scroll with the current scroll ID
+		s.scroll = s.client.Scroll(s.config.ElkIndexFrom).Size(s.config.BulkSize).Version(true).Preference(s.preference).ScrollId(result.ScrollId).Scroll(s.config.ScrollTimeout)
+		s.pending = result.Hits.Hits
+	}
+}
+
+// documents converts the pending hits of the page. A hit whose _source cannot be parsed goes to the
+// dead-letter queue; when the queue cannot store it, the documents before it are returned, or the
+// error if there are none, and the hit stays pending for the next call.
+func (s *ES2Source) documents(ctx context.Context) ([]*Document, error) {
+	batch := make([]*Document, 0, len(s.pending))
+	for ; len(s.pending) > 0; s.pending = s.pending[1:] {
+		hit := s.pending[0]
+		s.lastSort = hit.Sort
+
+		// Skip documents until we reach the one after lastID on recovery
+		if s.skipper.skip(hit.Id) {
+			continue
+		}
+
+		// Process the document, keeping the hit metadata in the envelope
+		doc := &Document{
+			ID:       hit.Id,
+			Type:     hit.Type,
+			Routing:  hit.Routing,
+			Parent:   hit.Parent,
+			Version:  hit.Version,
+			position: Checkpoint{ScrollID: s.scrollID, SortValues: hit.Sort},
+		}
+		if hit.Source == nil {
+			// Source filtering may leave nothing of the document
+			doc.Source = map[string]interface{}{}
+		} else if err := json.Unmarshal(*hit.Source, &doc.Source); err != nil {
+			if err := rejectSource(ctx, s.deadLetters, s.config, doc, *hit.Source, err); err != nil {
+				if len(batch) > 0 {
+					return batch, nil
+				}
+				return nil, err
+			}
+			continue
+		}
+		batch = append(batch, doc)
+	}
+	return batch, nil
+}
+
+func (s *ES2Source) Checkpoint(doc *Document) Checkpoint {
+	return doc.position
+}
+
+func (s *ES2Source) Close() error {
+	if s.scrollID == "" {
+		return nil
+	}
+	_, err := s.client.ClearScroll(s.scrollID).Do()
+	return err
+}
+
+// es2SortFields returns the sort fields of a sorted export: SORT_FIELD followed by
+// the _uid tiebreaker, so the sort order is total and a restart point is unambiguous.
+func es2SortFields(sortField string) []string {
+	if sortField == "" || sortField == es2TiebreakerField {
+		return []string{es2TiebreakerField}
+	}
+	return []string{sortField, es2TiebreakerField}
+}
+
+// newES2Scroll opens a new scroll over the source index, restricted to the shards in preference if set
+// and to the documents and fields of the export filter.
+// In sorted mode the scroll is sorted on sortFields and, when after is set,
+// restricted to documents sorting strictly after those sort values.
+func newES2Scroll(client *elastic.Client, config *config.Config, filter *ExportFilter, preference string, sorted bool, sortFields []string, after []interface{}) *elastic.ScrollService {
+	scroll := client.Scroll(config.ElkIndexFrom).Size(config.BulkSize).Version(true).Preference(preference).Scroll(config.ScrollTimeout)
+	if filter != nil && filter.NoSource {
+		scroll = scroll.FetchSource(false)
+	} else if filter != nil && (len(filter.Includes) > 0 || len(filter.Excludes) > 0) {
+		scroll = scroll.FetchSourceContext(elastic.NewFetchSourceContext(true).Include(filter.Includes...).Exclude(filter.Excludes...))
+	}
+
+	var query elastic.Query
+	if filter != nil && filter.Query != nil {
+		query = rawQuery(filter.Query)
+	}
+	if sorted {
+		for _, field := range sortFields {
+			scroll = scroll.Sort(field, true)
+		}
+		if len(after) == len(sortFields) {
+			if query == nil {
+				query = searchAfterQuery(sortFields, after)
+			} else {
+				query = elastic.NewBoolQuery().Filter(query, searchAfterQuery(sortFields, after))
+			}
+		}
+	}
+	if query != nil {
+		scroll = scroll.Query(query)
+	}
+	return scroll
+}
+
+// searchAfterQuery emulates search_after, which ES2 lacks, with a query matching
+// documents whose sort values are lexicographically greater than after:
+// (f0 > v0) OR (f0 = v0 AND f1 > v1) OR ...
+func searchAfterQuery(sortFields []string, after []interface{}) elastic.Query {
+	query := elastic.NewBoolQuery().MinimumNumberShouldMatch(1)
+	for i, field := range sortFields {
+		clause := elastic.NewBoolQuery()
+		for j := 0; j < i; j++ {
+			clause = clause.Filter(elastic.NewTermQuery(sortFields[j], after[j]))
+		}
+		clause = clause.Filter(elastic.NewRangeQuery(field).Gt(after[i]))
+		query = query.Should(clause)
+	}
+	return query
+}
@@ -0,0 +1,515 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"elkmigration/config"
+	"elkmigration/logger"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
+)
+
+// Source types, selected with SOURCE_TYPE
+const (
+	SourceElasticsearch = "elasticsearch"
+	SourceFile          = "file"
+)
+
+// Formats of the files read by the file source, selected with SOURCE_FILE_FORMAT
+const (
+	FileFormatAuto   = "auto"   // detected from the first line of each file
+	FileFormatNDJSON = "ndjson" // one document per line, as DocumentRecord or as a bare _source
+	FileFormatBulk   = "bulk"   // bulk request bodies: an action line, followed by a source line except for deletes
+)
+
+// sourceFile is a file read by the file source, with what its manifest records of it.
+type sourceFile struct {
+	path   string
+	size   int64  // bytes to read, 0 for the whole file
+	sha256 string // expected checksum, empty when unknown
+}
+
+// FileSource reads documents from NDJSON dumps, such as those of the dump command or the file sink,
+// or from Elasticsearch bulk files. Files ending in .gz or .zst are decompressed.
+// The documents are written to ELK_INDEX_TO: the _index of the records is not kept.
+// Lines that cannot be parsed are sent to the dead-letter queue, when there is one, with their file and offset.
+// Files are split between the slices, file n being read by slice n % Max, and the checkpoint
+// records the file and the uncompressed offset after the last committed document. A restart
+// seeks to that offset, or decompresses the file up to it.
+type FileSource struct {
+	config      *config.Config
+	slice       Slice
+	files       []sourceFile
+	deadLetters *DeadLetterQueue // nil to only log invalid lines
+
+	current int         // index of the file being read
+	offset  int64       // where to open the current file, right after the last document returned
+	reader  *fileReader // nil until the current file is opened
+	err     error       // set once a file fails its checksum
+}
+
+func NewFileSource(config *config.Config, slice Slice, filter *ExportFilter, deadLetters *DeadLetterQueue) (*FileSource, error) {
+	// Queries are run by the source cluster, which files do not have
+	if filter.Active() {
+		return nil, errors.New("export queries and _source filtering are not supported with SOURCE_TYPE=file")
+	}
+	switch config.SourceFileFormat {
+	case FileFormatAuto, FileFormatNDJSON, FileFormatBulk:
+	default:
+		return nil, fmt.Errorf("unknown SOURCE_FILE_FORMAT %q, expected auto, ndjson or bulk", config.SourceFileFormat)
+	}
+	files, err := sourceFiles(config.SourceFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	source := &FileSource{config: config, slice: slice, deadLetters: deadLetters}
+	for i, file := range files {
+		if !slice.Sliced() || i%slice.Max == slice.ID {
+			source.files = append(source.files, file)
+		}
+	}
+	return source, nil
+}
+
+// sourceFiles expands SOURCE_FILES into the files to read, in order. A file sink directory or
+// manifest stands for the parts it lists; other entries are files or globs.
+func sourceFiles(list string) ([]sourceFile, error) {
+	var files []sourceFile
+	for _, entry := range splitList(list) {
+		manifest := entry
+		if info, err := os.Stat(entry); err == nil && info.IsDir() {
+			manifest = filepath.Join(entry, ManifestFile)
+		}
+		if filepath.Base(manifest) == ManifestFile {
+			parts, err := manifestFiles(manifest)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, parts...)
+			continue
+		}
+
+		matches, err := filepath.Glob(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SOURCE_FILES pattern %q: %w", entry, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no file matches %s", entry)
+		}
+		for _, match := range matches {
+			files = append(files, sourceFile{path: match})
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("SOURCE_FILES must name at least one file")
+	}
+	return files, nil
+}
+
+// manifestFiles returns the parts listed in a file sink manifest. A part left open by an interrupted
+// run is only read up to its last recorded batch.
+func manifestFiles(path string) ([]sourceFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var manifest FileManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	files := make([]sourceFile, 0, len(manifest.Parts))
+	for _, part := range manifest.Parts {
+		if part.Documents == 0 {
+			continue
+		}
+		files = append(files, sourceFile{path: filepath.Join(filepath.Dir(path), part.File), size: part.Bytes, sha256: part.SHA256})
+	}
+	return files, nil
+}
+
+func (s *FileSource) Open(_ context.Context, from Checkpoint) error {
+	if from.File != "" {
+		s.current = -1
+		for i, file := range s.files {
+			if file.path == from.File {
+				s.current, s.offset = i, from.Offset
+				break
+			}
+		}
+		if s.current < 0 {
+			return fmt.Errorf("checkpoint file %s is not among the SOURCE_FILES of slice %d", from.File, s.slice.ID)
+		}
+	}
+	logger.Info("Reading source files", zap.Int("slice", s.slice.ID), zap.Int("files", len(s.files)), zap.String("from", from.File), zap.Int64("offset", from.Offset))
+	return nil
+}
+
+// Next returns up to BULK_SIZE documents, going on with the next file at the end of one.
+// Documents already read are returned before an error, which comes up again on the next call:
+// after a read error the file is reopened after the last document returned, while a checksum
+// mismatch stops the source.
+func (s *FileSource) Next(ctx context.Context) ([]*Document, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	var batch []*Document
+	for len(batch) < s.config.BulkSize && s.current < len(s.files) {
+		file := s.files[s.current]
+		if s.reader == nil {
+			reader, err := openSourceFile(file, s.offset, s.config.SourceFileFormat)
+			if err != nil {
+				if len(batch) > 0 {
+					return batch, nil
+				}
+				return nil, fmt.Errorf("failed to open %s: %w", file.path, err)
+			}
+			reader.reject = s.reject
+			s.reader = reader
+		}
+
+		doc, err := s.reader.next(ctx)
+		if err != nil {
+			s.closeReader()
+			if len(batch) > 0 {
+				return batch, nil
+			}
+			return nil, fmt.Errorf("failed to read %s: %w", file.path, err)
+		}
+		if doc == nil {
+			err := s.reader.verify()
+			s.closeReader()
+			if err != nil {
+				s.err = fmt.Errorf("failed to read %s: %w", file.path, err)
+				break
+			}
+			s.current++
+			s.offset = 0
+			continue
+		}
+
+		s.offset = s.reader.offset
+		doc.position = Checkpoint{File: file.path, Offset: s.offset}
+		batch = append(batch, doc)
+	}
+	if len(batch) == 0 && s.err != nil {
+		return nil, s.err
+	}
+	return batch, nil
+}
+
+func (s *FileSource) Checkpoint(doc *Document) Checkpoint {
+	return doc.position
+}
+
+func (s *FileSource) Close() error {
+	s.closeReader()
+	return nil
+}
+
+// reject logs a line that cannot be read as a document and sends it to the dead-letter queue.
+// When the queue cannot store it the error is returned, and the line is read again on the next call to Next.
+func (s *FileSource) reject(ctx context.Context, doc *Document, path string, offset int64, line []byte, reason string) error {
+	logger.Warn("Skipping invalid line", zap.String("file", path), zap.Int64("offset", offset), zap.String("reason", reason))
+	if s.deadLetters == nil {
+		return nil
+	}
+	failed := newFailedDocument(s.config.ElkIndexTo, doc, 0, "parse_error", reason)
+	failed.File, failed.Offset, failed.Line = path, offset, string(line)
+	return s.deadLetters.Add(ctx, failed)
+}
+
+func (s *FileSource) closeReader() {
+	if s.reader != nil {
+		s.reader.close()
+		s.reader = nil
+	}
+}
+
+// fileReader reads the documents of one file, line by line.
+type fileReader struct {
+	path   string
+	format string
+	file   *os.File
+	closer io.Closer // decompressor, if any
+	lines  *bufio.Reader
+	offset int64 // uncompressed offset of the next line
+
+	// reject is called with the lines that are not documents, and the document read so far if any
+	// An error from reject is returned by next, before the line is skipped.
+	reject func(ctx context.Context, doc *Document, path string, offset int64, line []byte, reason string) error
+
+	// Checksum of the file, computed when it is read from its start
+	raw    io.Reader
+	hash   hash.Hash
+	sha256 string
+}
+
+// openSourceFile opens a file at an uncompressed offset, right after a document.
+func openSourceFile(source sourceFile, offset int64, format string) (*fileReader, error) {
+	file, err := os.Open(source.path)
+	if err != nil {
+		return nil, err
+	}
+	r := &fileReader{path: source.path, file: file, offset: offset}
+	if format != FileFormatAuto {
+		r.format = format
+	}
+
+	ext := strings.ToLower(filepath.Ext(source.path))
+	compressed := ext == ".gz" || ext == ".zst" || ext == ".zstd"
+	start := int64(0)
+	if !compressed && offset > 0 {
+		// Plain files are resumed by seeking, which leaves the checksum unchecked
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+		start = offset
+	}
+	var raw io.Reader = file
+	if source.size > 0 {
+		raw = io.LimitReader(file, source.size-start)
+	}
+	if source.sha256 != "" && start == 0 {
+		r.hash, r.sha256 = sha256.New(), source.sha256
+		raw = io.TeeReader(raw, r.hash)
+	}
+	r.raw = raw
+
+	var content io.Reader = raw
+	switch ext {
+	case ".gz":
+		gz, err := gzip.NewReader(raw)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		content, r.closer = gz, gz
+	case ".zst", ".zstd":
+		decoder, err := zstd.NewReader(raw)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		readCloser := decoder.IOReadCloser()
+		content, r.closer = readCloser, readCloser
+	}
+	r.lines = bufio.NewReaderSize(content, 1024*1024)
+
+	if compressed && offset > 0 {
+		if _, err := io.CopyN(io.Discard, r.lines, offset); err != nil {
+			r.close()
+			return nil, fmt.Errorf("failed to skip to offset %d: %w", offset, err)
+		}
+	}
+	return r, nil
+}
+
+// readLine returns the next line without its line break, nil at the end of the file.
+func (r *fileReader) readLine() ([]byte, error) {
+	line, err := r.lines.ReadBytes('\n')
+	r.offset += int64(len(line))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+// next returns the next document of the file, nil at its end. Lines that cannot be parsed are
+// passed to reject and skipped, unless reject fails.
+func (r *fileReader) next(ctx context.Context) (*Document, error) {
+	for {
+		start := r.offset
+		line, err := r.readLine()
+		if line == nil || err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if r.format == "" {
+			r.format = detectFileFormat(line)
+			logger.Info("Detected source file format", zap.String("file", r.path), zap.String("format", r.format))
+		}
+
+		if r.format == FileFormatNDJSON {
+			doc, err := parseRecordLine(line)
+			if err != nil {
+				if err := r.reject(ctx, &Document{}, r.path, start, line, fmt.Sprintf("invalid NDJSON line: %v", err)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			return doc, nil
+		}
+
+		doc, action, err := parseBulkAction(line)
+		if err != nil {
+			if err := r.reject(ctx, &Document{}, r.path, start, line, fmt.Sprintf("invalid bulk action: %v", err)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if action == "delete" {
+			continue
+		}
+		sourceStart := r.offset
+		source, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if source == nil {
+			return nil, fmt.Errorf("bulk %s action for %q has no source line", action, doc.ID)
+		}
+		if action == "update" {
+			// A partial document cannot be replayed as an index action without overwriting the rest
+			logger.Warn("Skipping bulk update action", zap.String("file", r.path), zap.String("id", doc.ID))
+			continue
+		}
+		if err := json.Unmarshal(source, &doc.Source); err != nil {
+			doc.Source = nil
+			if err := r.reject(ctx, doc, r.path, sourceStart, source, fmt.Sprintf("invalid bulk source: %v", err)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return doc, nil
+	}
+}
+
+// verify checks the checksum recorded in the manifest once the file is read to its end.
+func (r *fileReader) verify() error {
+	if r.hash == nil {
+		return nil
+	}
+	// The decompressor may stop before the end of what it was given
+	if _, err := io.Copy(io.Discard, r.raw); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(r.hash.Sum(nil)); sum != r.sha256 {
+		return fmt.Errorf("checksum %s does not match %s recorded in the manifest", sum, r.sha256)
+	}
+	return nil
+}
+
+func (r *fileReader) close() {
+	if r.closer != nil {
+		r.closer.Close()
+	}
+	r.file.Close()
+}
+
+// bulkActions are the action names of bulk request bodies.
+var bulkActions = map[string]bool{"index": true, "create": true, "update": true, "delete": true}
+
+// detectFileFormat tells bulk files, whose first line is an action such as {"index":{...}}, from NDJSON dumps.
+func detectFileFormat(line []byte) string {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(line, &object); err != nil || len(object) != 1 {
+		return FileFormatNDJSON
+	}
+	for name, value := range object {
+		if bulkActions[name] && bytes.HasPrefix(bytes.TrimSpace(value), []byte("{")) {
+			return FileFormatBulk
+		}
+	}
+	return FileFormatNDJSON
+}
+
+// parseRecordLine reads a DocumentRecord line, or a bare document without metadata when it has no _source.
+func parseRecordLine(line []byte) (*Document, error) {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(line, &object); err != nil {
+		return nil, err
+	}
+	if _, ok := object["_source"]; !ok {
+		doc := &Document{}
+		if err := json.Unmarshal(line, &doc.Source); err != nil {
+			return nil, err
+		}
+		return doc, nil
+	}
+
+	var record DocumentRecord
+	if err := json.Unmarshal(line, &record); err != nil {
+		return nil, err
+	}
+	if record.Source == nil {
+		record.Source = map[string]interface{}{}
+	}
+	return &Document{
+		ID:      record.ID,
+		Type:    record.Type,
+		Routing: record.Routing,
+		Parent:  record.Parent,
+		Version: record.Version,
+		Source:  record.Source,
+	}, nil
+}
+
+// bulkMetadata is the metadata of a bulk action, under the names of every Elasticsearch version.
+type bulkMetadata struct {
+	ID       string `json:"_id"`
+	Type     string `json:"_type"`
+	Routing  string `json:"routing"`
+	Routing2 string `json:"_routing"`
+	Parent   string `json:"parent"`
+	Parent2  string `json:"_parent"`
+	Version  *int64 `json:"version"`
+	Version2 *int64 `json:"_version"`
+}
+
+// parseBulkAction reads an action line into a document without source, and returns the action name.
+// Every action but delete is followed by a source line.
+func parseBulkAction(line []byte) (*Document, string, error) {
+	var action map[string]bulkMetadata
+	if err := json.Unmarshal(line, &action); err != nil {
+		return nil, "", err
+	}
+	if len(action) != 1 {
+		return nil, "", fmt.Errorf("expected one action, got %d", len(action))
+	}
+	for name, meta := range action {
+		if !bulkActions[name] {
+			return nil, "", fmt.Errorf("unknown bulk action %q", name)
+		}
+		version := meta.Version
+		if version == nil {
+			version = meta.Version2
+		}
+		return &Document{
+			ID:      meta.ID,
+			Type:    meta.Type,
+			Routing: firstOf(meta.Routing, meta.Routing2),
+			Parent:  firstOf(meta.Parent, meta.Parent2),
+			Version: version,
+		}, name, nil
+	}
+	return nil, "", nil
+}
+
+func firstOf(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
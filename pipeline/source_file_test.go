@@ -0,0 +1,107 @@
+package pipeline
+
+import (
+	"context"
+	"elkmigration/config"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// readFileSource reads every document of a file with the file source.
+func readFileSource(t *testing.T, path, format string, deadLetters *DeadLetterQueue) []*Document {
+	t.Helper()
+	cfg := &config.Config{SourceType: SourceFile, SourceFiles: path, SourceFileFormat: format, BulkSize: 2, ElkIndexTo: "target"}
+	source, err := NewFileSource(cfg, Slice{}, &ExportFilter{}, deadLetters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := source.Open(ctx, Checkpoint{}); err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	var docs []*Document
+	for {
+		batch, err := source.Next(ctx)
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if len(batch) == 0 {
+			return docs
+		}
+		docs = append(docs, batch...)
+	}
+}
+
+func TestFileSourceDeadLettersInvalidLines(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		data   string
+		ids    []string
+		failed []FailedDocument
+	}{
+		{
+			name:   "ndjson",
+			format: FileFormatNDJSON,
+			data:   `{"_id": "1", "_source": {"a": 1}}` + "\n" + `{"_id": "2", "_source": ` + "\n" + `{"_id": "3", "_source": {}}` + "\n",
+			ids:    []string{"1", "3"},
+			failed: []FailedDocument{{Offset: 34, Line: `{"_id": "2", "_source": `}},
+		},
+		{
+			name:   "bulk action",
+			format: FileFormatBulk,
+			data:   `{"index": {"_id": "1"}}` + "\n" + `{"a": 1}` + "\n" + `{"upsert": {"_id": "2"}}` + "\n" + `{"index": {"_id": "3"}}` + "\n" + `{"a": 3}` + "\n",
+			ids:    []string{"1", "3"},
+			failed: []FailedDocument{{Offset: 33, Line: `{"upsert": {"_id": "2"}}`}},
+		},
+		{
+			name:   "bulk source",
+			format: FileFormatBulk,
+			data:   `{"index": {"_id": "1"}}` + "\n" + `{"a": }` + "\n" + `{"index": {"_id": "2"}}` + "\n" + `{"a": 2}` + "\n",
+			ids:    []string{"2"},
+			failed: []FailedDocument{{ID: "1", Offset: 24, Line: `{"a": }`}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "docs.ndjson")
+			if err := os.WriteFile(path, []byte(tt.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			deadLetters, recorded := newRecordedQueue()
+			docs := readFileSource(t, path, tt.format, deadLetters)
+
+			var ids []string
+			for _, doc := range docs {
+				ids = append(ids, doc.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.ids) {
+				t.Errorf("read %v, want %v", ids, tt.ids)
+			}
+
+			failed := recorded.documents()
+			if len(failed) != len(tt.failed) {
+				t.Fatalf("dead-lettered %d lines, want %d", len(failed), len(tt.failed))
+			}
+			for i, want := range tt.failed {
+				got := failed[i]
+				if got.Index != "target" || got.ID != want.ID || got.File != path || got.Offset != want.Offset || got.Line != want.Line || got.ErrorType != "parse_error" || got.Source != nil {
+					t.Errorf("dead letter %d = %+v, want %+v at %s", i, got, want, path)
+				}
+			}
+		})
+	}
+}
+
+func TestFileSourceWithoutDeadLetters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "docs.ndjson")
+	if err := os.WriteFile(path, []byte("not json\n"+`{"_id": "1", "_source": {}}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if docs := readFileSource(t, path, FileFormatNDJSON, nil); len(docs) != 1 || docs[0].ID != "1" {
+		t.Errorf("read %v, want document 1", docs)
+	}
+}
@@ -0,0 +1,351 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"elkmigration/clients"
+	"elkmigration/config"
+	"elkmigration/logger"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	restTiebreakerField = "_id"        // unique on ES7, used to break ties on a non-unique SORT_FIELD
+	pitTiebreakerField  = "_shard_doc" // the order of the documents in a point in time, used instead on ES8
+)
+
+// searchResponse is the subset of an ES7/ES8 search or scroll response read by the export.
+type searchResponse struct {
+	ScrollID string `json:"_scroll_id"`
+	PitID    string `json:"pit_id"`
+	Hits     struct {
+		Hits []searchHit `json:"hits"`
+	} `json:"hits"`
+}
+
+type searchHit struct {
+	Index   string          `json:"_index"`
+	Type    string          `json:"_type"`
+	ID      string          `json:"_id"`
+	Routing string          `json:"_routing"`
+	Version *int64          `json:"_version"`
+	Source  json.RawMessage `json:"_source"`
+	Sort    []interface{}   `json:"sort"`
+}
+
+// RestSource reads a slice of an ES7 or ES8 index through the REST search API.
+// In scroll mode it uses a sliced scroll; in sorted mode it pages with search_after on
+// SORT_FIELD and _id, so every page is a fresh query and nothing expires between restarts.
+// ES8 cannot sort on _id: there the sorted pages are searched in a point in time and sorted on
+// SORT_FIELD and _shard_doc. The point in time is recorded in the checkpoint and left open when the
+// export stops early, so a restart within SCROLL_TIMEOUT goes on in it; once it has expired, the
+// export goes back to the first document with the last committed SORT_FIELD value.
+type RestSource struct {
+	client      clients.SearchClient
+	config      *config.Config
+	slice       Slice
+	filter      *ExportFilter
+	deadLetters *DeadLetterQueue
+
+	keepAlive  time.Duration
+	preference string
+	sorted     bool
+	sortFields []string
+
+	scrollID string
+	lastSort []interface{} // sort values of the last document read
+	skipper  resumeSkipper
+
+	pit   clients.PointInTimeClient // set in sorted mode on ES8
+	pitID string
+	done  bool // every document was read
+
+	pending       []searchHit // hits of the current page not returned yet
+	pendingCursor string      // scroll or point in time ID of the pending hits
+}
+
+// NewRestSource creates a source for an ES7 or ES8 client. Hits whose _source cannot be parsed go to
+// deadLetters, if not nil.
+func NewRestSource(client clients.SearchClient, config *config.Config, slice Slice, filter *ExportFilter, deadLetters *DeadLetterQueue) (*RestSource, error) {
+	keepAlive, err := time.ParseDuration(config.ScrollTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SCROLL_TIMEOUT: %w", err)
+	}
+	source := &RestSource{
+		client:      client,
+		config:      config,
+		slice:       slice,
+		filter:      filter,
+		deadLetters: deadLetters,
+		keepAlive:   keepAlive,
+		sorted:      config.ExportMode == exportModeSorted,
+	}
+	if pit, ok := client.(clients.PointInTimeClient); ok && source.sorted {
+		source.pit = pit
+	}
+	source.sortFields = restSortFields(config.SortField, source.pit != nil)
+	return source, nil
+}
+
+func (s *RestSource) Open(ctx context.Context, from Checkpoint) error {
+	// Sliced scroll has no search_after equivalent without a point in time,
+	// so a sorted export splits slices by shard like on ES2.
+	if s.sorted && s.slice.Sliced() && s.pit == nil {
+		preference, err := s.shardPreference(ctx)
+		if err != nil {
+			return err
+		}
+		s.preference = preference
+	}
+
+	if s.sorted && len(from.SortValues) == len(s.sortFields) {
+		s.lastSort = from.SortValues
+		if s.pit != nil {
+			s.pitID = from.ScrollID
+		}
+	} else if from.LastID != "" {
+		if s.sorted {
+			logger.Warn("No sort values in checkpoint, resuming by skipping to the last committed ID")
+		}
+		s.skipper = resumeSkipper{lastID: from.LastID}
+	}
+	if s.pit != nil && s.pitID == "" {
+		return s.openPointInTime(ctx)
+	}
+	return nil
+}
+
+func (s *RestSource) Next(ctx context.Context) ([]*Document, error) {
+	for {
+		// Hits of the last page are returned before the next page is read. A page made
+		// only of skipped documents is not the end of the index.
+		if len(s.pending) > 0 {
+			batch, err := s.documents(ctx)
+			if err != nil || len(batch) > 0 {
+				return batch, err
+			}
+			continue
+		}
+
+		// Sorted mode queries the next page after lastSort; scroll mode follows the scroll ID
+		var result *searchResponse
+		var err error
+		if s.sorted || s.scrollID == "" {
+			result, err = s.search(ctx)
+		} else {
+			result, err = decodeSearchResponse(s.client.Scroll(ctx, s.scrollID, s.keepAlive))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if result.ScrollID != "" {
+			s.scrollID = result.ScrollID
+		}
+
+		// Check if the scroll has reached the end
+		if len(result.Hits.Hits) == 0 {
+			s.done = true
+			return nil, nil
+		}
+		s.pending, s.pendingCursor = result.Hits.Hits, firstOf(result.ScrollID, result.PitID)
+	}
+}
+
+// documents converts the pending hits of the page. A hit whose _source cannot be parsed goes to the
+// dead-letter queue; when the queue cannot store it, the documents before it are returned, or the
+// error if there are none, and the hit stays pending for the next call.
+func (s *RestSource) documents(ctx context.Context) ([]*Document, error) {
+	batch := make([]*Document, 0, len(s.pending))
+	for ; len(s.pending) > 0; s.pending = s.pending[1:] {
+		hit := s.pending[0]
+		s.lastSort = hit.Sort
+
+		// Skip documents until we reach the one after lastID on recovery
+		if s.skipper.skip(hit.ID) {
+			continue
+		}
+
+		// Process the document, keeping the hit metadata in the envelope
+		doc := &Document{
+			ID:       hit.ID,
+			Type:     hit.Type,
+			Routing:  hit.Routing,
+			Version:  hit.Version,
+			position: Checkpoint{ScrollID: s.pendingCursor, SortValues: hit.Sort},
+		}
+		if len(hit.Source) == 0 {
+			// Source filtering may leave nothing of the document
+			doc.Source = map[string]interface{}{}
+		} else if err := json.Unmarshal(hit.Source, &doc.Source); err != nil {
+			if err := rejectSource(ctx, s.deadLetters, s.config, doc, hit.Source, err); err != nil {
+				if len(batch) > 0 {
+					return batch, nil
+				}
+				return nil, err
+			}
+			continue
+		}
+		batch = append(batch, doc)
+	}
+	return batch, nil
+}
+
+func (s *RestSource) Checkpoint(doc *Document) Checkpoint {
+	return doc.position
+}
+
+func (s *RestSource) Close() error {
+	if s.pit != nil && s.pitID != "" && s.done {
+		return s.pit.ClosePointInTime(context.Background(), s.pitID)
+	}
+	if s.scrollID == "" {
+		return nil
+	}
+	return s.client.ClearScroll(context.Background(), s.scrollID)
+}
+
+// openPointInTime opens a new point in time for the sorted pages. Sort values read in another point in
+// time do not order the documents of this one by _shard_doc: the export goes back to the first document
+// with the last SORT_FIELD value read, whose documents are read again, or to the start without SORT_FIELD.
+func (s *RestSource) openPointInTime(ctx context.Context) error {
+	id, err := s.pit.OpenPointInTime(ctx, s.config.ElkIndexFrom, s.keepAlive)
+	if err != nil {
+		return fmt.Errorf("failed to open point in time: %w", err)
+	}
+	s.pitID = id
+	switch {
+	case len(s.lastSort) != len(s.sortFields):
+	case len(s.sortFields) > 1:
+		s.lastSort = []interface{}{s.lastSort[0], -1}
+	default:
+		logger.Warn("Restarting the export in a new point in time, set SORT_FIELD to resume it instead", zap.Int("slice", s.slice.ID))
+		s.lastSort = nil
+	}
+	return nil
+}
+
+// search opens the scroll, or runs the next search_after query in sorted mode.
+func (s *RestSource) search(ctx context.Context) (*searchResponse, error) {
+	body := map[string]interface{}{"version": true}
+	if s.filter != nil && s.filter.Query != nil {
+		body["query"] = s.filter.Query
+	}
+	if source := s.filter.sourceFilter(); source != nil {
+		body["_source"] = source
+	}
+	index, keepAlive := s.config.ElkIndexFrom, s.keepAlive
+	if s.pit != nil {
+		// The point in time names the index, and is sliced like a scroll
+		body["pit"] = map[string]string{"id": s.pitID, "keep_alive": fmt.Sprintf("%dms", s.keepAlive.Milliseconds())}
+		if s.slice.Sliced() {
+			body["slice"] = map[string]int{"id": s.slice.ID, "max": s.slice.Max}
+		}
+		index = ""
+	}
+	if s.sorted {
+		sort := make([]map[string]string, 0, len(s.sortFields))
+		for _, field := range s.sortFields {
+			sort = append(sort, map[string]string{field: "asc"})
+		}
+		body["sort"] = sort
+		if len(s.lastSort) == len(s.sortFields) {
+			body["search_after"] = s.lastSort
+		}
+		keepAlive = 0
+	} else {
+		body["sort"] = []string{"_doc"}
+		if s.slice.Sliced() {
+			body["slice"] = map[string]int{"id": s.slice.ID, "max": s.slice.Max}
+		}
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	status, response, err := s.client.Search(ctx, index, bytes.NewReader(payload), s.config.BulkSize, keepAlive, s.preference)
+	if err == nil && s.pit != nil && status == http.StatusNotFound {
+		// The point in time expired
+		response.Close()
+		logger.Warn("Point in time expired, opening a new one", zap.Int("slice", s.slice.ID))
+		if err := s.openPointInTime(ctx); err != nil {
+			return nil, err
+		}
+		return s.search(ctx)
+	}
+	result, err := decodeSearchResponse(status, response, err)
+	if err == nil && result.PitID != "" {
+		s.pitID = result.PitID
+	}
+	return result, err
+}
+
+// shardPreference returns the "_shards:n,m" search preference restricting a search to the shards of the slice.
+func (s *RestSource) shardPreference(ctx context.Context) (string, error) {
+	status, body, err := s.client.IndexSettings(ctx, s.config.ElkIndexFrom)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	if status != http.StatusOK {
+		return "", fmt.Errorf("get settings failed: %d %s", status, http.StatusText(status))
+	}
+
+	var response map[string]struct {
+		Settings map[string]interface{} `json:"settings"`
+	}
+	if err := json.NewDecoder(body).Decode(&response); err != nil {
+		return "", err
+	}
+	indexSettings := make([]map[string]interface{}, 0, len(response))
+	for _, settings := range response {
+		indexSettings = append(indexSettings, settings.Settings)
+	}
+
+	shards, err := maxShardCount(s.config.ElkIndexFrom, indexSettings)
+	if err != nil {
+		return "", err
+	}
+	return shardPreference(shards, s.slice)
+}
+
+// restSortFields returns the sort fields of a sorted export: SORT_FIELD followed by the _id tiebreaker,
+// or _shard_doc in a point in time. The ES2 default of _uid does not exist on ES7/ES8 and maps to the
+// tiebreaker, like _id.
+func restSortFields(sortField string, pointInTime bool) []string {
+	tiebreaker := restTiebreakerField
+	if pointInTime {
+		tiebreaker = pitTiebreakerField
+	}
+	if sortField == "" || sortField == es2TiebreakerField || sortField == restTiebreakerField || sortField == tiebreaker {
+		return []string{tiebreaker}
+	}
+	return []string{sortField, tiebreaker}
+}
+
+// decodeSearchResponse checks and decodes a search or scroll response.
+// Sort values are decoded as json.Number so long values survive the round trip to the checkpoint.
+func decodeSearchResponse(status int, body io.ReadCloser, err error) (*searchResponse, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	if status > 299 {
+		message, _ := io.ReadAll(body)
+		return nil, fmt.Errorf("search failed: %d %s: %s", status, http.StatusText(status), message)
+	}
+
+	var result searchResponse
+	decoder := json.NewDecoder(body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode search response: %w", err)
+	}
+	return &result, nil
+}
@@ -0,0 +1,174 @@
+package pipeline
+
+import (
+	"context"
+	"elkmigration/clients"
+	"elkmigration/config"
+	"elkmigration/estest"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// newSortedServer returns a fake cluster whose logs index holds documents 0 to count-1, with an n field
+// shared by pairs of documents so the sort needs its tiebreaker.
+func newSortedServer(t *testing.T, version, count int) (*estest.Server, clients.SearchClient) {
+	t.Helper()
+	server := estest.NewServer(version)
+	t.Cleanup(server.Close)
+	if err := server.CreateIndex("logs", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := count - 1; i >= 0; i-- {
+		doc := estest.Document{ID: fmt.Sprintf("doc-%02d", i), Source: map[string]interface{}{"n": i / 2}}
+		if err := server.AddDocuments("logs", doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, client.(clients.SearchClient)
+}
+
+func sortedConfig(sortField string) *config.Config {
+	return &config.Config{ElkIndexFrom: "logs", BulkSize: 3, ScrollTimeout: "1m", ExportMode: exportModeSorted, SortField: sortField}
+}
+
+// readBatches opens a source at from and reads up to limit batches, all when limit is zero.
+func readBatches(t *testing.T, source Source, from Checkpoint, limit int) []*Document {
+	t.Helper()
+	ctx := context.Background()
+	if err := source.Open(ctx, from); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	var docs []*Document
+	for batches := 0; limit == 0 || batches < limit; batches++ {
+		batch, err := source.Next(ctx)
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+		docs = append(docs, batch...)
+	}
+	if err := source.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return docs
+}
+
+func documentIDs(docs []*Document) []string {
+	ids := make([]string, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc.ID
+	}
+	return ids
+}
+
+func TestRestSourceSorted(t *testing.T) {
+	for _, version := range []int{7, 8} {
+		for _, sortField := range []string{"n", "_uid"} {
+			t.Run(fmt.Sprintf("ES%d by %s", version, sortField), func(t *testing.T) {
+				server, client := newSortedServer(t, version, 10)
+				source, err := NewRestSource(client, sortedConfig(sortField), Slice{}, nil, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				docs := readBatches(t, source, Checkpoint{}, 0)
+
+				ids := documentIDs(docs)
+				if sortField == "n" {
+					for i := 1; i < len(docs); i++ {
+						if docs[i].Source["n"].(float64) < docs[i-1].Source["n"].(float64) {
+							t.Fatalf("documents out of order: %v", ids)
+						}
+					}
+				}
+				sort.Strings(ids)
+				if want := documentIDs(allDocuments(10)); !reflect.DeepEqual(ids, want) {
+					t.Errorf("read %v, want %v", ids, want)
+				}
+				if open := server.OpenPointsInTime(); open != 0 {
+					t.Errorf("%d points in time left open", open)
+				}
+			})
+		}
+	}
+}
+
+func TestRestSourceSortedSlices(t *testing.T) {
+	_, client := newSortedServer(t, 8, 20)
+	var ids []string
+	for id := 0; id < 3; id++ {
+		source, err := NewRestSource(client, sortedConfig("n"), Slice{ID: id, Max: 3}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, documentIDs(readBatches(t, source, Checkpoint{}, 0))...)
+	}
+	sort.Strings(ids)
+	if want := documentIDs(allDocuments(20)); !reflect.DeepEqual(ids, want) {
+		t.Errorf("slices read %v, want %v", ids, want)
+	}
+}
+
+func TestRestSourceSortedResume(t *testing.T) {
+	tests := []struct {
+		name      string
+		sortField string
+		expire    bool
+		reread    int // documents read again after the restart
+	}{
+		{name: "open point in time", sortField: "n"},
+		{name: "expired point in time", sortField: "n", expire: true, reread: 1},
+		{name: "open point in time without sort field", sortField: "_uid"},
+		{name: "expired point in time without sort field", sortField: "_uid", expire: true, reread: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := newSortedServer(t, 8, 10)
+			first, err := NewRestSource(client, sortedConfig(tt.sortField), Slice{}, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Stop after the first page, whose last document is doc-02 when sorting on n
+			read := readBatches(t, first, Checkpoint{}, 1)
+			if server.OpenPointsInTime() != 1 {
+				t.Fatalf("%d points in time open after an interrupted export, want 1", server.OpenPointsInTime())
+			}
+			if tt.expire {
+				server.ExpireScrolls()
+			}
+
+			second, err := NewRestSource(client, sortedConfig(tt.sortField), Slice{}, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resumed := readBatches(t, second, first.Checkpoint(read[len(read)-1]), 0)
+			if got := len(read) + len(resumed); got != 10+tt.reread {
+				t.Errorf("read %v then %v, want %d documents read again", documentIDs(read), documentIDs(resumed), tt.reread)
+			}
+			ids := documentIDs(append(read, resumed...))
+			sort.Strings(ids)
+			seen := map[string]bool{}
+			for _, id := range ids {
+				seen[id] = true
+			}
+			if len(seen) != 10 {
+				t.Errorf("read %d distinct documents, want 10: %v", len(seen), ids)
+			}
+		})
+	}
+}
+
+func allDocuments(count int) []*Document {
+	docs := make([]*Document, count)
+	for i := range docs {
+		docs[i] = &Document{ID: fmt.Sprintf("doc-%02d", i)}
+	}
+	return docs
+}
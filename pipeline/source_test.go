@@ -0,0 +1,92 @@
+package pipeline
+
+import (
+	"context"
+	"elkmigration/estest"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSourceDeadLettersUnparseableHits(t *testing.T) {
+	for _, version := range []int{2, 7, 8} {
+		for _, exportMode := range []string{exportModeScroll, exportModeSorted} {
+			t.Run(fmt.Sprintf("ES%d %s", version, exportMode), func(t *testing.T) {
+				server := estest.NewServer(version)
+				t.Cleanup(server.Close)
+				if err := server.CreateIndex("logs", 1, nil); err != nil {
+					t.Fatal(err)
+				}
+				for i := 0; i < 10; i++ {
+					doc := estest.Document{ID: fmt.Sprintf("doc-%02d", i), Source: map[string]interface{}{"n": i}}
+					if i == 5 {
+						doc.RawSource = `"not an object"`
+					}
+					if version == 2 {
+						doc.Type = "log"
+					}
+					if err := server.AddDocuments("logs", doc); err != nil {
+						t.Fatal(err)
+					}
+				}
+				client, err := server.Client()
+				if err != nil {
+					t.Fatal(err)
+				}
+				cfg := migrationConfig()
+				cfg.ExportMode = exportMode
+
+				// The dead-letter sink is down when doc-05 is read: Next fails until it is back,
+				// without losing doc-05 or the documents after it
+				deadLetters, recorded := newRecordedQueue()
+				deadLetters.sink = failingDeadLetters{}
+				source, err := NewSource(client, cfg, Slice{}, &ExportFilter{}, deadLetters)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ctx := context.Background()
+				if err := source.Open(ctx, Checkpoint{}); err != nil {
+					t.Fatal(err)
+				}
+				defer source.Close()
+
+				var ids []string
+				failures := 0
+				for {
+					batch, err := source.Next(ctx)
+					if err != nil {
+						if !errors.Is(err, errDeadLetter) {
+							t.Fatalf("Next: %v", err)
+						}
+						if failures++; failures == 2 {
+							deadLetters.sink = recorded
+						}
+						continue
+					}
+					if len(batch) == 0 {
+						break
+					}
+					ids = append(ids, documentIDs(batch)...)
+				}
+
+				if failures != 2 {
+					t.Errorf("Next failed %d times, want 2", failures)
+				}
+				sort.Strings(ids)
+				want := []string{"doc-00", "doc-01", "doc-02", "doc-03", "doc-04", "doc-06", "doc-07", "doc-08", "doc-09"}
+				if !reflect.DeepEqual(ids, want) {
+					t.Errorf("read %v, want %v", ids, want)
+				}
+				failed := recorded.documents()
+				if len(failed) != 1 {
+					t.Fatalf("dead-lettered %d hits, want 1", len(failed))
+				}
+				if got := failed[0]; got.Index != "copy" || got.ID != "doc-05" || got.ErrorType != "parse_error" || got.RawSource != `"not an object"` || got.Source != nil {
+					t.Errorf("dead letter = %+v", got)
+				}
+			})
+		}
+	}
+}
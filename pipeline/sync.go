@@ -0,0 +1,180 @@
+package pipeline
+
+import (
+	"context"
+	"elkmigration/clients"
+	"elkmigration/config"
+	"elkmigration/logger"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SyncDocuments catches the target up with writes made on the source after the bulk copy.
+// Every SYNC_INTERVAL it exports the documents whose SYNC_FIELD is at or after the stored
+// high-water mark, sorted on that field, and indexes them into the target by _id, which
+// overwrites the copies already there. The mark is saved to the checkpoint store after each round once the
+// round is written, so a failed round is retried from the same mark. A round in which documents were
+// sent to deadLetters with a retryable error, such as a 429 after the last retry, fails too, so they are
+// read again by the next one; documents the target rejected for their content stay in deadLetters and
+// the mark moves past them. Documents deleted on the source are not propagated. It returns once ctx is cancelled.
+func SyncDocuments(ctx context.Context, client clients.ElasticsearchClient, config *config.Config, filter *ExportFilter, transformer *Transformer, sink Sink, deadLetters *DeadLetterQueue, store clients.CheckpointStore) error {
+	if config.SyncField == "" {
+		return errors.New("SYNC_FIELD must be set to sync")
+	}
+	interval, err := time.ParseDuration(config.SyncInterval)
+	if err != nil {
+		return fmt.Errorf("invalid SYNC_INTERVAL: %w", err)
+	}
+
+	mark, err := loadSyncMark(ctx, store, config)
+	if err != nil {
+		return err
+	}
+	logger.Info("Starting sync", zap.String("field", config.SyncField), zap.Any("from", mark), zap.Duration("interval", interval))
+
+	for {
+		start := time.Now()
+		next, count, err := syncRound(ctx, client, config, filter, transformer, sink, deadLetters, mark)
+		switch {
+		case err != nil && ctx.Err() != nil:
+			return nil
+		case err != nil:
+			logger.Error("Sync round failed, retrying from the same mark", zap.Any("mark", mark), zap.Error(err))
+		default:
+			if next != nil {
+				mark = next
+				if err := store.SaveJSON(context.Background(), syncMarkKey(config), mark); err != nil {
+					logger.Error("Failed to save sync mark", zap.Error(err))
+				}
+			}
+			logger.Info("Sync round completed", zap.Int("documents", count), zap.Any("mark", mark), zap.Duration("duration", time.Since(start)))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// loadSyncMark returns the stored high-water mark, or SYNC_FROM when no round has completed yet.
+// A nil mark syncs every document that has the sync field.
+func loadSyncMark(ctx context.Context, store clients.CheckpointStore, config *config.Config) (interface{}, error) {
+	var mark interface{}
+	err := store.GetJSON(ctx, syncMarkKey(config), &mark)
+	if errors.Is(err, clients.ErrNotFound) {
+		if config.SyncFrom == "" {
+			logger.Warn("No sync mark saved and SYNC_FROM not set, syncing every document")
+			return nil, nil
+		}
+		return config.SyncFrom, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load sync mark: %w", err)
+	}
+	return mark, nil
+}
+
+// syncMarkKey is the key of the sync mark of the source index, in the job namespace.
+func syncMarkKey(config *config.Config) string {
+	return clients.NewNamespace(config).SyncMark(config.ElkIndexFrom, config.ElkIndexTo)
+}
+
+// syncRound exports and writes the documents at or after mark, and returns the new mark:
+// the sync field value of the last document read, or nil when there was none.
+// It fails when any document of the round was dead-lettered with a retryable error, since the mark would move past it.
+func syncRound(ctx context.Context, client clients.ElasticsearchClient, config *config.Config, filter *ExportFilter, transformer *Transformer, sink Sink, deadLetters *DeadLetterQueue, mark interface{}) (interface{}, int, error) {
+	roundConfig := *config
+	roundConfig.ExportMode = exportModeSorted
+	roundConfig.SortField = config.SyncField
+
+	source, err := NewSource(client, &roundConfig, Slice{}, syncFilter(config, filter, mark), deadLetters)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := source.Open(ctx, Checkpoint{}); err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		if err := source.Close(); err != nil {
+			logger.Warn("Failed to close source", zap.Error(err))
+		}
+	}()
+
+	var next interface{}
+	count := 0
+	retryable := deadLetters.retryableTotal()
+	for {
+		batch, err := source.Next(ctx)
+		if err != nil {
+			return nil, count, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, doc := range batch {
+			if sortValues := source.Checkpoint(doc).SortValues; len(sortValues) > 0 {
+				next = sortValues[0]
+			}
+			transformed, err := transformer.Transform(ctx, doc)
+			if err != nil {
+				return nil, count, err
+			}
+			if err := sink.Write(ctx, transformed...); err != nil {
+				return nil, count, err
+			}
+			count++
+		}
+	}
+
+	// The mark only moves once everything read in this round is written
+	if err := sink.Flush(ctx); err != nil {
+		return nil, count, err
+	}
+	if retryable = deadLetters.retryableTotal() - retryable; retryable > 0 {
+		return nil, count, fmt.Errorf("%d documents of the round were dead-lettered with a retryable error", retryable)
+	}
+	return next, count, nil
+}
+
+// syncFilter restricts the export filter to documents whose sync field is at or after mark.
+// Documents without the field never match, so they cannot push the mark to the sort value of missing fields.
+// The mark is lowered by SYNC_OVERLAP when numeric, to pick up documents written late with an older value.
+func syncFilter(config *config.Config, filter *ExportFilter, mark interface{}) *ExportFilter {
+	var clause map[string]interface{}
+	if mark == nil {
+		clause = map[string]interface{}{"exists": map[string]interface{}{"field": config.SyncField}}
+	} else {
+		if number, ok := syncMarkNumber(mark); ok && config.SyncOverlap > 0 {
+			mark = number - config.SyncOverlap
+		}
+		clause = map[string]interface{}{"range": map[string]interface{}{config.SyncField: map[string]interface{}{"gte": mark}}}
+	}
+
+	roundFilter := &ExportFilter{Query: clause}
+	if filter != nil {
+		roundFilter.Includes = filter.Includes
+		roundFilter.Excludes = filter.Excludes
+		if filter.Query != nil {
+			roundFilter.Query = map[string]interface{}{"bool": map[string]interface{}{"filter": []interface{}{filter.Query, clause}}}
+		}
+	}
+	return roundFilter
+}
+
+// syncMarkNumber returns a mark read back from the store or a sort value as an integer, such as epoch milliseconds.
+func syncMarkNumber(mark interface{}) (int64, bool) {
+	switch v := mark.(type) {
+	case float64:
+		return int64(v), v == float64(int64(v))
+	case json.Number:
+		number, err := v.Int64()
+		return number, err == nil
+	}
+	return 0, false
+}
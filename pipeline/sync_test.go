@@ -0,0 +1,81 @@
+package pipeline
+
+import (
+	"context"
+	"elkmigration/estest"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSyncDocumentsRejections(t *testing.T) {
+	tests := []struct {
+		name    string
+		fault   estest.Fault
+		times   int
+		retries int // rounds that fail before the mark moves
+	}{
+		{name: "permanent", fault: estest.Fault{Status: http.StatusBadRequest, Type: "mapper_parsing_exception"}},
+		{name: "too many requests", fault: estest.Fault{Status: http.StatusTooManyRequests}, times: 1, retries: 1},
+		{name: "server error", fault: estest.Fault{Status: http.StatusServiceUnavailable}, times: 2, retries: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, target := newSourceServer(t, 8, 10), estest.NewServer(8)
+			defer target.Close()
+			target.FailBulkItems(tt.times, tt.fault, "doc-03")
+			cfg := migrationConfig()
+			cfg.SyncField = "n"
+			cfg.SyncInterval = "10ms"
+			store := newCheckpointStore(t)
+			deadLetters, recorded := newRecordedQueue()
+
+			sourceClient, err := source.Client()
+			if err != nil {
+				t.Fatal(err)
+			}
+			targetClient, err := target.Client()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sizer, err := NewBulkSizer(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sink, err := NewSink(targetClient, cfg, deadLetters, NewInFlightLimiter(0, 0), sizer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			transformer, err := NewTransformer(cfg, nil, deadLetters)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+			defer cancel()
+			if err := SyncDocuments(ctx, sourceClient, cfg, nil, transformer, sink, deadLetters, store); err != nil {
+				t.Fatalf("SyncDocuments: %v", err)
+			}
+
+			mark, err := loadSyncMark(context.Background(), store, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(mark) != "9" {
+				t.Errorf("sync mark = %v, want 9", mark)
+			}
+			// Each failed round dead-letters doc-03 again, and the mark then moves past it
+			if failed := recorded.documents(); len(failed) != max(tt.retries, 1) {
+				t.Errorf("dead-lettered doc-03 %d times, want %d", len(failed), max(tt.retries, 1))
+			}
+			want := 10
+			if tt.retries == 0 {
+				want = 9
+			}
+			if count := target.Count("copy"); count != want {
+				t.Errorf("target holds %d documents, want %d", count, want)
+			}
+		})
+	}
+}
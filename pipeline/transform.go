@@ -1,30 +1,275 @@
 package pipeline
 
-func TransformDocuments(docs <-chan map[string]interface{}, transformedDocs chan<- map[string]interface{}) {
+import (
+	"context"
+	"elkmigration/config"
+	"elkmigration/logger"
+	"elkmigration/script"
+	"elkmigration/transform"
+	"fmt"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Transformer applies the transform rules, the transform script and the type routing to documents,
+// in that order. Every part is optional.
+type Transformer struct {
+	config      *config.Config
+	rules       *transform.Rules
+	script      *script.Script
+	splitter    *TypeSplitter
+	deadLetters *DeadLetterQueue
+}
+
+// NewTransformer loads the rules of TRANSFORM_RULES_FILE and the script of TRANSFORM_SCRIPT_FILE.
+// Documents the script fails on are written to the dead-letter sink, when there is one.
+func NewTransformer(config *config.Config, splitter *TypeSplitter, deadLetters *DeadLetterQueue) (*Transformer, error) {
+	t := &Transformer{config: config, splitter: splitter, deadLetters: deadLetters}
+	if config.TransformRulesFile != "" {
+		rules, err := transform.LoadRules(config.TransformRulesFile)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("Loaded transform rules", zap.String("file", config.TransformRulesFile), zap.Int("rules", len(rules.Rules)))
+		t.rules = rules
+	}
+	if config.TransformScriptFile != "" {
+		compiled, err := script.Load(config.TransformScriptFile)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("Loaded transform script", zap.String("file", config.TransformScriptFile))
+		t.script = compiled
+	}
+	return t, nil
+}
+
+// WithSplitter returns a transformer sharing the rules and script of t, for another index of a job.
+func (t *Transformer) WithSplitter(config *config.Config, splitter *TypeSplitter) *Transformer {
+	copied := *t
+	copied.config = config
+	copied.splitter = splitter
+	return &copied
+}
+
+// Transform returns the documents to import for one exported document: none when it is dropped
+// or fails, several when the script fans it out. An error is returned when a document the script
+// failed on could not be written to the dead-letter queue; the document is left unacknowledged.
+func (t *Transformer) Transform(ctx context.Context, doc *Document) ([]*Document, error) {
+	if doc.Source == nil {
+		doc.Source = map[string]interface{}{}
+	}
+
+	// A failing rule is skipped, the document is still imported
+	if t.rules != nil {
+		if err := t.rules.Apply(doc.Source); err != nil {
+			logger.Warn("Error transforming document", zap.String("id", doc.ID), zap.Error(err))
+		}
+	}
+
+	docs := []*Document{doc}
+	if t.script != nil {
+		var err error
+		if docs, err = t.runScript(doc); err != nil {
+			logger.Warn("Transform script failed", zap.String("id", doc.ID), zap.Error(err))
+			if t.deadLetters != nil {
+				if err := t.deadLetters.Add(ctx, newFailedDocument(doc.TargetIndex(t.config.ElkIndexTo), doc, 0, "script_error", err.Error())); err != nil {
+					return nil, err
+				}
+			}
+			doc.Ack()
+			return nil, nil
+		}
+	}
+
+	// Route documents of multi-type ES2 indices by their _type
+	if t.splitter != nil {
+		for _, transformed := range docs {
+			t.splitter.Apply(transformed)
+		}
+	}
+	return docs, nil
+}
+
+// runScript runs the transform script and applies the metadata it changed.
+// The script runs on a copy of the source, so doc is left as it was when the script fails.
+func (t *Transformer) runScript(doc *Document) ([]*Document, error) {
+	meta := map[string]interface{}{
+		"id":      doc.ID,
+		"type":    doc.Type,
+		"routing": doc.Routing,
+		"index":   doc.Index,
+	}
+	result, err := t.script.Run(copyValue(doc.Source).(map[string]interface{}), meta)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := []struct {
+		name  string
+		value *string
+	}{{"id", &doc.ID}, {"type", &doc.Type}, {"routing", &doc.Routing}, {"index", &doc.Index}}
+	values := make([]string, len(fields))
+	for i, field := range fields {
+		switch value := meta[field.name].(type) {
+		case string:
+			values[i] = value
+		case nil:
+		default:
+			return nil, fmt.Errorf("meta.%s must be a string", field.name)
+		}
+	}
+	for i, field := range fields {
+		*field.value = values[i]
+	}
+	doc.Source = result.Source
+
+	// Emitted documents are derived before the original is dropped, so its position is held until they are written
+	docs := make([]*Document, 0, len(result.Emitted)+1)
+	if !result.Dropped {
+		docs = append(docs, doc)
+	}
+	for i, emitted := range result.Emitted {
+		id := emitted.ID
+		if id == "" && doc.ID != "" {
+			id = fmt.Sprintf("%s-%d", doc.ID, i)
+		}
+		docs = append(docs, doc.Derive(id, emitted.Source))
+	}
+	if result.Dropped {
+		doc.Ack()
+	}
+	return docs, nil
+}
+
+// copyValue copies objects and arrays, so a script changing a document does not change the original.
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			copied[key] = copyValue(child)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, child := range v {
+			copied[i] = copyValue(child)
+		}
+		return copied
+	}
+	return value
+}
+
+// orderedBacklog is how many documents per worker an ordered pool transforms ahead of the oldest pending one.
+const orderedBacklog = 64
+
+// TransformDocuments transforms the exported documents on a pool of workers and sends the results
+// to the import stage, closing transformedDocs once every document is transformed.
+// In ordered mode documents leave in the order they were exported, fanned out documents right
+// after their original, so the import stage writes and acknowledges them in export order.
+// Once ctx is cancelled the remaining documents are drained without being transformed, so the
+// export stage is never blocked, and left unacknowledged. The same goes after the first error
+// of Transform, which is returned.
+func TransformDocuments(ctx context.Context, transformer *Transformer, workers int, ordered bool, docs <-chan *Document, transformedDocs chan<- *Document) error {
 	defer close(transformedDocs)
-	for doc := range docs {
-		// Example transformation: renaming fields
-		//if val, ok := doc["old_field"]; ok {
-		//	doc["new_field"] = val
-		//	delete(doc, "old_field")
-		//}
-
-		// Check if "id" exists and is a string before logging
-		//if id, ok := doc["id"].(string); ok && id != "" {
-		//	logger.Info("Transformed document", zap.String("doc_id", id))
-		//} else {
-		//	fmt.Println("=======================================================================================================")
-		//	logger.Warn("Document ID is missing or not a string in Process Transforming", zap.Any("document", doc))
-		//	fmt.Println("=======================================================================================================")
-		//	fmt.Println(reflect.TypeOf(doc))
-		//	fmt.Println(reflect.TypeOf(doc["id"]))
-		//
-		//	os.Exit(9)
-		//}
-
-		// Send transformed document to next stage
-		transformedDocs <- doc
-		//logger.Info("Transformed document", zap.Any("client_ip", doc["client_ip"]))
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pool := &transformPool{transformer: transformer, cancel: cancel}
+	workers = max(workers, 1)
+	if ordered {
+		transformOrdered(ctx, pool, workers, docs, transformedDocs)
+	} else {
+		transformUnordered(ctx, pool, workers, docs, transformedDocs)
+	}
+	return pool.err
+}
+
+// transformPool runs the transformer for the workers of TransformDocuments and keeps its first error.
+type transformPool struct {
+	transformer *Transformer
+	cancel      context.CancelFunc
+
+	mu  sync.Mutex
+	err error
+}
+
+// transform transforms a document unless ctx is cancelled. An error cancels ctx.
+func (p *transformPool) transform(ctx context.Context, doc *Document) []*Document {
+	if ctx.Err() != nil {
+		return nil
+	}
+	docs, err := p.transformer.Transform(ctx, doc)
+	if err != nil {
+		p.mu.Lock()
+		if p.err == nil {
+			p.err = err
+		}
+		p.mu.Unlock()
+		p.cancel()
+		return nil
+	}
+	return docs
+}
+
+// send passes transformed documents to the import stage, dropping them once ctx is cancelled.
+func send(ctx context.Context, transformedDocs chan<- *Document, docs []*Document) {
+	for _, doc := range docs {
+		select {
+		case transformedDocs <- doc:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func transformUnordered(ctx context.Context, pool *transformPool, workers int, docs <-chan *Document, transformedDocs chan<- *Document) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for doc := range docs {
+				// Send transformed documents to next stage
+				send(ctx, transformedDocs, pool.transform(ctx, doc))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// transformJob is a document waiting for a worker, with the channel its result is delivered on.
+type transformJob struct {
+	doc    *Document
+	result chan []*Document
+}
+
+func transformOrdered(ctx context.Context, pool *transformPool, workers int, docs <-chan *Document, transformedDocs chan<- *Document) {
+	jobs := make(chan *transformJob, workers)
+	pending := make(chan *transformJob, workers*orderedBacklog) // jobs in export order
+
+	// Dispatch documents to the workers, remembering their order
+	go func() {
+		defer close(jobs)
+		defer close(pending)
+		for doc := range docs {
+			job := &transformJob{doc: doc, result: make(chan []*Document, 1)}
+			pending <- job
+			jobs <- job
+		}
+	}()
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range jobs {
+				job.result <- pool.transform(ctx, job.doc)
+			}
+		}()
+	}
 
+	// Collect results in export order; the dispatcher closes pending after the last document
+	for job := range pending {
+		send(ctx, transformedDocs, <-job.result)
 	}
 }
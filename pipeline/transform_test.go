@@ -0,0 +1,71 @@
+package pipeline
+
+import (
+	"context"
+	"elkmigration/config"
+	"elkmigration/script"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestTransformScriptFailureKeepsOriginal(t *testing.T) {
+	compiled, err := script.Compile("doc.a = 2\ndoc.nested.b = 'changed'\nmeta.id = 'renamed'\ndoc.c = 1 / 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadLetters, recorded := newRecordedQueue()
+	transformer := &Transformer{config: &config.Config{ElkIndexTo: "target"}, script: compiled, deadLetters: deadLetters}
+
+	doc := &Document{ID: "1", Source: map[string]interface{}{"a": 1.0, "nested": map[string]interface{}{"b": "original"}}}
+	if docs, err := transformer.Transform(context.Background(), doc); err != nil || len(docs) != 0 {
+		t.Fatalf("Transform returned %d documents and %v, want none", len(docs), err)
+	}
+
+	failed := recorded.documents()
+	if len(failed) != 1 {
+		t.Fatalf("%d dead-lettered documents, want 1", len(failed))
+	}
+	want := map[string]interface{}{"a": 1.0, "nested": map[string]interface{}{"b": "original"}}
+	if failed[0].ID != "1" || failed[0].ErrorType != "script_error" || !reflect.DeepEqual(failed[0].Source, want) {
+		t.Errorf("dead letter = %+v, want the original document", failed[0])
+	}
+}
+
+func TestTransformScriptInvalidMeta(t *testing.T) {
+	compiled, err := script.Compile("meta.routing = 'r'\nmeta.id = 5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadLetters, recorded := newRecordedQueue()
+	transformer := &Transformer{config: &config.Config{}, script: compiled, deadLetters: deadLetters}
+
+	doc := &Document{ID: "1", Routing: "old", Source: map[string]interface{}{}}
+	if docs, err := transformer.Transform(context.Background(), doc); err != nil || len(docs) != 0 {
+		t.Fatalf("Transform returned %d documents and %v, want none", len(docs), err)
+	}
+	if failed := recorded.documents(); len(failed) != 1 || failed[0].Routing != "old" || failed[0].Reason != "meta.id must be a string" {
+		t.Errorf("dead letters = %+v, want the document with its original routing", failed)
+	}
+}
+
+func TestTransformScriptFailureWithoutDeadLetters(t *testing.T) {
+	compiled, err := script.Compile("doc.c = 1 / 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unavailable := &DeadLetterQueue{sink: failingDeadLetters{}, counts: make(map[string]int)}
+	transformer := &Transformer{config: &config.Config{}, script: compiled, deadLetters: unavailable}
+
+	docs := make(chan *Document, 2)
+	docs <- &Document{ID: "1", Source: map[string]interface{}{}}
+	docs <- &Document{ID: "2", Source: map[string]interface{}{}}
+	close(docs)
+	transformedDocs := make(chan *Document, 2)
+	if err := TransformDocuments(context.Background(), transformer, 1, true, docs, transformedDocs); !errors.Is(err, errDeadLetter) {
+		t.Errorf("TransformDocuments error = %v, want the dead-letter failure", err)
+	}
+	if _, ok := <-transformedDocs; ok {
+		t.Error("TransformDocuments sent a document, want none")
+	}
+}
@@ -0,0 +1,131 @@
+package pipeline
+
+import (
+	"elkmigration/config"
+	"fmt"
+	"strings"
+)
+
+// Ways of migrating the mapping types of a multi-type ES2 index
+const (
+	typeSplitNone  = "none"  // keep every type in ELK_INDEX_TO as is
+	typeSplitIndex = "index" // write each type to its own index named by TYPE_INDEX_TEMPLATE
+	typeSplitField = "field" // keep the types in ELK_INDEX_TO, store the type in TYPE_FIELD and prefix the _id with it
+)
+
+// TypeSplitter routes documents by their ES2 _type, since ES7 and ES8 indices hold a single type.
+type TypeSplitter struct {
+	index    string            // ELK_INDEX_TO
+	template string            // target index name template of the index mode
+	field    string            // synthetic type field of the field mode
+	mode     string            // mode of types without an override
+	modes    map[string]string // per-type mode overrides
+}
+
+// NewTypeSplitter creates a splitter from TYPE_SPLIT_MODE and the per-type TYPE_SPLIT_MODES,
+// a comma-separated list of type:mode pairs.
+func NewTypeSplitter(config *config.Config) (*TypeSplitter, error) {
+	splitter := &TypeSplitter{
+		index:    config.ElkIndexTo,
+		template: config.TypeIndexTemplate,
+		field:    config.TypeField,
+		mode:     config.TypeSplitMode,
+		modes:    map[string]string{},
+	}
+	if splitter.mode == "" {
+		splitter.mode = typeSplitNone
+	}
+	if err := checkTypeSplitMode(splitter.mode); err != nil {
+		return nil, err
+	}
+
+	for _, pair := range strings.Split(config.TypeSplitModes, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		typeName, mode, ok := strings.Cut(pair, ":")
+		if !ok || typeName == "" {
+			return nil, fmt.Errorf("invalid TYPE_SPLIT_MODES entry %q, expected type:mode", pair)
+		}
+		if err := checkTypeSplitMode(mode); err != nil {
+			return nil, err
+		}
+		splitter.modes[typeName] = mode
+	}
+
+	if splitter.uses(typeSplitIndex) && !strings.Contains(splitter.template, "{type}") {
+		return nil, fmt.Errorf("TYPE_INDEX_TEMPLATE %q must contain {type}", splitter.template)
+	}
+	if splitter.uses(typeSplitField) && splitter.field == "" {
+		return nil, fmt.Errorf("TYPE_FIELD must be set to split types by field")
+	}
+	return splitter, nil
+}
+
+func checkTypeSplitMode(mode string) error {
+	switch mode {
+	case typeSplitNone, typeSplitIndex, typeSplitField:
+		return nil
+	default:
+		return fmt.Errorf("invalid type split mode %q, expected %s, %s or %s", mode, typeSplitNone, typeSplitIndex, typeSplitField)
+	}
+}
+
+// uses reports whether any type is migrated with the given mode.
+func (s *TypeSplitter) uses(mode string) bool {
+	if s.mode == mode {
+		return true
+	}
+	for _, typeMode := range s.modes {
+		if typeMode == mode {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *TypeSplitter) modeOf(typeName string) string {
+	// ES7 sources report the single _doc type, which has nothing to split
+	if typeName == "" || typeName == "_doc" {
+		return typeSplitNone
+	}
+	if mode, ok := s.modes[typeName]; ok {
+		return mode
+	}
+	return s.mode
+}
+
+// Route returns the target index of a mapping type, and the synthetic field holding the type, if any.
+func (s *TypeSplitter) Route(typeName string) (index, typeField string) {
+	switch s.modeOf(typeName) {
+	case typeSplitIndex:
+		// Index names must be lowercase
+		name := strings.ReplaceAll(s.template, "{index}", s.index)
+		return strings.ReplaceAll(name, "{type}", strings.ToLower(typeName)), ""
+	case typeSplitField:
+		return s.index, s.field
+	default:
+		return s.index, ""
+	}
+}
+
+// Apply routes a document to the index of its type, unless an earlier transform chose its index.
+// In field mode the type is stored in the document and the _id becomes "{type}#{id}"
+// so documents of different types with the same _id do not collide.
+func (s *TypeSplitter) Apply(doc *Document) {
+	index, typeField := s.Route(doc.Type)
+	if doc.Index == "" && index != s.index {
+		doc.Index = index
+	}
+	if typeField == "" {
+		return
+	}
+	if doc.Source == nil {
+		doc.Source = map[string]interface{}{}
+	}
+	doc.Source[typeField] = doc.Type
+	if doc.ID != "" {
+		doc.ID = doc.Type + "#" + doc.ID
+	}
+}
@@ -0,0 +1,429 @@
+package script
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type builtin func(e *env, args []interface{}) (interface{}, error)
+
+var builtins map[string]builtin
+
+func init() {
+	builtins = map[string]builtin{
+		"len":        builtinLen,
+		"has":        builtinHas,
+		"keys":       builtinKeys,
+		"contains":   builtinContains,
+		"split":      builtinSplit,
+		"join":       builtinJoin,
+		"trim":       stringFunc(strings.TrimSpace),
+		"lower":      stringFunc(strings.ToLower),
+		"upper":      stringFunc(strings.ToUpper),
+		"replace":    builtinReplace,
+		"startsWith": builtinStartsWith,
+		"endsWith":   builtinEndsWith,
+		"matches":    builtinMatches,
+		"number":     builtinNumber,
+		"int":        builtinInt,
+		"string":     builtinString,
+		"type":       builtinType,
+		"round":      builtinRound,
+		"append":     builtinAppend,
+		"merge":      builtinMerge,
+		"copy":       builtinCopy,
+		"now":        builtinNow,
+		"emit":       builtinEmit,
+	}
+}
+
+func checkArgs(args []interface{}, min, max int) error {
+	if len(args) < min || len(args) > max {
+		if min == max {
+			return fmt.Errorf("expects %d arguments, got %d", min, len(args))
+		}
+		return fmt.Errorf("expects %d to %d arguments, got %d", min, max, len(args))
+	}
+	return nil
+}
+
+func stringArg(args []interface{}, i int) (string, error) {
+	text, ok := args[i].(string)
+	if !ok {
+		return "", fmt.Errorf("argument %d must be a string, not %s", i+1, typeName(args[i]))
+	}
+	return text, nil
+}
+
+func stringFunc(f func(string) string) builtin {
+	return func(_ *env, args []interface{}) (interface{}, error) {
+		if err := checkArgs(args, 1, 1); err != nil {
+			return nil, err
+		}
+		if args[0] == nil {
+			return nil, nil
+		}
+		text, err := stringArg(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		return f(text), nil
+	}
+}
+
+// len(x) is the length of a string, array or object; null has length 0.
+func builtinLen(_ *env, args []interface{}) (interface{}, error) {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	switch v := args[0].(type) {
+	case nil:
+		return float64(0), nil
+	case string:
+		return float64(len([]rune(v))), nil
+	case []interface{}:
+		return float64(len(v)), nil
+	case map[string]interface{}:
+		return float64(len(v)), nil
+	}
+	return nil, fmt.Errorf("no length for %s", typeName(args[0]))
+}
+
+// has(object, key) reports whether the object has the key, even with a null value.
+func builtinHas(_ *env, args []interface{}) (interface{}, error) {
+	if err := checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	object, ok := args[0].(map[string]interface{})
+	if !ok {
+		return false, nil
+	}
+	key, err := toString(args[1])
+	if err != nil {
+		return nil, err
+	}
+	_, exists := object[key]
+	return exists, nil
+}
+
+// keys(object) returns the keys of an object, sorted.
+func builtinKeys(_ *env, args []interface{}) (interface{}, error) {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	object, ok := args[0].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("argument must be an object, not %s", typeName(args[0]))
+	}
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]interface{}, len(keys))
+	for i, key := range keys {
+		result[i] = key
+	}
+	return result, nil
+}
+
+// contains(x, v) reports whether a string contains a substring or an array an element.
+func builtinContains(_ *env, args []interface{}) (interface{}, error) {
+	if err := checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	switch v := args[0].(type) {
+	case nil:
+		return false, nil
+	case string:
+		needle, err := toString(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return strings.Contains(v, needle), nil
+	case []interface{}:
+		for _, element := range v {
+			if equal(element, args[1]) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return nil, fmt.Errorf("cannot search %s", typeName(args[0]))
+}
+
+// split(s, sep) splits a string into an array of trimmed, non-empty parts.
+func builtinSplit(_ *env, args []interface{}) (interface{}, error) {
+	if err := checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	if args[0] == nil {
+		return []interface{}{}, nil
+	}
+	text, err := stringArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	separator, err := stringArg(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	parts := []interface{}{}
+	for _, part := range strings.Split(text, separator) {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts, nil
+}
+
+// join(array, sep) joins the elements of an array into a string.
+func builtinJoin(_ *env, args []interface{}) (interface{}, error) {
+	if err := checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	array, ok := args[0].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("argument 1 must be an array, not %s", typeName(args[0]))
+	}
+	separator, err := stringArg(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	parts := make([]string, len(array))
+	for i, element := range array {
+		if parts[i], err = toString(element); err != nil {
+			return nil, err
+		}
+	}
+	return strings.Join(parts, separator), nil
+}
+
+// replace(s, old, new) replaces every occurrence of old.
+func builtinReplace(_ *env, args []interface{}) (interface{}, error) {
+	if err := checkArgs(args, 3, 3); err != nil {
+		return nil, err
+	}
+	var texts [3]string
+	for i := range texts {
+		text, err := stringArg(args, i)
+		if err != nil {
+			return nil, err
+		}
+		texts[i] = text
+	}
+	return strings.ReplaceAll(texts[0], texts[1], texts[2]), nil
+}
+
+func builtinStartsWith(_ *env, args []interface{}) (interface{}, error) {
+	return stringPredicate(args, strings.HasPrefix)
+}
+
+func builtinEndsWith(_ *env, args []interface{}) (interface{}, error) {
+	return stringPredicate(args, strings.HasSuffix)
+}
+
+func stringPredicate(args []interface{}, predicate func(string, string) bool) (interface{}, error) {
+	if err := checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	text, ok := args[0].(string)
+	if !ok {
+		return false, nil
+	}
+	affix, err := stringArg(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	return predicate(text, affix), nil
+}
+
+// patterns caches the regular expressions of matches, shared by every run.
+var patterns sync.Map
+
+// matches(s, pattern) reports whether a string matches a regular expression.
+func builtinMatches(_ *env, args []interface{}) (interface{}, error) {
+	if err := checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	text, ok := args[0].(string)
+	if !ok {
+		return false, nil
+	}
+	source, err := stringArg(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	pattern, ok := patterns.Load(source)
+	if !ok {
+		compiled, err := regexp.Compile(source)
+		if err != nil {
+			return nil, err
+		}
+		pattern, _ = patterns.LoadOrStore(source, compiled)
+	}
+	return pattern.(*regexp.Regexp).MatchString(text), nil
+}
+
+// number(x) converts a number, numeric string or boolean to a number; null stays null.
+func builtinNumber(_ *env, args []interface{}) (interface{}, error) {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	switch v := args[0].(type) {
+	case nil:
+		return nil, nil
+	case bool:
+		if v {
+			return float64(1), nil
+		}
+		return float64(0), nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(v), 64)
+	}
+	if number, ok := toNumber(args[0]); ok {
+		return number, nil
+	}
+	return nil, fmt.Errorf("cannot convert %s to number", typeName(args[0]))
+}
+
+// int(x) converts like number and truncates the fraction.
+func builtinInt(e *env, args []interface{}) (interface{}, error) {
+	value, err := builtinNumber(e, args)
+	if err != nil || value == nil {
+		return value, err
+	}
+	return math.Trunc(value.(float64)), nil
+}
+
+// string(x) converts a value to a string; objects and arrays become JSON.
+func builtinString(_ *env, args []interface{}) (interface{}, error) {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	return toString(args[0])
+}
+
+// type(x) returns the type name of a value: null, boolean, number, string, array or object.
+func builtinType(_ *env, args []interface{}) (interface{}, error) {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	return typeName(args[0]), nil
+}
+
+// round(x, digits) rounds a number to the given number of decimals, 0 by default.
+func builtinRound(_ *env, args []interface{}) (interface{}, error) {
+	if err := checkArgs(args, 1, 2); err != nil {
+		return nil, err
+	}
+	number, ok := toNumber(args[0])
+	if !ok {
+		return nil, fmt.Errorf("argument 1 must be a number, not %s", typeName(args[0]))
+	}
+	scale := 1.0
+	if len(args) == 2 {
+		digits, ok := toNumber(args[1])
+		if !ok {
+			return nil, fmt.Errorf("argument 2 must be a number, not %s", typeName(args[1]))
+		}
+		scale = math.Pow(10, digits)
+	}
+	return math.Round(number*scale) / scale, nil
+}
+
+// append(array, values...) returns a new array with the values added; null is an empty array.
+func builtinAppend(_ *env, args []interface{}) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("expects at least 1 argument")
+	}
+	var array []interface{}
+	switch v := args[0].(type) {
+	case nil:
+	case []interface{}:
+		array = v
+	default:
+		return nil, fmt.Errorf("argument 1 must be an array, not %s", typeName(args[0]))
+	}
+	return append(append([]interface{}{}, array...), args[1:]...), nil
+}
+
+// merge(objects...) returns a new object with the fields of every object, later ones winning.
+func builtinMerge(_ *env, args []interface{}) (interface{}, error) {
+	merged := map[string]interface{}{}
+	for i, arg := range args {
+		if arg == nil {
+			continue
+		}
+		object, ok := arg.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("argument %d must be an object, not %s", i+1, typeName(arg))
+		}
+		for key, value := range object {
+			merged[key] = deepCopy(value)
+		}
+	}
+	return merged, nil
+}
+
+// copy(x) returns a deep copy of a value, so changes to it do not affect the original.
+func builtinCopy(_ *env, args []interface{}) (interface{}, error) {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	return deepCopy(args[0]), nil
+}
+
+// now() returns the current time in RFC 3339 format.
+func builtinNow(_ *env, args []interface{}) (interface{}, error) {
+	if err := checkArgs(args, 0, 0); err != nil {
+		return nil, err
+	}
+	return time.Now().UTC().Format(time.RFC3339Nano), nil
+}
+
+// emit(source, id) writes a new document with a copy of source, after the current one.
+// Without an id the caller derives one from the current document.
+func builtinEmit(e *env, args []interface{}) (interface{}, error) {
+	if err := checkArgs(args, 1, 2); err != nil {
+		return nil, err
+	}
+	source, ok := args[0].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("argument 1 must be an object, not %s", typeName(args[0]))
+	}
+	emitted := &Emitted{Source: deepCopy(source).(map[string]interface{})}
+	if len(args) == 2 && args[1] != nil {
+		id, err := toString(args[1])
+		if err != nil {
+			return nil, err
+		}
+		emitted.ID = id
+	}
+	e.result.Emitted = append(e.result.Emitted, emitted)
+	return nil, nil
+}
+
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			copied[key] = deepCopy(child)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, child := range v {
+			copied[i] = deepCopy(child)
+		}
+		return copied
+	}
+	return value
+}
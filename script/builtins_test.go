@@ -0,0 +1,148 @@
+package script
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBuiltins(t *testing.T) {
+	doc := `{"s": " A,b,,c ", "n": 2.5, "o": {"b": 1, "a": null}, "l": [1, "x"], "big": 12345678901}`
+	tests := []struct {
+		expr string
+		want string // JSON of the result
+	}{
+		{expr: "len('héllo')", want: `5`},
+		{expr: "len(doc.l)", want: `2`},
+		{expr: "len(doc.o)", want: `2`},
+		{expr: "len(doc.missing)", want: `0`},
+		{expr: "has(doc.o, 'a')", want: `true`},
+		{expr: "has(doc.o, 'z')", want: `false`},
+		{expr: "has(doc.s, 'a')", want: `false`},
+		{expr: "keys(doc.o)", want: `["a", "b"]`},
+		{expr: "contains(doc.s, 'b,')", want: `true`},
+		{expr: "contains(doc.l, 1)", want: `true`},
+		{expr: "contains(doc.l, 'y')", want: `false`},
+		{expr: "contains(null, 'y')", want: `false`},
+		{expr: "split(doc.s, ',')", want: `["A", "b", "c"]`},
+		{expr: "split(null, ',')", want: `[]`},
+		{expr: "join(doc.l, '-')", want: `"1-x"`},
+		{expr: "trim(doc.s)", want: `"A,b,,c"`},
+		{expr: "lower('AbC')", want: `"abc"`},
+		{expr: "upper('AbC')", want: `"ABC"`},
+		{expr: "upper(null)", want: `null`},
+		{expr: "replace('a-b-c', '-', '+')", want: `"a+b+c"`},
+		{expr: "startsWith('prefix', 'pre')", want: `true`},
+		{expr: "endsWith('prefix', 'pre')", want: `false`},
+		{expr: "startsWith(1, 'pre')", want: `false`},
+		{expr: "matches('2024-01-02', '^\\d{4}-')", want: `true`},
+		{expr: "matches('x', '^\\d')", want: `false`},
+		{expr: "matches(null, 'x')", want: `false`},
+		{expr: "number(' 42 ')", want: `42`},
+		{expr: "number(true)", want: `1`},
+		{expr: "number(null)", want: `null`},
+		{expr: "number(doc.big)", want: `12345678901`},
+		{expr: "int('-3.7')", want: `-3`},
+		{expr: "int(null)", want: `null`},
+		{expr: "string(1.5)", want: `"1.5"`},
+		{expr: "string(doc.big)", want: `"12345678901"`},
+		{expr: "string(doc.l)", want: `"[1,\"x\"]"`},
+		{expr: "string(null)", want: `""`},
+		{expr: "[type(null), type(true), type(1), type('s'), type([]), type({})]", want: `["null", "boolean", "number", "string", "array", "object"]`},
+		{expr: "round(2.5)", want: `3`},
+		{expr: "round(3.14159, 2)", want: `3.14`},
+		{expr: "append(doc.l, 2, 3)", want: `[1, "x", 2, 3]`},
+		{expr: "append(null, 1)", want: `[1]`},
+		{expr: "merge(doc.o, null, {b: 2, c: 3})", want: `{"a": null, "b": 2, "c": 3}`},
+		{expr: "copy(doc.o)", want: `{"a": null, "b": 1}`},
+	}
+	for _, tt := range tests {
+		s, err := Compile("doc.result = " + tt.expr)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", tt.expr, err)
+			continue
+		}
+		result, err := s.Run(decode(t, doc), map[string]interface{}{})
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		var want interface{}
+		if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+			t.Fatalf("invalid expected value %s: %v", tt.want, err)
+		}
+		if got := result.Source["result"]; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s = %#v, want %#v", tt.expr, got, want)
+		}
+	}
+}
+
+func TestBuiltinsDoNotShareValues(t *testing.T) {
+	s, err := Compile("c = copy(doc.o); c.x = 1; m = merge(doc.o); m.o2.y = 2; a = append(doc.l, 3); a[0] = 9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := decode(t, `{"o": {"o2": {}}, "l": [1]}`)
+	if _, err := s.Run(doc, map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if want := decode(t, `{"o": {"o2": {}}, "l": [1]}`); !reflect.DeepEqual(doc, want) {
+		t.Errorf("doc = %v, want it unchanged", doc)
+	}
+}
+
+func TestBuiltinNow(t *testing.T) {
+	s, err := Compile("doc.t = now()")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := s.Run(map[string]interface{}{}, map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stamp, _ := result.Source["t"].(string)
+	parsed, err := time.Parse(time.RFC3339Nano, stamp)
+	if err != nil || time.Since(parsed) > time.Minute {
+		t.Errorf("now() = %q, want the current RFC 3339 time", stamp)
+	}
+}
+
+func TestBuiltinErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{expr: "len()", want: "len: expects 1 arguments, got 0"},
+		{expr: "len(1, 2)", want: "len: expects 1 arguments, got 2"},
+		{expr: "round()", want: "round: expects 1 to 2 arguments, got 0"},
+		{expr: "keys([])", want: "keys: argument must be an object, not array"},
+		{expr: "contains(1, 1)", want: "contains: cannot search number"},
+		{expr: "split('a', 1)", want: "split: argument 2 must be a string, not number"},
+		{expr: "split(1, ',')", want: "split: argument 1 must be a string, not number"},
+		{expr: "join('a', ',')", want: "join: argument 1 must be an array, not string"},
+		{expr: "lower(1)", want: "lower: argument 1 must be a string, not number"},
+		{expr: "replace('a', 'b', null)", want: "replace: argument 3 must be a string, not null"},
+		{expr: "matches('a', '(')", want: "matches: error parsing regexp: missing closing ): `(`"},
+		{expr: "number('abc')", want: `number: strconv.ParseFloat: parsing "abc": invalid syntax`},
+		{expr: "number([])", want: "number: cannot convert array to number"},
+		{expr: "round('1')", want: "round: argument 1 must be a number, not string"},
+		{expr: "round(1, 'a')", want: "round: argument 2 must be a number, not string"},
+		{expr: "append()", want: "append: expects at least 1 argument"},
+		{expr: "append(1, 2)", want: "append: argument 1 must be an array, not number"},
+		{expr: "merge({}, 1)", want: "merge: argument 2 must be an object, not number"},
+		{expr: "now(1)", want: "now: expects 0 arguments, got 1"},
+		{expr: "emit('x')", want: "emit: argument 1 must be an object, not string"},
+	}
+	for _, tt := range tests {
+		s, err := Compile("doc.result = " + tt.expr)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", tt.expr, err)
+			continue
+		}
+		_, err = s.Run(map[string]interface{}{}, map[string]interface{}{})
+		if want := "line 1: " + tt.want; err == nil || err.Error() != want {
+			t.Errorf("%s error = %v, want %q", tt.expr, err, want)
+		}
+	}
+}
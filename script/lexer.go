@@ -0,0 +1,113 @@
+package script
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokPunct
+)
+
+type token struct {
+	kind  tokenKind
+	text  string      // identifier, punctuation or the source text of a literal
+	value interface{} // decoded number or string literal
+	line  int
+}
+
+// twoCharPuncts are matched before the single characters of singlePuncts.
+var twoCharPuncts = []string{"==", "!=", "<=", ">=", "&&", "||"}
+
+const singlePuncts = "=<>+-*/%!()[]{},.:;"
+
+// lex splits a script into tokens. Comments run from # or // to the end of the line.
+func lex(src string) ([]token, error) {
+	var tokens []token
+	line := 1
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#' || strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == '_' || unicode.IsLetter(rune(c)):
+			start := i
+			for i < len(src) && (src[i] == '_' || unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: src[start:i], line: line})
+		case unicode.IsDigit(rune(c)):
+			start := i
+			for i < len(src) && (unicode.IsDigit(rune(src[i])) || src[i] == '.' || src[i] == 'e' || src[i] == 'E' ||
+				((src[i] == '+' || src[i] == '-') && (src[i-1] == 'e' || src[i-1] == 'E'))) {
+				i++
+			}
+			number, err := strconv.ParseFloat(src[start:i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid number %q", line, src[start:i])
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: src[start:i], value: number, line: line})
+		case c == '"' || c == '\'':
+			start := i
+			i++
+			for i < len(src) && src[i] != c {
+				if src[i] == '\\' {
+					i++
+				}
+				if i < len(src) && src[i] == '\n' {
+					return nil, fmt.Errorf("line %d: unterminated string", line)
+				}
+				i++
+			}
+			if i >= len(src) {
+				return nil, fmt.Errorf("line %d: unterminated string", line)
+			}
+			i++
+			text := src[start:i]
+			var value string
+			if c == '"' {
+				unquoted, err := strconv.Unquote(text)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid string %s", line, text)
+				}
+				value = unquoted
+			} else {
+				// Single-quoted strings are raw apart from escaped quotes
+				value = strings.ReplaceAll(text[1:len(text)-1], `\'`, `'`)
+			}
+			tokens = append(tokens, token{kind: tokString, text: text, value: value, line: line})
+		default:
+			text := ""
+			for _, punct := range twoCharPuncts {
+				if strings.HasPrefix(src[i:], punct) {
+					text = punct
+					break
+				}
+			}
+			if text == "" && strings.IndexByte(singlePuncts, c) >= 0 {
+				text = string(c)
+			}
+			if text == "" {
+				return nil, fmt.Errorf("line %d: unexpected character %q", line, c)
+			}
+			tokens = append(tokens, token{kind: tokPunct, text: text, line: line})
+			i += len(text)
+		}
+	}
+	return append(tokens, token{kind: tokEOF, line: line}), nil
+}
@@ -0,0 +1,86 @@
+package script
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLex(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		texts  []string
+		values []interface{} // decoded literals, in order
+	}{
+		{name: "empty", src: "", texts: nil},
+		{name: "identifiers", src: "doc _x a1", texts: []string{"doc", "_x", "a1"}},
+		{name: "two-char operators", src: "a==b!=c<=d>=e&&f||g", texts: []string{"a", "==", "b", "!=", "c", "<=", "d", ">=", "e", "&&", "f", "||", "g"}},
+		{name: "single punctuation", src: "=<>+-*/%!()[]{},.:;", texts: strings.Split("=<>+-*/%!()[]{},.:;", "")},
+		{name: "numbers", src: "1 2.5 1e3 1.5E-2", texts: []string{"1", "2.5", "1e3", "1.5E-2"}, values: []interface{}{1.0, 2.5, 1000.0, 0.015}},
+		{name: "double-quoted escapes", src: `"a\"b\n"`, texts: []string{`"a\"b\n"`}, values: []interface{}{"a\"b\n"}},
+		{name: "single-quoted raw", src: `'a\nb\'c'`, texts: []string{`'a\nb\'c'`}, values: []interface{}{`a\nb'c`}},
+		{name: "hash comment", src: "a # b c\nd", texts: []string{"a", "d"}},
+		{name: "slash comment", src: "a // b\nd", texts: []string{"a", "d"}},
+		{name: "division is not a comment", src: "a / b", texts: []string{"a", "/", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := lex(tt.src)
+			if err != nil {
+				t.Fatalf("lex(%q): %v", tt.src, err)
+			}
+			if last := tokens[len(tokens)-1]; last.kind != tokEOF {
+				t.Fatalf("last token is %v, want EOF", last)
+			}
+			var texts []string
+			var values []interface{}
+			for _, tok := range tokens[:len(tokens)-1] {
+				texts = append(texts, tok.text)
+				if tok.kind == tokNumber || tok.kind == tokString {
+					values = append(values, tok.value)
+				}
+			}
+			if !reflect.DeepEqual(texts, tt.texts) {
+				t.Errorf("texts = %q, want %q", texts, tt.texts)
+			}
+			if !reflect.DeepEqual(values, tt.values) {
+				t.Errorf("values = %#v, want %#v", values, tt.values)
+			}
+		})
+	}
+}
+
+func TestLexLines(t *testing.T) {
+	tokens, err := lex("a\n# comment\n\nb 'c'\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []int{1, 4, 4, 5}
+	for i, tok := range tokens {
+		if tok.line != lines[i] {
+			t.Errorf("token %d (%q) on line %d, want %d", i, tok.text, tok.line, lines[i])
+		}
+	}
+}
+
+func TestLexErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{src: `"abc`, want: "line 1: unterminated string"},
+		{src: "a\n'abc\ndef'", want: "line 2: unterminated string"},
+		{src: `"\q"`, want: "line 1: invalid string"},
+		{src: "1.2.3", want: `line 1: invalid number "1.2.3"`},
+		{src: "a @ b", want: "line 1: unexpected character '@'"},
+		{src: "a & b", want: "line 1: unexpected character '&'"},
+		{src: "a |\nb", want: "line 1: unexpected character '|'"},
+	}
+	for _, tt := range tests {
+		_, err := lex(tt.src)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("lex(%q) error = %v, want %q", tt.src, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,478 @@
+package script
+
+import "fmt"
+
+// Statements
+
+type stmt interface{ stmtLine() int }
+
+type assignStmt struct {
+	line   int
+	target expr // identifier, member or index expression
+	value  expr
+}
+
+type deleteStmt struct {
+	line   int
+	target expr
+}
+
+type dropStmt struct{ line int }
+
+type returnStmt struct{ line int }
+
+type ifStmt struct {
+	line     int
+	cond     expr
+	then     []stmt
+	elseBody []stmt
+}
+
+type forStmt struct {
+	line     int
+	key      string // index or key, empty when only values are iterated
+	value    string
+	iterable expr
+	body     []stmt
+}
+
+type exprStmt struct {
+	line int
+	expr expr
+}
+
+func (s *assignStmt) stmtLine() int { return s.line }
+func (s *deleteStmt) stmtLine() int { return s.line }
+func (s *dropStmt) stmtLine() int   { return s.line }
+func (s *returnStmt) stmtLine() int { return s.line }
+func (s *ifStmt) stmtLine() int     { return s.line }
+func (s *forStmt) stmtLine() int    { return s.line }
+func (s *exprStmt) stmtLine() int   { return s.line }
+
+// Expressions
+
+type expr interface{}
+
+type literalExpr struct{ value interface{} }
+
+type identExpr struct{ name string }
+
+type memberExpr struct {
+	object expr
+	name   string
+}
+
+type indexExpr struct {
+	object expr
+	index  expr
+}
+
+type callExpr struct {
+	name string
+	args []expr
+}
+
+type unaryExpr struct {
+	op      string
+	operand expr
+}
+
+type binaryExpr struct {
+	op          string
+	left, right expr
+}
+
+type arrayExpr struct{ elements []expr }
+
+type objectExpr struct {
+	keys   []string
+	values []expr
+}
+
+// Binary operators by precedence, lowest first
+var binaryPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+var keywords = map[string]bool{
+	"if": true, "else": true, "for": true, "in": true, "let": true, "delete": true,
+	"drop": true, "return": true, "true": true, "false": true, "null": true,
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func parse(src string) ([]stmt, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	var body []stmt
+	for p.peek().kind != tokEOF {
+		statement, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, statement)
+	}
+	return body, nil
+}
+
+func (p *parser) peek() token { return p.tokens[p.pos] }
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isPunct(text string) bool {
+	t := p.peek()
+	return t.kind == tokPunct && t.text == text
+}
+
+func (p *parser) isKeyword(word string) bool {
+	t := p.peek()
+	return t.kind == tokIdent && t.text == word
+}
+
+func (p *parser) expect(text string) error {
+	t := p.next()
+	if t.kind != tokPunct || t.text != text {
+		return p.errorf(t, "expected %q", text)
+	}
+	return nil
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	found := t.text
+	if t.kind == tokEOF {
+		found = "end of script"
+	}
+	return fmt.Errorf("line %d: %s, found %s", t.line, fmt.Sprintf(format, args...), found)
+}
+
+func (p *parser) ident() (string, error) {
+	t := p.next()
+	if t.kind != tokIdent || keywords[t.text] {
+		return "", p.errorf(t, "expected a name")
+	}
+	return t.text, nil
+}
+
+func (p *parser) block() ([]stmt, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var body []stmt
+	for !p.isPunct("}") {
+		if p.peek().kind == tokEOF {
+			return nil, p.errorf(p.peek(), "expected \"}\"")
+		}
+		statement, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, statement)
+	}
+	p.next()
+	return body, nil
+}
+
+func (p *parser) statement() (stmt, error) {
+	for p.isPunct(";") {
+		p.next()
+	}
+	t := p.peek()
+	line := t.line
+	var statement stmt
+	switch {
+	case p.isKeyword("if"):
+		return p.ifStatement()
+	case p.isKeyword("for"):
+		p.next()
+		s := &forStmt{line: line}
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		s.value = name
+		if p.isPunct(",") {
+			p.next()
+			if s.value, err = p.ident(); err != nil {
+				return nil, err
+			}
+			s.key = name
+		}
+		if !p.isKeyword("in") {
+			return nil, p.errorf(p.peek(), "expected \"in\"")
+		}
+		p.next()
+		if s.iterable, err = p.expression(); err != nil {
+			return nil, err
+		}
+		if s.body, err = p.block(); err != nil {
+			return nil, err
+		}
+		return s, nil
+	case p.isKeyword("drop"):
+		p.next()
+		statement = &dropStmt{line: line}
+	case p.isKeyword("return"):
+		p.next()
+		statement = &returnStmt{line: line}
+	case p.isKeyword("delete"):
+		p.next()
+		target, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if !assignable(target) || isIdent(target) {
+			return nil, fmt.Errorf("line %d: delete needs a field or element", line)
+		}
+		statement = &deleteStmt{line: line, target: target}
+	default:
+		if p.isKeyword("let") {
+			p.next()
+		}
+		target, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if p.isPunct("=") {
+			p.next()
+			if !assignable(target) {
+				return nil, fmt.Errorf("line %d: cannot assign to this expression", line)
+			}
+			value, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			statement = &assignStmt{line: line, target: target, value: value}
+		} else if _, ok := target.(*callExpr); ok {
+			statement = &exprStmt{line: line, expr: target}
+		} else {
+			return nil, fmt.Errorf("line %d: expression result is not used", line)
+		}
+	}
+	if p.isPunct(";") {
+		p.next()
+	}
+	return statement, nil
+}
+
+func (p *parser) ifStatement() (stmt, error) {
+	s := &ifStmt{line: p.next().line}
+	var err error
+	if s.cond, err = p.expression(); err != nil {
+		return nil, err
+	}
+	if s.then, err = p.block(); err != nil {
+		return nil, err
+	}
+	if p.isKeyword("else") {
+		p.next()
+		if p.isKeyword("if") {
+			elseIf, err := p.ifStatement()
+			if err != nil {
+				return nil, err
+			}
+			s.elseBody = []stmt{elseIf}
+		} else if s.elseBody, err = p.block(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func assignable(e expr) bool {
+	switch e.(type) {
+	case *identExpr, *memberExpr, *indexExpr:
+		return true
+	}
+	return false
+}
+
+func isIdent(e expr) bool {
+	_, ok := e.(*identExpr)
+	return ok
+}
+
+func (p *parser) expression() (expr, error) {
+	return p.binary(0)
+}
+
+func (p *parser) binary(level int) (expr, error) {
+	if level == len(binaryPrecedence) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ""
+		for _, candidate := range binaryPrecedence[level] {
+			if p.isPunct(candidate) {
+				op = candidate
+				break
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+		p.next()
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: op, left: left, right: right}
+	}
+}
+
+func (p *parser) unary() (expr, error) {
+	if p.isPunct("!") || p.isPunct("-") {
+		op := p.next().text
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: op, operand: operand}, nil
+	}
+	return p.postfix()
+}
+
+func (p *parser) postfix() (expr, error) {
+	e, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.isPunct("."):
+			p.next()
+			t := p.next()
+			if t.kind != tokIdent {
+				return nil, p.errorf(t, "expected a field name")
+			}
+			e = &memberExpr{object: e, name: t.text}
+		case p.isPunct("["):
+			p.next()
+			index, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			e = &indexExpr{object: e, index: index}
+		default:
+			return e, nil
+		}
+	}
+}
+
+func (p *parser) primary() (expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber, tokString:
+		return &literalExpr{value: t.value}, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return &literalExpr{value: true}, nil
+		case "false":
+			return &literalExpr{value: false}, nil
+		case "null":
+			return &literalExpr{value: nil}, nil
+		}
+		if keywords[t.text] {
+			return nil, p.errorf(t, "unexpected keyword")
+		}
+		if !p.isPunct("(") {
+			return &identExpr{name: t.text}, nil
+		}
+		if _, ok := builtins[t.text]; !ok {
+			return nil, fmt.Errorf("line %d: unknown function %s", t.line, t.text)
+		}
+		p.next()
+		call := &callExpr{name: t.text}
+		for !p.isPunct(")") {
+			arg, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			if !p.isPunct(")") {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+		}
+		p.next()
+		return call, nil
+	case tokPunct:
+		switch t.text {
+		case "(":
+			e, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			return e, p.expect(")")
+		case "[":
+			array := &arrayExpr{}
+			for !p.isPunct("]") {
+				element, err := p.expression()
+				if err != nil {
+					return nil, err
+				}
+				array.elements = append(array.elements, element)
+				if !p.isPunct("]") {
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+				}
+			}
+			p.next()
+			return array, nil
+		case "{":
+			object := &objectExpr{}
+			for !p.isPunct("}") {
+				key := p.next()
+				if key.kind == tokString {
+					object.keys = append(object.keys, key.value.(string))
+				} else if key.kind == tokIdent {
+					object.keys = append(object.keys, key.text)
+				} else {
+					return nil, p.errorf(key, "expected an object key")
+				}
+				if err := p.expect(":"); err != nil {
+					return nil, err
+				}
+				value, err := p.expression()
+				if err != nil {
+					return nil, err
+				}
+				object.values = append(object.values, value)
+				if !p.isPunct("}") {
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+				}
+			}
+			p.next()
+			return object, nil
+		}
+	}
+	return nil, p.errorf(t, "expected an expression")
+}
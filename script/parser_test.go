@@ -0,0 +1,113 @@
+package script
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompile(t *testing.T) {
+	scripts := []string{
+		"",
+		"# only a comment",
+		"doc.a = 1",
+		"doc.a = 1; doc.b = 2;",
+		";;doc.a = 1",
+		"let x = 1",
+		"doc['a b'] = doc[\"c\"][0]",
+		"delete doc.a",
+		"delete doc.items[0]",
+		"drop",
+		"return",
+		"if doc.a { drop }",
+		"if doc.a { drop } else { return }",
+		"if doc.a { drop } else if doc.b { return } else { doc.c = 1 }",
+		"for x in doc.items { emit(x) }",
+		"for i, x in doc.items { doc.last = i }",
+		"doc.o = {a: 1, 'b': [1, 2,], \"c\": {}, if: null}",
+		"doc.x = -(1 + 2) * !true",
+		"emit(doc, meta.id + '-copy')",
+		"now()",
+	}
+	for _, src := range scripts {
+		if _, err := Compile(src); err != nil {
+			t.Errorf("Compile(%q): %v", src, err)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{src: "doc.a = ", want: "line 1: expected an expression, found end of script"},
+		{src: "doc.a = 1 +", want: "line 1: expected an expression, found end of script"},
+		{src: "doc.a 1", want: "line 1: expression result is not used"},
+		{src: "doc.a + 1 = 2", want: "line 1: cannot assign to this expression"},
+		{src: "len(doc) = 2", want: "line 1: cannot assign to this expression"},
+		{src: "delete x", want: "line 1: delete needs a field or element"},
+		{src: "delete len(doc)", want: "line 1: delete needs a field or element"},
+		{src: "if doc.a drop", want: `line 1: expected "{", found drop`},
+		{src: "if doc.a {\ndrop", want: `line 2: expected "}", found end of script`},
+		{src: "if doc.a { drop } else drop", want: `line 1: expected "{", found drop`},
+		{src: "for x doc.items {}", want: `line 1: expected "in", found doc`},
+		{src: "for if in doc.items {}", want: "line 1: expected a name, found if"},
+		{src: "for i, in doc.items {}", want: "line 1: expected a name, found in"},
+		{src: "doc.a = unknown(1)", want: "line 1: unknown function unknown"},
+		{src: "doc.a = len(1 2)", want: `line 1: expected ",", found 2`},
+		{src: "doc.a = [1 2]", want: `line 1: expected ",", found 2`},
+		{src: "doc.a = {1: 2}", want: "line 1: expected an object key, found 1"},
+		{src: "doc.a = {a 2}", want: `line 1: expected ":", found 2`},
+		{src: "doc.a = (1", want: `line 1: expected ")", found end of script`},
+		{src: "doc.a = doc[1", want: `line 1: expected "]", found end of script`},
+		{src: "doc.\n1 = 2", want: "line 2: expected a field name, found 1"},
+		{src: "doc.a = else", want: "line 1: unexpected keyword, found else"},
+		{src: "\n\ndoc.a = 'x", want: "line 3: unterminated string"},
+	}
+	for _, tt := range tests {
+		_, err := Compile(tt.src)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Compile(%q) error = %v, want %q", tt.src, err, tt.want)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), "script syntax error: ") {
+			t.Errorf("Compile(%q) error = %v, want a syntax error", tt.src, err)
+		}
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	tests := []struct {
+		src  string
+		want interface{}
+	}{
+		{src: "1 + 2 * 3", want: 7.0},
+		{src: "(1 + 2) * 3", want: 9.0},
+		{src: "10 - 4 - 3", want: 3.0},
+		{src: "12 / 3 / 2", want: 2.0},
+		{src: "7 % 4 * 2", want: 6.0},
+		{src: "-2 * -3", want: 6.0},
+		{src: "1 + 2 < 4", want: true},
+		{src: "1 < 2 == 2 < 3", want: true},
+		{src: "true || false && false", want: true},
+		{src: "(true || false) && false", want: false},
+		{src: "!true == false", want: true},
+		{src: "!!'x'", want: true},
+		{src: "1 == 1 && 2 != 3", want: true},
+	}
+	for _, tt := range tests {
+		s, err := Compile("doc.result = " + tt.src)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", tt.src, err)
+			continue
+		}
+		doc := map[string]interface{}{}
+		if _, err := s.Run(doc, map[string]interface{}{}); err != nil {
+			t.Errorf("Run(%q): %v", tt.src, err)
+			continue
+		}
+		if doc["result"] != tt.want {
+			t.Errorf("%s = %#v, want %#v", tt.src, doc["result"], tt.want)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+// Package script runs small user-supplied programs on documents during the transform stage.
+//
+// A script sees the document body as doc and its metadata (id, type, routing, index) as meta.
+// It can assign and delete fields, branch and loop, drop the document and emit new ones:
+//
+//	# split a CSV field into an array
+//	if has(doc, "tags") { doc.tags = split(doc.tags, ",") }
+//	doc.total = doc.price * doc.quantity
+//	if doc.status == "deleted" { drop }
+//	for i, item in doc.items { emit(merge(doc, {item: item}), meta.id + "-" + string(i)) }
+package script
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Script is a compiled script. It is safe for concurrent use.
+type Script struct {
+	body []stmt
+}
+
+// Result is what a script did with a document besides modifying it in place.
+type Result struct {
+	Source  map[string]interface{} // the document body, which the script may have replaced
+	Dropped bool                   // the document must not be written
+	Emitted []*Emitted             // new documents to write after the original
+}
+
+// Emitted is a document created by the script with emit.
+type Emitted struct {
+	ID     string // empty to let the caller derive one
+	Source map[string]interface{}
+}
+
+// Load compiles the script in a file.
+func Load(path string) (*Script, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read script: %w", err)
+	}
+	return Compile(string(src))
+}
+
+// Compile parses a script.
+func Compile(src string) (*Script, error) {
+	body, err := parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("script syntax error: %w", err)
+	}
+	return &Script{body: body}, nil
+}
+
+// Run executes the script on a document. doc and meta are modified in place;
+// meta holds the string metadata fields the script may read and change.
+func (s *Script) Run(doc, meta map[string]interface{}) (*Result, error) {
+	e := &env{
+		vars:   map[string]interface{}{"doc": doc, "meta": meta},
+		result: &Result{},
+	}
+	if err := e.run(s.body); err != nil && !errors.Is(err, errStop) {
+		return nil, err
+	}
+	source, ok := e.vars["doc"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("doc must be an object, not %s", typeName(e.vars["doc"]))
+	}
+	e.result.Source = source
+	return e.result, nil
+}
+
+// env is the state of one run.
+type env struct {
+	vars   map[string]interface{}
+	result *Result
+}
+
+// errStop unwinds every enclosing block on drop and return.
+var errStop = errors.New("stop")
+
+func (e *env) exec(statement stmt) error {
+	err := e.execStatement(statement)
+	if err != nil && !errors.Is(err, errStop) {
+		var lineErr *lineError
+		if !errors.As(err, &lineErr) {
+			err = &lineError{line: statement.stmtLine(), err: err}
+		}
+	}
+	return err
+}
+
+type lineError struct {
+	line int
+	err  error
+}
+
+func (e *lineError) Error() string { return fmt.Sprintf("line %d: %v", e.line, e.err) }
+func (e *lineError) Unwrap() error { return e.err }
+
+func (e *env) execStatement(statement stmt) error {
+	switch s := statement.(type) {
+	case *assignStmt:
+		value, err := e.eval(s.value)
+		if err != nil {
+			return err
+		}
+		return e.assign(s.target, value)
+	case *deleteStmt:
+		return e.delete(s.target)
+	case *dropStmt:
+		e.result.Dropped = true
+		return errStop
+	case *returnStmt:
+		return errStop
+	case *ifStmt:
+		cond, err := e.eval(s.cond)
+		if err != nil {
+			return err
+		}
+		body := s.elseBody
+		if truthy(cond) {
+			body = s.then
+		}
+		return e.run(body)
+	case *forStmt:
+		iterable, err := e.eval(s.iterable)
+		if err != nil {
+			return err
+		}
+		switch collection := iterable.(type) {
+		case nil:
+			return nil
+		case []interface{}:
+			items := append([]interface{}(nil), collection...)
+			for i, item := range items {
+				if s.key != "" {
+					e.vars[s.key] = float64(i)
+				}
+				e.vars[s.value] = item
+				if err := e.run(s.body); err != nil {
+					return err
+				}
+			}
+		case map[string]interface{}:
+			keys := make([]string, 0, len(collection))
+			for key := range collection {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				if s.key != "" {
+					e.vars[s.key] = key
+					e.vars[s.value] = collection[key]
+				} else {
+					e.vars[s.value] = key
+				}
+				if err := e.run(s.body); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("cannot loop over %s", typeName(iterable))
+		}
+		return nil
+	case *exprStmt:
+		_, err := e.eval(s.expr)
+		return err
+	}
+	return fmt.Errorf("unknown statement %T", statement)
+}
+
+// run executes a block, returning errStop on drop and return.
+func (e *env) run(body []stmt) error {
+	for _, statement := range body {
+		if err := e.exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *env) eval(expression expr) (interface{}, error) {
+	switch x := expression.(type) {
+	case *literalExpr:
+		return x.value, nil
+	case *identExpr:
+		value, ok := e.vars[x.name]
+		if !ok {
+			return nil, fmt.Errorf("undefined variable %s", x.name)
+		}
+		return value, nil
+	case *memberExpr:
+		object, err := e.eval(x.object)
+		if err != nil {
+			return nil, err
+		}
+		return member(object, x.name)
+	case *indexExpr:
+		object, err := e.eval(x.object)
+		if err != nil {
+			return nil, err
+		}
+		index, err := e.eval(x.index)
+		if err != nil {
+			return nil, err
+		}
+		return element(object, index)
+	case *callExpr:
+		args := make([]interface{}, len(x.args))
+		for i, arg := range x.args {
+			value, err := e.eval(arg)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = value
+		}
+		value, err := builtins[x.name](e, args)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", x.name, err)
+		}
+		return value, nil
+	case *unaryExpr:
+		operand, err := e.eval(x.operand)
+		if err != nil {
+			return nil, err
+		}
+		if x.op == "!" {
+			return !truthy(operand), nil
+		}
+		number, ok := toNumber(operand)
+		if !ok {
+			return nil, fmt.Errorf("cannot negate %s", typeName(operand))
+		}
+		return -number, nil
+	case *binaryExpr:
+		left, err := e.eval(x.left)
+		if err != nil {
+			return nil, err
+		}
+		// && and || short-circuit and return booleans
+		switch x.op {
+		case "&&":
+			if !truthy(left) {
+				return false, nil
+			}
+			right, err := e.eval(x.right)
+			return truthy(right), err
+		case "||":
+			if truthy(left) {
+				return true, nil
+			}
+			right, err := e.eval(x.right)
+			return truthy(right), err
+		}
+		right, err := e.eval(x.right)
+		if err != nil {
+			return nil, err
+		}
+		return binary(x.op, left, right)
+	case *arrayExpr:
+		array := make([]interface{}, len(x.elements))
+		for i, element := range x.elements {
+			value, err := e.eval(element)
+			if err != nil {
+				return nil, err
+			}
+			array[i] = value
+		}
+		return array, nil
+	case *objectExpr:
+		object := make(map[string]interface{}, len(x.keys))
+		for i, key := range x.keys {
+			value, err := e.eval(x.values[i])
+			if err != nil {
+				return nil, err
+			}
+			object[key] = value
+		}
+		return object, nil
+	}
+	return nil, fmt.Errorf("unknown expression %T", expression)
+}
+
+// assign stores value at target, creating missing intermediate objects.
+func (e *env) assign(target expr, value interface{}) error {
+	switch t := target.(type) {
+	case *identExpr:
+		e.vars[t.name] = value
+		return nil
+	case *memberExpr:
+		object, err := e.container(t.object)
+		if err != nil {
+			return err
+		}
+		object[t.name] = value
+		return nil
+	case *indexExpr:
+		index, err := e.eval(t.index)
+		if err != nil {
+			return err
+		}
+		if key, ok := index.(string); ok {
+			object, err := e.container(t.object)
+			if err != nil {
+				return err
+			}
+			object[key] = value
+			return nil
+		}
+		base, err := e.eval(t.object)
+		if err != nil {
+			return err
+		}
+		array, ok := base.([]interface{})
+		if !ok {
+			return fmt.Errorf("cannot index %s with a number", typeName(base))
+		}
+		i, err := arrayIndex(array, index)
+		if err != nil {
+			return err
+		}
+		array[i] = value
+		return nil
+	}
+	return errors.New("cannot assign to this expression")
+}
+
+// container evaluates an expression that must hold an object, creating the object if it is null.
+func (e *env) container(expression expr) (map[string]interface{}, error) {
+	value, err := e.evalOrNil(expression)
+	if err != nil {
+		return nil, err
+	}
+	switch object := value.(type) {
+	case map[string]interface{}:
+		return object, nil
+	case nil:
+		created := map[string]interface{}{}
+		return created, e.assign(expression, created)
+	}
+	return nil, fmt.Errorf("cannot set a field of %s", typeName(value))
+}
+
+// evalOrNil evaluates an expression, treating an undefined variable as null so it can be created.
+func (e *env) evalOrNil(expression expr) (interface{}, error) {
+	if ident, ok := expression.(*identExpr); ok {
+		return e.vars[ident.name], nil
+	}
+	return e.eval(expression)
+}
+
+func (e *env) delete(target expr) error {
+	switch t := target.(type) {
+	case *memberExpr:
+		object, err := e.eval(t.object)
+		if err != nil {
+			return err
+		}
+		if m, ok := object.(map[string]interface{}); ok {
+			delete(m, t.name)
+		}
+		return nil
+	case *indexExpr:
+		object, err := e.eval(t.object)
+		if err != nil {
+			return err
+		}
+		index, err := e.eval(t.index)
+		if err != nil {
+			return err
+		}
+		switch collection := object.(type) {
+		case map[string]interface{}:
+			key, err := toString(index)
+			if err != nil {
+				return err
+			}
+			delete(collection, key)
+		case []interface{}:
+			i, err := arrayIndex(collection, index)
+			if err != nil {
+				return err
+			}
+			// Removing an element changes the length, so the shorter array is stored back
+			shorter := append(append([]interface{}{}, collection[:i]...), collection[i+1:]...)
+			return e.assign(t.object, shorter)
+		}
+		return nil
+	}
+	return errors.New("cannot delete this expression")
+}
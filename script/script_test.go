@@ -0,0 +1,201 @@
+package script
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// decode parses the JSON of a test document the way exported documents are decoded.
+func decode(t *testing.T, data string) map[string]interface{} {
+	t.Helper()
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &doc); err != nil {
+		t.Fatalf("invalid test document %s: %v", data, err)
+	}
+	return doc
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		doc     string
+		want    string
+		dropped bool
+	}{
+		{name: "empty script", src: "", doc: `{"a": 1}`, want: `{"a": 1}`},
+		{name: "assign field", src: "doc.b = doc.a + 1", doc: `{"a": 1}`, want: `{"a": 1, "b": 2}`},
+		{name: "assign creates objects", src: "doc.x.y.z = 1", doc: `{}`, want: `{"x": {"y": {"z": 1}}}`},
+		{name: "assign by key", src: "doc['a b'] = 1; doc.o[doc.k] = 2", doc: `{"k": "c"}`, want: `{"k": "c", "a b": 1, "o": {"c": 2}}`},
+		{name: "assign array element", src: "doc.a[1] = 'x'; doc.a[-1] = 'z'", doc: `{"a": [1, 2, 3]}`, want: `{"a": [1, "x", "z"]}`},
+		{name: "read missing field", src: "doc.b = doc.missing.deeper", doc: `{}`, want: `{"b": null}`},
+		{name: "read out of range", src: "doc.b = doc.a[5]; doc.c = doc.a[-1]", doc: `{"a": [1, 2]}`, want: `{"a": [1, 2], "b": null, "c": 2}`},
+		{name: "index string", src: "doc.b = doc.s[0] + doc.s[-1]", doc: `{"s": "héllo"}`, want: `{"s": "héllo", "b": "ho"}`},
+		{name: "delete field", src: "delete doc.a; delete doc.missing", doc: `{"a": 1, "b": 2}`, want: `{"b": 2}`},
+		{name: "delete key", src: "delete doc.o['x']", doc: `{"o": {"x": 1, "y": 2}}`, want: `{"o": {"y": 2}}`},
+		{name: "delete element", src: "delete doc.a[0]; delete doc.a[-1]", doc: `{"a": [1, 2, 3, 4]}`, want: `{"a": [2, 3]}`},
+		{name: "variables", src: "let total = doc.a * 2\ntotal = total + 1\ndoc.t = total", doc: `{"a": 3}`, want: `{"a": 3, "t": 7}`},
+		{name: "if else", src: "if doc.a > 1 { doc.r = 'big' } else if doc.a > 0 { doc.r = 'small' } else { doc.r = 'none' }", doc: `{"a": 1}`, want: `{"a": 1, "r": "small"}`},
+		{name: "truthiness", src: "doc.r = [!!doc.z, !!doc.e, !!doc.s, !!doc.l, !!doc.o, !!doc.n]", doc: `{"z": 0, "e": "", "s": "x", "l": [], "o": {"a": 1}, "n": null}`, want: `{"z": 0, "e": "", "s": "x", "l": [], "o": {"a": 1}, "n": null, "r": [false, false, true, false, true, false]}`},
+		{name: "for over array", src: "doc.sum = 0; for i, x in doc.a { doc.sum = doc.sum + x * i }", doc: `{"a": [5, 6, 7]}`, want: `{"a": [5, 6, 7], "sum": 20}`},
+		{name: "for over object keys", src: "doc.k = ''; for k in doc.o { doc.k = doc.k + k }", doc: `{"o": {"b": 1, "a": 2}}`, want: `{"o": {"b": 1, "a": 2}, "k": "ab"}`},
+		{name: "for over object entries", src: "doc.s = 0; for k, v in doc.o { doc.s = doc.s + v }", doc: `{"o": {"b": 1, "a": 2}}`, want: `{"o": {"b": 1, "a": 2}, "s": 3}`},
+		{name: "for over null", src: "for x in doc.missing { drop }", doc: `{}`, want: `{}`},
+		{name: "loop changes do not affect iteration", src: "for x in doc.a { doc.a = append(doc.a, x) }", doc: `{"a": [1, 2]}`, want: `{"a": [1, 2, 1, 2]}`},
+		{name: "return stops", src: "doc.a = 1; if true { return }; doc.b = 2", doc: `{}`, want: `{"a": 1}`},
+		{name: "drop", src: "if doc.status == 'deleted' { drop }\ndoc.kept = true", doc: `{"status": "deleted"}`, want: `{"status": "deleted"}`, dropped: true},
+		{name: "drop inside loop", src: "for x in doc.a { if x == 2 { drop } }; doc.after = 1", doc: `{"a": [1, 2, 3]}`, want: `{"a": [1, 2, 3]}`, dropped: true},
+		{name: "replace doc", src: "doc = {wrapped: doc}", doc: `{"a": 1}`, want: `{"wrapped": {"a": 1}}`},
+		{name: "string concatenation", src: "doc.s = 'n=' + doc.n + ', ok=' + true + ', nil=' + null", doc: `{"n": 1.5}`, want: `{"n": 1.5, "s": "n=1.5, ok=true, nil="}`},
+		{name: "array concatenation", src: "doc.a = doc.a + [3]", doc: `{"a": [1, 2]}`, want: `{"a": [1, 2, 3]}`},
+		{name: "comparisons", src: "doc.r = ['a' < 'b', 2 >= 2, 1 == '1', null == null, [1] == [1], {a: 1} != {a: 1}]", doc: `{}`, want: `{"r": [true, true, false, true, true, false]}`},
+		{name: "modulo and division", src: "doc.r = [7 % 3, -7 % 3, 7 / 2]", doc: `{}`, want: `{"r": [1, -1, 3.5]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Compile(tt.src)
+			if err != nil {
+				t.Fatalf("Compile: %v", err)
+			}
+			result, err := s.Run(decode(t, tt.doc), map[string]interface{}{})
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if want := decode(t, tt.want); !reflect.DeepEqual(result.Source, want) {
+				t.Errorf("doc = %v, want %v", result.Source, want)
+			}
+			if result.Dropped != tt.dropped {
+				t.Errorf("dropped = %v, want %v", result.Dropped, tt.dropped)
+			}
+		})
+	}
+}
+
+func TestRunMeta(t *testing.T) {
+	s, err := Compile("doc.from = meta.index + '/' + meta.id\nmeta.id = meta.id + '-1'\nmeta.routing = doc.user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := map[string]interface{}{"id": "7", "type": "", "routing": "", "index": "logs"}
+	result, err := s.Run(map[string]interface{}{"user": "u1"}, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Source["from"] != "logs/7" {
+		t.Errorf("from = %v, want logs/7", result.Source["from"])
+	}
+	if meta["id"] != "7-1" || meta["routing"] != "u1" {
+		t.Errorf("meta = %v, want id 7-1 and routing u1", meta)
+	}
+}
+
+func TestRunEmit(t *testing.T) {
+	s, err := Compile("for i, item in doc.items { emit(merge(doc, {item: item}), meta.id + '-' + string(i)) }\nemit({alone: true})\ndrop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := s.Run(decode(t, `{"items": ["a", "b"]}`), map[string]interface{}{"id": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Dropped {
+		t.Error("document not dropped")
+	}
+	want := []*Emitted{
+		{ID: "x-0", Source: decode(t, `{"items": ["a", "b"], "item": "a"}`)},
+		{ID: "x-1", Source: decode(t, `{"items": ["a", "b"], "item": "b"}`)},
+		{Source: decode(t, `{"alone": true}`)},
+	}
+	if !reflect.DeepEqual(result.Emitted, want) {
+		t.Errorf("emitted = %v, want %v", result.Emitted, want)
+	}
+
+	// Emitted documents are copies, later changes to the document do not reach them
+	s, err = Compile("emit(doc, 'copy'); doc.a = 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = s.Run(decode(t, `{"a": 1}`), map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := result.Emitted[0].Source["a"]; got != 1.0 {
+		t.Errorf("emitted a = %v, want 1", got)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		doc  string
+		want string
+	}{
+		{src: "doc.a = x", want: "line 1: undefined variable x"},
+		{src: "doc.a = 1\ndoc.b = doc.s.x", doc: `{"s": "text"}`, want: "line 2: cannot read field x of string"},
+		{src: "doc.s.x = 1", doc: `{"s": "text"}`, want: "line 1: cannot set a field of string"},
+		{src: "doc.s[0] = 1", doc: `{"s": "text"}`, want: "line 1: cannot index string with a number"},
+		{src: "doc.a[5] = 1", doc: `{"a": [1]}`, want: "line 1: array index 5 out of range"},
+		{src: "doc.a[0.5] = 1", doc: `{"a": [1]}`, want: "line 1: array index must be a whole number, not number"},
+		{src: "delete doc.a[9]", doc: `{"a": [1]}`, want: "line 1: array index 9 out of range"},
+		{src: "doc.b = doc.n[0]", doc: `{"n": 1}`, want: "line 1: cannot index number"},
+		{src: "doc.b = 1 / 0", want: "line 1: division by zero"},
+		{src: "doc.b = 1 % 0", want: "line 1: division by zero"},
+		{src: "doc.b = 'a' - 1", want: "line 1: invalid operands for -: string and number"},
+		{src: "doc.b = true + 1", want: "line 1: invalid operands for +: boolean and number"},
+		{src: "doc.b = 'a' < 1", want: "line 1: cannot compare string and number"},
+		{src: "doc.b = -'a'", want: "line 1: cannot negate string"},
+		{src: "for x in 1 { drop }", want: "line 1: cannot loop over number"},
+		{src: "if true {\n  for x in doc.a {\n    doc.b = x / 0\n  }\n}", doc: `{"a": [1]}`, want: "line 3: division by zero"},
+		{src: "doc.b = len(1)", want: "line 1: len: no length for number"},
+		{src: "doc = 1", want: "doc must be an object, not number"},
+	}
+	for _, tt := range tests {
+		s, err := Compile(tt.src)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", tt.src, err)
+			continue
+		}
+		doc := tt.doc
+		if doc == "" {
+			doc = "{}"
+		}
+		_, err = s.Run(decode(t, doc), map[string]interface{}{})
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("Run(%q) error = %v, want %q", tt.src, err, tt.want)
+		}
+		if errors.Is(err, errStop) {
+			t.Errorf("Run(%q) leaked the stop error", tt.src)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "transform.script")
+	if err := os.WriteFile(path, []byte("doc.loaded = true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	result, err := s.Run(map[string]interface{}{}, map[string]interface{}{})
+	if err != nil || result.Source["loaded"] != true {
+		t.Errorf("Run = %v, %v, want loaded", result, err)
+	}
+
+	if _, err := Load(filepath.Join(dir, "missing")); err == nil || !strings.HasPrefix(err.Error(), "failed to read script") {
+		t.Errorf("Load(missing) error = %v", err)
+	}
+	if err := os.WriteFile(path, []byte("doc.a = ("), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil || !strings.HasPrefix(err.Error(), "script syntax error") {
+		t.Errorf("Load(bad syntax) error = %v", err)
+	}
+}
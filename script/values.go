@@ -0,0 +1,248 @@
+package script
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+)
+
+// Script values are the types of decoded JSON: nil, bool, float64, string, []interface{}
+// and map[string]interface{}. Integers set by other transforms are read as numbers too.
+
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	if _, ok := toNumber(value); ok {
+		return "number"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case json.Number:
+		number, err := v.Float64()
+		return number, err == nil
+	}
+	return 0, false
+}
+
+func toString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case nil:
+		return "", nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case map[string]interface{}, []interface{}:
+		data, err := json.Marshal(v)
+		return string(data), err
+	}
+	if number, ok := toNumber(value); ok {
+		return strconv.FormatFloat(number, 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("cannot convert %s to string", typeName(value))
+}
+
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	case map[string]interface{}:
+		return len(v) > 0
+	}
+	number, _ := toNumber(value)
+	return number != 0
+}
+
+func equal(left, right interface{}) bool {
+	leftNumber, leftOk := toNumber(left)
+	rightNumber, rightOk := toNumber(right)
+	if leftOk && rightOk {
+		return leftNumber == rightNumber
+	}
+	return reflect.DeepEqual(left, right)
+}
+
+// member reads a field of an object. Fields of null and missing fields are null.
+func member(object interface{}, name string) (interface{}, error) {
+	switch o := object.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		return o[name], nil
+	}
+	return nil, fmt.Errorf("cannot read field %s of %s", name, typeName(object))
+}
+
+// element reads an array element or an object field. Out of range elements are null.
+func element(object, index interface{}) (interface{}, error) {
+	switch o := object.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		key, err := toString(index)
+		if err != nil {
+			return nil, err
+		}
+		return o[key], nil
+	case []interface{}:
+		i, err := arrayIndex(o, index)
+		if err != nil {
+			return nil, nil
+		}
+		return o[i], nil
+	case string:
+		runes := []rune(o)
+		number, ok := toNumber(index)
+		i := int(number)
+		if i < 0 {
+			i += len(runes)
+		}
+		if !ok || i < 0 || i >= len(runes) {
+			return nil, nil
+		}
+		return string(runes[i]), nil
+	}
+	return nil, fmt.Errorf("cannot index %s", typeName(object))
+}
+
+// arrayIndex checks an array index. Negative indices count from the end.
+func arrayIndex(array []interface{}, index interface{}) (int, error) {
+	number, ok := toNumber(index)
+	if !ok || number != math.Trunc(number) {
+		return 0, fmt.Errorf("array index must be a whole number, not %s", typeName(index))
+	}
+	i := int(number)
+	if i < 0 {
+		i += len(array)
+	}
+	if i < 0 || i >= len(array) {
+		return 0, fmt.Errorf("array index %d out of range", int(number))
+	}
+	return i, nil
+}
+
+func binary(op string, left, right interface{}) (interface{}, error) {
+	switch op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	}
+
+	leftNumber, leftOk := toNumber(left)
+	rightNumber, rightOk := toNumber(right)
+	numbers := leftOk && rightOk
+	leftString, leftIsString := left.(string)
+	rightString, rightIsString := right.(string)
+
+	switch op {
+	case "+":
+		if numbers {
+			return leftNumber + rightNumber, nil
+		}
+		if leftArray, ok := left.([]interface{}); ok {
+			if rightArray, ok := right.([]interface{}); ok {
+				return append(append([]interface{}{}, leftArray...), rightArray...), nil
+			}
+		}
+		if leftIsString || rightIsString {
+			l, err := toString(left)
+			if err != nil {
+				return nil, err
+			}
+			r, err := toString(right)
+			if err != nil {
+				return nil, err
+			}
+			return l + r, nil
+		}
+	case "-", "*", "/", "%":
+		if !numbers {
+			break
+		}
+		switch op {
+		case "-":
+			return leftNumber - rightNumber, nil
+		case "*":
+			return leftNumber * rightNumber, nil
+		case "/":
+			if rightNumber == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			return leftNumber / rightNumber, nil
+		default:
+			if rightNumber == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			return math.Mod(leftNumber, rightNumber), nil
+		}
+	case "<", "<=", ">", ">=":
+		var compare int
+		switch {
+		case numbers:
+			compare = cmpFloat(leftNumber, rightNumber)
+		case leftIsString && rightIsString:
+			compare = cmpString(leftString, rightString)
+		default:
+			return nil, fmt.Errorf("cannot compare %s and %s", typeName(left), typeName(right))
+		}
+		switch op {
+		case "<":
+			return compare < 0, nil
+		case "<=":
+			return compare <= 0, nil
+		case ">":
+			return compare > 0, nil
+		default:
+			return compare >= 0, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid operands for %s: %s and %s", op, typeName(left), typeName(right))
+}
+
+func cmpFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func cmpString(a, b string) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
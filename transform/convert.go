@@ -0,0 +1,168 @@
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Target types of the convert action
+const (
+	typeString  = "string"
+	typeNumber  = "number"  // integer when the value is whole, float otherwise
+	typeInteger = "integer" // fractions are truncated
+	typeFloat   = "float"
+	typeBoolean = "boolean"
+	typeDate    = "date"
+)
+
+// Date formats understood besides Go time layouts
+const (
+	formatEpochMillis = "epoch_millis"
+	formatEpochSecond = "epoch_second"
+)
+
+func checkConvertType(typeName string) error {
+	switch typeName {
+	case typeString, typeNumber, typeInteger, typeFloat, typeBoolean, typeDate:
+		return nil
+	default:
+		return fmt.Errorf("unknown type %q", typeName)
+	}
+}
+
+// convertValue converts value to typeName. Dates are parsed with the given formats, tried in order,
+// and written with outputFormat.
+func convertValue(value interface{}, typeName string, formats []string, outputFormat string) (interface{}, error) {
+	switch typeName {
+	case typeString:
+		return toString(value)
+	case typeNumber:
+		number, err := toFloat(value)
+		if err != nil {
+			return nil, err
+		}
+		if number == math.Trunc(number) && math.Abs(number) < 1<<53 {
+			return int64(number), nil
+		}
+		return number, nil
+	case typeInteger:
+		number, err := toFloat(value)
+		if err != nil {
+			return nil, err
+		}
+		return int64(number), nil
+	case typeFloat:
+		return toFloat(value)
+	case typeBoolean:
+		return toBool(value)
+	case typeDate:
+		date, err := toTime(value, formats)
+		if err != nil {
+			return nil, err
+		}
+		return formatTime(date, outputFormat), nil
+	}
+	return nil, fmt.Errorf("unknown type %q", typeName)
+}
+
+func toString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case json.Number:
+		return v.String(), nil
+	case bool, int, int64:
+		return fmt.Sprint(v), nil
+	case map[string]interface{}, []interface{}:
+		data, err := json.Marshal(v)
+		return string(data), err
+	}
+	return "", fmt.Errorf("cannot convert %T to string", value)
+}
+
+func toFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case json.Number:
+		return v.Float64()
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(v), 64)
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("cannot convert %T to number", value)
+}
+
+func toBool(value interface{}) (bool, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case string:
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "true", "yes", "on", "1", "t", "y":
+			return true, nil
+		case "false", "no", "off", "0", "f", "n", "":
+			return false, nil
+		}
+		return false, fmt.Errorf("cannot convert %q to boolean", v)
+	}
+	number, err := toFloat(value)
+	if err != nil {
+		return false, fmt.Errorf("cannot convert %T to boolean", value)
+	}
+	return number != 0, nil
+}
+
+func toTime(value interface{}, formats []string) (time.Time, error) {
+	if len(formats) == 0 {
+		formats = []string{time.RFC3339Nano, formatEpochMillis}
+	}
+	for _, format := range formats {
+		switch format {
+		case formatEpochMillis, formatEpochSecond:
+			number, err := toFloat(value)
+			if err != nil {
+				continue
+			}
+			if format == formatEpochSecond {
+				number *= 1000
+			}
+			return time.UnixMilli(int64(number)).UTC(), nil
+		default:
+			text, ok := value.(string)
+			if !ok {
+				continue
+			}
+			if date, err := time.Parse(format, text); err == nil {
+				return date, nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("value %v matches none of the date formats %s", value, strings.Join(formats, ", "))
+}
+
+func formatTime(date time.Time, format string) interface{} {
+	switch format {
+	case "":
+		return date.Format(time.RFC3339Nano)
+	case formatEpochMillis:
+		return date.UnixMilli()
+	case formatEpochSecond:
+		return date.Unix()
+	}
+	return date.Format(format)
+}
@@ -0,0 +1,151 @@
+package transform
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Field paths are dotted, "address.city" naming the city key of the address object.
+// A key that itself contains dots is matched literally before being treated as a path.
+
+// getPath returns the value at path and whether it exists.
+func getPath(source map[string]interface{}, path string) (interface{}, bool) {
+	if value, ok := source[path]; ok {
+		return value, true
+	}
+	head, rest, nested := strings.Cut(path, ".")
+	if !nested {
+		return nil, false
+	}
+	child, ok := source[head].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	return getPath(child, rest)
+}
+
+// setPath sets the value at path, creating intermediate objects as needed.
+// A non-object value in the way is replaced by an object.
+func setPath(source map[string]interface{}, path string, value interface{}) {
+	if _, ok := source[path]; ok {
+		source[path] = value
+		return
+	}
+	head, rest, nested := strings.Cut(path, ".")
+	if !nested {
+		source[path] = value
+		return
+	}
+	child, ok := source[head].(map[string]interface{})
+	if !ok {
+		child = map[string]interface{}{}
+		source[head] = child
+	}
+	setPath(child, rest, value)
+}
+
+// deletePath removes the value at path and returns it. Objects left empty are kept.
+func deletePath(source map[string]interface{}, path string) (interface{}, bool) {
+	if value, ok := source[path]; ok {
+		delete(source, path)
+		return value, true
+	}
+	head, rest, nested := strings.Cut(path, ".")
+	if !nested {
+		return nil, false
+	}
+	child, ok := source[head].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	return deletePath(child, rest)
+}
+
+// flatten moves the leaves of nested objects up to dotted keys of object: {"a": {"b": 1}} becomes {"a.b": 1}.
+func flatten(object map[string]interface{}, separator string) {
+	for key, value := range object {
+		child, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		flatten(child, separator)
+		delete(object, key)
+		for childKey, childValue := range child {
+			object[key+separator+childKey] = childValue
+		}
+	}
+}
+
+// expand turns dotted keys of object into nested objects: {"a.b": 1} becomes {"a": {"b": 1}}.
+// Keys naming the same field, such as "a.b" next to {"a": {"b": 2}} or next to a value "a" that is
+// not an object, are a conflict: an error is returned and object is left unchanged.
+func expand(object map[string]interface{}, separator string) error {
+	expanded, err := expandObject(object, separator, "")
+	if err != nil {
+		return err
+	}
+	clear(object)
+	for key, value := range expanded {
+		object[key] = value
+	}
+	return nil
+}
+
+// expandObject returns a copy of object with its dotted keys expanded; prefix is the path of object, for errors.
+func expandObject(object map[string]interface{}, separator, prefix string) (map[string]interface{}, error) {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // report the same conflict whatever the map order
+
+	expanded := make(map[string]interface{}, len(object))
+	for _, key := range keys {
+		value := object[key]
+		if child, ok := value.(map[string]interface{}); ok {
+			var err error
+			if value, err = expandObject(child, separator, prefix+key+separator); err != nil {
+				return nil, err
+			}
+		}
+		parts := strings.Split(key, separator)
+		parent := expanded
+		for i, part := range parts[:len(parts)-1] {
+			next, ok := parent[part].(map[string]interface{})
+			if !ok {
+				if _, exists := parent[part]; exists {
+					return nil, fmt.Errorf("key %s%s conflicts with %s%s, which is not an object", prefix, key, prefix, strings.Join(parts[:i+1], separator))
+				}
+				next = map[string]interface{}{}
+				parent[part] = next
+			}
+			parent = next
+		}
+		if !mergeField(parent, parts[len(parts)-1], value) {
+			return nil, fmt.Errorf("key %s%s conflicts with another value of %s%s", prefix, key, prefix, strings.Join(parts, separator))
+		}
+	}
+	return expanded, nil
+}
+
+// mergeField sets key of parent to value, merging objects present on both sides.
+// It reports false when both sides hold a value for the same field.
+func mergeField(parent map[string]interface{}, key string, value interface{}) bool {
+	existing, exists := parent[key]
+	if !exists {
+		parent[key] = value
+		return true
+	}
+	existingObject, existingIsObject := existing.(map[string]interface{})
+	valueObject, valueIsObject := value.(map[string]interface{})
+	if !existingIsObject || !valueIsObject {
+		return false
+	}
+	for childKey, childValue := range valueObject {
+		if !mergeField(existingObject, childKey, childValue) {
+			return false
+		}
+	}
+	return true
+}
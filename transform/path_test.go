@@ -0,0 +1,144 @@
+package transform
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// decode parses the JSON of a test document the way exported documents are decoded.
+func decode(t *testing.T, data string) map[string]interface{} {
+	t.Helper()
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &doc); err != nil {
+		t.Fatalf("invalid test document %s: %v", data, err)
+	}
+	return doc
+}
+
+func TestGetPath(t *testing.T) {
+	doc := `{"a": {"b": {"c": 1}, "n": null}, "x.y": 2, "x": {"y": 3}, "s": "text"}`
+	tests := []struct {
+		path   string
+		want   interface{}
+		exists bool
+	}{
+		{path: "a.b.c", want: 1.0, exists: true},
+		{path: "a.b", want: map[string]interface{}{"c": 1.0}, exists: true},
+		{path: "a.n", want: nil, exists: true},
+		{path: "x.y", want: 2.0, exists: true}, // the literal key wins
+		{path: "a.missing", exists: false},
+		{path: "s.length", exists: false},
+		{path: "missing", exists: false},
+	}
+	for _, tt := range tests {
+		value, exists := getPath(decode(t, doc), tt.path)
+		if exists != tt.exists || !reflect.DeepEqual(value, tt.want) {
+			t.Errorf("getPath(%s) = %v, %v, want %v, %v", tt.path, value, exists, tt.want, tt.exists)
+		}
+	}
+}
+
+func TestSetPath(t *testing.T) {
+	tests := []struct {
+		doc  string
+		path string
+		want string
+	}{
+		{doc: `{}`, path: "a", want: `{"a": 9}`},
+		{doc: `{}`, path: "a.b.c", want: `{"a": {"b": {"c": 9}}}`},
+		{doc: `{"a": {"x": 1}}`, path: "a.b", want: `{"a": {"x": 1, "b": 9}}`},
+		{doc: `{"a": "scalar"}`, path: "a.b", want: `{"a": {"b": 9}}`},
+		{doc: `{"a.b": 1}`, path: "a.b", want: `{"a.b": 9}`},
+	}
+	for _, tt := range tests {
+		doc := decode(t, tt.doc)
+		setPath(doc, tt.path, 9.0)
+		if want := decode(t, tt.want); !reflect.DeepEqual(doc, want) {
+			t.Errorf("setPath(%s, %s) = %v, want %v", tt.doc, tt.path, doc, want)
+		}
+	}
+}
+
+func TestDeletePath(t *testing.T) {
+	tests := []struct {
+		doc     string
+		path    string
+		want    string
+		deleted interface{}
+		exists  bool
+	}{
+		{doc: `{"a": 1, "b": 2}`, path: "a", want: `{"b": 2}`, deleted: 1.0, exists: true},
+		{doc: `{"a": {"b": 1}}`, path: "a.b", want: `{"a": {}}`, deleted: 1.0, exists: true},
+		{doc: `{"a.b": 1, "a": {"b": 2}}`, path: "a.b", want: `{"a": {"b": 2}}`, deleted: 1.0, exists: true},
+		{doc: `{"a": 1}`, path: "a.b", want: `{"a": 1}`},
+		{doc: `{"a": 1}`, path: "b", want: `{"a": 1}`},
+	}
+	for _, tt := range tests {
+		doc := decode(t, tt.doc)
+		deleted, exists := deletePath(doc, tt.path)
+		if want := decode(t, tt.want); !reflect.DeepEqual(doc, want) || exists != tt.exists || deleted != tt.deleted {
+			t.Errorf("deletePath(%s, %s) = %v, %v leaving %v, want %v, %v leaving %v", tt.doc, tt.path, deleted, exists, doc, tt.deleted, tt.exists, want)
+		}
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	tests := []struct {
+		doc       string
+		separator string
+		want      string
+	}{
+		{doc: `{"a": {"b": 1, "c": {"d": 2}}, "e": 3}`, separator: ".", want: `{"a.b": 1, "a.c.d": 2, "e": 3}`},
+		{doc: `{"a": {"b": [1, {"c": 2}]}}`, separator: "_", want: `{"a_b": [1, {"c": 2}]}`},
+		{doc: `{"a": {}}`, separator: ".", want: `{}`},
+	}
+	for _, tt := range tests {
+		doc := decode(t, tt.doc)
+		flatten(doc, tt.separator)
+		if want := decode(t, tt.want); !reflect.DeepEqual(doc, want) {
+			t.Errorf("flatten(%s) = %v, want %v", tt.doc, doc, want)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	tests := []struct {
+		doc       string
+		separator string
+		want      string
+		err       string
+	}{
+		{doc: `{"a.b": 1, "a.c.d": 2, "e": 3}`, separator: ".", want: `{"a": {"b": 1, "c": {"d": 2}}, "e": 3}`},
+		{doc: `{"a_b": 1, "a.c": 2}`, separator: "_", want: `{"a": {"b": 1}, "a.c": 2}`},
+		{doc: `{"a.b": 1, "a": {"c": 2}}`, separator: ".", want: `{"a": {"b": 1, "c": 2}}`},
+		{doc: `{"a.b": {"c.d": 1}, "a": {"b": {"e": 2}}}`, separator: ".", want: `{"a": {"b": {"c": {"d": 1}, "e": 2}}}`},
+		{doc: `{"o": {"x.y": 1}}`, separator: ".", want: `{"o": {"x": {"y": 1}}}`},
+		{doc: `{"a.b": 1, "a": "scalar"}`, separator: ".", err: "key a.b conflicts with a, which is not an object"},
+		{doc: `{"a.b.c": 1, "a": {"b": 2}}`, separator: ".", err: "key a.b.c conflicts with a.b, which is not an object"},
+		{doc: `{"a.b": 1, "a": null}`, separator: ".", err: "key a.b conflicts with a, which is not an object"},
+		{doc: `{"a.b": 1, "a": {"b": 2}}`, separator: ".", err: "key a.b conflicts with another value of a.b"},
+		{doc: `{"a.b": {"c": 1}, "a": {"b": {"c": 2}}}`, separator: ".", err: "key a.b conflicts with another value of a.b"},
+		{doc: `{"o": {"x.y": 1, "x": 2}}`, separator: ".", err: "key o.x.y conflicts with o.x, which is not an object"},
+	}
+	for _, tt := range tests {
+		doc := decode(t, tt.doc)
+		err := expand(doc, tt.separator)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("expand(%s) error = %v, want %q", tt.doc, err, tt.err)
+			}
+			if original := decode(t, tt.doc); !reflect.DeepEqual(doc, original) {
+				t.Errorf("expand(%s) changed the document to %v on a conflict", tt.doc, doc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expand(%s): %v", tt.doc, err)
+			continue
+		}
+		if want := decode(t, tt.want); !reflect.DeepEqual(doc, want) {
+			t.Errorf("expand(%s) = %v, want %v", tt.doc, doc, want)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package transform
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Rule actions
+const (
+	actionRename  = "rename"  // move field to to
+	actionRemove  = "remove"  // delete field, or every field of fields
+	actionCopy    = "copy"    // copy field to to
+	actionSet     = "set"     // set field to value
+	actionMove    = "move"    // move fields into the object at to, e.g. city into address
+	actionFlatten = "flatten" // turn nested objects into dotted keys
+	actionExpand  = "expand"  // turn dotted keys into nested objects
+	actionConvert = "convert" // convert field to type
+	actionDefault = "default" // set field to value when missing or null
+)
+
+// Rules is an ordered list of field transformations applied to every document.
+type Rules struct {
+	Rules []*Rule `yaml:"rules"`
+}
+
+// Rule is one transformation. Field names are dotted paths into the document.
+type Rule struct {
+	Action string      `yaml:"action"`
+	Field  string      `yaml:"field"`
+	Fields []string    `yaml:"fields"`
+	To     string      `yaml:"to"`
+	Value  interface{} `yaml:"value"`
+
+	Type         string   `yaml:"type"`          // convert: string, number, integer, float, boolean or date
+	Formats      []string `yaml:"formats"`       // convert to date: input layouts tried in order, or epoch_millis/epoch_second
+	OutputFormat string   `yaml:"output_format"` // convert to date: output layout, RFC 3339 by default
+	Separator    string   `yaml:"separator"`     // flatten and expand: key separator, "." by default
+
+	When []*Condition `yaml:"when"` // the rule applies only when every condition holds
+}
+
+// Condition is a predicate on a field of the document.
+type Condition struct {
+	Field     string        `yaml:"field"`
+	Exists    *bool         `yaml:"exists"`
+	Equals    interface{}   `yaml:"equals"`
+	NotEquals interface{}   `yaml:"not_equals"`
+	In        []interface{} `yaml:"in"`
+	Matches   string        `yaml:"matches"`
+
+	pattern *regexp.Regexp
+}
+
+// LoadRules reads rules from a YAML or JSON file.
+func LoadRules(path string) (*Rules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transform rules: %w", err)
+	}
+	return ParseRules(data)
+}
+
+// ParseRules parses and validates YAML or JSON rules.
+func ParseRules(data []byte) (*Rules, error) {
+	var rules Rules
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse transform rules: %w", err)
+	}
+	for i, rule := range rules.Rules {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("transform rule %d (%s): %w", i+1, rule.Action, err)
+		}
+	}
+	return &rules, nil
+}
+
+func (r *Rule) validate() error {
+	switch r.Action {
+	case actionRename, actionCopy:
+		if r.Field == "" || r.To == "" {
+			return errors.New("field and to are required")
+		}
+	case actionRemove:
+		if r.Field == "" && len(r.Fields) == 0 {
+			return errors.New("field or fields is required")
+		}
+	case actionSet, actionDefault:
+		if r.Field == "" {
+			return errors.New("field is required")
+		}
+	case actionMove:
+		if (r.Field == "" && len(r.Fields) == 0) || r.To == "" {
+			return errors.New("field or fields, and to are required")
+		}
+	case actionFlatten, actionExpand:
+	case actionConvert:
+		if r.Field == "" {
+			return errors.New("field is required")
+		}
+		if err := checkConvertType(r.Type); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	if r.Separator == "" {
+		r.Separator = "."
+	}
+
+	for _, condition := range r.When {
+		if condition.Field == "" {
+			return errors.New("condition field is required")
+		}
+		if condition.Matches != "" {
+			pattern, err := regexp.Compile(condition.Matches)
+			if err != nil {
+				return fmt.Errorf("invalid condition pattern: %w", err)
+			}
+			condition.pattern = pattern
+		}
+	}
+	return nil
+}
+
+// Apply runs every rule on the document source in order. A rule that fails leaves the document
+// as it was before that rule; the remaining rules still run and the errors are returned together.
+func (r *Rules) Apply(source map[string]interface{}) error {
+	var errs []error
+	for i, rule := range r.Rules {
+		if !rule.matches(source) {
+			continue
+		}
+		if err := rule.apply(source); err != nil {
+			errs = append(errs, fmt.Errorf("transform rule %d (%s): %w", i+1, rule.Action, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Rule) matches(source map[string]interface{}) bool {
+	for _, condition := range r.When {
+		if !condition.holds(source) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Rule) fields() []string {
+	if r.Field != "" {
+		return append([]string{r.Field}, r.Fields...)
+	}
+	return r.Fields
+}
+
+func (r *Rule) apply(source map[string]interface{}) error {
+	switch r.Action {
+	case actionRename:
+		if value, ok := deletePath(source, r.Field); ok {
+			setPath(source, r.To, value)
+		}
+	case actionRemove:
+		for _, field := range r.fields() {
+			deletePath(source, field)
+		}
+	case actionCopy:
+		if value, ok := getPath(source, r.Field); ok {
+			setPath(source, r.To, deepCopy(value))
+		}
+	case actionSet:
+		setPath(source, r.Field, deepCopy(r.Value))
+	case actionMove:
+		for _, field := range r.fields() {
+			if value, ok := deletePath(source, field); ok {
+				setPath(source, r.To+"."+field, value)
+			}
+		}
+	case actionFlatten, actionExpand:
+		object := source
+		if r.Field != "" {
+			value, ok := getPath(source, r.Field)
+			if !ok {
+				return nil
+			}
+			if object, ok = value.(map[string]interface{}); !ok {
+				return fmt.Errorf("field %s is not an object", r.Field)
+			}
+		}
+		if r.Action == actionFlatten {
+			flatten(object, r.Separator)
+		} else if err := expand(object, r.Separator); err != nil {
+			return err
+		}
+	case actionConvert:
+		value, ok := getPath(source, r.Field)
+		if !ok || value == nil {
+			return nil
+		}
+		converted, err := convertValue(value, r.Type, r.Formats, r.OutputFormat)
+		if err != nil {
+			return fmt.Errorf("field %s: %w", r.Field, err)
+		}
+		setPath(source, r.Field, converted)
+	case actionDefault:
+		if value, ok := getPath(source, r.Field); !ok || value == nil {
+			setPath(source, r.Field, deepCopy(r.Value))
+		}
+	}
+	return nil
+}
+
+func (c *Condition) holds(source map[string]interface{}) bool {
+	value, exists := getPath(source, c.Field)
+	if c.Exists != nil && *c.Exists != exists {
+		return false
+	}
+	if c.Equals != nil && !(exists && equal(value, c.Equals)) {
+		return false
+	}
+	if c.NotEquals != nil && exists && equal(value, c.NotEquals) {
+		return false
+	}
+	if c.In != nil {
+		found := false
+		for _, candidate := range c.In {
+			if exists && equal(value, candidate) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if c.pattern != nil {
+		text, err := toString(value)
+		if !exists || err != nil || !c.pattern.MatchString(text) {
+			return false
+		}
+	}
+	return true
+}
+
+// equal compares a document value with a rule value, treating numbers of any type as equal by value.
+func equal(value, expected interface{}) bool {
+	if isNumber(value) && isNumber(expected) {
+		actual, _ := toFloat(value)
+		number, _ := toFloat(expected)
+		return actual == number
+	}
+	return reflect.DeepEqual(value, expected)
+}
+
+func isNumber(value interface{}) bool {
+	switch value.(type) {
+	case int, int64, float64, json.Number:
+		return true
+	}
+	return false
+}
+
+// deepCopy copies objects and arrays so rule values and copied fields are not shared between documents.
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			copied[key] = deepCopy(child)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, child := range v {
+			copied[i] = deepCopy(child)
+		}
+		return copied
+	}
+	return value
+}
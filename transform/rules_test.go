@@ -0,0 +1,146 @@
+package transform
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// applyRules parses YAML rules and applies them to a JSON document.
+func applyRules(t *testing.T, rules, doc string) (map[string]interface{}, error) {
+	t.Helper()
+	parsed, err := ParseRules([]byte(rules))
+	if err != nil {
+		t.Fatalf("ParseRules(%s): %v", rules, err)
+	}
+	source := decode(t, doc)
+	return source, parsed.Apply(source)
+}
+
+func TestRenameRule(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+		doc   string
+		want  string
+	}{
+		{name: "top level", rules: `{rules: [{action: rename, field: a, to: b}]}`, doc: `{"a": 1}`, want: `{"b": 1}`},
+		{name: "into nested", rules: `{rules: [{action: rename, field: a, to: x.y}]}`, doc: `{"a": 1}`, want: `{"x": {"y": 1}}`},
+		{name: "out of nested", rules: `{rules: [{action: rename, field: x.y, to: a}]}`, doc: `{"x": {"y": 1, "z": 2}}`, want: `{"x": {"z": 2}, "a": 1}`},
+		{name: "object value", rules: `{rules: [{action: rename, field: a, to: b}]}`, doc: `{"a": {"c": [1]}}`, want: `{"b": {"c": [1]}}`},
+		{name: "null value", rules: `{rules: [{action: rename, field: a, to: b}]}`, doc: `{"a": null}`, want: `{"b": null}`},
+		{name: "overwrites target", rules: `{rules: [{action: rename, field: a, to: b}]}`, doc: `{"a": 1, "b": 2}`, want: `{"b": 1}`},
+		{name: "missing field", rules: `{rules: [{action: rename, field: a, to: b}]}`, doc: `{"c": 1}`, want: `{"c": 1}`},
+		{name: "dotted key", rules: `{rules: [{action: rename, field: a.b, to: c}]}`, doc: `{"a.b": 1}`, want: `{"c": 1}`},
+		{name: "condition holds", rules: `{rules: [{action: rename, field: a, to: b, when: [{field: kind, equals: x}]}]}`, doc: `{"a": 1, "kind": "x"}`, want: `{"b": 1, "kind": "x"}`},
+		{name: "condition fails", rules: `{rules: [{action: rename, field: a, to: b, when: [{field: kind, equals: x}]}]}`, doc: `{"a": 1, "kind": "y"}`, want: `{"a": 1, "kind": "y"}`},
+		{name: "chained", rules: `{rules: [{action: rename, field: a, to: b}, {action: rename, field: b, to: c}]}`, doc: `{"a": 1}`, want: `{"c": 1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := applyRules(t, tt.rules, tt.doc)
+			if err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+			if want := decode(t, tt.want); !reflect.DeepEqual(doc, want) {
+				t.Errorf("doc = %v, want %v", doc, want)
+			}
+		})
+	}
+}
+
+func TestConvertRule(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  string
+		value string // JSON of the field value, empty when missing
+		want  interface{}
+		err   string
+	}{
+		{name: "number to string", rule: `type: string`, value: `1.5`, want: "1.5"},
+		{name: "boolean to string", rule: `type: string`, value: `true`, want: "true"},
+		{name: "object to string", rule: `type: string`, value: `{"a": 1}`, want: `{"a":1}`},
+		{name: "string to number", rule: `type: number`, value: `" 42 "`, want: int64(42)},
+		{name: "fraction to number", rule: `type: number`, value: `"2.5"`, want: 2.5},
+		{name: "string to integer", rule: `type: integer`, value: `"-3.9"`, want: int64(-3)},
+		{name: "integer to float", rule: `type: float`, value: `3`, want: 3.0},
+		{name: "yes to boolean", rule: `type: boolean`, value: `"Yes"`, want: true},
+		{name: "empty to boolean", rule: `type: boolean`, value: `""`, want: false},
+		{name: "number to boolean", rule: `type: boolean`, value: `0`, want: false},
+		{name: "epoch millis to date", rule: `type: date`, value: `1700000000000`, want: "2023-11-14T22:13:20Z"},
+		{name: "epoch seconds to date", rule: `{type: date, formats: [epoch_second]}`, value: `1700000000`, want: "2023-11-14T22:13:20Z"},
+		{name: "layout to date", rule: `{type: date, formats: ["02/01/2006 15:04"]}`, value: `"14/11/2023 22:13"`, want: "2023-11-14T22:13:00Z"},
+		{name: "formats tried in order", rule: `{type: date, formats: ["2006-01-02", epoch_millis]}`, value: `0`, want: "1970-01-01T00:00:00Z"},
+		{name: "date to epoch millis", rule: `{type: date, output_format: epoch_millis}`, value: `"2023-11-14T22:13:20Z"`, want: int64(1700000000000)},
+		{name: "date to layout", rule: `{type: date, output_format: "2006-01-02"}`, value: `"2023-11-14T22:13:20+02:00"`, want: "2023-11-14"},
+		{name: "missing field", rule: `type: number`, value: ``, want: nil},
+		{name: "null field", rule: `type: number`, value: `null`, want: nil},
+		{name: "invalid number", rule: `type: number`, value: `"abc"`, err: `transform rule 1 (convert): field f: strconv.ParseFloat: parsing "abc": invalid syntax`},
+		{name: "array to number", rule: `type: integer`, value: `[1]`, err: "transform rule 1 (convert): field f: cannot convert []interface {} to number"},
+		{name: "invalid boolean", rule: `type: boolean`, value: `"maybe"`, err: `transform rule 1 (convert): field f: cannot convert "maybe" to boolean`},
+		{name: "invalid date", rule: `{type: date, formats: ["2006-01-02"]}`, value: `"soon"`, err: "transform rule 1 (convert): field f: value soon matches none of the date formats 2006-01-02"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := tt.rule
+			if !strings.HasPrefix(rule, "{") {
+				rule = "{" + rule + "}"
+			}
+			rules := `{rules: [` + strings.Replace(rule, "{", "{action: convert, field: f, ", 1) + `]}`
+			doc := `{}`
+			if tt.value != "" {
+				doc = `{"f": ` + tt.value + `}`
+			}
+			source, err := applyRules(t, rules, doc)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("error = %v, want %q", err, tt.err)
+				}
+				if original := decode(t, doc); !reflect.DeepEqual(source, original) {
+					t.Errorf("doc = %v, want it unchanged", source)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+			if got := source["f"]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("f = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandRuleConflict(t *testing.T) {
+	rules := `{rules: [{action: expand}, {action: set, field: done, value: true}]}`
+	doc, err := applyRules(t, rules, `{"a.b": 1, "a": "scalar"}`)
+	if err == nil || err.Error() != "transform rule 1 (expand): key a.b conflicts with a, which is not an object" {
+		t.Errorf("error = %v, want the expand conflict", err)
+	}
+	if want := decode(t, `{"a.b": 1, "a": "scalar", "done": true}`); !reflect.DeepEqual(doc, want) {
+		t.Errorf("doc = %v, want %v", doc, want)
+	}
+}
+
+func TestParseRulesErrors(t *testing.T) {
+	tests := []struct {
+		rules string
+		want  string
+	}{
+		{rules: `{rules: [{action: rename, field: a}]}`, want: "transform rule 1 (rename): field and to are required"},
+		{rules: `{rules: [{action: set, field: a}, {action: convert, field: b, type: decimal}]}`, want: `transform rule 2 (convert): unknown type "decimal"`},
+		{rules: `{rules: [{action: convert, type: string}]}`, want: "transform rule 1 (convert): field is required"},
+		{rules: `{rules: [{action: explode}]}`, want: `transform rule 1 (explode): unknown action "explode"`},
+		{rules: `{rules: [{action: remove}]}`, want: "transform rule 1 (remove): field or fields is required"},
+		{rules: `{rules: [{action: move, fields: [a]}]}`, want: "transform rule 1 (move): field or fields, and to are required"},
+		{rules: `{rules: [{action: set, field: a, when: [{equals: 1}]}]}`, want: "transform rule 1 (set): condition field is required"},
+		{rules: `{rules: [{action: set, field: a, when: [{field: b, matches: "("}]}]}`, want: "transform rule 1 (set): invalid condition pattern"},
+		{rules: `rules: [`, want: "failed to parse transform rules"},
+	}
+	for _, tt := range tests {
+		_, err := ParseRules([]byte(tt.rules))
+		if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("ParseRules(%s) error = %v, want %q", tt.rules, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !unix
+
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// LockFile opens or creates the file at path. Without flock the file is not locked:
+// the caller has to make sure a single process uses what it guards.
+func LockFile(path string, _ time.Duration) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+}
+
+// UnlockFile closes a file opened with LockFile.
+func UnlockFile(file *os.File) error {
+	return file.Close()
+}
@@ -0,0 +1,49 @@
+//go:build unix
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// lockRetryInterval is how often LockFile tries again while another process holds the lock.
+const lockRetryInterval = 50 * time.Millisecond
+
+// LockFile opens or creates the file at path and takes an exclusive flock on it, waiting up to timeout
+// for another process to release it. The lock is held until the returned file is passed to UnlockFile,
+// or the process exits.
+func LockFile(path string, timeout time.Duration) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return file, nil
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) || time.Now().After(deadline) {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// UnlockFile releases a lock taken with LockFile and closes the file.
+func UnlockFile(file *os.File) error {
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_UN); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
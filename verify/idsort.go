@@ -0,0 +1,200 @@
+package verify
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+)
+
+// sortRunSize is the number of records an idSorter keeps in memory before writing them to a sorted run.
+var sortRunSize = 100000
+
+// idRecord is a document of one side of the verification, compared with the other side by index and _id.
+type idRecord struct {
+	Index   string `json:"index"`
+	ID      string `json:"id"`
+	Type    string `json:"type,omitempty"`    // mapping type of a target document on ES2
+	Routing string `json:"routing,omitempty"` // routing of a target document, to fetch it by _id
+	Hash    string `json:"hash,omitempty"`    // content hash of a sampled expected document
+}
+
+// compare orders records by index, then _id.
+func (r *idRecord) compare(other *idRecord) int {
+	switch {
+	case r.Index < other.Index:
+		return -1
+	case r.Index > other.Index:
+		return 1
+	case r.ID < other.ID:
+		return -1
+	case r.ID > other.ID:
+		return 1
+	}
+	return 0
+}
+
+// idSorter sorts records by index and _id in bounded memory: every sortRunSize records are sorted
+// and written to a temporary file, and the files are merged when reading the records back.
+// Records with the same index and _id come back in the order they were added.
+type idSorter struct {
+	dir    string
+	buffer []idRecord
+	runs   []string
+}
+
+// newIDSorter returns a sorter writing its runs to dir.
+func newIDSorter(dir string) *idSorter {
+	return &idSorter{dir: dir}
+}
+
+func (s *idSorter) add(record idRecord) error {
+	s.buffer = append(s.buffer, record)
+	if len(s.buffer) < sortRunSize {
+		return nil
+	}
+	return s.spill()
+}
+
+// sortBuffer sorts the buffered records, keeping the order of equal records.
+func (s *idSorter) sortBuffer() {
+	sort.SliceStable(s.buffer, func(i, j int) bool { return s.buffer[i].compare(&s.buffer[j]) < 0 })
+}
+
+// spill writes the buffered records to a new sorted run.
+func (s *idSorter) spill() error {
+	s.sortBuffer()
+	file, err := os.CreateTemp(s.dir, "run-*.ndjson")
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, file.Name())
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for i := range s.buffer {
+		if err := encoder.Encode(&s.buffer[i]); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	s.buffer = s.buffer[:0]
+	return file.Close()
+}
+
+// sorted returns a stream of every record added, in order. Nothing may be added afterwards.
+func (s *idSorter) sorted() (*idStream, error) {
+	s.sortBuffer()
+	stream := &idStream{}
+	for _, path := range s.runs {
+		file, err := os.Open(path)
+		if err != nil {
+			stream.Close()
+			return nil, err
+		}
+		stream.files = append(stream.files, file)
+		stream.runs = append(stream.runs, &sortRun{order: len(stream.runs), decoder: json.NewDecoder(bufio.NewReader(file))})
+	}
+	// The records still in memory were added last
+	stream.runs = append(stream.runs, &sortRun{order: len(stream.runs), records: s.buffer})
+
+	for _, run := range stream.runs {
+		ok, err := run.advance()
+		if err != nil {
+			stream.Close()
+			return nil, err
+		}
+		if ok {
+			stream.heap = append(stream.heap, run)
+		}
+	}
+	heap.Init(&stream.heap)
+	return stream, nil
+}
+
+// sortRun is a sorted run being merged, read from a file or from memory, with its next record.
+type sortRun struct {
+	order   int // runs added earlier win ties
+	decoder *json.Decoder
+	records []idRecord
+	head    idRecord
+}
+
+// advance reads the next record of the run into head, and reports whether there was one.
+func (r *sortRun) advance() (bool, error) {
+	if r.decoder == nil {
+		if len(r.records) == 0 {
+			return false, nil
+		}
+		r.head, r.records = r.records[0], r.records[1:]
+		return true, nil
+	}
+	r.head = idRecord{}
+	if err := r.decoder.Decode(&r.head); err != nil {
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// runHeap orders the runs being merged by their next record.
+type runHeap []*sortRun
+
+func (h runHeap) Len() int { return len(h) }
+func (h runHeap) Less(i, j int) bool {
+	if c := h[i].head.compare(&h[j].head); c != 0 {
+		return c < 0
+	}
+	return h[i].order < h[j].order
+}
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*sortRun)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	run := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return run
+}
+
+// idStream merges the sorted runs of an idSorter.
+type idStream struct {
+	runs  []*sortRun
+	files []*os.File
+	heap  runHeap
+}
+
+// next returns the next record, nil after the last one.
+func (s *idStream) next() (*idRecord, error) {
+	if len(s.heap) == 0 {
+		return nil, nil
+	}
+	run := s.heap[0]
+	record := run.head
+	ok, err := run.advance()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		heap.Fix(&s.heap, 0)
+	} else {
+		heap.Pop(&s.heap)
+	}
+	return &record, nil
+}
+
+// Close closes the run files, which are left in the directory of the sorter.
+func (s *idStream) Close() error {
+	var errs []error
+	for _, file := range s.files {
+		errs = append(errs, file.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,392 @@
+package verify
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"elkmigration/clients"
+	"elkmigration/config"
+	"elkmigration/job"
+	"elkmigration/logger"
+	"elkmigration/pipeline"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Report is the outcome of a verification, saved as JSON and, as a summary, in the checkpoint store for the cutover.
+type Report struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+
+	SourceCount   int `json:"source_count"`   // documents read from the source
+	ExpectedCount int `json:"expected_count"` // documents the source should produce on the target after transforms, one per index and _id
+	TargetCount   int `json:"target_count"`   // documents read from the target indices
+
+	MissingCount int      `json:"missing_count"` // expected on the target but not found
+	ExtraCount   int      `json:"extra_count"`   // found on the target but not expected
+	Missing      []string `json:"missing,omitempty"`
+	Extra        []string `json:"extra,omitempty"`
+
+	SampleRate    float64  `json:"sample_rate"`
+	SampledCount  int      `json:"sampled_count"`
+	MismatchCount int      `json:"mismatch_count"` // sampled documents whose content differs
+	Mismatched    []string `json:"mismatched,omitempty"`
+
+	Passed     bool      `json:"passed"`
+	VerifiedAt time.Time `json:"verified_at"`
+}
+
+// Summary is the part of a report the cutover checks before moving an alias.
+type Summary struct {
+	Target     string    `json:"target"`
+	Passed     bool      `json:"passed"`
+	VerifiedAt time.Time `json:"verified_at"`
+}
+
+// Summary returns the summary of the report.
+func (r *Report) Summary() Summary {
+	return Summary{Target: r.Target, Passed: r.Passed, VerifiedAt: r.VerifiedAt}
+}
+
+// Verify reads the source indices of the job, applies the transforms to know what the target should
+// hold, then reads the target indices and compares: document counts, missing and extra _ids, and for
+// a deterministic sample of VERIFY_SAMPLE_RATE of the documents a hash of their canonical JSON source.
+// Every source of a job is read before the targets, since several sources may roll up into one target.
+// The _ids of both sides are sorted on disk and merged, the target is read without its _source and
+// the sampled documents are fetched with _mget, so memory does not grow with the size of the indices.
+// Document IDs are listed in the report up to VERIFY_MAX_IDS per category, as index/id.
+func Verify(ctx context.Context, sourceClient, targetClient clients.ElasticsearchClient, config *config.Config, indices []job.Index, filter *pipeline.ExportFilter, transformer *pipeline.Transformer) (*Report, error) {
+	report := &Report{
+		Source:     config.ElkIndexFrom,
+		Target:     config.ElkIndexTo,
+		SampleRate: config.VerifySampleRate,
+	}
+	dir, err := os.MkdirTemp("", "elkmigration-verify-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	// Read the sources in full, since the transforms need the document body
+	expected := newIDSorter(dir)
+	targets := map[string]bool{} // every target index the documents were routed to, and those of empty sources
+	for _, source := range indices {
+		targets[source.Target] = true
+		if err := readExpected(ctx, sourceClient, source.Config(config), filter, transformer, expected, targets, report); err != nil {
+			return nil, fmt.Errorf("failed to read source index %s: %w", source.Source, err)
+		}
+	}
+	logger.Info("Read source for verification", zap.Int("source", report.SourceCount))
+
+	// Only the _ids of the target are read; sampled bodies are fetched by _id during the comparison
+	names := make([]string, 0, len(targets))
+	for index := range targets {
+		names = append(names, index)
+	}
+	sort.Strings(names)
+	found := newIDSorter(dir)
+	for _, index := range names {
+		targetConfig := *config
+		targetConfig.ElkIndexFrom = index
+		targetConfig.SourceType = pipeline.SourceElasticsearch
+		targetConfig.ExportMode = "scroll"
+		err := pipeline.ReadSource(ctx, targetClient, &targetConfig, &pipeline.ExportFilter{NoSource: true}, func(doc *pipeline.Document) error {
+			report.TargetCount++
+			return found.add(idRecord{Index: index, ID: doc.ID, Type: doc.Type, Routing: doc.Routing})
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read target index %s: %w", index, err)
+		}
+	}
+
+	if err := compare(ctx, targetClient, config, expected, found, report); err != nil {
+		return nil, err
+	}
+	report.Passed = report.ExpectedCount == report.TargetCount && report.MissingCount == 0 && report.ExtraCount == 0 && report.MismatchCount == 0
+	report.VerifiedAt = time.Now()
+	return report, nil
+}
+
+// readExpected reads a source index and records the documents its transformed documents should be on the target.
+func readExpected(ctx context.Context, client clients.ElasticsearchClient, config *config.Config, filter *pipeline.ExportFilter, transformer *pipeline.Transformer, expected *idSorter, targets map[string]bool, report *Report) error {
+	splitter, err := pipeline.NewTypeSplitter(config)
+	if err != nil {
+		return err
+	}
+	transformer = transformer.WithSplitter(config, splitter)
+
+	config.ExportMode = "scroll"
+	return pipeline.ReadSource(ctx, client, config, filter, func(doc *pipeline.Document) error {
+		report.SourceCount++
+		docs, err := transformer.Transform(ctx, doc)
+		if err != nil {
+			return err
+		}
+		for _, transformed := range docs {
+			record := idRecord{Index: transformed.TargetIndex(config.ElkIndexTo), ID: transformed.ID}
+			if sampled(transformed.ID, config.VerifySampleRate) {
+				hash, err := contentHash(transformed.Source)
+				if err != nil {
+					return err
+				}
+				record.Hash = hash
+			}
+			if err := expected.add(record); err != nil {
+				return err
+			}
+			targets[record.Index] = true
+		}
+		return nil
+	})
+}
+
+// compare merges the sorted expected and target documents into the report. When several source
+// documents produce the same _id, the last one read is the one expected, and it is counted once.
+func compare(ctx context.Context, client clients.ElasticsearchClient, config *config.Config, expectedIDs, foundIDs *idSorter, report *Report) error {
+	expected, err := expectedIDs.sorted()
+	if err != nil {
+		return err
+	}
+	defer expected.Close()
+	found, err := foundIDs.sorted()
+	if err != nil {
+		return err
+	}
+	defer found.Close()
+
+	samples := &sampleChecker{config: config, report: report}
+	if config.VerifySampleRate > 0 {
+		documents, ok := client.(clients.DocumentClient)
+		if !ok {
+			return fmt.Errorf("unsupported target client %T", client)
+		}
+		samples.client = documents
+	}
+
+	// nextExpected returns the next expected document, the last of those with the same index and _id
+	var pending *idRecord
+	nextExpected := func() (*idRecord, error) {
+		if pending == nil {
+			var err error
+			if pending, err = expected.next(); pending == nil || err != nil {
+				return nil, err
+			}
+		}
+		for {
+			record, err := expected.next()
+			if err != nil {
+				return nil, err
+			}
+			if record == nil || record.compare(pending) != 0 {
+				current := pending
+				pending = record
+				report.ExpectedCount++
+				return current, nil
+			}
+			pending = record
+		}
+	}
+
+	want, err := nextExpected()
+	if err != nil {
+		return err
+	}
+	got, err := found.next()
+	if err != nil {
+		return err
+	}
+	for want != nil || got != nil {
+		switch {
+		case got == nil || want != nil && want.compare(got) < 0:
+			report.MissingCount++
+			report.Missing = appendID(report.Missing, want.Index, want.ID, config.VerifyMaxIDs)
+			want, err = nextExpected()
+		case want == nil || got.compare(want) < 0:
+			report.ExtraCount++
+			report.Extra = appendID(report.Extra, got.Index, got.ID, config.VerifyMaxIDs)
+			got, err = found.next()
+		default:
+			if want.Hash != "" {
+				got.Hash = want.Hash
+				if err := samples.add(ctx, got); err != nil {
+					return err
+				}
+			}
+			if want, err = nextExpected(); err == nil {
+				got, err = found.next()
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return samples.flush(ctx)
+}
+
+// sampleChecker fetches sampled target documents by batches of BULK_SIZE with _mget, and compares
+// their content hash with the expected one.
+type sampleChecker struct {
+	client clients.DocumentClient
+	config *config.Config
+	report *Report
+	batch  []*idRecord // documents of one target index, with their expected hash
+}
+
+func (c *sampleChecker) add(ctx context.Context, record *idRecord) error {
+	if len(c.batch) > 0 && (c.batch[0].Index != record.Index || len(c.batch) >= max(c.config.BulkSize, 1)) {
+		if err := c.flush(ctx); err != nil {
+			return err
+		}
+	}
+	c.batch = append(c.batch, record)
+	return nil
+}
+
+// flush fetches and compares the documents of the batch. A document gone from the target counts as mismatched.
+func (c *sampleChecker) flush(ctx context.Context) error {
+	if len(c.batch) == 0 {
+		return nil
+	}
+	index := c.batch[0].Index
+	docs := make([]map[string]string, len(c.batch))
+	for i, record := range c.batch {
+		docs[i] = map[string]string{"_id": record.ID}
+		if _, ok := c.client.(*clients.ES2Client); ok {
+			docs[i]["_type"] = record.Type
+			if record.Routing != "" {
+				docs[i]["_routing"] = record.Routing
+			}
+		} else if record.Routing != "" {
+			docs[i]["routing"] = record.Routing
+		}
+	}
+	payload, err := json.Marshal(map[string]interface{}{"docs": docs})
+	if err != nil {
+		return err
+	}
+	status, body, err := c.client.MultiGet(ctx, index, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to fetch sampled documents of %s: %w", index, err)
+	}
+	defer body.Close()
+	if status > 299 {
+		message, _ := io.ReadAll(body)
+		return fmt.Errorf("failed to fetch sampled documents of %s: %d %s: %s", index, status, http.StatusText(status), message)
+	}
+	var response struct {
+		Docs []struct {
+			ID     string                 `json:"_id"`
+			Found  bool                   `json:"found"`
+			Source map[string]interface{} `json:"_source"`
+			Error  json.RawMessage        `json:"error"`
+		} `json:"docs"`
+	}
+	if err := json.NewDecoder(body).Decode(&response); err != nil {
+		return fmt.Errorf("failed to decode sampled documents of %s: %w", index, err)
+	}
+	if len(response.Docs) != len(c.batch) {
+		return fmt.Errorf("fetched %d sampled documents of %s, expected %d", len(response.Docs), index, len(c.batch))
+	}
+
+	for i, doc := range response.Docs {
+		record := c.batch[i]
+		if len(doc.Error) > 0 {
+			return fmt.Errorf("failed to fetch %s/%s: %s", index, record.ID, doc.Error)
+		}
+		c.report.SampledCount++
+		hash := ""
+		if doc.Found {
+			if doc.Source == nil {
+				doc.Source = map[string]interface{}{}
+			}
+			if hash, err = contentHash(doc.Source); err != nil {
+				return err
+			}
+		}
+		if hash != record.Hash {
+			c.report.MismatchCount++
+			c.report.Mismatched = appendID(c.report.Mismatched, index, record.ID, c.config.VerifyMaxIDs)
+		}
+	}
+	c.batch = c.batch[:0]
+	return nil
+}
+
+// sampled deterministically picks a rate fraction of the document IDs, the same on both sides.
+func sampled(id string, rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	if rate >= 1 {
+		return true
+	}
+	sum := sha256.Sum256([]byte(id))
+	return float64(binary.BigEndian.Uint64(sum[:8]))/float64(^uint64(0)) < rate
+}
+
+// contentHash hashes the canonical JSON of a document body: object keys are sorted by encoding/json
+// and numbers of any Go type encode alike, so the source and target versions hash the same when equal.
+func contentHash(source map[string]interface{}) (string, error) {
+	data, err := json.Marshal(source)
+	if err != nil {
+		return "", err
+	}
+	// Decode and encode again so integers and floats of equal value hash alike
+	var canonical interface{}
+	if err := json.Unmarshal(data, &canonical); err != nil {
+		return "", err
+	}
+	if data, err = json.Marshal(canonical); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func appendID(ids []string, index, id string, limit int) []string {
+	if limit > 0 && len(ids) >= limit {
+		return ids
+	}
+	return append(ids, index+"/"+id)
+}
+
+// Log writes the outcome of the verification to the logger.
+func (r *Report) Log() {
+	fields := []zap.Field{
+		zap.Int("source", r.SourceCount),
+		zap.Int("expected", r.ExpectedCount),
+		zap.Int("target", r.TargetCount),
+		zap.Int("missing", r.MissingCount),
+		zap.Int("extra", r.ExtraCount),
+		zap.Int("sampled", r.SampledCount),
+		zap.Int("mismatched", r.MismatchCount),
+	}
+	if r.Passed {
+		logger.Info("Verification passed", fields...)
+	} else {
+		logger.Error("Verification failed", fields...)
+	}
+}
+
+// Save records the summary of the report in the store under key.
+func (r *Report) Save(ctx context.Context, store clients.CheckpointStore, key string) error {
+	return store.SaveJSON(ctx, key, r.Summary())
+}
+
+// WriteFile saves the report as JSON.
+func (r *Report) WriteFile(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,193 @@
+package verify
+
+import (
+	"context"
+	"elkmigration/config"
+	"elkmigration/estest"
+	"elkmigration/job"
+	"elkmigration/logger"
+	"elkmigration/pipeline"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	logger.Log = zap.NewNop()
+	os.Exit(m.Run())
+}
+
+func TestVerify(t *testing.T) {
+	// Small runs, so the comparison merges several of them
+	defer func(size int) { sortRunSize = size }(sortRunSize)
+	sortRunSize = 3
+
+	tests := []struct {
+		source, target int
+	}{
+		{source: 2, target: 2},
+		{source: 2, target: 7},
+		{source: 7, target: 8},
+		{source: 8, target: 8},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("ES%d to ES%d", tt.source, tt.target), func(t *testing.T) {
+			source := estest.NewServer(tt.source)
+			defer source.Close()
+			target := source
+			if tt.target != tt.source {
+				target = estest.NewServer(tt.target)
+				defer target.Close()
+			}
+
+			var docs []estest.Document
+			for i := 10; i >= 1; i-- {
+				docs = append(docs, estest.Document{ID: fmt.Sprint(i), Source: map[string]interface{}{"n": i}})
+			}
+			if err := source.AddDocuments("logs", docs...); err != nil {
+				t.Fatal(err)
+			}
+			// The target misses 4, has 5 changed, 7 routed elsewhere and an extra document
+			if err := target.CreateIndex("logs-new", 3, nil); err != nil {
+				t.Fatal(err)
+			}
+			var copied []estest.Document
+			for _, doc := range docs {
+				switch doc.ID {
+				case "4":
+					continue
+				case "5":
+					doc.Source = map[string]interface{}{"n": 50}
+				case "7":
+					doc.Routing = "user-7"
+				}
+				copied = append(copied, doc)
+			}
+			copied = append(copied, estest.Document{ID: "x", Source: map[string]interface{}{}})
+			if err := target.AddDocuments("logs-new", copied...); err != nil {
+				t.Fatal(err)
+			}
+
+			sourceClient, err := source.Client()
+			if err != nil {
+				t.Fatal(err)
+			}
+			targetClient, err := target.Client()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg := &config.Config{ElkIndexFrom: "logs", ElkIndexTo: "logs-new", BulkSize: 4, ScrollTimeout: "1m", VerifySampleRate: 1}
+			transformer, err := pipeline.NewTransformer(cfg, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			indices := []job.Index{{Source: "logs", Target: "logs-new"}}
+			report, err := Verify(context.Background(), sourceClient, targetClient, cfg, indices, &pipeline.ExportFilter{}, transformer)
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+
+			if report.SourceCount != 10 || report.ExpectedCount != 10 || report.TargetCount != 10 || report.SampledCount != 9 {
+				t.Errorf("counts = %d source, %d expected, %d target, %d sampled, want 10, 10, 10, 9",
+					report.SourceCount, report.ExpectedCount, report.TargetCount, report.SampledCount)
+			}
+			if !reflect.DeepEqual(report.Missing, []string{"logs-new/4"}) || report.MissingCount != 1 {
+				t.Errorf("missing = %v", report.Missing)
+			}
+			if !reflect.DeepEqual(report.Extra, []string{"logs-new/x"}) || report.ExtraCount != 1 {
+				t.Errorf("extra = %v", report.Extra)
+			}
+			if !reflect.DeepEqual(report.Mismatched, []string{"logs-new/5"}) || report.MismatchCount != 1 {
+				t.Errorf("mismatched = %v", report.Mismatched)
+			}
+			if report.Passed {
+				t.Error("verification passed")
+			}
+			if target.Requests(estest.EndpointMultiGet) != 3 {
+				t.Errorf("%d _mget requests, want 3 batches of BULK_SIZE", target.Requests(estest.EndpointMultiGet))
+			}
+		})
+	}
+}
+
+func TestVerifyDuplicateIDs(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int // of the source; the target is ES8
+		sources map[string][]estest.Document
+	}{
+		{
+			// Both source indices roll up into one target, where the later copy of 1 wins
+			name:    "rolled up indices",
+			version: 7,
+			sources: map[string][]estest.Document{
+				"logs-a": {{ID: "1", Source: map[string]interface{}{"from": "a"}}},
+				"logs-b": {{ID: "1", Source: map[string]interface{}{"from": "b"}}},
+			},
+		},
+		{
+			// Documents of two ES2 mapping types with the same _id are flattened into one
+			name:    "flattened types",
+			version: 2,
+			sources: map[string][]estest.Document{
+				"logs-a": {
+					{Type: "event", ID: "1", Source: map[string]interface{}{"from": "b"}},
+					{Type: "metric", ID: "1", Source: map[string]interface{}{"from": "b"}},
+					{Type: "event", ID: "2", Source: map[string]interface{}{"from": "a"}},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, target := estest.NewServer(tt.version), estest.NewServer(8)
+			defer source.Close()
+			defer target.Close()
+			var indices []job.Index
+			targetDocs := map[string]estest.Document{}
+			for _, name := range []string{"logs-a", "logs-b"} {
+				docs, ok := tt.sources[name]
+				if !ok {
+					continue
+				}
+				if err := source.AddDocuments(name, docs...); err != nil {
+					t.Fatal(err)
+				}
+				for _, doc := range docs {
+					targetDocs[doc.ID] = estest.Document{ID: doc.ID, Source: doc.Source}
+				}
+				indices = append(indices, job.Index{Source: name, Target: "logs"})
+			}
+			for _, doc := range targetDocs {
+				if err := target.AddDocuments("logs", doc); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			sourceClient, err := source.Client()
+			if err != nil {
+				t.Fatal(err)
+			}
+			targetClient, err := target.Client()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg := &config.Config{ElkIndexFrom: "logs-*", ElkIndexTo: "logs", BulkSize: 10, ScrollTimeout: "1m", VerifySampleRate: 1}
+			transformer, err := pipeline.NewTransformer(cfg, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			report, err := Verify(context.Background(), sourceClient, targetClient, cfg, indices, &pipeline.ExportFilter{}, transformer)
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			want := len(targetDocs)
+			if report.SourceCount != want+1 || report.ExpectedCount != want || report.TargetCount != want || report.SampledCount != want || !report.Passed {
+				t.Errorf("report = %+v, want %d matching documents from %d source documents", report, want, want+1)
+			}
+		})
+	}
+}